@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"path/filepath"
 	"syscall"
 	"time"
 
@@ -13,12 +14,21 @@ import (
 	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/rs/cors"
 
+	"github.com/himanshu/file-vault-app/backend/internal/archive"
+	"github.com/himanshu/file-vault-app/backend/internal/bulk"
 	"github.com/himanshu/file-vault-app/backend/internal/config"
+	"github.com/himanshu/file-vault-app/backend/internal/dedup"
+	"github.com/himanshu/file-vault-app/backend/internal/gc"
 	"github.com/himanshu/file-vault-app/backend/internal/graph"
 	"github.com/himanshu/file-vault-app/backend/internal/httpext"
 	"github.com/himanshu/file-vault-app/backend/internal/rate"
 	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/scrub"
+	"github.com/himanshu/file-vault-app/backend/internal/search"
 	"github.com/himanshu/file-vault-app/backend/internal/storage"
+	"github.com/himanshu/file-vault-app/backend/internal/trash"
+	"github.com/himanshu/file-vault-app/backend/internal/tus"
+	"github.com/himanshu/file-vault-app/backend/internal/versions"
 )
 
 func main() {
@@ -43,7 +53,58 @@ func main() {
 	if err := repo.RunMigrations(ctx, pool); err != nil {
 		log.Fatalf("migrate: %v", err)
 	}
-	store := storage.New(cfg.StorageDir)
+	store, err := storage.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+	store.Recorded = repository.ObjectEncoding
+	if store.Keys != nil {
+		// pick up master key rotations done by vaultctl rotate-key
+		go func() {
+			for range time.Tick(30 * time.Second) {
+				if err := store.Keys.ReloadIfChanged(); err != nil {
+					log.Printf("keyfile reload: %v", err)
+				}
+			}
+		}()
+	}
+	bgCtx, stopBackground := context.WithCancel(ctx)
+	defer stopBackground()
+	if cfg.GCInterval > 0 {
+		gc.New(repository, store, gc.Options{
+			Grace:         cfg.GCGrace,
+			TempMaxAge:    cfg.GCTempMaxAge,
+			DeleteOrphans: cfg.GCDeleteOrphans,
+			DryRun:        cfg.GCDryRun,
+		}).Start(bgCtx, cfg.GCInterval)
+	}
+	scrubber := scrub.New(repository, store, scrub.Options{MaxAge: cfg.ScrubMaxAge, BytesPerSecond: cfg.ScrubBytesPerSecond})
+	if cfg.ScrubInterval > 0 {
+		scrubber.Start(bgCtx, cfg.ScrubInterval)
+	}
+	tusDir := cfg.TusDir
+	if tusDir == "" {
+		tusDir = filepath.Join(store.TempDir, "tus")
+	}
+	tusStore, err := tus.NewStore(tusDir, cfg.TusExpiry)
+	if err != nil {
+		log.Fatalf("tus: %v", err)
+	}
+	tusStore.Start(bgCtx, 15*time.Minute)
+	retention := repo.VersionRetention{Keep: cfg.VersionKeep, MaxAge: cfg.VersionMaxAge}
+	if cfg.VersionPruneInterval > 0 {
+		versions.New(repository, retention).Start(bgCtx, cfg.VersionPruneInterval)
+	}
+	if cfg.SearchIndexInterval > 0 {
+		search.New(repository, store, search.Options{MaxBytes: cfg.SearchMaxBytes, MaxText: cfg.SearchMaxText}).Start(bgCtx, cfg.SearchIndexInterval)
+	}
+	if cfg.TrashPurgeInterval > 0 {
+		trash.New(repository, cfg.TrashRetention).Start(bgCtx, cfg.TrashPurgeInterval)
+	}
+	if cfg.BulkJobInterval > 0 {
+		bulk.New(repository, bulk.Options{BatchSize: cfg.BulkBatchSize, Retention: cfg.BulkJobRetention}).Start(bgCtx, cfg.BulkJobInterval)
+	}
+	dedupSvc := dedup.New(repository, store, cfg.UserQuotaBytes)
 	limiter := rate.NewLimiter(cfg.RateLimitRPS)
 
 	// simple user identity via header for now
@@ -51,16 +112,22 @@ func main() {
 
 	r.Group(func(gr chi.Router) {
 		gr.Use(limiter.Middleware(func(r *http.Request) string { return getUser(r) }))
-		httpext.RegisterUploadRoutes(gr, httpext.UploadDeps{Storage: store, Repo: repository, MaxFormMemory: 32 << 20, GetUserID: getUser})
+		httpext.RegisterUploadRoutes(gr, httpext.UploadDeps{Storage: store, Repo: repository, MaxPartSize: cfg.MaxUploadPartBytes, GetUserID: getUser, QuotaBytes: cfg.UserQuotaBytes, Tus: tusStore, TusMaxSize: cfg.TusMaxSize, Dedup: dedupSvc,
+			Archive: archive.Limits{MaxEntries: cfg.ArchiveMaxEntries, MaxBytes: cfg.ArchiveMaxBytes, MaxRatio: cfg.ArchiveMaxRatio}, Versions: retention})
 	})
 
 	// Public downloads
-	httpext.RegisterPublicRoutes(r, httpext.PublicDeps{Repo: repository})
+	httpext.RegisterPublicRoutes(r, httpext.PublicDeps{Repo: repository, Storage: store})
 
 	// GraphQL
-	r.Handle("/graphql", graph.NewHandler(graph.Deps{Repo: repository, GetUserID: getUser}))
+	r.Handle("/graphql", graph.NewHandler(graph.Deps{Repo: repository, Scrubber: scrubber, GetUserID: getUser, QuotaBytes: cfg.UserQuotaBytes, Dedup: dedupSvc, Versions: retention, BulkSyncLimit: cfg.BulkSyncLimit}))
 
-	handler := cors.AllowAll().Handler(r)
+	handler := cors.New(cors.Options{
+		AllowedOrigins: []string{"*"},
+		AllowedMethods: []string{http.MethodHead, http.MethodGet, http.MethodPost, http.MethodPut, http.MethodPatch, http.MethodDelete},
+		AllowedHeaders: []string{"*"},
+		ExposedHeaders: httpext.TusExposedHeaders,
+	}).Handler(r)
 	server := &http.Server{Addr: ":" + addr, Handler: handler, ReadHeaderTimeout: 10 * time.Second}
 
 	go func() {
@@ -73,6 +140,7 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
+	stopBackground()
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_ = server.Shutdown(ctx)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+
+	"github.com/himanshu/file-vault-app/backend/internal/config"
+	"github.com/himanshu/file-vault-app/backend/internal/fsck"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// runFsck checks the database against the storage backend. The exit status
+// is 1 when problems remain that were not repaired.
+func runFsck(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("fsck", flag.ExitOnError)
+	repair := fs.String("repair", "", "comma separated categories to repair: refcounts, dangling, missing, orphans or all")
+	grace := fs.Duration("grace", cfg.GCGrace, "ignore stored objects without rows younger than this")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	_ = fs.Parse(args)
+	fix, err := fsck.ParseRepair(*repair)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	ctx := context.Background()
+	pool, repository := connect(ctx, cfg)
+	defer pool.Close()
+	store, err := storage.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	rep, runErr := fsck.New(repository, store, fsck.Options{Repair: fix, Grace: *grace}).Run(ctx)
+	if *asJSON {
+		printJSON(rep)
+	} else {
+		rep.WriteText(os.Stdout)
+	}
+	if runErr != nil {
+		log.Fatalf("fsck: %v", runErr)
+	}
+	if rep.Outstanding(fix) {
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"github.com/himanshu/file-vault-app/backend/internal/config"
+	"github.com/himanshu/file-vault-app/backend/internal/gc"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// runGC runs a single garbage collection pass and prints what was reclaimed.
+func runGC(cfg config.Config, args []string) {
+	fs := flag.NewFlagSet("gc", flag.ExitOnError)
+	var opts gc.Options
+	fs.DurationVar(&opts.Grace, "grace", cfg.GCGrace, "minimum time a blob must have been unreferenced")
+	fs.DurationVar(&opts.TempMaxAge, "temp-max-age", cfg.GCTempMaxAge, "age after which upload spool files are removed")
+	fs.BoolVar(&opts.DeleteOrphans, "delete-orphans", cfg.GCDeleteOrphans, "delete stored objects that have no database row")
+	fs.BoolVar(&opts.DryRun, "dry-run", false, "report what would be reclaimed without deleting anything")
+	asJSON := fs.Bool("json", false, "print the report as JSON")
+	_ = fs.Parse(args)
+
+	ctx := context.Background()
+	pool, repository := connect(ctx, cfg)
+	defer pool.Close()
+	store, err := storage.NewFromConfig(cfg)
+	if err != nil {
+		log.Fatalf("storage: %v", err)
+	}
+
+	rep, runErr := gc.New(repository, store, opts).Run(ctx)
+	if *asJSON {
+		printJSON(struct {
+			gc.Report
+			ReclaimedBytes int64 `json:"reclaimedBytes"`
+		}{rep, rep.ReclaimedBytes()})
+	} else {
+		fmt.Println(rep.String())
+		for _, k := range rep.OrphanKeys {
+			fmt.Println("orphan:", k)
+		}
+		for _, e := range rep.Errors {
+			fmt.Println("error:", e)
+		}
+	}
+	if runErr != nil {
+		log.Fatalf("gc: %v", runErr)
+	}
+}
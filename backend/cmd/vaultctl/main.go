@@ -0,0 +1,54 @@
+// Command vaultctl is the operator tool for a File Vault deployment. It reads
+// the same environment as the server.
+//
+//	vaultctl fsck [-repair=refcounts,dangling,missing,orphans|all] [-json]
+//	vaultctl gc [-dry-run] [-json]
+//	vaultctl rotate-key [-init] [-prune]
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/himanshu/file-vault-app/backend/internal/config"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+var commands = map[string]func(cfg config.Config, args []string){
+	"fsck":       runFsck,
+	"gc":         runGC,
+	"rotate-key": runRotateKey,
+}
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("vaultctl: ")
+	if len(os.Args) < 2 || commands[os.Args[1]] == nil {
+		fmt.Fprintln(os.Stderr, "usage: vaultctl <fsck|gc|rotate-key> [flags]")
+		os.Exit(2)
+	}
+	commands[os.Args[1]](config.FromEnv(), os.Args[2:])
+}
+
+// connect opens the database and brings the schema up to date.
+func connect(ctx context.Context, cfg config.Config) (*pgxpool.Pool, *repo.Repository) {
+	pool, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	if err != nil {
+		log.Fatalf("db: %v", err)
+	}
+	if err := repo.RunMigrations(ctx, pool); err != nil {
+		log.Fatalf("migrate: %v", err)
+	}
+	return pool, repo.New(pool)
+}
+
+func printJSON(v any) {
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	_ = enc.Encode(v)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"io/fs"
+	"log"
+
+	"github.com/himanshu/file-vault-app/backend/internal/config"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// runRotateKey rotates the master key used for encryption at rest. It adds a
+// new key to the key file, makes it active and re-wraps every stored data key
+// under it. Blob content is never rewritten, so object headers keep naming
+// the key they were sealed under; deduplication goes by the re-wrapped keys
+// in the database instead, which is what makes -prune safe.
+func runRotateKey(cfg config.Config, args []string) {
+	flags := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	keyFile := flags.String("keyfile", cfg.EncryptionKeyFile, "path to the master key file")
+	initKeys := flags.Bool("init", false, "create the key file if it does not exist")
+	prune := flags.Bool("prune", false, "remove key versions no longer referenced after re-wrapping")
+	_ = flags.Parse(args)
+	if *keyFile == "" {
+		log.Fatal("no key file: set ENCRYPTION_KEY_FILE or -keyfile")
+	}
+
+	keys, err := storage.LoadKeyring(*keyFile)
+	if errors.Is(err, fs.ErrNotExist) && *initKeys {
+		keys, err = storage.NewKeyring(*keyFile), nil
+	}
+	if err != nil {
+		log.Fatalf("keyfile: %v", err)
+	}
+	id, err := keys.Rotate()
+	if err != nil {
+		log.Fatalf("rotate: %v", err)
+	}
+	if err := keys.Save(); err != nil {
+		log.Fatalf("save keyfile: %v", err)
+	}
+	log.Printf("active key is now %s", id)
+
+	ctx := context.Background()
+	pool, repository := connect(ctx, cfg)
+	defer pool.Close()
+
+	n, err := repository.RewrapKeys(ctx, id, keys.Rewrap)
+	if err != nil {
+		log.Fatalf("rewrap: %v (after %d keys)", err, n)
+	}
+	log.Printf("re-wrapped %d data keys", n)
+
+	if *prune {
+		inUse, err := repository.KeyIDsInUse(ctx)
+		if err != nil {
+			log.Fatalf("prune: %v", err)
+		}
+		used := map[string]bool{id: true}
+		for _, k := range inUse {
+			used[k] = true
+		}
+		for _, k := range keys.IDs() {
+			if !used[k] {
+				_ = keys.Remove(k)
+				log.Printf("removed key %s", k)
+			}
+		}
+		if err := keys.Save(); err != nil {
+			log.Fatalf("save keyfile: %v", err)
+		}
+	}
+}
@@ -7,6 +7,7 @@ require (
 	github.com/graphql-go/graphql v0.8.1
 	github.com/graphql-go/handler v0.2.4
 	github.com/jackc/pgx/v5 v5.6.0
+	github.com/klauspost/compress v1.18.0
 	github.com/rs/cors v1.11.0
 )
 
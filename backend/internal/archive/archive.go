@@ -0,0 +1,330 @@
+// Package archive expands zip, tar and gzip-compressed tar archives entry by
+// entry for uploads that ask for it. Entry paths are checked so that no entry
+// can name a location outside the archive, and the amount and compression
+// ratio of expanded data are bounded so that a small upload cannot expand
+// into an unbounded amount of storage.
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Formats that can be expanded.
+const (
+	Zip     = "zip"
+	Tar     = "tar"
+	TarGzip = "tar.gz"
+)
+
+var (
+	// ErrUnsafePath is reported for entries whose name is absolute or climbs
+	// out of the archive with "..".
+	ErrUnsafePath = errors.New("archive: unsafe entry path")
+	// ErrUnsupportedEntry is reported for links, devices and encrypted entries.
+	ErrUnsupportedEntry = errors.New("archive: unsupported entry type")
+	// Limit errors stop the expansion.
+	ErrTooManyEntries = errors.New("archive: too many entries")
+	ErrTooLarge       = errors.New("archive: expanded size exceeds the limit")
+	ErrRatio          = errors.New("archive: compression ratio exceeds the limit")
+)
+
+// Limits bound one expansion; zero fields are not enforced.
+type Limits struct {
+	MaxEntries int
+	// MaxBytes bounds the expanded size of all entries together.
+	MaxBytes int64
+	// MaxRatio bounds expanded bytes per compressed byte, per zip entry and
+	// for a compressed tar as a whole. Data below ratioFloor is not checked,
+	// as small files of repetitive text legitimately compress very well.
+	MaxRatio int64
+}
+
+const ratioFloor = 1 << 20
+
+// Entry is a file within an archive. Err is set for entries that are not
+// expanded; their content is not offered.
+type Entry struct {
+	Path    string
+	ModTime time.Time
+	Err     error
+}
+
+// Format returns the format of an archive detected as MIME type detected
+// whose content starts with head, or "" when it is not an archive Walk
+// expands. Zip based documents are reported under their own types by
+// mimetype.Detect and are therefore not expanded.
+func Format(detected string, head []byte) string {
+	switch detected {
+	case "application/zip":
+		return Zip
+	case "application/x-tar":
+		return Tar
+	case "application/gzip":
+		// only a compressed tar; a single gzipped file is kept as it is
+		zr, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return ""
+		}
+		var block [512]byte
+		if _, err := io.ReadFull(zr, block[:]); err != nil {
+			return ""
+		}
+		if string(block[257:262]) == "ustar" {
+			return TarGzip
+		}
+	}
+	return ""
+}
+
+// Walk expands the archive read from r, calling fn for every entry in archive
+// order: with the content for regular files, with a nil reader and Entry.Err
+// set for entries it refuses. Directories are skipped. Zip archives are
+// spooled to a temporary file in tempDir, as their directory is at the end.
+//
+// Walk stops with fn's error, with a limit error once the limits are reached
+// (the entry being read then fails with the same error), or with the error of
+// reading the archive.
+func Walk(r io.Reader, format, tempDir string, lim Limits, fn func(Entry, io.Reader) error) error {
+	w := &walker{lim: lim, fn: fn}
+	switch format {
+	case Zip:
+		return w.zip(r, tempDir)
+	case Tar:
+		return w.tar(r, nil)
+	case TarGzip:
+		cr := &countingReader{r: r}
+		zr, err := gzip.NewReader(cr)
+		if err != nil {
+			return err
+		}
+		return w.tar(zr, &cr.n)
+	}
+	return fmt.Errorf("archive: unknown format %q", format)
+}
+
+type walker struct {
+	lim     Limits
+	fn      func(Entry, io.Reader) error
+	entries int
+	// expanded counts the content bytes handed out so far.
+	expanded int64
+	// err is the limit error an entry's reader ran into.
+	err error
+}
+
+func (w *walker) zip(r io.Reader, tempDir string) error {
+	f, err := os.CreateTemp(tempDir, "expand-*.zip")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, r)
+	if err != nil {
+		return err
+	}
+	zr, err := zip.NewReader(f, size)
+	if err != nil {
+		return err
+	}
+	for _, zf := range zr.File {
+		if zf.Mode().IsDir() {
+			continue
+		}
+		e, err := w.entry(zf.Name, zf.Modified, int64(zf.UncompressedSize64))
+		if err != nil {
+			return err
+		}
+		switch {
+		case e.Err != nil:
+		case !zf.Mode().IsRegular():
+			e.Err = ErrUnsupportedEntry
+		case zf.Flags&0x1 != 0:
+			e.Err = fmt.Errorf("%w: encrypted", ErrUnsupportedEntry)
+		}
+		if e.Err != nil {
+			if err := w.fn(e, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		rc, err := zf.Open()
+		if errors.Is(err, zip.ErrAlgorithm) {
+			e.Err = fmt.Errorf("%w: compression method %d", ErrUnsupportedEntry, zf.Method)
+			if err := w.fn(e, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		// zip entries are compressed one by one, so the ratio is per entry
+		compressed := int64(zf.CompressedSize64)
+		err = w.content(e, &guardReader{r: rc, w: w, perEntry: true, compressed: func() int64 { return compressed }})
+		rc.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// tar walks a tar stream. compressed, when set, counts the compressed bytes
+// consumed so far for the ratio check.
+func (w *walker) tar(r io.Reader, compressed *int64) error {
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return w.limitErr(err)
+		}
+		mode := hdr.FileInfo().Mode()
+		if mode.IsDir() || hdr.Typeflag == tar.TypeXGlobalHeader {
+			continue
+		}
+		e, err := w.entry(hdr.Name, hdr.ModTime, hdr.Size)
+		if err != nil {
+			return err
+		}
+		if e.Err == nil && !mode.IsRegular() {
+			e.Err = ErrUnsupportedEntry
+		}
+		if e.Err != nil {
+			if err := w.fn(e, nil); err != nil {
+				return err
+			}
+			continue
+		}
+		g := &guardReader{r: tr, w: w}
+		if compressed != nil {
+			g.compressed = func() int64 { return *compressed }
+		}
+		if err := w.content(e, g); err != nil {
+			return err
+		}
+	}
+}
+
+// entry counts an entry and checks its name and declared size.
+func (w *walker) entry(name string, modTime time.Time, size int64) (Entry, error) {
+	w.entries++
+	if w.lim.MaxEntries > 0 && w.entries > w.lim.MaxEntries {
+		return Entry{}, ErrTooManyEntries
+	}
+	if w.lim.MaxBytes > 0 && size > w.lim.MaxBytes-w.expanded {
+		return Entry{}, ErrTooLarge
+	}
+	p, err := CleanPath(name)
+	if err != nil {
+		return Entry{Path: name, Err: err}, nil
+	}
+	return Entry{Path: p, ModTime: modTime}, nil
+}
+
+// content hands an entry's data to fn through g, which enforces the limits.
+func (w *walker) content(e Entry, g *guardReader) error {
+	if err := w.fn(e, g); err != nil {
+		return err
+	}
+	return w.err
+}
+
+// limitErr prefers the limit error a guarded read ran into over the error
+// that reading on produced.
+func (w *walker) limitErr(err error) error {
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+type guardReader struct {
+	r io.Reader
+	w *walker
+	n int64
+	// compressed returns the compressed size the ratio is checked against;
+	// nil for uncompressed archives.
+	compressed func() int64
+	// perEntry applies the ratio to this entry rather than to the whole stream.
+	perEntry bool
+}
+
+func (g *guardReader) Read(p []byte) (int, error) {
+	if g.w.err != nil {
+		return 0, g.w.err
+	}
+	n, err := g.r.Read(p)
+	g.n += int64(n)
+	g.w.expanded += int64(n)
+	lim := g.w.lim
+	switch {
+	case lim.MaxBytes > 0 && g.w.expanded > lim.MaxBytes:
+		g.w.err = ErrTooLarge
+	case lim.MaxRatio > 0 && g.compressed != nil && g.expandedForRatio() > ratioFloor &&
+		g.expandedForRatio() > lim.MaxRatio*max(g.compressed(), 1):
+		g.w.err = ErrRatio
+	}
+	if g.w.err != nil {
+		return n, g.w.err
+	}
+	return n, err
+}
+
+func (g *guardReader) expandedForRatio() int64 {
+	if g.perEntry {
+		return g.n
+	}
+	return g.w.expanded
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// CleanPath turns an entry name into a clean relative slash-separated path,
+// refusing names that are absolute, carry a drive letter, climb out with ".."
+// or contain control characters.
+func CleanPath(name string) (string, error) {
+	name = strings.ReplaceAll(name, `\`, "/")
+	if name == "" || !utf8.ValidString(name) || strings.HasPrefix(name, "/") ||
+		(len(name) >= 2 && name[1] == ':') {
+		return "", ErrUnsafePath
+	}
+	for _, c := range name {
+		if c < 0x20 || c == 0x7f {
+			return "", ErrUnsafePath
+		}
+	}
+	for _, part := range strings.Split(name, "/") {
+		if part == ".." {
+			return "", ErrUnsafePath
+		}
+	}
+	p := path.Clean(name)
+	if p == "." {
+		return "", ErrUnsafePath
+	}
+	return p, nil
+}
@@ -0,0 +1,208 @@
+package archive
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"io"
+	"testing"
+)
+
+func TestCleanPath(t *testing.T) {
+	for _, c := range []struct {
+		name, want string
+	}{
+		{"a.txt", "a.txt"},
+		{"dir/sub/a.txt", "dir/sub/a.txt"},
+		{"./dir//a.txt", "dir/a.txt"},
+		{`dir\win\a.txt`, "dir/win/a.txt"},
+		{"dir/./a.txt/", "dir/a.txt"},
+		{"..a/b..", "..a/b.."},
+		{"", ""},
+		{".", ""},
+		{"./", ""},
+		{"/etc/passwd", ""},
+		{`\windows\system.ini`, ""},
+		{"C:/boot.ini", ""},
+		{"c:evil", ""},
+		{"../a", ""},
+		{"a/../../b", ""},
+		// ".." is refused even where it would stay inside the archive
+		{"a/../b", ""},
+		{`a\..\..\b`, ""},
+		{"a\x00b", ""},
+		{"a\nb", ""},
+		{"a\x7fb", ""},
+		{"bad\xffutf8", ""},
+	} {
+		got, err := CleanPath(c.name)
+		if c.want == "" {
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Errorf("CleanPath(%q) = %q, %v; want ErrUnsafePath", c.name, got, err)
+			}
+			continue
+		}
+		if err != nil || got != c.want {
+			t.Errorf("CleanPath(%q) = %q, %v; want %q", c.name, got, err, c.want)
+		}
+	}
+}
+
+type testEntry struct {
+	name    string
+	content []byte
+	symlink bool
+}
+
+func zipOf(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(e.content)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarOf(t *testing.T, entries ...testEntry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.content)), Typeflag: tar.TypeReg}
+		if e.symlink {
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeSymlink, "/etc/passwd", 0
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		tw.Write(e.content)
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func gzipOf(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+type walked struct {
+	path    string
+	content string
+	err     error
+}
+
+func walk(t *testing.T, data []byte, format string, lim Limits) ([]walked, error) {
+	t.Helper()
+	var got []walked
+	err := Walk(bytes.NewReader(data), format, t.TempDir(), lim, func(e Entry, r io.Reader) error {
+		w := walked{path: e.Path, err: e.Err}
+		if r != nil {
+			b, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			w.content = string(b)
+		}
+		got = append(got, w)
+		return nil
+	})
+	return got, err
+}
+
+func TestWalk(t *testing.T) {
+	entries := []testEntry{
+		{name: "a.txt", content: []byte("alpha")},
+		{name: "../escape.txt", content: []byte("nope")},
+		{name: "dir/b.txt", content: []byte("beta")},
+	}
+	tarball := tarOf(t, append(entries, testEntry{name: "link", symlink: true})...)
+	for _, c := range []struct {
+		format string
+		data   []byte
+	}{
+		{Zip, zipOf(t, entries...)},
+		{Tar, tarball},
+		{TarGzip, gzipOf(t, tarball)},
+	} {
+		got, err := walk(t, c.data, c.format, Limits{MaxEntries: 10, MaxBytes: 100, MaxRatio: 10})
+		if err != nil {
+			t.Fatalf("%s: %v", c.format, err)
+		}
+		if len(got) < 3 ||
+			got[0] != (walked{path: "a.txt", content: "alpha"}) ||
+			!errors.Is(got[1].err, ErrUnsafePath) || got[1].content != "" ||
+			got[2] != (walked{path: "dir/b.txt", content: "beta"}) {
+			t.Fatalf("%s: walked %+v", c.format, got)
+		}
+		if c.format != Zip && (len(got) != 4 || !errors.Is(got[3].err, ErrUnsupportedEntry)) {
+			t.Fatalf("%s: symlink walked as %+v", c.format, got[3:])
+		}
+	}
+}
+
+func TestWalkLimits(t *testing.T) {
+	small := []testEntry{{name: "1", content: []byte("one")}, {name: "2", content: []byte("two")}, {name: "3", content: []byte("three")}}
+	zeros := []testEntry{{name: "zeros", content: make([]byte, 4<<20)}}
+	for _, c := range []struct {
+		name   string
+		format string
+		data   []byte
+		lim    Limits
+		want   error
+		walked int
+	}{
+		{"entries", Tar, tarOf(t, small...), Limits{MaxEntries: 2}, ErrTooManyEntries, 2},
+		{"entries at the limit", Zip, zipOf(t, small...), Limits{MaxEntries: 3}, nil, 3},
+		// tar declares sizes up front, so the entry is refused before it is read
+		{"declared bytes", Tar, tarOf(t, small...), Limits{MaxBytes: 7}, ErrTooLarge, 2},
+		{"bytes at the limit", Tar, tarOf(t, small...), Limits{MaxBytes: 11}, nil, 3},
+		{"zip ratio", Zip, zipOf(t, zeros...), Limits{MaxRatio: 100}, ErrRatio, 0},
+		{"tar.gz ratio", TarGzip, gzipOf(t, tarOf(t, zeros...)), Limits{MaxRatio: 100}, ErrRatio, 0},
+		{"ratio within the limit", TarGzip, gzipOf(t, tarOf(t, zeros...)), Limits{MaxRatio: 10000}, nil, 1},
+		// repetitive data below the floor is not held to the ratio
+		{"ratio below the floor", Zip, zipOf(t, testEntry{name: "z", content: make([]byte, ratioFloor)}), Limits{MaxRatio: 2}, nil, 1},
+	} {
+		got, err := walk(t, c.data, c.format, c.lim)
+		if !errors.Is(err, c.want) || len(got) != c.walked {
+			t.Errorf("%s: walked %d entries, %v; want %d, %v", c.name, len(got), err, c.walked, c.want)
+		}
+	}
+}
+
+func TestFormat(t *testing.T) {
+	tarball := tarOf(t, testEntry{name: "a", content: []byte("x")})
+	for _, c := range []struct {
+		detected string
+		head     []byte
+		want     string
+	}{
+		{"application/zip", nil, Zip},
+		{"application/x-tar", tarball, Tar},
+		{"application/gzip", gzipOf(t, tarball), TarGzip},
+		{"application/gzip", gzipOf(t, []byte("just a gzipped text file")), ""},
+		{"application/vnd.openxmlformats-officedocument.wordprocessingml.document", nil, ""},
+	} {
+		if got := Format(c.detected, c.head); got != c.want {
+			t.Errorf("Format(%q) = %q, want %q", c.detected, got, c.want)
+		}
+	}
+}
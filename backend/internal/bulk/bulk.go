@@ -0,0 +1,95 @@
+// Package bulk runs the bulk file operations that were queued as jobs because
+// they selected too many files to handle within a request. A job works
+// through its files in batches, each applied and recorded in one
+// transaction, so a job interrupted by a restart resumes where it stopped.
+package bulk
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// lease is how long a job stays claimed without progress before another
+// worker may take it up.
+const lease = 5 * time.Minute
+
+type Options struct {
+	// BatchSize is the number of files handled per transaction.
+	BatchSize int
+	// Retention is how long finished jobs can still be polled.
+	Retention time.Duration
+}
+
+type Runner struct {
+	Repo *repo.Repository
+	Opts Options
+}
+
+func New(r *repo.Repository, opts Options) *Runner {
+	return &Runner{Repo: r, Opts: opts}
+}
+
+// Run runs queued jobs to completion and returns how many it finished. A
+// job whose batch fails is marked failed; the batches before it stay applied.
+func (rn *Runner) Run(ctx context.Context) (int, error) {
+	n := 0
+	for {
+		job, err := rn.Repo.ClaimBulkJob(ctx, lease)
+		if errors.Is(err, pgx.ErrNoRows) {
+			break
+		}
+		if err != nil {
+			return n, err
+		}
+		for job.Status == repo.JobRunning {
+			next, err := rn.Repo.RunBulkBatch(ctx, job, rn.Opts.BatchSize, lease)
+			if err != nil {
+				if ctx.Err() != nil {
+					// left to be taken up again once the lease runs out
+					return n, ctx.Err()
+				}
+				log.Printf("bulk: job %s: %v", job.ID, err)
+				if err := rn.Repo.FailBulkJob(ctx, job.ID, err.Error()); err != nil {
+					return n, err
+				}
+				break
+			}
+			job = next
+		}
+		n++
+	}
+	if rn.Opts.Retention > 0 {
+		if _, err := rn.Repo.DeleteFinishedBulkJobs(ctx, rn.Opts.Retention); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Start runs queued jobs every interval until ctx is cancelled.
+func (rn *Runner) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				n, err := rn.Run(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("bulk: %v", err)
+				}
+				if n > 0 {
+					log.Printf("bulk: finished %d jobs", n)
+				}
+			}
+		}
+	}()
+}
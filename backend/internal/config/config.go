@@ -3,6 +3,7 @@ package config
 import (
     "os"
     "strconv"
+    "time"
 )
 
 type Config struct {
@@ -11,6 +12,83 @@ type Config struct {
     StorageDir     string
     RateLimitRPS   int
     UserQuotaBytes int64
+
+    // MaxUploadPartBytes limits each file of a multipart upload; 0 disables the limit.
+    MaxUploadPartBytes int64
+
+    // Limits on expanding uploaded archives; 0 disables a limit.
+    ArchiveMaxEntries int
+    ArchiveMaxBytes   int64
+    ArchiveMaxRatio   int64
+
+    // Earlier file versions kept: the newest VersionKeep per file, each for
+    // VersionMaxAge once replaced; 0 disables a bound. VersionPruneInterval
+    // applies the age bound in the background; 0 disables it.
+    VersionKeep          int
+    VersionMaxAge        time.Duration
+    VersionPruneInterval time.Duration
+
+    // Deleted files stay in the trash for TrashRetention; the purge runs every
+    // TrashPurgeInterval, 0 disabling it.
+    TrashRetention     time.Duration
+    TrashPurgeInterval time.Duration
+
+    // Full-text indexing of file contents every SearchIndexInterval (0
+    // disables it), reading at most SearchMaxBytes of a file and keeping at
+    // most SearchMaxText bytes of its text.
+    SearchIndexInterval time.Duration
+    SearchMaxBytes      int64
+    SearchMaxText       int
+
+    // Bulk operations selecting more than BulkSyncLimit files run as jobs,
+    // BulkBatchSize files per transaction, picked up every BulkJobInterval
+    // (0 disables them) and kept for BulkJobRetention once finished.
+    BulkSyncLimit    int
+    BulkBatchSize    int
+    BulkJobInterval  time.Duration
+    BulkJobRetention time.Duration
+
+    // Blob storage backend: "disk" (StorageDir) or "s3".
+    StorageBackend string
+    StorageTempDir string
+    S3Endpoint     string
+    S3Region       string
+    S3Bucket       string
+    S3AccessKey    string
+    S3SecretKey    string
+    S3Prefix       string
+    S3PathStyle    bool
+
+    // Content-defined chunking for sub-file deduplication of new blobs.
+    ChunkingEnabled bool
+    ChunkMinBytes   int
+    ChunkAvgBytes   int
+    ChunkMaxBytes   int
+
+    // Encryption at rest; disabled when no key file is configured.
+    EncryptionKeyFile string
+
+    // Transparent zstd compression of compressible blobs.
+    CompressionEnabled bool
+    CompressionLevel   int
+
+    // Background garbage collection of unreferenced blobs; 0 disables it.
+    GCInterval      time.Duration
+    GCGrace         time.Duration
+    GCTempMaxAge    time.Duration
+    GCDeleteOrphans bool
+    GCDryRun        bool
+
+    // Integrity scrubbing of stored blobs; 0 interval disables it.
+    ScrubInterval       time.Duration
+    ScrubMaxAge         time.Duration
+    ScrubBytesPerSecond int64
+
+    // Resumable (tus) uploads; partial uploads live in TusDir until complete
+    // or idle for TusExpiry.
+    TusDir     string
+    TusMaxSize int64
+    TusExpiry  time.Duration
 }
 
 func FromEnv() Config {
@@ -20,6 +98,62 @@ func FromEnv() Config {
         StorageDir:     getenv("STORAGE_DIR", "/data"),
         RateLimitRPS:   getenvInt("RATE_LIMIT_RPS", 2),
         UserQuotaBytes: getenvInt64("USER_QUOTA_BYTES", 10*1024*1024),
+
+        MaxUploadPartBytes: getenvInt64("UPLOAD_MAX_PART_BYTES", 1<<30),
+
+        ArchiveMaxEntries: getenvInt("ARCHIVE_MAX_ENTRIES", 10000),
+        ArchiveMaxBytes:   getenvInt64("ARCHIVE_MAX_BYTES", 4<<30),
+        ArchiveMaxRatio:   getenvInt64("ARCHIVE_MAX_RATIO", 100),
+
+        VersionKeep:          getenvInt("VERSION_KEEP", 10),
+        VersionMaxAge:        getenvDuration("VERSION_MAX_AGE", 0),
+        VersionPruneInterval: getenvDuration("VERSION_PRUNE_INTERVAL", time.Hour),
+
+        TrashRetention:     getenvDuration("TRASH_RETENTION", 30*24*time.Hour),
+        TrashPurgeInterval: getenvDuration("TRASH_PURGE_INTERVAL", time.Hour),
+
+        SearchIndexInterval: getenvDuration("SEARCH_INDEX_INTERVAL", time.Minute),
+        SearchMaxBytes:      getenvInt64("SEARCH_MAX_BYTES", 32<<20),
+        SearchMaxText:       getenvInt("SEARCH_MAX_TEXT", 512<<10),
+
+        BulkSyncLimit:    getenvInt("BULK_SYNC_LIMIT", 1000),
+        BulkBatchSize:    getenvInt("BULK_BATCH_SIZE", 500),
+        BulkJobInterval:  getenvDuration("BULK_JOB_INTERVAL", 5*time.Second),
+        BulkJobRetention: getenvDuration("BULK_JOB_RETENTION", 7*24*time.Hour),
+
+        StorageBackend: getenv("STORAGE_BACKEND", "disk"),
+        StorageTempDir: getenv("STORAGE_TEMP_DIR", ""),
+        S3Endpoint:     getenv("S3_ENDPOINT", ""),
+        S3Region:       getenv("S3_REGION", "us-east-1"),
+        S3Bucket:       getenv("S3_BUCKET", ""),
+        S3AccessKey:    getenv("S3_ACCESS_KEY_ID", ""),
+        S3SecretKey:    getenv("S3_SECRET_ACCESS_KEY", ""),
+        S3Prefix:       getenv("S3_PREFIX", ""),
+        S3PathStyle:    getenvBool("S3_PATH_STYLE", true),
+
+        ChunkingEnabled: getenvBool("STORAGE_CHUNKING", false),
+        ChunkMinBytes:   getenvInt("CHUNK_MIN_BYTES", 64<<10),
+        ChunkAvgBytes:   getenvInt("CHUNK_AVG_BYTES", 256<<10),
+        ChunkMaxBytes:   getenvInt("CHUNK_MAX_BYTES", 1<<20),
+
+        EncryptionKeyFile: getenv("ENCRYPTION_KEY_FILE", ""),
+
+        CompressionEnabled: getenvBool("STORAGE_COMPRESSION", false),
+        CompressionLevel:   getenvInt("COMPRESSION_LEVEL", 3),
+
+        GCInterval:      getenvDuration("GC_INTERVAL", time.Hour),
+        GCGrace:         getenvDuration("GC_GRACE", 24*time.Hour),
+        GCTempMaxAge:    getenvDuration("GC_TEMP_MAX_AGE", 24*time.Hour),
+        GCDeleteOrphans: getenvBool("GC_DELETE_ORPHANS", false),
+        GCDryRun:        getenvBool("GC_DRY_RUN", false),
+
+        ScrubInterval:       getenvDuration("SCRUB_INTERVAL", time.Hour),
+        ScrubMaxAge:         getenvDuration("SCRUB_MAX_AGE", 7*24*time.Hour),
+        ScrubBytesPerSecond: getenvInt64("SCRUB_BYTES_PER_SECOND", 8<<20),
+
+        TusDir:     getenv("TUS_DIR", ""),
+        TusMaxSize: getenvInt64("TUS_MAX_SIZE", 10<<30),
+        TusExpiry:  getenvDuration("TUS_EXPIRY", 24*time.Hour),
     }
 }
 
@@ -48,4 +182,20 @@ func getenvInt64(k string, def int64) int64 {
     return def
 }
 
+func getenvBool(k string, def bool) bool {
+    if v := os.Getenv(k); v != "" {
+        if b, err := strconv.ParseBool(v); err == nil {
+            return b
+        }
+    }
+    return def
+}
 
+func getenvDuration(k string, def time.Duration) time.Duration {
+    if v := os.Getenv(k); v != "" {
+        if d, err := time.ParseDuration(v); err == nil {
+            return d
+        }
+    }
+    return def
+}
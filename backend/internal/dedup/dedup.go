@@ -0,0 +1,296 @@
+// Package dedup lets a client that knows a file's SHA-256 skip uploading
+// content the vault already stores. Knowing the hash is not proof of holding
+// the content (hashes leak, and are published for many files), so before a
+// file row is created for another user's blob the client must answer a
+// challenge: the SHA-256 of a server-chosen nonce followed by server-chosen
+// byte ranges of the content.
+//
+// Challenges are issued whether or not the blob exists, and a wrong answer
+// looks the same as a missing blob, so the pre-check does not reveal to
+// someone without the content whether anybody stored it.
+package dedup
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/himanshu/file-vault-app/backend/internal/mimetype"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// Outcomes of Precheck and Answer.
+const (
+	// StatusCreated means the file was added without uploading its content.
+	StatusCreated = "created"
+	// StatusChallenge means the client must answer Result.Challenge.
+	StatusChallenge = "challenge"
+	// StatusUploadRequired means the content has to be uploaded normally.
+	StatusUploadRequired = "upload_required"
+	// StatusRejected means the upload policy refuses the file; see Result.Verdict.
+	StatusRejected = "rejected"
+)
+
+var (
+	ErrInvalidRequest    = errors.New("dedup: invalid request")
+	ErrChallengeNotFound = errors.New("dedup: challenge not found or expired")
+)
+
+// QuotaError is returned when adding the file would exceed the user's quota.
+// It matches repo.ErrQuotaExceeded.
+type QuotaError struct {
+	Quota repo.Quota
+	Size  int64
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("%v: %d bytes requested", repo.ErrQuotaExceeded, e.Size)
+}
+func (e *QuotaError) Unwrap() error { return repo.ErrQuotaExceeded }
+
+// Content up to challengeWholeFileMax bytes is proven whole; larger content
+// by challengeRanges random ranges of challengeRangeLen bytes.
+const (
+	challengeWholeFileMax = 4096
+	challengeRanges       = 3
+	challengeRangeLen     = 1024
+)
+
+// Request describes the file a client wants to add.
+type Request struct {
+	Hash     string
+	Size     int64
+	Filename string
+	MIMEType string
+	Tags     []string
+}
+
+// Range is a byte range of the content, part of a challenge.
+type Range struct {
+	Offset int64 `json:"offset"`
+	Length int64 `json:"length"`
+}
+
+type Challenge struct {
+	ID        string    `json:"id"`
+	Nonce     string    `json:"nonce"` // hex
+	Ranges    []Range   `json:"ranges"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+type Result struct {
+	Status    string
+	File      *repo.File
+	Challenge *Challenge
+	// Verdict is the upload policy's view of the file once its type is known.
+	Verdict mimetype.Verdict
+}
+
+type Service struct {
+	Repo    *repo.Repository
+	Storage *storage.Service
+	// QuotaBytes is the default per-user quota; negative means unlimited.
+	QuotaBytes int64
+	// TTL is how long a challenge may be answered.
+	TTL time.Duration
+}
+
+func New(r *repo.Repository, s *storage.Service, quotaBytes int64) *Service {
+	return &Service{Repo: r, Storage: s, QuotaBytes: quotaBytes, TTL: 10 * time.Minute}
+}
+
+// Precheck looks for stored content matching req. Files whose content the
+// user already owns are added at once; otherwise a challenge is issued.
+func (s *Service) Precheck(ctx context.Context, userID string, req Request) (Result, error) {
+	req.Hash = strings.ToLower(req.Hash)
+	if b, err := hex.DecodeString(req.Hash); err != nil || len(b) != sha256.Size {
+		return Result{}, fmt.Errorf("%w: hash must be a hex SHA-256", ErrInvalidRequest)
+	}
+	if req.Size < 0 || strings.TrimSpace(req.Filename) == "" {
+		return Result{}, fmt.Errorf("%w: size and filename are required", ErrInvalidRequest)
+	}
+	if req.MIMEType != "" && mimetype.Normalize(req.MIMEType) == "" {
+		return Result{}, fmt.Errorf("%w: invalid mime type", ErrInvalidRequest)
+	}
+	policy, err := s.Repo.GetUploadPolicy(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	// only the declared type is checked until the content is proven; the
+	// stored type would tell that the blob exists
+	if v := policy.Check(req.MIMEType, ""); v.Rejected() {
+		return Result{Status: StatusRejected, Verdict: v}, nil
+	}
+	if req.Size == 0 {
+		// nothing to save, and nothing to prove possession of
+		return Result{Status: StatusUploadRequired}, nil
+	}
+	owned, err := s.Repo.UserHasBlob(ctx, userID, req.Hash)
+	if err != nil {
+		return Result{}, err
+	}
+	if owned {
+		b, err := s.Repo.GetServableBlob(ctx, req.Hash)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && b.SizeBytes != req.Size) {
+			return Result{Status: StatusUploadRequired}, nil
+		}
+		if err != nil {
+			return Result{}, err
+		}
+		return s.addFile(ctx, userID, b, req.Filename, req.MIMEType, req.Tags, policy.Policy)
+	}
+
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return Result{}, err
+	}
+	ranges, err := pickRanges(req.Size)
+	if err != nil {
+		return Result{}, err
+	}
+	c := repo.UploadChallenge{UserID: userID, BlobHash: req.Hash, SizeBytes: req.Size, Filename: req.Filename, Tags: req.Tags, Nonce: nonce}
+	if req.MIMEType != "" {
+		c.MIMEType = &req.MIMEType
+	}
+	if c.Tags == nil {
+		c.Tags = []string{}
+	}
+	for _, r := range ranges {
+		c.RangeOffsets = append(c.RangeOffsets, r.Offset)
+		c.RangeLengths = append(c.RangeLengths, r.Length)
+	}
+	if c, err = s.Repo.CreateUploadChallenge(ctx, c, s.TTL); err != nil {
+		return Result{}, err
+	}
+	return Result{Status: StatusChallenge, Challenge: &Challenge{ID: c.ID, Nonce: hex.EncodeToString(nonce), Ranges: ranges, ExpiresAt: c.ExpiresAt}}, nil
+}
+
+// Answer checks proof (hex) against the user's challenge id and adds the file
+// if it matches. Every challenge can be answered once.
+func (s *Service) Answer(ctx context.Context, userID, id, proof string) (Result, error) {
+	got, err := hex.DecodeString(strings.TrimSpace(proof))
+	if err != nil || len(got) != sha256.Size {
+		return Result{}, fmt.Errorf("%w: proof must be a hex SHA-256", ErrInvalidRequest)
+	}
+	c, err := s.Repo.TakeUploadChallenge(ctx, userID, id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return Result{}, ErrChallengeNotFound
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	b, err := s.Repo.GetServableBlob(ctx, c.BlobHash)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && b.SizeBytes != c.SizeBytes) {
+		return Result{Status: StatusUploadRequired}, nil
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	ranges := make([]Range, len(c.RangeOffsets))
+	for i := range ranges {
+		ranges[i] = Range{Offset: c.RangeOffsets[i], Length: c.RangeLengths[i]}
+	}
+	sb, err := s.Repo.GetStoredBlob(ctx, b.Hash)
+	if err != nil {
+		return Result{}, err
+	}
+	content, err := s.Storage.Open(ctx, sb)
+	if err != nil {
+		return Result{}, fmt.Errorf("open blob %s: %w", b.Hash, err)
+	}
+	defer content.Close()
+	want, err := Proof(c.Nonce, ranges, content)
+	if err != nil {
+		return Result{}, fmt.Errorf("read blob %s: %w", b.Hash, err)
+	}
+	if subtle.ConstantTimeCompare(got, want) != 1 {
+		return Result{Status: StatusUploadRequired}, nil
+	}
+	policy, err := s.Repo.GetUploadPolicy(ctx)
+	if err != nil {
+		return Result{}, err
+	}
+	declared := ""
+	if c.MIMEType != nil {
+		declared = *c.MIMEType
+	}
+	return s.addFile(ctx, userID, b, c.Filename, declared, c.Tags, policy.Policy)
+}
+
+// addFile creates the user's file for stored blob b within their quota.
+func (s *Service) addFile(ctx context.Context, userID string, b repo.Blob, filename, declared string, tags []string, policy mimetype.Policy) (Result, error) {
+	detected := ""
+	if b.MIMEType != nil {
+		detected = *b.MIMEType
+	}
+	v := policy.Check(declared, detected)
+	if v.Rejected() {
+		return Result{Status: StatusRejected, Verdict: v}, nil
+	}
+	res, quota, err := s.Repo.ReserveQuota(ctx, userID, b.SizeBytes, false, s.QuotaBytes, time.Minute)
+	if errors.Is(err, repo.ErrQuotaExceeded) {
+		return Result{}, &QuotaError{Quota: quota, Size: b.SizeBytes}
+	}
+	if err != nil {
+		return Result{}, err
+	}
+	defer func() { _ = s.Repo.ReleaseReservation(context.Background(), res.ID) }()
+	f := repo.File{OwnerID: userID, BlobHash: b.Hash, Filename: filename, SizeBytes: b.SizeBytes, MIMEMismatch: v.Mismatch, Tags: tags}
+	if v.Declared != "" {
+		f.MIMEType = &v.Declared
+	}
+	if v.Detected != "" {
+		f.DetectedMIME = &v.Detected
+	}
+	if f.Tags == nil {
+		f.Tags = []string{}
+	}
+	created, err := s.Repo.CreateFileRef(ctx, f)
+	if err != nil {
+		return Result{}, err
+	}
+	return Result{Status: StatusCreated, File: &created, Verdict: v}, nil
+}
+
+// pickRanges chooses the ranges of a challenge for content of size bytes.
+func pickRanges(size int64) ([]Range, error) {
+	if size <= challengeWholeFileMax {
+		return []Range{{Offset: 0, Length: size}}, nil
+	}
+	ranges := make([]Range, challengeRanges)
+	var b [8]byte
+	for i := range ranges {
+		if _, err := rand.Read(b[:]); err != nil {
+			return nil, err
+		}
+		ranges[i] = Range{Offset: int64(binary.BigEndian.Uint64(b[:]) % uint64(size-challengeRangeLen+1)), Length: challengeRangeLen}
+	}
+	return ranges, nil
+}
+
+// Proof computes the answer to a challenge: the SHA-256 of nonce followed by
+// each range of content in order. Clients compute the same over their copy.
+func Proof(nonce []byte, ranges []Range, content io.ReadSeeker) ([]byte, error) {
+	h := sha256.New()
+	h.Write(nonce)
+	for _, r := range ranges {
+		if _, err := content.Seek(r.Offset, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if _, err := io.CopyN(h, content, r.Length); err != nil {
+			return nil, err
+		}
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,258 @@
+// Package filequery parses the query language of file listings into
+// repo.FileFilters.
+//
+// A query is a list of terms, all of which must match:
+//
+//	name:report type:image/* size>10MB created:2026-01..2026-03 tag:invoice -tag:draft is:public
+//
+// Terms are combined with AND (implied between terms), OR and NOT, which are
+// written in capitals; "-" before a term or a parenthesised group negates it.
+// AND binds tighter than OR:
+//
+//	query  = or
+//	or     = and { "OR" and }
+//	and    = unary { [ "AND" ] unary }
+//	unary  = ( "NOT" | "-" ) unary | "(" or ")" | term
+//	term   = field op value | value
+//	op     = ":" | ">" | ">=" | "<" | "<="
+//
+// A value on its own matches file names containing it. Values containing
+// spaces or operators are written in double quotes, with \" and \\ for
+// quotes and backslashes. The fields are:
+//
+//	name:TEXT        file names containing TEXT, ignoring case
+//	type:TYPE        declared or detected type TYPE; * stands for any run of
+//	                 characters, as in image/*
+//	size OP SIZE     size compared with SIZE, a number with an optional unit
+//	                 B, KB, MB, GB or TB (powers of 1024); size:A..B is a range
+//	created OP DATE  creation time compared with DATE: YYYY, YYYY-MM,
+//	                 YYYY-MM-DD (UTC) or an RFC 3339 time; created:DATE is
+//	                 the whole period DATE names, created:A..B the periods
+//	                 from A through B, and either end may be left out
+//	tag:TAG          files tagged TAG
+//	is:public        public files; is:private and is:mismatch (declared type
+//	                 contradicted by the content) are also known
+//	has:KEY          files with metadata KEY
+//	meta.KEY:VALUE   metadata KEY equal to VALUE: true and false are
+//	                 booleans, numbers are numbers, anything else (or
+//	                 anything quoted) is a string; meta.KEY>=N, meta.KEY<=N
+//	                 and meta.KEY:A..B compare numbers
+package filequery
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/himanshu/file-vault-app/backend/internal/mimetype"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// Error is a syntax error or an unacceptable value in a query.
+type Error struct {
+	// Pos is the offset of Token in the query, in characters.
+	Pos     int
+	Token   string
+	Message string
+}
+
+func (e *Error) Error() string {
+	if e.Token == "" {
+		return fmt.Sprintf("query: %s (position %d)", e.Message, e.Pos)
+	}
+	return fmt.Sprintf("query: %s at %q (position %d)", e.Message, e.Token, e.Pos)
+}
+
+// Parse parses query into filters. An empty query matches every file.
+func Parse(query string) (repo.FileFilters, error) {
+	toks, err := lex(query)
+	if err != nil {
+		return repo.FileFilters{}, err
+	}
+	p := &parser{query: query, toks: toks}
+	if p.peek().kind == tokEOF {
+		return repo.FileFilters{}, nil
+	}
+	e, err := p.or()
+	if err != nil {
+		return repo.FileFilters{}, err
+	}
+	if t := p.peek(); t.kind != tokEOF {
+		return repo.FileFilters{}, p.errorf(t, "unexpected %s", t.describe())
+	}
+	return repo.FileFilters{Expr: &e}, nil
+}
+
+type parser struct {
+	query string
+	toks  []token
+	i     int
+}
+
+func (p *parser) peek() token { return p.toks[p.i] }
+
+func (p *parser) next() token {
+	t := p.toks[p.i]
+	if t.kind != tokEOF {
+		p.i++
+	}
+	return t
+}
+
+func (p *parser) errorf(t token, format string, args ...any) error {
+	return &Error{Pos: utf8.RuneCountInString(p.query[:t.pos]), Token: t.text, Message: fmt.Sprintf(format, args...)}
+}
+
+func (p *parser) or() (repo.FilterExpr, error) {
+	e, err := p.and()
+	if err != nil {
+		return e, err
+	}
+	es := []repo.FilterExpr{e}
+	for p.peek().kind == tokOr {
+		p.next()
+		e, err := p.and()
+		if err != nil {
+			return e, err
+		}
+		es = append(es, e)
+	}
+	if len(es) == 1 {
+		return es[0], nil
+	}
+	return repo.FilterExpr{Or: es}, nil
+}
+
+func (p *parser) and() (repo.FilterExpr, error) {
+	var es []repo.FilterExpr
+	for {
+		switch p.peek().kind {
+		case tokEOF, tokOr, tokRParen:
+			if len(es) == 0 {
+				t := p.peek()
+				return repo.FilterExpr{}, p.errorf(t, "expected a term, found %s", t.describe())
+			}
+			if len(es) == 1 {
+				return es[0], nil
+			}
+			return repo.FilterExpr{And: es}, nil
+		case tokAnd:
+			if len(es) == 0 {
+				t := p.peek()
+				return repo.FilterExpr{}, p.errorf(t, "expected a term, found %s", t.describe())
+			}
+			p.next()
+			if k := p.peek().kind; k == tokEOF || k == tokOr || k == tokRParen || k == tokAnd {
+				t := p.peek()
+				return repo.FilterExpr{}, p.errorf(t, "expected a term after AND, found %s", t.describe())
+			}
+		}
+		e, err := p.unary()
+		if err != nil {
+			return e, err
+		}
+		es = append(es, e)
+	}
+}
+
+func (p *parser) unary() (repo.FilterExpr, error) {
+	t := p.next()
+	switch t.kind {
+	case tokNot:
+		e, err := p.unary()
+		if err != nil {
+			return e, err
+		}
+		return repo.FilterExpr{Not: &e}, nil
+	case tokLParen:
+		e, err := p.or()
+		if err != nil {
+			return e, err
+		}
+		if c := p.next(); c.kind != tokRParen {
+			return e, p.errorf(c, "expected ) to close the ( at position %d, found %s", utf8.RuneCountInString(p.query[:t.pos]), c.describe())
+		}
+		return e, nil
+	case tokWord:
+		f, err := p.term(t)
+		if err != nil {
+			return repo.FilterExpr{}, err
+		}
+		return repo.FilterExpr{Filters: &f}, nil
+	}
+	return repo.FilterExpr{}, p.errorf(t, "expected a term, found %s", t.describe())
+}
+
+// term returns the filters of a word.
+func (p *parser) term(t token) (repo.FileFilters, error) {
+	var f repo.FileFilters
+	if t.field == "" {
+		v := t.value
+		f.NameLike = &v
+		return f, nil
+	}
+	if t.value == "" && !t.quoted {
+		return f, p.errorf(t, "%s%s needs a value", t.field, t.op)
+	}
+	field := t.field
+	if strings.HasPrefix(field, "meta.") {
+		field = "meta"
+	}
+	ops := map[string]string{
+		"name": ":", "type": ":", "tag": ":", "is": ":", "has": ":",
+		"size": ": > >= < <=", "created": ": > >= < <=", "meta": ": >= <=",
+	}
+	allowed, ok := ops[field]
+	if !ok {
+		return f, p.errorf(t, "unknown field %q; quote the word to search names for it", t.field)
+	}
+	if !strings.Contains(" "+allowed+" ", " "+t.op+" ") {
+		return f, p.errorf(t, "%s cannot be compared with %s", t.field, t.op)
+	}
+	var err error
+	switch field {
+	case "name":
+		v := t.value
+		f.NameLike = &v
+	case "type":
+		v := strings.ToLower(t.value)
+		if !mimetype.ValidPattern(v) {
+			return f, p.errorf(t, "%q is not a type such as image/png or image/*", t.value)
+		}
+		f.MIMETypes = []string{v}
+	case "tag":
+		var tag string
+		if tag, err = repo.CleanTag(t.value); err != nil {
+			return f, p.errorf(t, "%q is not a valid tag", t.value)
+		}
+		f.Tags = []string{tag}
+	case "is":
+		yes, no := true, false
+		switch t.value {
+		case "public":
+			f.IsPublic = &yes
+		case "private":
+			f.IsPublic = &no
+		case "mismatch":
+			f.MIMEMismatch = &yes
+		default:
+			return f, p.errorf(t, "unknown state %q; expected public, private or mismatch", t.value)
+		}
+	case "has":
+		if err := repo.CheckMetadataKey(t.value); err != nil {
+			return f, p.errorf(t, "%q is not a metadata key", t.value)
+		}
+		yes := true
+		f.Metadata = []repo.MetadataFilter{{Key: t.value, Exists: &yes}}
+	case "size":
+		err = sizeTerm(&f, t)
+	case "created":
+		err = createdTerm(&f, t)
+	case "meta":
+		err = metaTerm(&f, t)
+	}
+	if err != nil {
+		return f, p.errorf(t, "%v", err)
+	}
+	return f, nil
+}
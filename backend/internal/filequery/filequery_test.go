@@ -0,0 +1,180 @@
+package filequery
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// show renders filters compactly for comparison.
+func show(f repo.FileFilters) string {
+	var parts []string
+	if f.NameLike != nil {
+		parts = append(parts, fmt.Sprintf("name~%q", *f.NameLike))
+	}
+	for _, t := range f.MIMETypes {
+		parts = append(parts, "type="+t)
+	}
+	if f.SizeMin != nil {
+		parts = append(parts, fmt.Sprintf("size>=%d", *f.SizeMin))
+	}
+	if f.SizeMax != nil {
+		parts = append(parts, fmt.Sprintf("size<=%d", *f.SizeMax))
+	}
+	if f.DateFrom != nil {
+		parts = append(parts, "from="+f.DateFrom.Format(time.RFC3339Nano))
+	}
+	if f.DateTo != nil {
+		parts = append(parts, "to="+f.DateTo.Format(time.RFC3339Nano))
+	}
+	for _, t := range f.Tags {
+		parts = append(parts, "tag="+t)
+	}
+	if f.IsPublic != nil {
+		parts = append(parts, fmt.Sprintf("public=%v", *f.IsPublic))
+	}
+	if f.MIMEMismatch != nil {
+		parts = append(parts, fmt.Sprintf("mismatch=%v", *f.MIMEMismatch))
+	}
+	for _, m := range f.Metadata {
+		switch {
+		case m.Exists != nil:
+			parts = append(parts, "has "+m.Key)
+		case m.Equals != nil:
+			parts = append(parts, fmt.Sprintf("%s=%#v", m.Key, m.Equals))
+		}
+		if m.Min != nil {
+			parts = append(parts, fmt.Sprintf("%s>=%v", m.Key, *m.Min))
+		}
+		if m.Max != nil {
+			parts = append(parts, fmt.Sprintf("%s<=%v", m.Key, *m.Max))
+		}
+	}
+	if f.Expr != nil {
+		parts = append(parts, showExpr(*f.Expr))
+	}
+	return strings.Join(parts, " ")
+}
+
+func showExpr(e repo.FilterExpr) string {
+	join := func(op string, es []repo.FilterExpr) string {
+		s := make([]string, len(es))
+		for i, x := range es {
+			s[i] = showExpr(x)
+		}
+		return "(" + op + " " + strings.Join(s, " ") + ")"
+	}
+	switch {
+	case e.And != nil:
+		return join("and", e.And)
+	case e.Or != nil:
+		return join("or", e.Or)
+	case e.Not != nil:
+		return "(not " + showExpr(*e.Not) + ")"
+	}
+	return "[" + show(*e.Filters) + "]"
+}
+
+func TestParse(t *testing.T) {
+	for _, c := range []struct{ query, want string }{
+		{"", ""},
+		{"   ", ""},
+		{"report", `[name~"report"]`},
+		{`"quarterly report"`, `[name~"quarterly report"]`},
+		{`name:"a \"b\" \\c"`, `[name~"a \"b\" \\c"]`},
+		{`"size>1"`, `[name~"size>1"]`},
+		{"type:IMAGE/*", `[type=image/*]`},
+		{"size>10MB", `[size>=10485761]`},
+		{"size>=10mb", `[size>=10485760]`},
+		{"size<1KB", `[size<=1023]`},
+		{"size<=1.5k", `[size<=1536]`},
+		{"size:1KB..2KB", `[size>=1024 size<=2048]`},
+		{"size:..2", `[size<=2]`},
+		{"size:100", `[size>=100 size<=100]`},
+		{"created:2026", `[from=2026-01-01T00:00:00Z to=2026-12-31T23:59:59.999999Z]`},
+		{"created:2026-02", `[from=2026-02-01T00:00:00Z to=2026-02-28T23:59:59.999999Z]`},
+		{"created:2026-01..2026-03", `[from=2026-01-01T00:00:00Z to=2026-03-31T23:59:59.999999Z]`},
+		{"created>2026-01-31", `[from=2026-02-01T00:00:00Z]`},
+		{"created>=2026-01-31", `[from=2026-01-31T00:00:00Z]`},
+		{"created<2026-01-31", `[to=2026-01-30T23:59:59.999999Z]`},
+		{"created<=2026-01-31", `[to=2026-01-31T23:59:59.999999Z]`},
+		{"created>=2026-01-31T12:00:00Z", `[from=2026-01-31T12:00:00Z]`},
+		{"tag:Invoice", `[tag=Invoice]`},
+		{"is:public", `[public=true]`},
+		{"is:private", `[public=false]`},
+		{"is:mismatch", `[mismatch=true]`},
+		{"has:project", `[has project]`},
+		{"meta.project:apollo", `[project="apollo"]`},
+		{`meta.project:"42"`, `[project="42"]`},
+		{"meta.pages:42", `[pages=42]`},
+		{"meta.final:true", `[final=true]`},
+		{"meta.pages>=10", `[pages>=10]`},
+		{"meta.pages:1..5", `[pages>=1 pages<=5]`},
+		// implied AND, and AND binding tighter than OR
+		{"a b", `(and [name~"a"] [name~"b"])`},
+		{"a AND b OR c", `(or (and [name~"a"] [name~"b"]) [name~"c"])`},
+		{"a OR b c", `(or [name~"a"] (and [name~"b"] [name~"c"]))`},
+		{"a (b OR c)", `(and [name~"a"] (or [name~"b"] [name~"c"]))`},
+		{"-tag:draft", `(not [tag=draft])`},
+		{"NOT NOT a", `(not (not [name~"a"]))`},
+		{"-(a OR b)", `(not (or [name~"a"] [name~"b"]))`},
+		// lower case operators and a lone dash are words
+		{"a or b", `(and [name~"a"] [name~"or"] [name~"b"])`},
+		{"a - b", `(and [name~"a"] [name~"-"] [name~"b"])`},
+	} {
+		f, err := Parse(c.query)
+		if err != nil {
+			t.Errorf("Parse(%q): %v", c.query, err)
+			continue
+		}
+		var got string
+		if f.Expr != nil {
+			got = showExpr(*f.Expr)
+		}
+		if got != c.want {
+			t.Errorf("Parse(%q) = %s, want %s", c.query, got, c.want)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	for _, c := range []struct {
+		query string
+		pos   int
+		msg   string
+	}{
+		{"a OR", 4, "expected a term"},
+		{"OR a", 0, "expected a term"},
+		{"a AND AND b", 6, "expected a term after AND"},
+		{"(a b", 4, "expected ) to close the ( at position 0"},
+		{"a)", 1, `unexpected ")"`},
+		{"()", 1, "expected a term"},
+		{"color:red", 0, "unknown field"},
+		{"name>a", 0, "cannot be compared"},
+		{"meta.n>1", 0, "cannot be compared"},
+		{"size:", 0, "needs a value"},
+		{"size>ten", 0, "not a size"},
+		{"size:..", 0, "at least one end"},
+		{"size>1PB", 0, "not a size"},
+		{"created:2026-13", 0, "not a date"},
+		{"type:image", 0, "not a type"},
+		{"is:shared", 0, "unknown state"},
+		{`tag:"a,b"`, 0, "not a valid tag"},
+		{"meta.pages>=many", 0, "not a number"},
+		{"über size>x", 5, "not a size"},
+	} {
+		_, err := Parse(c.query)
+		var qe *Error
+		if !errors.As(err, &qe) {
+			t.Errorf("Parse(%q) = %v, want a query error", c.query, err)
+			continue
+		}
+		if qe.Pos != c.pos || !strings.Contains(qe.Message, c.msg) {
+			t.Errorf("Parse(%q): %v; want %q at position %d", c.query, err, c.msg, c.pos)
+		}
+	}
+}
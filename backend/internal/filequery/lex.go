@@ -0,0 +1,159 @@
+package filequery
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+type tokKind int
+
+const (
+	tokEOF tokKind = iota
+	tokWord
+	tokLParen
+	tokRParen
+	tokNot
+	tokAnd
+	tokOr
+)
+
+type token struct {
+	kind tokKind
+	// pos is the byte offset of text in the query.
+	pos  int
+	text string
+	// field, op and value split a word such as size>=10MB; field and op
+	// are empty for a bare value. quoted is set for values in quotes.
+	field, op, value string
+	quoted           bool
+}
+
+func (t token) describe() string {
+	if t.kind == tokEOF {
+		return "end of query"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+var fieldRe = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]*$`)
+
+// lex splits query into tokens, ending with tokEOF.
+func lex(query string) ([]token, error) {
+	var toks []token
+	for i := 0; i < len(query); {
+		r, n := utf8.DecodeRuneInString(query[i:])
+		switch {
+		case unicode.IsSpace(r):
+			i += n
+		case r == '(':
+			toks = append(toks, token{kind: tokLParen, pos: i, text: "("})
+			i++
+		case r == ')':
+			toks = append(toks, token{kind: tokRParen, pos: i, text: ")"})
+			i++
+		case r == '-' && i+1 < len(query) && !isSpaceAt(query, i+1):
+			toks = append(toks, token{kind: tokNot, pos: i, text: "-"})
+			i++
+		default:
+			t, err := lexWord(query, i)
+			if err != nil {
+				return nil, err
+			}
+			toks = append(toks, t)
+			i += len(t.text)
+		}
+	}
+	return append(toks, token{kind: tokEOF, pos: len(query)}), nil
+}
+
+func isSpaceAt(s string, i int) bool {
+	r, _ := utf8.DecodeRuneInString(s[i:])
+	return unicode.IsSpace(r)
+}
+
+// lexWord reads the word starting at start: everything up to a space or
+// parenthesis outside quotes.
+func lexWord(query string, start int) (token, error) {
+	t := token{kind: tokWord, pos: start}
+	opAt := -1
+	quote := -1
+	i := start
+	for i < len(query) {
+		r, n := utf8.DecodeRuneInString(query[i:])
+		if quote >= 0 {
+			switch r {
+			case '\\':
+				n++
+			case '"':
+				quote = -1
+			}
+			i = min(i+n, len(query))
+			continue
+		}
+		if unicode.IsSpace(r) || r == '(' || r == ')' {
+			break
+		}
+		switch r {
+		case '"':
+			quote = i
+		case ':', '<', '>':
+			if opAt < 0 {
+				opAt = i
+			}
+		}
+		i += n
+	}
+	t.text = query[start:i]
+	if quote >= 0 {
+		return t, &Error{Pos: utf8.RuneCountInString(query[:quote]), Token: query[quote:i], Message: "unterminated quoted value"}
+	}
+	switch t.text {
+	case "AND":
+		t.kind = tokAnd
+		return t, nil
+	case "OR":
+		t.kind = tokOr
+		return t, nil
+	case "NOT":
+		t.kind = tokNot
+		return t, nil
+	}
+	raw := t.text
+	if opAt >= 0 && fieldRe.MatchString(query[start:opAt]) {
+		rel := opAt - start
+		t.field = raw[:rel]
+		t.op = raw[rel : rel+1]
+		if t.op != ":" && rel+1 < len(raw) && raw[rel+1] == '=' {
+			t.op += "="
+		}
+		raw = raw[rel+len(t.op):]
+	}
+	t.quoted = strings.HasPrefix(raw, `"`)
+	t.value = unquote(raw)
+	return t, nil
+}
+
+// unquote removes the quotes of the quoted parts of s and their escapes.
+func unquote(s string) string {
+	if !strings.Contains(s, `"`) {
+		return s
+	}
+	var b strings.Builder
+	quoted := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '"':
+			quoted = !quoted
+		case c == '\\' && quoted && i+1 < len(s):
+			i++
+			b.WriteByte(s[i])
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,194 @@
+package filequery
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+var sizeUnits = map[string]float64{
+	"": 1, "b": 1,
+	"k": 1 << 10, "kb": 1 << 10, "kib": 1 << 10,
+	"m": 1 << 20, "mb": 1 << 20, "mib": 1 << 20,
+	"g": 1 << 30, "gb": 1 << 30, "gib": 1 << 30,
+	"t": 1 << 40, "tb": 1 << 40, "tib": 1 << 40,
+}
+
+// parseSize parses a size such as 10MB or 1.5GB.
+func parseSize(s string) (int64, error) {
+	i := strings.IndexFunc(s, func(r rune) bool { return (r < '0' || r > '9') && r != '.' })
+	if i < 0 {
+		i = len(s)
+	}
+	n, err := strconv.ParseFloat(s[:i], 64)
+	unit, ok := sizeUnits[strings.ToLower(s[i:])]
+	if err != nil || !ok || n*unit > math.MaxInt64 {
+		return 0, fmt.Errorf("%q is not a size such as 10MB", s)
+	}
+	return int64(math.Round(n * unit)), nil
+}
+
+func sizeTerm(f *repo.FileFilters, t token) error {
+	if t.op == ":" {
+		lo, hi, isRange := strings.Cut(t.value, "..")
+		if !isRange {
+			hi = lo
+		}
+		if lo == "" && hi == "" {
+			return errors.New("a size range needs at least one end")
+		}
+		if lo != "" {
+			n, err := parseSize(lo)
+			if err != nil {
+				return err
+			}
+			f.SizeMin = &n
+		}
+		if hi != "" {
+			n, err := parseSize(hi)
+			if err != nil {
+				return err
+			}
+			f.SizeMax = &n
+		}
+		return nil
+	}
+	n, err := parseSize(t.value)
+	if err != nil {
+		return err
+	}
+	switch t.op {
+	case ">":
+		n++
+		f.SizeMin = &n
+	case ">=":
+		f.SizeMin = &n
+	case "<":
+		n--
+		f.SizeMax = &n
+	case "<=":
+		f.SizeMax = &n
+	}
+	return nil
+}
+
+// parsePeriod parses a year, month, day or instant into the period it names,
+// from start up to but excluding end.
+func parsePeriod(s string) (start, end time.Time, err error) {
+	for _, p := range []struct {
+		layout string
+		y, m   int
+		d      int
+	}{{"2006", 1, 0, 0}, {"2006-01", 0, 1, 0}, {"2006-01-02", 0, 0, 1}} {
+		if len(s) == len(p.layout) {
+			if start, err = time.Parse(p.layout, s); err == nil {
+				return start, start.AddDate(p.y, p.m, p.d), nil
+			}
+		}
+	}
+	if start, err = time.Parse(time.RFC3339, s); err == nil {
+		return start, start.Add(time.Microsecond), nil
+	}
+	return start, end, fmt.Errorf("%q is not a date such as 2026-01, 2026-01-31 or 2026-01-31T12:00:00Z", s)
+}
+
+func createdTerm(f *repo.FileFilters, t token) error {
+	// timestamps are stored to the microsecond, so the microsecond before a
+	// period ends is the last time in it
+	const last = -time.Microsecond
+	if t.op == ":" {
+		lo, hi, isRange := strings.Cut(t.value, "..")
+		if !isRange {
+			hi = lo
+		}
+		if lo == "" && hi == "" {
+			return errors.New("a date range needs at least one end")
+		}
+		if lo != "" {
+			start, _, err := parsePeriod(lo)
+			if err != nil {
+				return err
+			}
+			f.DateFrom = &start
+		}
+		if hi != "" {
+			_, end, err := parsePeriod(hi)
+			if err != nil {
+				return err
+			}
+			end = end.Add(last)
+			f.DateTo = &end
+		}
+		return nil
+	}
+	start, end, err := parsePeriod(t.value)
+	if err != nil {
+		return err
+	}
+	switch t.op {
+	case ">":
+		f.DateFrom = &end
+	case ">=":
+		f.DateFrom = &start
+	case "<":
+		start = start.Add(last)
+		f.DateTo = &start
+	case "<=":
+		end = end.Add(last)
+		f.DateTo = &end
+	}
+	return nil
+}
+
+func metaTerm(f *repo.FileFilters, t token) error {
+	key := strings.TrimPrefix(t.field, "meta.")
+	if err := repo.CheckMetadataKey(key); err != nil {
+		return fmt.Errorf("%q is not a metadata key", key)
+	}
+	mf := repo.MetadataFilter{Key: key}
+	number := func(s string) (*float64, error) {
+		if s == "" {
+			return nil, nil
+		}
+		n, err := strconv.ParseFloat(s, 64)
+		if err != nil || math.IsNaN(n) || math.IsInf(n, 0) {
+			return nil, fmt.Errorf("%q is not a number", s)
+		}
+		return &n, nil
+	}
+	var err error
+	switch {
+	case t.op == ">=":
+		mf.Min, err = number(t.value)
+	case t.op == "<=":
+		mf.Max, err = number(t.value)
+	case t.quoted:
+		mf.Equals = t.value
+	case strings.Contains(t.value, ".."):
+		lo, hi, _ := strings.Cut(t.value, "..")
+		if lo == "" && hi == "" {
+			return errors.New("a number range needs at least one end")
+		}
+		if mf.Min, err = number(lo); err == nil {
+			mf.Max, err = number(hi)
+		}
+	case t.value == "true" || t.value == "false":
+		mf.Equals = t.value == "true"
+	default:
+		if n, err := number(t.value); err == nil {
+			mf.Equals = *n
+		} else {
+			mf.Equals = t.value
+		}
+	}
+	if err != nil {
+		return err
+	}
+	f.Metadata = []repo.MetadataFilter{mf}
+	return nil
+}
@@ -0,0 +1,321 @@
+// Package fsck cross-checks the database against the storage backend:
+// reference counts, files without blobs, blobs without content and content
+// without blobs. Each category can optionally be repaired.
+package fsck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/gc"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// Categories of problems, also the names accepted by ParseRepair.
+const (
+	RefCounts = "refcounts"
+	Dangling  = "dangling"
+	Missing   = "missing"
+	Orphans   = "orphans"
+)
+
+type Options struct {
+	// Repair holds the categories to fix.
+	Repair map[string]bool
+	// Grace is the minimum age of an object without a row before it is
+	// reported, so that in-flight uploads are not flagged.
+	Grace time.Duration
+}
+
+// ParseRepair turns a comma separated list of categories (or "all") into Options.Repair.
+func ParseRepair(s string) (map[string]bool, error) {
+	out := map[string]bool{}
+	for _, c := range strings.Split(s, ",") {
+		switch c = strings.TrimSpace(c); c {
+		case "":
+		case "all":
+			for _, k := range []string{RefCounts, Dangling, Missing, Orphans} {
+				out[k] = true
+			}
+		case RefCounts, Dangling, Missing, Orphans:
+			out[c] = true
+		default:
+			return nil, fmt.Errorf("unknown repair category %q", c)
+		}
+	}
+	return out, nil
+}
+
+// DanglingFile is a files row whose blob row does not exist.
+type DanglingFile struct {
+	ID       string `json:"id"`
+	OwnerID  string `json:"ownerId"`
+	Filename string `json:"filename"`
+	BlobHash string `json:"blobHash"`
+}
+
+// MissingObject is a blob or chunk row whose content is not in the backend.
+type MissingObject struct {
+	Hash  string `json:"hash"`
+	Key   string `json:"key"`
+	Chunk bool   `json:"chunk"`
+}
+
+// OrphanObject is backend content with no blobs/chunks row.
+type OrphanObject struct {
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+type Report struct {
+	BlobRefCounts  []repo.RefCountDrift `json:"blobRefCounts"`
+	ChunkRefCounts []repo.RefCountDrift `json:"chunkRefCounts"`
+	DanglingFiles  []DanglingFile       `json:"danglingFiles"`
+	MissingObjects []MissingObject      `json:"missingObjects"`
+	// MissingBlobs are the blobs that cannot be served because of MissingObjects.
+	MissingBlobs  []string       `json:"missingBlobs"`
+	OrphanObjects []OrphanObject `json:"orphanObjects"`
+	// Repaired counts rows or objects fixed per category.
+	Repaired map[string]int64 `json:"repaired"`
+	Errors   []string         `json:"errors,omitempty"`
+}
+
+// Clean reports whether no problems were found.
+func (r Report) Clean() bool {
+	return len(r.BlobRefCounts) == 0 && len(r.ChunkRefCounts) == 0 && len(r.DanglingFiles) == 0 &&
+		len(r.MissingObjects) == 0 && len(r.OrphanObjects) == 0
+}
+
+// Outstanding reports whether problems were found in a category not being repaired.
+func (r Report) Outstanding(repair map[string]bool) bool {
+	return (len(r.BlobRefCounts)+len(r.ChunkRefCounts) > 0 && !repair[RefCounts]) ||
+		(len(r.DanglingFiles) > 0 && !repair[Dangling]) ||
+		(len(r.MissingObjects) > 0 && !repair[Missing]) ||
+		(len(r.OrphanObjects) > 0 && !repair[Orphans]) ||
+		len(r.Errors) > 0
+}
+
+type Checker struct {
+	Repo    *repo.Repository
+	Storage *storage.Service
+	Opts    Options
+}
+
+func New(r *repo.Repository, s *storage.Service, opts Options) *Checker {
+	return &Checker{Repo: r, Storage: s, Opts: opts}
+}
+
+const batchSize = 500
+
+// Run checks every category, repairing those selected in Opts.Repair.
+func (c *Checker) Run(ctx context.Context) (Report, error) {
+	rep := Report{Repaired: map[string]int64{}}
+	if err := c.checkRefCounts(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("ref counts: %w", err)
+	}
+	if err := c.checkDangling(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("dangling files: %w", err)
+	}
+	if err := c.checkMissing(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("missing content: %w", err)
+	}
+	if err := c.checkOrphans(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("orphaned content: %w", err)
+	}
+	return rep, nil
+}
+
+func (c *Checker) checkRefCounts(ctx context.Context, rep *Report) error {
+	var err error
+	if rep.BlobRefCounts, err = c.Repo.BlobRefCountDrift(ctx); err != nil {
+		return err
+	}
+	if rep.ChunkRefCounts, err = c.Repo.ChunkRefCountDrift(ctx); err != nil {
+		return err
+	}
+	if !c.Opts.Repair[RefCounts] {
+		return nil
+	}
+	nb, err := c.Repo.FixBlobRefCounts(ctx)
+	if err != nil {
+		return err
+	}
+	nc, err := c.Repo.FixChunkRefCounts(ctx)
+	if err != nil {
+		return err
+	}
+	rep.Repaired[RefCounts] = nb + nc
+	return nil
+}
+
+func (c *Checker) checkDangling(ctx context.Context, rep *Report) error {
+	files, err := c.Repo.DanglingFiles(ctx)
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		rep.DanglingFiles = append(rep.DanglingFiles, DanglingFile{ID: f.ID, OwnerID: f.OwnerID, Filename: f.Filename, BlobHash: f.BlobHash})
+	}
+	if !c.Opts.Repair[Dangling] || len(files) == 0 {
+		return nil
+	}
+	n, err := c.Repo.DeleteDanglingFiles(ctx)
+	rep.Repaired[Dangling] = n
+	return err
+}
+
+// checkMissing stats every blob and chunk object. Blobs whose content (or any
+// of whose chunks) is gone are repaired by quarantining them, which stops
+// downloads from serving a broken file; the rows are kept so that content can
+// still be restored from a backup.
+func (c *Checker) checkMissing(ctx context.Context, rep *Report) error {
+	missing := map[string]bool{}
+	after := ""
+	for {
+		blobs, err := c.Repo.ListBlobs(ctx, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			after = b.Hash
+			if b.Chunked && b.StoragePath == "" {
+				continue
+			}
+			if c.exists(ctx, rep, b.StoragePath) {
+				continue
+			}
+			rep.MissingObjects = append(rep.MissingObjects, MissingObject{Hash: b.Hash, Key: b.StoragePath})
+			missing[b.Hash] = true
+		}
+		if len(blobs) < batchSize {
+			break
+		}
+	}
+	var missingChunks []string
+	after = ""
+	for {
+		chunks, err := c.Repo.ListChunks(ctx, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, ch := range chunks {
+			after = ch.Hash
+			if c.exists(ctx, rep, ch.StoragePath) {
+				continue
+			}
+			rep.MissingObjects = append(rep.MissingObjects, MissingObject{Hash: ch.Hash, Key: ch.StoragePath, Chunk: true})
+			missingChunks = append(missingChunks, ch.Hash)
+		}
+		if len(chunks) < batchSize {
+			break
+		}
+	}
+	if len(missingChunks) > 0 {
+		hashes, err := c.Repo.BlobsUsingChunks(ctx, missingChunks)
+		if err != nil {
+			return err
+		}
+		for _, h := range hashes {
+			missing[h] = true
+		}
+	}
+	for h := range missing {
+		rep.MissingBlobs = append(rep.MissingBlobs, h)
+	}
+	sort.Strings(rep.MissingBlobs)
+	if !c.Opts.Repair[Missing] {
+		return nil
+	}
+	for _, h := range rep.MissingBlobs {
+		if err := c.Repo.RecordVerification(ctx, h, repo.VerifyMissing, "fsck: stored content not found"); err != nil {
+			return err
+		}
+		rep.Repaired[Missing]++
+	}
+	return nil
+}
+
+// exists stats key, recording backend errors other than ErrNotFound in the
+// report and treating such objects as present.
+func (c *Checker) exists(ctx context.Context, rep *Report, key string) bool {
+	_, err := c.Storage.Backend.Stat(ctx, key)
+	if errors.Is(err, storage.ErrNotFound) {
+		return false
+	}
+	if err != nil {
+		rep.Errors = append(rep.Errors, fmt.Sprintf("stat %s: %v", key, err))
+	}
+	return true
+}
+
+func (c *Checker) checkOrphans(ctx context.Context, rep *Report) error {
+	finder := gc.New(c.Repo, c.Storage, gc.Options{Grace: c.Opts.Grace})
+	return finder.Orphans(ctx, func(o storage.ObjectInfo) error {
+		rep.OrphanObjects = append(rep.OrphanObjects, OrphanObject{Key: o.Key, Size: o.Size})
+		if !c.Opts.Repair[Orphans] {
+			return nil
+		}
+		// an upload may have recorded the object since it was listed
+		deleted, err := c.Repo.DeleteUnreferenced(ctx, []string{o.Key}, func([]string) error {
+			if err := c.Storage.Backend.Delete(ctx, o.Key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+				return err
+			}
+			return nil
+		})
+		if err != nil {
+			rep.Errors = append(rep.Errors, fmt.Sprintf("delete %s: %v", o.Key, err))
+			return nil
+		}
+		if len(deleted) > 0 {
+			rep.Repaired[Orphans]++
+		}
+		return nil
+	})
+}
+
+// WriteText prints the report for humans.
+func (r Report) WriteText(w io.Writer) {
+	section := func(title string, n int, fix string) {
+		fmt.Fprintf(w, "%s: %d", title, n)
+		if fixed, ok := r.Repaired[fix]; ok {
+			fmt.Fprintf(w, " (repaired %d)", fixed)
+		}
+		fmt.Fprintln(w)
+	}
+	section("blob ref_count mismatches", len(r.BlobRefCounts), RefCounts)
+	for _, d := range r.BlobRefCounts {
+		fmt.Fprintf(w, "  blob %s: ref_count %d, referenced by %d files\n", d.Hash, d.Stored, d.Actual)
+	}
+	section("chunk ref_count mismatches", len(r.ChunkRefCounts), RefCounts)
+	for _, d := range r.ChunkRefCounts {
+		fmt.Fprintf(w, "  chunk %s: ref_count %d, referenced %d times\n", d.Hash, d.Stored, d.Actual)
+	}
+	section("files with missing blobs", len(r.DanglingFiles), Dangling)
+	for _, f := range r.DanglingFiles {
+		fmt.Fprintf(w, "  file %s (%s, owner %s): blob %s\n", f.ID, f.Filename, f.OwnerID, f.BlobHash)
+	}
+	section("blobs with missing content", len(r.MissingBlobs), Missing)
+	for _, o := range r.MissingObjects {
+		kind := "blob"
+		if o.Chunk {
+			kind = "chunk"
+		}
+		fmt.Fprintf(w, "  %s %s: %s not found\n", kind, o.Hash, o.Key)
+	}
+	section("stored objects without rows", len(r.OrphanObjects), Orphans)
+	for _, o := range r.OrphanObjects {
+		fmt.Fprintf(w, "  %s (%d bytes)\n", o.Key, o.Size)
+	}
+	for _, e := range r.Errors {
+		fmt.Fprintf(w, "error: %s\n", e)
+	}
+	if r.Clean() {
+		fmt.Fprintln(w, "no problems found")
+	}
+}
@@ -0,0 +1,315 @@
+// Package gc reclaims storage that is no longer referenced: blobs and chunks
+// whose ref_count dropped to zero, stale upload spool files and objects in the
+// backend that have no database row.
+package gc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+type Options struct {
+	// Grace is how long a blob or chunk must have had zero references, and how
+	// old an unknown object must be, before it is deleted.
+	Grace time.Duration
+	// TempMaxAge is the age after which upload-* spool files are considered abandoned.
+	TempMaxAge time.Duration
+	// DeleteOrphans removes backend objects that have no blobs/chunks row.
+	// Orphans are always reported.
+	DeleteOrphans bool
+	// DryRun reports what would be reclaimed without changing anything.
+	DryRun bool
+}
+
+// Tally counts items and the bytes they occupy in the backend.
+type Tally struct {
+	Count int   `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (t *Tally) add(n int64) { t.Count++; t.Bytes += n }
+
+type Report struct {
+	DryRun    bool  `json:"dryRun"`
+	Blobs     Tally `json:"blobs"`
+	Chunks    Tally `json:"chunks"`
+	TempFiles Tally `json:"tempFiles"`
+	Orphans   Tally `json:"orphans"`
+	// OrphanKeys lists the orphaned objects found; they are only deleted
+	// (and counted as reclaimed) with DeleteOrphans.
+	OrphanKeys    []string `json:"orphanKeys,omitempty"`
+	DeleteOrphans bool     `json:"deleteOrphans"`
+	Errors        []string `json:"errors,omitempty"`
+}
+
+// ReclaimedBytes is the total reclaimed (or, in a dry run, reclaimable) bytes.
+func (r Report) ReclaimedBytes() int64 {
+	n := r.Blobs.Bytes + r.Chunks.Bytes + r.TempFiles.Bytes
+	if r.DeleteOrphans {
+		n += r.Orphans.Bytes
+	}
+	return n
+}
+
+func (r Report) String() string {
+	verb := "reclaimed"
+	if r.DryRun {
+		verb = "reclaimable"
+	}
+	return fmt.Sprintf("gc: %s %d bytes (blobs %d/%dB, chunks %d/%dB, temp files %d/%dB, orphans %d/%dB, %d errors)",
+		verb, r.ReclaimedBytes(), r.Blobs.Count, r.Blobs.Bytes, r.Chunks.Count, r.Chunks.Bytes,
+		r.TempFiles.Count, r.TempFiles.Bytes, r.Orphans.Count, r.Orphans.Bytes, len(r.Errors))
+}
+
+type Collector struct {
+	Repo    *repo.Repository
+	Storage *storage.Service
+	Opts    Options
+}
+
+func New(r *repo.Repository, s *storage.Service, opts Options) *Collector {
+	return &Collector{Repo: r, Storage: s, Opts: opts}
+}
+
+const batchSize = 500
+
+// Run performs one full collection pass.
+func (c *Collector) Run(ctx context.Context) (Report, error) {
+	rep := Report{DryRun: c.Opts.DryRun, DeleteOrphans: c.Opts.DeleteOrphans}
+	if err := c.collectBlobs(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("blobs: %w", err)
+	}
+	if err := c.collectChunks(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("chunks: %w", err)
+	}
+	if err := c.sweepTemp(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("temp files: %w", err)
+	}
+	if err := c.findOrphans(ctx, &rep); err != nil {
+		return rep, fmt.Errorf("orphans: %w", err)
+	}
+	return rep, nil
+}
+
+// Start runs the collector every interval until ctx is cancelled.
+func (c *Collector) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				rep, err := c.Run(ctx)
+				if err != nil {
+					log.Printf("gc: %v", err)
+				}
+				log.Print(rep.String())
+			}
+		}
+	}()
+}
+
+func storedBytes(size int64, stored *int64) int64 {
+	if stored != nil {
+		return *stored
+	}
+	return size
+}
+
+func (c *Collector) collectBlobs(ctx context.Context, rep *Report) error {
+	after := ""
+	for {
+		blobs, err := c.Repo.ListCollectableBlobs(ctx, c.Opts.Grace, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, b := range blobs {
+			after = b.Hash
+			n := int64(0)
+			if !b.Chunked || b.StoragePath != "" {
+				n = storedBytes(b.SizeBytes, b.StoredSize)
+			}
+			if c.Opts.DryRun {
+				rep.Blobs.add(n)
+				continue
+			}
+			// the content is deleted before the row is; if that fails the
+			// blob stays for the next pass
+			deleted, err := c.Repo.DeleteCollectableBlob(ctx, b.Hash, c.Opts.Grace, func() error {
+				if b.StoragePath == "" {
+					return nil
+				}
+				return c.deleteObject(ctx, b.StoragePath)
+			})
+			if err != nil {
+				rep.Errors = append(rep.Errors, fmt.Sprintf("blob %s: %v", b.Hash, err))
+				continue
+			}
+			if deleted {
+				rep.Blobs.add(n)
+			}
+		}
+		if len(blobs) < batchSize {
+			return nil
+		}
+	}
+}
+
+func (c *Collector) collectChunks(ctx context.Context, rep *Report) error {
+	after := ""
+	for {
+		chunks, err := c.Repo.ListCollectableChunks(ctx, c.Opts.Grace, after, batchSize)
+		if err != nil {
+			return err
+		}
+		for _, ch := range chunks {
+			after = ch.Hash
+			n := storedBytes(ch.SizeBytes, ch.StoredSize)
+			if c.Opts.DryRun {
+				rep.Chunks.add(n)
+				continue
+			}
+			deleted, err := c.Repo.DeleteCollectableChunk(ctx, ch.Hash, c.Opts.Grace, func() error {
+				return c.deleteObject(ctx, ch.StoragePath)
+			})
+			if err != nil {
+				rep.Errors = append(rep.Errors, fmt.Sprintf("chunk %s: %v", ch.Hash, err))
+				continue
+			}
+			if deleted {
+				rep.Chunks.add(n)
+			}
+		}
+		if len(chunks) < batchSize {
+			return nil
+		}
+	}
+}
+
+// deleteObject deletes the object under key; one that is already gone counts
+// as deleted.
+func (c *Collector) deleteObject(ctx context.Context, key string) error {
+	if err := c.Storage.Backend.Delete(ctx, key); err != nil && !errors.Is(err, storage.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// sweepTemp removes upload spool files abandoned by crashed requests.
+func (c *Collector) sweepTemp(ctx context.Context, rep *Report) error {
+	entries, err := os.ReadDir(c.Storage.TempDir)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-c.Opts.TempMaxAge)
+	for _, e := range entries {
+		if e.IsDir() || !strings.HasPrefix(e.Name(), "upload-") {
+			continue
+		}
+		info, err := e.Info()
+		if err != nil || info.ModTime().After(cutoff) {
+			continue
+		}
+		if !c.Opts.DryRun {
+			if err := os.Remove(filepath.Join(c.Storage.TempDir, e.Name())); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				rep.Errors = append(rep.Errors, fmt.Sprintf("temp %s: %v", e.Name(), err))
+				continue
+			}
+		}
+		rep.TempFiles.add(info.Size())
+	}
+	return ctx.Err()
+}
+
+// findOrphans reports, and with DeleteOrphans removes, objects found by Orphans.
+func (c *Collector) findOrphans(ctx context.Context, rep *Report) error {
+	return c.Orphans(ctx, func(o storage.ObjectInfo) error {
+		if c.Opts.DeleteOrphans && !c.Opts.DryRun {
+			// an upload may have recorded the object since it was listed
+			deleted, err := c.Repo.DeleteUnreferenced(ctx, []string{o.Key}, func([]string) error {
+				return c.deleteObject(ctx, o.Key)
+			})
+			if err != nil {
+				rep.OrphanKeys = append(rep.OrphanKeys, o.Key)
+				rep.Errors = append(rep.Errors, fmt.Sprintf("orphan %s: %v", o.Key, err))
+				return nil
+			}
+			if len(deleted) == 0 {
+				return nil
+			}
+		}
+		rep.OrphanKeys = append(rep.OrphanKeys, o.Key)
+		rep.Orphans.add(o.Size)
+		return nil
+	})
+}
+
+// Orphans lists the backend and calls fn for every blob or chunk object that
+// has no database row. Objects younger than the grace period are skipped
+// because an upload may not have inserted its row yet.
+func (c *Collector) Orphans(ctx context.Context, fn func(storage.ObjectInfo) error) error {
+	cutoff := time.Now().Add(-c.Opts.Grace)
+	var batch []storage.ObjectInfo
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+		var blobHashes, chunkHashes []string
+		for _, o := range batch {
+			h, chunk, _ := storage.ParseKey(o.Key)
+			if chunk {
+				chunkHashes = append(chunkHashes, h)
+			} else {
+				blobHashes = append(blobHashes, h)
+			}
+		}
+		knownBlobs, err := c.Repo.KnownBlobHashes(ctx, blobHashes)
+		if err != nil {
+			return err
+		}
+		knownChunks, err := c.Repo.KnownChunkHashes(ctx, chunkHashes)
+		if err != nil {
+			return err
+		}
+		for _, o := range batch {
+			h, chunk, _ := storage.ParseKey(o.Key)
+			if (chunk && knownChunks[h]) || (!chunk && knownBlobs[h]) {
+				continue
+			}
+			if err := fn(o); err != nil {
+				return err
+			}
+		}
+		batch = batch[:0]
+		return nil
+	}
+	err := c.Storage.Backend.List(ctx, "", func(o storage.ObjectInfo) error {
+		if _, _, ok := storage.ParseKey(o.Key); !ok || o.ModTime.After(cutoff) {
+			return nil
+		}
+		batch = append(batch, o)
+		if len(batch) >= batchSize {
+			return flush()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
@@ -0,0 +1,219 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// bulkFields returns the bulk job queries and the bulk mutation. A bulk
+// operation over up to Deps.BulkSyncLimit files runs in one transaction and
+// reports the outcome for each file; a larger one is queued as a job whose
+// progress is polled with bulkJob.
+func bulkFields(d Deps, mt metadataTypes) (queries, mutations graphql.Fields) {
+	filterArgs := fileFilterArgs(mt)
+	actionType := graphql.NewEnum(graphql.EnumConfig{
+		Name: "BulkAction",
+		Values: graphql.EnumValueConfigMap{
+			// TRASH moves files to the trash; DELETE deletes them for good,
+			// from the trash too
+			"TRASH":       &graphql.EnumValueConfig{Value: repo.BulkTrash},
+			"DELETE":      &graphql.EnumValueConfig{Value: repo.BulkDelete},
+			"SET_PUBLIC":  &graphql.EnumValueConfig{Value: repo.BulkSetPublic},
+			"ADD_TAGS":    &graphql.EnumValueConfig{Value: repo.BulkAddTags},
+			"REMOVE_TAGS": &graphql.EnumValueConfig{Value: repo.BulkRemoveTags},
+			"MOVE":        &graphql.EnumValueConfig{Value: repo.BulkMove},
+		},
+	})
+	itemType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BulkItem",
+		Fields: graphql.Fields{
+			"fileId": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// done or not_found
+			"status": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	jobType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BulkJob",
+		Fields: graphql.Fields{
+			"id":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"action": &graphql.Field{Type: graphql.NewNonNull(actionType)},
+			// queued, running, done or failed
+			"status":          &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"total":           &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"processed":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"succeeded":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"notFoundIds":     &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"progressPercent": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			// why a failed job stopped; files processed before stay changed
+			"error":      &graphql.Field{Type: graphql.String},
+			"createdAt":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"startedAt":  &graphql.Field{Type: graphql.String},
+			"finishedAt": &graphql.Field{Type: graphql.String},
+		},
+	})
+	paramsType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "BulkParams",
+		Fields: graphql.InputObjectConfigFieldMap{
+			// for SET_PUBLIC
+			"isPublic": &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			// for ADD_TAGS and REMOVE_TAGS
+			"tags": &graphql.InputObjectFieldConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			// for MOVE; null moves the files to the root folder
+			"folderId": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+	resultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BulkResult",
+		Fields: graphql.Fields{
+			// null when the operation was queued as job
+			"items": &graphql.Field{Type: graphql.NewList(graphql.NewNonNull(itemType))},
+			"job":   &graphql.Field{Type: jobType},
+		},
+	})
+
+	queries = graphql.Fields{
+		"bulkJob": &graphql.Field{
+			Type: jobType,
+			Args: graphql.FieldConfigArgument{
+				"id": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				j, err := d.Repo.GetBulkJob(context.Background(), userID, p.Args["id"].(string))
+				if err != nil {
+					return nil, err
+				}
+				return bulkJobMap(j), nil
+			},
+		},
+		"myBulkJobs": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(jobType))),
+			Args: graphql.FieldConfigArgument{
+				"limit": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				limit, _ := p.Args["limit"].(int)
+				if limit == 0 {
+					limit = 20
+				}
+				jobs, err := d.Repo.ListBulkJobs(context.Background(), userID, limit)
+				if err != nil {
+					return nil, err
+				}
+				out := make([]map[string]any, len(jobs))
+				for i, j := range jobs {
+					out[i] = bulkJobMap(j)
+				}
+				return out, nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{
+		// bulkUpdateFiles applies action to the files fileIds, or to the files
+		// outside the trash matching the filters (which with query "" is all
+		// of them)
+		"bulkUpdateFiles": &graphql.Field{
+			Type: graphql.NewNonNull(resultType),
+			Args: withArgs(filterArgs, graphql.FieldConfigArgument{
+				"action":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(actionType)},
+				"params":  &graphql.ArgumentConfig{Type: paramsType},
+				"fileIds": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+			}),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				params, _ := p.Args["params"].(map[string]any)
+				op := repo.BulkOp{
+					Action:   p.Args["action"].(string),
+					Tags:     strListArg(params, "tags"),
+					FolderID: optStrArg(params, "folderId"),
+				}
+				if op.Action == repo.BulkSetPublic {
+					v, ok := params["isPublic"].(bool)
+					if !ok {
+						return nil, errors.New("SET_PUBLIC needs params.isPublic")
+					}
+					op.IsPublic = v
+				}
+				sel, err := bulkSelectionArg(p.Args, filterArgs)
+				if err != nil {
+					return nil, err
+				}
+				items, job, err := d.Repo.Bulk(context.Background(), userID, op, sel, d.BulkSyncLimit)
+				if err != nil {
+					return nil, err
+				}
+				if job != nil {
+					return map[string]any{"items": nil, "job": bulkJobMap(*job)}, nil
+				}
+				out := make([]map[string]any, len(items))
+				for i, it := range items {
+					out[i] = map[string]any{"fileId": it.FileID, "status": it.Status}
+				}
+				return map[string]any{"items": out, "job": nil}, nil
+			},
+		},
+	}
+	return queries, mutations
+}
+
+// bulkSelectionArg returns the files bulkUpdateFiles was given: fileIds, or
+// the filters of filterArgs, one of which must be present.
+func bulkSelectionArg(args map[string]any, filterArgs graphql.FieldConfigArgument) (repo.BulkSelection, error) {
+	filtered := false
+	for name := range filterArgs {
+		if _, ok := args[name]; ok {
+			filtered = true
+		}
+	}
+	_, byID := args["fileIds"]
+	switch {
+	case byID && filtered:
+		return repo.BulkSelection{}, errors.New("select files by fileIds or by filters, not both")
+	case byID:
+		return repo.BulkSelection{FileIDs: strListArg(args, "fileIds")}, nil
+	case filtered:
+		f, err := fileFiltersArg(args)
+		return repo.BulkSelection{Filters: &f}, err
+	}
+	return repo.BulkSelection{}, errors.New("select files with fileIds or filters; query \"\" selects every file")
+}
+
+func bulkJobMap(j repo.BulkJob) map[string]any {
+	progress := 100.0
+	if len(j.FileIDs) > 0 {
+		progress = float64(j.Processed) / float64(len(j.FileIDs)) * 100.0
+	}
+	notFound := j.NotFound
+	if notFound == nil {
+		notFound = []string{}
+	}
+	return map[string]any{
+		"id":              j.ID,
+		"action":          j.Op.Action,
+		"status":          j.Status,
+		"total":           len(j.FileIDs),
+		"processed":       j.Processed,
+		"succeeded":       j.Succeeded,
+		"notFoundIds":     notFound,
+		"progressPercent": progress,
+		"error":           optStr(j.Error),
+		"createdAt":       j.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		"startedAt":       optTime(j.StartedAt),
+		"finishedAt":      optTime(j.FinishedAt),
+	}
+}
@@ -0,0 +1,154 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// connectionFields returns the Relay-style connections over the caller's
+// files and, for admins, everyone's. Pages are selected with first/after or
+// last/before; cursors are opaque and only valid for the order they were
+// issued in.
+func connectionFields(d Deps, fileType *graphql.Object, mt metadataTypes) graphql.Fields {
+	pageInfoType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PageInfo",
+		Fields: graphql.Fields{
+			"hasNextPage":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"hasPreviousPage": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"startCursor":     &graphql.Field{Type: graphql.String},
+			"endCursor":       &graphql.Field{Type: graphql.String},
+		},
+	})
+	edgeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FileEdge",
+		Fields: graphql.Fields{
+			"cursor": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"node":   &graphql.Field{Type: graphql.NewNonNull(fileType)},
+		},
+	})
+	connectionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FileConnection",
+		Fields: graphql.Fields{
+			"edges":    &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(edgeType)))},
+			"pageInfo": &graphql.Field{Type: graphql.NewNonNull(pageInfoType)},
+			// totals of every file in the listing, not just the page
+			"totalCount":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"totalSizeBytes": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	orderType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "FileOrder",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"field": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.NewEnum(graphql.EnumConfig{
+				Name: "FileOrderField",
+				Values: graphql.EnumValueConfigMap{
+					"NAME":           &graphql.EnumValueConfig{Value: repo.SortName},
+					"SIZE":           &graphql.EnumValueConfig{Value: repo.SortSize},
+					"CREATED_AT":     &graphql.EnumValueConfig{Value: repo.SortCreatedAt},
+					"DOWNLOAD_COUNT": &graphql.EnumValueConfig{Value: repo.SortDownloadCount},
+				},
+			}))},
+			"direction": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.NewEnum(graphql.EnumConfig{
+				Name: "OrderDirection",
+				Values: graphql.EnumValueConfigMap{
+					"ASC":  &graphql.EnumValueConfig{Value: "asc"},
+					"DESC": &graphql.EnumValueConfig{Value: "desc"},
+				},
+			}))},
+		},
+	})
+	pageArgs := func() graphql.FieldConfigArgument {
+		return graphql.FieldConfigArgument{
+			"first":  &graphql.ArgumentConfig{Type: graphql.Int},
+			"after":  &graphql.ArgumentConfig{Type: graphql.String},
+			"last":   &graphql.ArgumentConfig{Type: graphql.Int},
+			"before": &graphql.ArgumentConfig{Type: graphql.String},
+			// defaults to the newest files first
+			"orderBy": &graphql.ArgumentConfig{Type: orderType},
+		}
+	}
+
+	return graphql.Fields{
+		"myFilesConnection": &graphql.Field{
+			Type: connectionType,
+			Args: withArgs(fileFilterArgs(mt), pageArgs()),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				filters, err := fileFiltersArg(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				page, err := d.Repo.ListFilesPage(context.Background(), userID, filters, pageArg(p.Args))
+				if err != nil {
+					return nil, err
+				}
+				return connectionMap(page, fileMaps(d, userID, page.Files)), nil
+			},
+		},
+		// allFilesConnection includes files in the trash
+		"allFilesConnection": &graphql.Field{
+			Type: connectionType,
+			Args: pageArgs(),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				r := p.Context.Value(http.Request{}).(*http.Request)
+				if !isAdmin(p.Context, d, r) {
+					return nil, nil
+				}
+				page, err := d.Repo.ListAllFilesPage(context.Background(), pageArg(p.Args))
+				if err != nil {
+					return nil, err
+				}
+				nodes := make([]map[string]any, len(page.Files))
+				for i, f := range page.Files {
+					token, _ := d.Repo.GetPublicTokenForFile(context.Background(), f.OwnerID, f.ID)
+					nodes[i] = fileMap(f, token, f.DownloadCount)
+				}
+				return connectionMap(page, nodes), nil
+			},
+		},
+	}
+}
+
+// pageArg returns the page selected by the connection arguments.
+func pageArg(args map[string]any) repo.Page {
+	pg := repo.Page{}
+	pg.First, _ = args["first"].(int)
+	pg.After, _ = args["after"].(string)
+	pg.Last, _ = args["last"].(int)
+	pg.Before, _ = args["before"].(string)
+	if o, ok := args["orderBy"].(map[string]any); ok {
+		pg.Sort.Key, _ = o["field"].(string)
+		pg.Sort.Desc = o["direction"] == "desc"
+	}
+	return pg
+}
+
+// connectionMap maps a page to a FileConnection with the file maps nodes.
+func connectionMap(page repo.FilePage, nodes []map[string]any) map[string]any {
+	edges := make([]map[string]any, len(nodes))
+	for i, n := range nodes {
+		edges[i] = map[string]any{"cursor": page.Cursors[i], "node": n}
+	}
+	info := map[string]any{
+		"hasNextPage":     page.HasNextPage,
+		"hasPreviousPage": page.HasPreviousPage,
+		"startCursor":     nil,
+		"endCursor":       nil,
+	}
+	if len(page.Cursors) > 0 {
+		info["startCursor"] = page.Cursors[0]
+		info["endCursor"] = page.Cursors[len(page.Cursors)-1]
+	}
+	return map[string]any{
+		"edges":          edges,
+		"pageInfo":       info,
+		"totalCount":     page.TotalCount,
+		"totalSizeBytes": page.TotalSize,
+	}
+}
@@ -0,0 +1,94 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// copyMutations returns copyFile and copyFiles, which copy files without
+// copying their content: the copies reference the stored blobs. Copies count
+// toward the caller's quota like uploads do.
+func copyMutations(d Deps, fileType *graphql.Object) graphql.Fields {
+	sourceType := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "CopySource",
+		Fields: graphql.InputObjectConfigFieldMap{
+			// fileId is one of the caller's files or one shared with them;
+			// token is a public link. Exactly one of them is given.
+			"fileId": &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"token":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			// the name of the copy, by default that of the source
+			"filename": &graphql.InputObjectFieldConfig{Type: graphql.String},
+		},
+	})
+	copyFiles := func(p graphql.ResolveParams, srcs []repo.CopySource) ([]map[string]any, error) {
+		userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+		if userID == "" {
+			return nil, nil
+		}
+		files, err := d.Repo.CopyFiles(context.Background(), userID, srcs, optStrArg(p.Args, "folderId"), d.QuotaBytes)
+		if err != nil {
+			return nil, err
+		}
+		return fileMaps(d, userID, files), nil
+	}
+
+	return graphql.Fields{
+		"copyFile": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId":   &graphql.ArgumentConfig{Type: graphql.String},
+				"token":    &graphql.ArgumentConfig{Type: graphql.String},
+				"filename": &graphql.ArgumentConfig{Type: graphql.String},
+				// null copies into the root folder
+				"folderId": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				src, err := copySourceArg(p.Args)
+				if err != nil {
+					return nil, err
+				}
+				files, err := copyFiles(p, []repo.CopySource{src})
+				if len(files) == 0 {
+					return nil, err
+				}
+				return files[0], nil
+			},
+		},
+		// copyFiles copies all sources into one folder, or none of them when
+		// one is not found or they do not fit the quota
+		"copyFiles": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+			Args: graphql.FieldConfigArgument{
+				"sources":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(sourceType)))},
+				"folderId": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				var srcs []repo.CopySource
+				for _, s := range p.Args["sources"].([]any) {
+					src, err := copySourceArg(s.(map[string]any))
+					if err != nil {
+						return nil, err
+					}
+					srcs = append(srcs, src)
+				}
+				return copyFiles(p, srcs)
+			},
+		},
+	}
+}
+
+// copySourceArg returns the source given by fileId or token, and filename.
+func copySourceArg(args map[string]any) (repo.CopySource, error) {
+	var src repo.CopySource
+	src.FileID, _ = args["fileId"].(string)
+	src.Token, _ = args["token"].(string)
+	src.Filename, _ = args["filename"].(string)
+	if (src.FileID == "") == (src.Token == "") {
+		return src, errors.New("copy either fileId or token")
+	}
+	return src, nil
+}
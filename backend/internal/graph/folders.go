@@ -0,0 +1,202 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// folderFields returns the folder queries and mutations. Folder arguments
+// are folder ids; a null folder stands for the root.
+func folderFields(d Deps, fileType *graphql.Object) (queries, mutations graphql.Fields) {
+	folderType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Folder",
+		Fields: graphql.Fields{
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"name":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"parentId":  &graphql.Field{Type: graphql.String},
+			"createdAt": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	folderListType := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(folderType)))
+
+	folderContentsType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FolderContents",
+		Fields: graphql.Fields{
+			// null for the root
+			"folder": &graphql.Field{Type: folderType},
+			// breadcrumbs from the top-level folder down to folder; empty for the root
+			"path":    &graphql.Field{Type: folderListType},
+			"folders": &graphql.Field{Type: folderListType},
+			"files":   &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType)))},
+		},
+	})
+
+	queries = graphql.Fields{
+		"folderContents": &graphql.Field{
+			Type: folderContentsType,
+			Args: graphql.FieldConfigArgument{
+				"folderId": &graphql.ArgumentConfig{Type: graphql.String},
+				// limit and offset page through the files; subfolders are listed in full
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+				"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				ctx := context.Background()
+				folderID := optStrArg(p.Args, "folderId")
+				limit, _ := p.Args["limit"].(int)
+				offset, _ := p.Args["offset"].(int)
+				if limit == 0 {
+					limit = 50
+				}
+				out := map[string]any{"path": []map[string]any{}}
+				if folderID != nil {
+					path, err := d.Repo.FolderPath(ctx, userID, *folderID)
+					if err != nil {
+						return nil, err
+					}
+					out["folder"] = folderMap(path[len(path)-1])
+					out["path"] = folderMaps(path)
+				}
+				folders, err := d.Repo.ListFolders(ctx, userID, folderID)
+				if err != nil {
+					return nil, err
+				}
+				files, err := d.Repo.ListFilesInFolder(ctx, userID, folderID, limit, offset)
+				if err != nil {
+					return nil, err
+				}
+				out["folders"] = folderMaps(folders)
+				out["files"] = fileMaps(d, userID, files)
+				return out, nil
+			},
+		},
+		"breadcrumbs": &graphql.Field{
+			Type: folderListType,
+			Args: graphql.FieldConfigArgument{
+				"folderId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				path, err := d.Repo.FolderPath(context.Background(), userID, p.Args["folderId"].(string))
+				if err != nil {
+					return nil, err
+				}
+				return folderMaps(path), nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{
+		"createFolder": &graphql.Field{
+			Type: folderType,
+			Args: graphql.FieldConfigArgument{
+				"name":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"parentId": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				f, err := d.Repo.CreateFolder(context.Background(), userID, optStrArg(p.Args, "parentId"), p.Args["name"].(string))
+				if err != nil {
+					return nil, err
+				}
+				return folderMap(f), nil
+			},
+		},
+		"renameFolder": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{
+				"folderId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"name":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return false, nil
+				}
+				return true, d.Repo.RenameFolder(context.Background(), userID, p.Args["folderId"].(string), p.Args["name"].(string))
+			},
+		},
+		"moveFolder": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{
+				"folderId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"parentId": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return false, nil
+				}
+				return true, d.Repo.MoveFolder(context.Background(), userID, p.Args["folderId"].(string), optStrArg(p.Args, "parentId"))
+			},
+		},
+		// deleteFolder deletes the folder and its subfolders and moves all their
+		// files to the trash, returning the number of files moved
+		"deleteFolder": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Int),
+			Args: graphql.FieldConfigArgument{
+				"folderId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return 0, nil
+				}
+				return d.Repo.DeleteFolder(context.Background(), userID, p.Args["folderId"].(string))
+			},
+		},
+		"moveFile": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{
+				"fileId":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"folderId": &graphql.ArgumentConfig{Type: graphql.String},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return false, nil
+				}
+				return true, d.Repo.MoveFile(context.Background(), userID, p.Args["fileId"].(string), optStrArg(p.Args, "folderId"))
+			},
+		},
+	}
+	return queries, mutations
+}
+
+func folderMap(f repo.Folder) map[string]any {
+	return map[string]any{
+		"id":        f.ID,
+		"name":      f.Name,
+		"parentId":  optStr(f.ParentID),
+		"createdAt": f.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+	}
+}
+
+func folderMaps(folders []repo.Folder) []map[string]any {
+	out := make([]map[string]any, len(folders))
+	for i, f := range folders {
+		out[i] = folderMap(f)
+	}
+	return out
+}
+
+// optStrArg returns a nullable string argument; "" counts as null.
+func optStrArg(args map[string]any, name string) *string {
+	if v, ok := args[name].(string); ok && v != "" {
+		return &v
+	}
+	return nil
+}
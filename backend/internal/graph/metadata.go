@@ -0,0 +1,310 @@
+package graph
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// metadataTypes are the metadata types the File type and myFiles refer to.
+type metadataTypes struct {
+	entry  *graphql.Object
+	value  *graphql.InputObject
+	filter *graphql.InputObject
+}
+
+func newMetadataTypes() metadataTypes {
+	// a value is a string, a number or a boolean; the field of its type is set
+	entry := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MetadataEntry",
+		Fields: graphql.Fields{
+			"key":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"type":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"string":  &graphql.Field{Type: graphql.String},
+			"number":  &graphql.Field{Type: graphql.Float},
+			"boolean": &graphql.Field{Type: graphql.Boolean},
+		},
+	})
+	// exactly one field is to be set
+	value := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MetadataValueInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"string":  &graphql.InputObjectFieldConfig{Type: graphql.String},
+			"number":  &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"boolean": &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+		},
+	})
+	filter := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MetadataFilterInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"key":    &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"equals": &graphql.InputObjectFieldConfig{Type: value},
+			// true for files with the key, false for files without it
+			"exists": &graphql.InputObjectFieldConfig{Type: graphql.Boolean},
+			// inclusive bounds; only numbers are in range
+			"min": &graphql.InputObjectFieldConfig{Type: graphql.Float},
+			"max": &graphql.InputObjectFieldConfig{Type: graphql.Float},
+		},
+	})
+	return metadataTypes{entry: entry, value: value, filter: filter}
+}
+
+// metadataFields returns the metadata rule query and the metadata mutations.
+// Rules of the organization apply to every user and are managed by admins.
+func metadataFields(d Deps, fileType *graphql.Object, mt metadataTypes) (queries, mutations graphql.Fields) {
+	ruleType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "MetadataRule",
+		Fields: graphql.Fields{
+			"id":   &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"key":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"type": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// strings must match pattern in full and be among allowed when set
+			"pattern": &graphql.Field{Type: graphql.String},
+			"allowed": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			// inclusive bounds for numbers
+			"min":          &graphql.Field{Type: graphql.Float},
+			"max":          &graphql.Field{Type: graphql.Float},
+			"organization": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"updatedAt":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+	entryInput := graphql.NewInputObject(graphql.InputObjectConfig{
+		Name: "MetadataEntryInput",
+		Fields: graphql.InputObjectConfigFieldMap{
+			"key":   &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(graphql.String)},
+			"value": &graphql.InputObjectFieldConfig{Type: graphql.NewNonNull(mt.value)},
+		},
+	})
+
+	queries = graphql.Fields{
+		// myMetadataRules lists the organization's rules and the caller's
+		"myMetadataRules": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(ruleType))),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				rules, err := d.Repo.ListMetadataRules(context.Background(), userID)
+				if err != nil {
+					return nil, err
+				}
+				out := make([]map[string]any, len(rules))
+				for i, m := range rules {
+					out[i] = metadataRuleMap(m)
+				}
+				return out, nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{
+		"setFileMetadata": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"entries": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(entryInput)))},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				set := map[string]any{}
+				entries, _ := p.Args["entries"].([]any)
+				for _, e := range entries {
+					e, _ := e.(map[string]any)
+					key, _ := e["key"].(string)
+					v, err := metadataValue(key, e["value"])
+					if err != nil {
+						return nil, err
+					}
+					set[key] = v
+				}
+				f, err := d.Repo.SetFileMetadata(context.Background(), userID, p.Args["fileId"].(string), set)
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, []repo.File{f})[0], nil
+			},
+		},
+		"unsetFileMetadata": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"keys":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				f, err := d.Repo.UnsetFileMetadata(context.Background(), userID, p.Args["fileId"].(string), strListArg(p.Args, "keys"))
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, []repo.File{f})[0], nil
+			},
+		},
+		// setMetadataRule creates or replaces the caller's rule for key, or
+		// with organization the organization's (admins only). Values already
+		// stored are not re-checked.
+		"setMetadataRule": &graphql.Field{
+			Type: ruleType,
+			Args: graphql.FieldConfigArgument{
+				"key":          &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"type":         &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"pattern":      &graphql.ArgumentConfig{Type: graphql.String},
+				"allowed":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				"min":          &graphql.ArgumentConfig{Type: graphql.Float},
+				"max":          &graphql.ArgumentConfig{Type: graphql.Float},
+				"organization": &graphql.ArgumentConfig{Type: graphql.Boolean},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				owner, ok := metadataRuleOwner(p, d)
+				if !ok {
+					return nil, nil
+				}
+				m := repo.MetadataRule{
+					OwnerID: owner,
+					Key:     p.Args["key"].(string),
+					Type:    p.Args["type"].(string),
+					Pattern: optStrArg(p.Args, "pattern"),
+					Allowed: strListArg(p.Args, "allowed"),
+					Min:     optFloatArg(p.Args, "min"),
+					Max:     optFloatArg(p.Args, "max"),
+				}
+				out, err := d.Repo.PutMetadataRule(context.Background(), m)
+				if err != nil {
+					return nil, err
+				}
+				return metadataRuleMap(out), nil
+			},
+		},
+		"deleteMetadataRule": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Boolean),
+			Args: graphql.FieldConfigArgument{
+				"key":          &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"organization": &graphql.ArgumentConfig{Type: graphql.Boolean},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				owner, ok := metadataRuleOwner(p, d)
+				if !ok {
+					return false, nil
+				}
+				return true, d.Repo.DeleteMetadataRule(context.Background(), owner, p.Args["key"].(string))
+			},
+		},
+	}
+	return queries, mutations
+}
+
+// metadataRuleOwner returns the owner of the rule a mutation is about: the
+// caller, or nil for the organization. ok is false when the caller may not
+// change it.
+func metadataRuleOwner(p graphql.ResolveParams, d Deps) (owner *string, ok bool) {
+	r := p.Context.Value(http.Request{}).(*http.Request)
+	if org, _ := p.Args["organization"].(bool); org {
+		return nil, isAdmin(p.Context, d, r)
+	}
+	userID := d.GetUserID(r)
+	return &userID, userID != ""
+}
+
+// metadataValue returns the value of a MetadataValueInput, which must have
+// exactly one field set.
+func metadataValue(key string, arg any) (any, error) {
+	in, _ := arg.(map[string]any)
+	var out any
+	n := 0
+	for _, f := range []string{"string", "number", "boolean"} {
+		if v, ok := in[f]; ok && v != nil {
+			out = v
+			n++
+		}
+	}
+	if n != 1 {
+		return nil, fmt.Errorf("%w: %s: set exactly one of string, number and boolean", repo.ErrInvalidMetadata, key)
+	}
+	if i, ok := out.(int); ok {
+		out = float64(i)
+	}
+	return out, nil
+}
+
+// metadataFiltersArg returns the metadata filters of myFiles.
+func metadataFiltersArg(args map[string]any) ([]repo.MetadataFilter, error) {
+	arr, _ := args["metadata"].([]any)
+	out := make([]repo.MetadataFilter, 0, len(arr))
+	for _, x := range arr {
+		in, _ := x.(map[string]any)
+		key, _ := in["key"].(string)
+		mf := repo.MetadataFilter{Key: key, Min: optFloatArg(in, "min"), Max: optFloatArg(in, "max")}
+		if v, ok := in["exists"].(bool); ok {
+			mf.Exists = &v
+		}
+		if eq, ok := in["equals"]; ok && eq != nil {
+			v, err := metadataValue(mf.Key, eq)
+			if err != nil {
+				return nil, err
+			}
+			mf.Equals = v
+		}
+		if mf.Equals == nil && mf.Exists == nil && mf.Min == nil && mf.Max == nil {
+			return nil, errors.New("a metadata filter needs equals, exists, min or max")
+		}
+		out = append(out, mf)
+	}
+	return out, nil
+}
+
+func optFloatArg(args map[string]any, name string) *float64 {
+	switch v := args[name].(type) {
+	case float64:
+		return &v
+	case int:
+		f := float64(v)
+		return &f
+	}
+	return nil
+}
+
+// metadataEntries lists a file's metadata by key.
+func metadataEntries(md map[string]any) []map[string]any {
+	out := make([]map[string]any, 0, len(md))
+	for k, v := range md {
+		t := repo.MetadataType(v)
+		if t == "" {
+			continue
+		}
+		out = append(out, map[string]any{"key": k, "type": t, t: v})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i]["key"].(string) < out[j]["key"].(string) })
+	return out
+}
+
+func metadataRuleMap(m repo.MetadataRule) map[string]any {
+	out := map[string]any{
+		"id":           m.ID,
+		"key":          m.Key,
+		"type":         m.Type,
+		"pattern":      optStr(m.Pattern),
+		"allowed":      m.Allowed,
+		"min":          nil,
+		"max":          nil,
+		"organization": m.OwnerID == nil,
+		"updatedAt":    m.UpdatedAt.Format("2006-01-02T15:04:05Z07:00"),
+	}
+	if m.Min != nil {
+		out["min"] = *m.Min
+	}
+	if m.Max != nil {
+		out["max"] = *m.Max
+	}
+	return out
+}
@@ -0,0 +1,74 @@
+package graph
+
+import (
+	"context"
+	"html"
+	"net/http"
+	"strings"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// searchFields returns the full-text search query.
+func searchFields(d Deps, fileType *graphql.Object) graphql.Fields {
+	resultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "SearchResult",
+		Fields: graphql.Fields{
+			"file": &graphql.Field{Type: graphql.NewNonNull(fileType)},
+			"rank": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			// HTML-escaped excerpt of the file's text with the matches in <mark>
+			// elements; empty for files whose text is not indexed
+			"snippet": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// set for files another user shared with the caller
+			"shared": &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+		},
+	})
+
+	return graphql.Fields{
+		// search matches file names and the text of plain text, Markdown, CSV,
+		// HTML and PDF files, in web search syntax: "a phrase", -excluded, or
+		"search": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(resultType))),
+			Args: graphql.FieldConfigArgument{
+				"query":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+				"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				query := strings.TrimSpace(p.Args["query"].(string))
+				if query == "" {
+					return []map[string]any{}, nil
+				}
+				limit, _ := p.Args["limit"].(int)
+				offset, _ := p.Args["offset"].(int)
+				if limit == 0 {
+					limit = 20
+				}
+				hits, err := d.Repo.SearchFiles(context.Background(), userID, query, limit, offset)
+				if err != nil {
+					return nil, err
+				}
+				out := make([]map[string]any, len(hits))
+				for i, h := range hits {
+					// share links and download counts are the owner's business
+					file := fileMap(h.File, "", 0)
+					if !h.Shared {
+						file = fileMaps(d, userID, []repo.File{h.File})[0]
+					}
+					out[i] = map[string]any{"file": file, "rank": h.Rank, "snippet": snippetHTML(h.Snippet), "shared": h.Shared}
+				}
+				return out, nil
+			},
+		},
+	}
+}
+
+// snippetHTML escapes a search snippet and marks its highlighted matches.
+func snippetHTML(s string) string {
+	return strings.NewReplacer(repo.HighlightStart, "<mark>", repo.HighlightStop, "</mark>").Replace(html.EscapeString(s))
+}
@@ -2,17 +2,34 @@ package graph
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/graphql-go/graphql"
 	"github.com/graphql-go/handler"
+	"github.com/himanshu/file-vault-app/backend/internal/dedup"
+	"github.com/himanshu/file-vault-app/backend/internal/filequery"
+	"github.com/himanshu/file-vault-app/backend/internal/mimetype"
 	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/scrub"
 )
 
 type Deps struct {
 	Repo      *repo.Repository
+	Scrubber  *scrub.Scrubber
 	GetUserID func(*http.Request) string
+	// QuotaBytes is the default per-user quota; negative means unlimited.
+	QuotaBytes int64
+	Dedup      *dedup.Service
+	// Versions bounds the earlier versions kept when a version is restored.
+	Versions repo.VersionRetention
+	// BulkSyncLimit is the most files a bulk operation handles within the
+	// request; larger ones are queued as jobs.
+	BulkSyncLimit int
 }
 
 func isAdmin(ctx context.Context, d Deps, r *http.Request) bool {
@@ -28,17 +45,33 @@ func isAdmin(ctx context.Context, d Deps, r *http.Request) bool {
 }
 
 func NewHandler(d Deps) http.Handler {
+	mt := newMetadataTypes()
 	fileType := graphql.NewObject(graphql.ObjectConfig{
 		Name: "File",
 		Fields: graphql.Fields{
-			"id":            &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-			"filename":      &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-			"sizeBytes":     &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
-			"mimeType":      &graphql.Field{Type: graphql.String},
-			"isPublic":      &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
-			"createdAt":     &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
-			"publicToken":   &graphql.Field{Type: graphql.String},
-			"downloadCount": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"id":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"filename":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"sizeBytes": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"mimeType":  &graphql.Field{Type: graphql.String},
+			// type sniffed from the content; mimeMismatch is set when mimeType disagreed with it
+			"detectedMimeType": &graphql.Field{Type: graphql.String},
+			"mimeMismatch":     &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"isPublic":         &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"createdAt":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"publicToken":      &graphql.Field{Type: graphql.String},
+			"downloadCount":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			// path and modification time of the archive entry the file was expanded from
+			"sourcePath": &graphql.Field{Type: graphql.String},
+			"modifiedAt": &graphql.Field{Type: graphql.String},
+			// null for files in the root folder
+			"folderId": &graphql.Field{Type: graphql.String},
+			// version counts from 1 and grows with every replaced content
+			"version":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"updatedAt": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// set while the file is in the trash
+			"deletedAt": &graphql.Field{Type: graphql.String},
+			"tags":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"metadata":  &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(mt.entry)))},
 		},
 	})
 
@@ -49,6 +82,26 @@ func NewHandler(d Deps) http.Handler {
 			"dedupedBytes":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
 			"savedBytes":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
 			"savedPercent":  &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			// chunk-level deduplication on top of whole-blob dedup
+			"chunkedBytes":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"chunkSavedBytes":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"chunkSavedPercent": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+			// compression, reported separately from dedup savings
+			"storedBytes":             &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"compressionSavedBytes":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"compressionSavedPercent": &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
+		},
+	})
+
+	quotaType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Quota",
+		Fields: graphql.Fields{
+			// limitBytes and remainingBytes are null when the quota is unlimited
+			"limitBytes":     &graphql.Field{Type: graphql.Int},
+			"usedBytes":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"reservedBytes":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"remainingBytes": &graphql.Field{Type: graphql.Int},
+			"usedPercent":    &graphql.Field{Type: graphql.NewNonNull(graphql.Float)},
 		},
 	})
 
@@ -63,22 +116,80 @@ func NewHandler(d Deps) http.Handler {
 		},
 	})
 
+	blobIntegrityType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "BlobIntegrity",
+		Fields: graphql.Fields{
+			"hash":           &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"sizeBytes":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"refCount":       &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"status":         &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"lastVerifiedAt": &graphql.Field{Type: graphql.String},
+			"error":          &graphql.Field{Type: graphql.String},
+			"quarantinedAt":  &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	integritySummaryType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "IntegritySummary",
+		Fields: graphql.Fields{
+			"unverified": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"ok":         &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"mismatch":   &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"missing":    &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"error":      &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+
+	uploadPolicyType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UploadPolicy",
+		Fields: graphql.Fields{
+			"allow":      &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"deny":       &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+			"onMismatch": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"updatedAt":  &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"updatedBy":  &graphql.Field{Type: graphql.String},
+		},
+	})
+
+	uploadChallengeType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "UploadChallenge",
+		Fields: graphql.Fields{
+			"id": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// the proof is the hex SHA-256 of the nonce bytes followed by the ranges of the content
+			"nonce": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"ranges": &graphql.Field{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.NewObject(graphql.ObjectConfig{
+				Name: "ByteRange",
+				Fields: graphql.Fields{
+					"offset": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+					"length": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+				},
+			}))))},
+			"expiresAt": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	precheckResultType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "PrecheckResult",
+		Fields: graphql.Fields{
+			// created, challenge, upload_required or rejected
+			"status":    &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"file":      &graphql.Field{Type: fileType},
+			"challenge": &graphql.Field{Type: uploadChallengeType},
+			// set when rejected by the upload policy
+			"reason": &graphql.Field{Type: graphql.String},
+		},
+	})
+
 	query := graphql.NewObject(graphql.ObjectConfig{
 		Name: "Query",
 		Fields: graphql.Fields{
 			"myFiles": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
-				Args: graphql.FieldConfigArgument{
-					"limit":     &graphql.ArgumentConfig{Type: graphql.Int},
-					"offset":    &graphql.ArgumentConfig{Type: graphql.Int},
-					"nameLike":  &graphql.ArgumentConfig{Type: graphql.String},
-					"mimeTypes": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String)},
-					"sizeMin":   &graphql.ArgumentConfig{Type: graphql.Int},
-					"sizeMax":   &graphql.ArgumentConfig{Type: graphql.Int},
-					"dateFrom":  &graphql.ArgumentConfig{Type: graphql.String},
-					"dateTo":    &graphql.ArgumentConfig{Type: graphql.String},
-					"tags":      &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String)},
-				},
+				Type:              graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+				DeprecationReason: "Pages by offset; use myFilesConnection.",
+				Args: withArgs(fileFilterArgs(mt), graphql.FieldConfigArgument{
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+				}),
 				Resolve: func(p graphql.ResolveParams) (any, error) {
 					r := d.Repo
 					userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
@@ -90,79 +201,15 @@ func NewHandler(d Deps) http.Handler {
 					if limit == 0 {
 						limit = 50
 					}
-					// Filters
-					var nameLikePtr *string
-					if v, ok := p.Args["nameLike"].(string); ok && v != "" {
-						nameLikePtr = &v
-					}
-					var sizeMinPtr *int64
-					if v, ok := p.Args["sizeMin"].(int); ok {
-						vv := int64(v)
-						sizeMinPtr = &vv
-					}
-					var sizeMaxPtr *int64
-					if v, ok := p.Args["sizeMax"].(int); ok {
-						vv := int64(v)
-						sizeMaxPtr = &vv
-					}
-					var dateFromPtr *time.Time
-					if v, ok := p.Args["dateFrom"].(string); ok && v != "" {
-						if t, err := time.Parse(time.RFC3339, v); err == nil {
-							dateFromPtr = &t
-						}
-					}
-					var dateToPtr *time.Time
-					if v, ok := p.Args["dateTo"].(string); ok && v != "" {
-						if t, err := time.Parse(time.RFC3339, v); err == nil {
-							dateToPtr = &t
-						}
-					}
-					var mimeTypes []string
-					if arr, ok := p.Args["mimeTypes"].([]any); ok {
-						for _, x := range arr {
-							if s, ok := x.(string); ok {
-								mimeTypes = append(mimeTypes, s)
-							}
-						}
-					}
-					var tags []string
-					if arr, ok := p.Args["tags"].([]any); ok {
-						for _, x := range arr {
-							if s, ok := x.(string); ok {
-								tags = append(tags, s)
-							}
-						}
-					}
-
-					files, err := r.ListFilesFiltered(context.Background(), userID, repo.FileFilters{
-						NameLike:  nameLikePtr,
-						MIMETypes: mimeTypes,
-						SizeMin:   sizeMinPtr,
-						SizeMax:   sizeMaxPtr,
-						DateFrom:  dateFromPtr,
-						DateTo:    dateToPtr,
-						Tags:      tags,
-					}, limit, offset)
+					filters, err := fileFiltersArg(p.Args)
 					if err != nil {
 						return nil, err
 					}
-					// map to graphql
-					var out []map[string]any
-					for _, f := range files {
-						token, _ := d.Repo.GetPublicTokenForFile(context.Background(), userID, f.ID)
-						cnt, _ := d.Repo.CountDownloads(context.Background(), f.ID)
-						out = append(out, map[string]any{
-							"id":            f.ID,
-							"filename":      f.Filename,
-							"sizeBytes":     f.SizeBytes,
-							"mimeType":      optStr(f.MIMEType),
-							"isPublic":      f.IsPublic,
-							"createdAt":     f.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
-							"publicToken":   token,
-							"downloadCount": cnt,
-						})
+					files, err := r.ListFilesFiltered(context.Background(), userID, filters, limit, offset)
+					if err != nil {
+						return nil, err
 					}
-					return out, nil
+					return fileMaps(d, userID, files), nil
 				},
 			},
 			"myStorageStats": &graphql.Field{
@@ -172,25 +219,70 @@ func NewHandler(d Deps) http.Handler {
 					if userID == "" {
 						return nil, nil
 					}
-					orig, dedup, err := d.Repo.UserStorageStats(context.Background(), userID)
+					st, err := d.Repo.UserStorageStats(context.Background(), userID)
 					if err != nil {
 						return nil, err
 					}
+					orig, dedup := st.OriginalBytes, st.DedupedBytes
 					saved := orig - dedup
 					percent := 0.0
 					if orig > 0 {
 						percent = float64(saved) / float64(orig) * 100.0
 					}
+					chunkSaved := dedup - st.ChunkedBytes
+					chunkPercent := 0.0
+					if dedup > 0 {
+						chunkPercent = float64(chunkSaved) / float64(dedup) * 100.0
+					}
+					compressionPercent := 0.0
+					if st.ChunkedBytes > 0 {
+						compressionPercent = float64(st.CompressionSavedBytes) / float64(st.ChunkedBytes) * 100.0
+					}
 					return map[string]any{
-						"originalBytes": orig,
-						"dedupedBytes":  dedup,
-						"savedBytes":    saved,
-						"savedPercent":  percent,
+						"originalBytes":           orig,
+						"dedupedBytes":            dedup,
+						"savedBytes":              saved,
+						"savedPercent":            percent,
+						"chunkedBytes":            st.ChunkedBytes,
+						"chunkSavedBytes":         chunkSaved,
+						"chunkSavedPercent":       chunkPercent,
+						"storedBytes":             st.StoredBytes,
+						"compressionSavedBytes":   st.CompressionSavedBytes,
+						"compressionSavedPercent": compressionPercent,
 					}, nil
 				},
 			},
+			"myQuota": &graphql.Field{
+				Type: graphql.NewNonNull(quotaType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+					if userID == "" {
+						return nil, nil
+					}
+					q, err := d.Repo.GetQuota(context.Background(), userID, d.QuotaBytes)
+					if err != nil {
+						return nil, err
+					}
+					out := map[string]any{
+						"limitBytes":     nil,
+						"usedBytes":      q.UsedBytes,
+						"reservedBytes":  q.ReservedBytes,
+						"remainingBytes": nil,
+						"usedPercent":    0.0,
+					}
+					if !q.Unlimited() {
+						out["limitBytes"] = q.LimitBytes
+						out["remainingBytes"] = q.Remaining()
+						if q.LimitBytes > 0 {
+							out["usedPercent"] = float64(q.UsedBytes) / float64(q.LimitBytes) * 100.0
+						}
+					}
+					return out, nil
+				},
+			},
 			"allFiles": &graphql.Field{
-				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+				Type:              graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+				DeprecationReason: "Pages by offset; use allFilesConnection.",
 				Args: graphql.FieldConfigArgument{
 					"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
 					"offset": &graphql.ArgumentConfig{Type: graphql.Int},
@@ -212,21 +304,83 @@ func NewHandler(d Deps) http.Handler {
 					var out []map[string]any
 					for _, f := range files {
 						token, _ := d.Repo.GetPublicTokenForFile(context.Background(), f.OwnerID, f.ID)
-						cnt, _ := d.Repo.CountDownloads(context.Background(), f.ID)
+						out = append(out, fileMap(f, token, f.DownloadCount))
+					}
+					return out, nil
+				},
+			},
+			"integritySummary": &graphql.Field{
+				Type: graphql.NewNonNull(integritySummaryType),
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return nil, nil
+					}
+					counts, err := d.Repo.IntegritySummary(context.Background())
+					if err != nil {
+						return nil, err
+					}
+					return map[string]any{
+						"unverified": counts[repo.VerifyUnverified],
+						"ok":         counts[repo.VerifyOK],
+						"mismatch":   counts[repo.VerifyMismatch],
+						"missing":    counts[repo.VerifyMissing],
+						"error":      counts[repo.VerifyError],
+					}, nil
+				},
+			},
+			"blobIntegrity": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(blobIntegrityType))),
+				Args: graphql.FieldConfigArgument{
+					// one of unverified, ok, mismatch, missing, error; defaults to everything not ok
+					"status": &graphql.ArgumentConfig{Type: graphql.String},
+					"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+					"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return nil, nil
+					}
+					status, _ := p.Args["status"].(string)
+					limit, _ := p.Args["limit"].(int)
+					offset, _ := p.Args["offset"].(int)
+					if limit == 0 {
+						limit = 50
+					}
+					blobs, err := d.Repo.ListBlobIntegrity(context.Background(), status, limit, offset)
+					if err != nil {
+						return nil, err
+					}
+					var out []map[string]any
+					for _, b := range blobs {
 						out = append(out, map[string]any{
-							"id":            f.ID,
-							"filename":      f.Filename,
-							"sizeBytes":     f.SizeBytes,
-							"mimeType":      optStr(f.MIMEType),
-							"isPublic":      f.IsPublic,
-							"createdAt":     f.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
-							"publicToken":   token,
-							"downloadCount": cnt,
+							"hash":           b.Hash,
+							"sizeBytes":      b.SizeBytes,
+							"refCount":       b.RefCount,
+							"status":         b.Status,
+							"lastVerifiedAt": optTime(b.LastVerifiedAt),
+							"error":          optStr(b.Error),
+							"quarantinedAt":  optTime(b.QuarantinedAt),
 						})
 					}
 					return out, nil
 				},
 			},
+			"uploadPolicy": &graphql.Field{
+				Type: uploadPolicyType,
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return nil, nil
+					}
+					pol, err := d.Repo.GetUploadPolicy(context.Background())
+					if err != nil {
+						return nil, err
+					}
+					return uploadPolicyMap(pol), nil
+				},
+			},
 			"allUsers": &graphql.Field{
 				Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(userType))),
 				Args: graphql.FieldConfigArgument{
@@ -314,6 +468,7 @@ func NewHandler(d Deps) http.Handler {
 					return true, d.Repo.SetFilePublic(context.Background(), userID, fileID, isPublic)
 				},
 			},
+			// deleteFile moves the file to the trash; see trashFields
 			"deleteFile": &graphql.Field{
 				Type: graphql.NewNonNull(graphql.Boolean),
 				Args: graphql.FieldConfigArgument{
@@ -325,7 +480,128 @@ func NewHandler(d Deps) http.Handler {
 						return false, nil
 					}
 					fileID := p.Args["fileId"].(string)
-					return true, d.Repo.DeleteFileAndMaybeBlob(context.Background(), userID, fileID)
+					return true, d.Repo.TrashFile(context.Background(), userID, fileID)
+				},
+			},
+			"setUserQuota": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.Boolean),
+				Args: graphql.FieldConfigArgument{
+					"userId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					// null restores the default quota; negative means unlimited
+					"quotaBytes": &graphql.ArgumentConfig{Type: graphql.Int},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return false, nil
+					}
+					var quota *int64
+					if v, ok := p.Args["quotaBytes"].(int); ok {
+						q := int64(v)
+						quota = &q
+					}
+					return true, d.Repo.SetUserQuota(context.Background(), p.Args["userId"].(string), quota)
+				},
+			},
+			"verifyBlob": &graphql.Field{
+				Type: graphql.NewNonNull(graphql.String),
+				Args: graphql.FieldConfigArgument{
+					"hash": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return "", nil
+					}
+					return d.Scrubber.Verify(context.Background(), p.Args["hash"].(string))
+				},
+			},
+			"setUploadPolicy": &graphql.Field{
+				Type: uploadPolicyType,
+				Args: graphql.FieldConfigArgument{
+					// MIME types or patterns such as image/*; an empty allow list allows every type not denied
+					"allow": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+					"deny":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))},
+					// flag (default) stores mismatching files and marks them; reject refuses them
+					"onMismatch": &graphql.ArgumentConfig{Type: graphql.String},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					r := p.Context.Value(http.Request{}).(*http.Request)
+					if !isAdmin(p.Context, d, r) {
+						return nil, nil
+					}
+					pol := mimetype.Policy{OnMismatch: mimetype.MismatchFlag}
+					if v, ok := p.Args["onMismatch"].(string); ok && v != "" {
+						if v != mimetype.MismatchFlag && v != mimetype.MismatchReject {
+							return nil, fmt.Errorf("onMismatch must be %q or %q", mimetype.MismatchFlag, mimetype.MismatchReject)
+						}
+						pol.OnMismatch = v
+					}
+					var err error
+					if pol.Allow, err = mimePatterns(p.Args["allow"]); err != nil {
+						return nil, err
+					}
+					if pol.Deny, err = mimePatterns(p.Args["deny"]); err != nil {
+						return nil, err
+					}
+					saved, err := d.Repo.SetUploadPolicy(context.Background(), pol, d.GetUserID(r))
+					if err != nil {
+						return nil, err
+					}
+					return uploadPolicyMap(saved), nil
+				},
+			},
+			"precheckUpload": &graphql.Field{
+				Type: precheckResultType,
+				Args: graphql.FieldConfigArgument{
+					// hex SHA-256 of the content
+					"hash":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"size":     &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+					"filename": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"mimeType": &graphql.ArgumentConfig{Type: graphql.String},
+					"tags":     &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(graphql.String))},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+					if userID == "" {
+						return nil, nil
+					}
+					tags, err := repo.CleanTags(strListArg(p.Args, "tags"))
+					if err != nil {
+						return nil, err
+					}
+					req := dedup.Request{
+						Hash:     p.Args["hash"].(string),
+						Size:     int64(p.Args["size"].(int)),
+						Filename: p.Args["filename"].(string),
+						Tags:     tags,
+					}
+					if v, ok := p.Args["mimeType"].(string); ok {
+						req.MIMEType = v
+					}
+					res, err := d.Dedup.Precheck(context.Background(), userID, req)
+					if err != nil {
+						return nil, err
+					}
+					return precheckResultMap(res), nil
+				},
+			},
+			"answerUploadChallenge": &graphql.Field{
+				Type: precheckResultType,
+				Args: graphql.FieldConfigArgument{
+					"challengeId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+					"proof":       &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				},
+				Resolve: func(p graphql.ResolveParams) (any, error) {
+					userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+					if userID == "" {
+						return nil, nil
+					}
+					res, err := d.Dedup.Answer(context.Background(), userID, p.Args["challengeId"].(string), p.Args["proof"].(string))
+					if err != nil {
+						return nil, err
+					}
+					return precheckResultMap(res), nil
 				},
 			},
 			"setUserRole": &graphql.Field{
@@ -347,6 +623,23 @@ func NewHandler(d Deps) http.Handler {
 		},
 	})
 
+	folderQueries, folderMutations := folderFields(d, fileType)
+	versionQueries, versionMutations := versionFields(d, fileType)
+	trashQueries, trashMutations := trashFields(d, fileType)
+	tagQueries, tagMutations := tagFields(d, fileType)
+	metadataQueries, metadataMutations := metadataFields(d, fileType, mt)
+	bulkQueries, bulkMutations := bulkFields(d, mt)
+	for _, fields := range []graphql.Fields{folderQueries, versionQueries, trashQueries, searchFields(d, fileType), tagQueries, metadataQueries, connectionFields(d, fileType, mt), bulkQueries} {
+		for name, f := range fields {
+			query.AddFieldConfig(name, f)
+		}
+	}
+	for _, fields := range []graphql.Fields{folderMutations, versionMutations, trashMutations, tagMutations, metadataMutations, bulkMutations, copyMutations(d, fileType)} {
+		for name, f := range fields {
+			mutation.AddFieldConfig(name, f)
+		}
+	}
+
 	schema, _ := graphql.NewSchema(graphql.SchemaConfig{Query: query, Mutation: mutation})
 	h := handler.New(&handler.Config{Schema: &schema, Pretty: true, GraphiQL: true})
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -356,9 +649,199 @@ func NewHandler(d Deps) http.Handler {
 	})
 }
 
+func fileMap(f repo.File, token string, downloads int64) map[string]any {
+	return map[string]any{
+		"id":               f.ID,
+		"filename":         f.Filename,
+		"sizeBytes":        f.SizeBytes,
+		"mimeType":         optStr(f.MIMEType),
+		"detectedMimeType": optStr(f.DetectedMIME),
+		"mimeMismatch":     f.MIMEMismatch,
+		"isPublic":         f.IsPublic,
+		"createdAt":        f.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		"publicToken":      token,
+		"downloadCount":    downloads,
+		"sourcePath":       optStr(f.SourcePath),
+		"modifiedAt":       optTime(f.ModifiedAt),
+		"folderId":         optStr(f.FolderID),
+		"version":          f.Version,
+		"updatedAt":        f.UpdatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		"deletedAt":        optTime(f.DeletedAt),
+		"tags":             f.Tags,
+		"metadata":         metadataEntries(f.Metadata),
+	}
+}
+
+func precheckResultMap(res dedup.Result) map[string]any {
+	out := map[string]any{"status": res.Status}
+	if res.File != nil {
+		out["file"] = fileMap(*res.File, "", 0)
+	}
+	if c := res.Challenge; c != nil {
+		ranges := make([]map[string]any, len(c.Ranges))
+		for i, r := range c.Ranges {
+			ranges[i] = map[string]any{"offset": r.Offset, "length": r.Length}
+		}
+		out["challenge"] = map[string]any{
+			"id":        c.ID,
+			"nonce":     c.Nonce,
+			"ranges":    ranges,
+			"expiresAt": c.ExpiresAt.Format("2006-01-02T15:04:05Z07:00"),
+		}
+	}
+	if res.Verdict.Rejected() {
+		out["reason"] = res.Verdict.Reason
+	}
+	return out
+}
+
+// fileMaps maps the user's files to graphql, with their public links and
+// download counts.
+func fileMaps(d Deps, userID string, files []repo.File) []map[string]any {
+	out := []map[string]any{}
+	for _, f := range files {
+		token, _ := d.Repo.GetPublicTokenForFile(context.Background(), userID, f.ID)
+		out = append(out, fileMap(f, token, f.DownloadCount))
+	}
+	return out
+}
+
+// fileFilterArgs returns the filter arguments of the file listings.
+func fileFilterArgs(mt metadataTypes) graphql.FieldConfigArgument {
+	return graphql.FieldConfigArgument{
+		// a query such as "type:image/* size>10MB -tag:draft", combined with
+		// the other filters; see package filequery for the grammar
+		"query":        &graphql.ArgumentConfig{Type: graphql.String},
+		"nameLike":     &graphql.ArgumentConfig{Type: graphql.String},
+		"mimeTypes":    &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String)},
+		"sizeMin":      &graphql.ArgumentConfig{Type: graphql.Int},
+		"sizeMax":      &graphql.ArgumentConfig{Type: graphql.Int},
+		"dateFrom":     &graphql.ArgumentConfig{Type: graphql.String},
+		"dateTo":       &graphql.ArgumentConfig{Type: graphql.String},
+		"tags":         &graphql.ArgumentConfig{Type: graphql.NewList(graphql.String)},
+		"mimeMismatch": &graphql.ArgumentConfig{Type: graphql.Boolean},
+		// all metadata filters must match
+		"metadata": &graphql.ArgumentConfig{Type: graphql.NewList(graphql.NewNonNull(mt.filter))},
+	}
+}
+
+// fileFiltersArg returns the filters given by the arguments of fileFilterArgs.
+func fileFiltersArg(args map[string]any) (repo.FileFilters, error) {
+	var f repo.FileFilters
+	if v, ok := args["query"].(string); ok {
+		q, err := filequery.Parse(v)
+		var qe *filequery.Error
+		if errors.As(err, &qe) {
+			return f, queryError{qe}
+		} else if err != nil {
+			return f, err
+		}
+		f.Expr = q.Expr
+	}
+	if v, ok := args["nameLike"].(string); ok && v != "" {
+		f.NameLike = &v
+	}
+	if v, ok := args["sizeMin"].(int); ok {
+		vv := int64(v)
+		f.SizeMin = &vv
+	}
+	if v, ok := args["sizeMax"].(int); ok {
+		vv := int64(v)
+		f.SizeMax = &vv
+	}
+	if v, ok := args["dateFrom"].(string); ok && v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("dateFrom: %q is not an RFC 3339 time", v)
+		}
+		f.DateFrom = &t
+	}
+	if v, ok := args["dateTo"].(string); ok && v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			return f, fmt.Errorf("dateTo: %q is not an RFC 3339 time", v)
+		}
+		f.DateTo = &t
+	}
+	if arr, ok := args["mimeTypes"].([]any); ok {
+		for _, x := range arr {
+			if s, ok := x.(string); ok {
+				f.MIMETypes = append(f.MIMETypes, s)
+			}
+		}
+	}
+	if arr, ok := args["tags"].([]any); ok {
+		for _, x := range arr {
+			if s, ok := x.(string); ok {
+				f.Tags = append(f.Tags, s)
+			}
+		}
+	}
+	if v, ok := args["mimeMismatch"].(bool); ok {
+		f.MIMEMismatch = &v
+	}
+	var err error
+	f.Metadata, err = metadataFiltersArg(args)
+	return f, err
+}
+
+// queryError is a GraphQL error pointing at the offending token of a query.
+type queryError struct{ err *filequery.Error }
+
+func (e queryError) Error() string { return e.err.Error() }
+
+func (e queryError) Extensions() map[string]any {
+	return map[string]any{"code": "INVALID_QUERY", "position": e.err.Pos, "token": e.err.Token, "reason": e.err.Message}
+}
+
+// withArgs returns the union of argument sets.
+func withArgs(sets ...graphql.FieldConfigArgument) graphql.FieldConfigArgument {
+	out := graphql.FieldConfigArgument{}
+	for _, set := range sets {
+		for name, a := range set {
+			out[name] = a
+		}
+	}
+	return out
+}
+
+func uploadPolicyMap(p repo.UploadPolicy) map[string]any {
+	return map[string]any{
+		"allow":      p.Allow,
+		"deny":       p.Deny,
+		"onMismatch": p.OnMismatch,
+		"updatedAt":  p.UpdatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		"updatedBy":  optStr(p.UpdatedBy),
+	}
+}
+
+// mimePatterns validates and normalises an allow or deny list argument.
+func mimePatterns(arg any) ([]string, error) {
+	out := []string{}
+	arr, _ := arg.([]any)
+	for _, x := range arr {
+		s, _ := x.(string)
+		s = strings.ToLower(strings.TrimSpace(s))
+		if !mimetype.ValidPattern(s) {
+			return nil, fmt.Errorf("invalid MIME type pattern %q", s)
+		}
+		if !slices.Contains(out, s) {
+			out = append(out, s)
+		}
+	}
+	return out, nil
+}
+
 func optStr(p *string) any {
 	if p == nil {
 		return nil
 	}
 	return *p
 }
+
+func optTime(t *time.Time) any {
+	if t == nil {
+		return nil
+	}
+	return t.Format("2006-01-02T15:04:05Z07:00")
+}
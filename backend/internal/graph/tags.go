@@ -0,0 +1,138 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/jackc/pgx/v5"
+)
+
+// tagFields returns the tag catalog query and the tag mutations. Each tag
+// mutation comes in a single-file form returning the file and a bulk form
+// returning the files that were found.
+func tagFields(d Deps, fileType *graphql.Object) (queries, mutations graphql.Fields) {
+	tagType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "Tag",
+		Fields: graphql.Fields{
+			"name": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// files carrying the tag, outside the trash, and their total size
+			"fileCount":  &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"totalBytes": &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+		},
+	})
+	stringList := graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(graphql.String)))
+
+	queries = graphql.Fields{
+		"myTags": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(tagType))),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				tags, err := d.Repo.ListTags(context.Background(), userID)
+				if err != nil {
+					return nil, err
+				}
+				out := make([]map[string]any, len(tags))
+				for i, t := range tags {
+					out[i] = map[string]any{"name": t.Tag, "fileCount": t.Files, "totalBytes": t.Bytes}
+				}
+				return out, nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{}
+	for name, update := range map[string]func(context.Context, string, []string, []string) ([]repo.File, error){
+		"addTags":    d.Repo.AddTags,
+		"removeTags": d.Repo.RemoveTags,
+		"setTags":    d.Repo.SetTags,
+	} {
+		mutations[name] = &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"tags":   &graphql.ArgumentConfig{Type: stringList},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				files, err := update(context.Background(), userID, []string{p.Args["fileId"].(string)}, strListArg(p.Args, "tags"))
+				if err != nil {
+					return nil, err
+				}
+				if len(files) == 0 {
+					return nil, pgx.ErrNoRows
+				}
+				return fileMaps(d, userID, files)[0], nil
+			},
+		}
+		mutations[name+"Bulk"] = &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+			Args: graphql.FieldConfigArgument{
+				"fileIds": &graphql.ArgumentConfig{Type: stringList},
+				"tags":    &graphql.ArgumentConfig{Type: stringList},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				files, err := update(context.Background(), userID, strListArg(p.Args, "fileIds"), strListArg(p.Args, "tags"))
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, files), nil
+			},
+		}
+	}
+	// renameTag and mergeTags apply to all of the caller's files, returning
+	// the number of files changed; renaming to an existing tag merges them
+	mutations["renameTag"] = &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Int),
+		Args: graphql.FieldConfigArgument{
+			"from": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			"to":   &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+			if userID == "" {
+				return 0, nil
+			}
+			return d.Repo.MergeTags(context.Background(), userID, []string{p.Args["from"].(string)}, p.Args["to"].(string))
+		},
+	}
+	mutations["mergeTags"] = &graphql.Field{
+		Type: graphql.NewNonNull(graphql.Int),
+		Args: graphql.FieldConfigArgument{
+			"tags": &graphql.ArgumentConfig{Type: stringList},
+			"into": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+		},
+		Resolve: func(p graphql.ResolveParams) (any, error) {
+			userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+			if userID == "" {
+				return 0, nil
+			}
+			return d.Repo.MergeTags(context.Background(), userID, strListArg(p.Args, "tags"), p.Args["into"].(string))
+		},
+	}
+	return queries, mutations
+}
+
+// strListArg returns a list of strings argument.
+func strListArg(args map[string]any, name string) []string {
+	out := []string{}
+	if arr, ok := args[name].([]any); ok {
+		for _, x := range arr {
+			if s, ok := x.(string); ok {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
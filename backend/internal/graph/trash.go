@@ -0,0 +1,73 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// trashFields returns the trash queries and mutations. deleteFile moves a
+// file to the trash; files are deleted for good by emptyTrash or once they
+// have been in the trash for the retention period.
+func trashFields(d Deps, fileType *graphql.Object) (queries, mutations graphql.Fields) {
+	queries = graphql.Fields{
+		// myTrash lists the files in the trash, most recently deleted first
+		"myTrash": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.NewList(graphql.NewNonNull(fileType))),
+			Args: graphql.FieldConfigArgument{
+				"limit":  &graphql.ArgumentConfig{Type: graphql.Int},
+				"offset": &graphql.ArgumentConfig{Type: graphql.Int},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				limit, _ := p.Args["limit"].(int)
+				offset, _ := p.Args["offset"].(int)
+				if limit == 0 {
+					limit = 50
+				}
+				files, err := d.Repo.ListTrash(context.Background(), userID, limit, offset)
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, files), nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{
+		"restoreFile": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				f, err := d.Repo.RestoreFile(context.Background(), userID, p.Args["fileId"].(string))
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, []repo.File{f})[0], nil
+			},
+		},
+		// emptyTrash deletes the files in the trash for good, returning how many
+		"emptyTrash": &graphql.Field{
+			Type: graphql.NewNonNull(graphql.Int),
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return 0, nil
+				}
+				return d.Repo.EmptyTrash(context.Background(), userID)
+			},
+		},
+	}
+	return queries, mutations
+}
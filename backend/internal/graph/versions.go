@@ -0,0 +1,104 @@
+package graph
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+
+	"github.com/graphql-go/graphql"
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// versionFields returns the file version queries and mutations.
+func versionFields(d Deps, fileType *graphql.Object) (queries, mutations graphql.Fields) {
+	versionType := graphql.NewObject(graphql.ObjectConfig{
+		Name: "FileVersion",
+		Fields: graphql.Fields{
+			"version":          &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"sizeBytes":        &graphql.Field{Type: graphql.NewNonNull(graphql.Int)},
+			"mimeType":         &graphql.Field{Type: graphql.String},
+			"detectedMimeType": &graphql.Field{Type: graphql.String},
+			"hash":             &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			"current":          &graphql.Field{Type: graphql.NewNonNull(graphql.Boolean)},
+			"createdAt":        &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+			// null for the current version
+			"supersededAt": &graphql.Field{Type: graphql.String},
+			// GET path serving the version's content
+			"downloadPath": &graphql.Field{Type: graphql.NewNonNull(graphql.String)},
+		},
+	})
+
+	queries = graphql.Fields{
+		// fileVersions lists the file's versions, the current one first
+		"fileVersions": &graphql.Field{
+			Type: graphql.NewList(graphql.NewNonNull(versionType)),
+			Args: graphql.FieldConfigArgument{
+				"fileId": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				ctx := context.Background()
+				f, err := d.Repo.GetFile(ctx, userID, p.Args["fileId"].(string))
+				if err != nil {
+					return nil, err
+				}
+				history, err := d.Repo.ListVersions(ctx, userID, f.ID)
+				if err != nil {
+					return nil, err
+				}
+				cur := repo.FileVersion{FileID: f.ID, Version: f.Version, BlobHash: f.BlobHash, SizeBytes: f.SizeBytes,
+					MIMEType: f.MIMEType, DetectedMIME: f.DetectedMIME, CreatedAt: f.UpdatedAt}
+				out := []map[string]any{versionMap(cur, true)}
+				for _, v := range history {
+					out = append(out, versionMap(v, false))
+				}
+				return out, nil
+			},
+		},
+	}
+
+	mutations = graphql.Fields{
+		// restoreVersion makes an earlier version's content current again as a
+		// new version, keeping the history
+		"restoreVersion": &graphql.Field{
+			Type: fileType,
+			Args: graphql.FieldConfigArgument{
+				"fileId":  &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.String)},
+				"version": &graphql.ArgumentConfig{Type: graphql.NewNonNull(graphql.Int)},
+			},
+			Resolve: func(p graphql.ResolveParams) (any, error) {
+				userID := d.GetUserID(p.Context.Value(http.Request{}).(*http.Request))
+				if userID == "" {
+					return nil, nil
+				}
+				f, err := d.Repo.RestoreVersion(context.Background(), userID, p.Args["fileId"].(string), p.Args["version"].(int), d.Versions)
+				if err != nil {
+					return nil, err
+				}
+				return fileMaps(d, userID, []repo.File{f})[0], nil
+			},
+		},
+	}
+	return queries, mutations
+}
+
+func versionMap(v repo.FileVersion, current bool) map[string]any {
+	out := map[string]any{
+		"version":          v.Version,
+		"sizeBytes":        v.SizeBytes,
+		"mimeType":         optStr(v.MIMEType),
+		"detectedMimeType": optStr(v.DetectedMIME),
+		"hash":             v.BlobHash,
+		"current":          current,
+		"createdAt":        v.CreatedAt.Format("2006-01-02T15:04:05Z07:00"),
+		"supersededAt":     nil,
+		"downloadPath":     "/files/" + v.FileID + "/versions/" + strconv.Itoa(v.Version),
+	}
+	if !current {
+		out["supersededAt"] = v.SupersededAt.Format("2006-01-02T15:04:05Z07:00")
+	}
+	return out
+}
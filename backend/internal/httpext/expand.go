@@ -0,0 +1,96 @@
+package httpext
+
+import (
+    "context"
+    "errors"
+    "io"
+    "mime"
+    "net/http"
+    "path"
+
+    "github.com/himanshu/file-vault-app/backend/internal/archive"
+    "github.com/himanshu/file-vault-app/backend/internal/mimetype"
+    "github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// Error codes of archive expansion.
+const (
+    codeUnsafePath   = "unsafe_path"
+    codeUnsupported  = "unsupported_entry"
+    codeArchiveLimit = "archive_limit"
+    codeBadArchive   = "bad_archive"
+    codeEmptyArchive = "empty_archive"
+)
+
+// errStopExpanding ends an expansion early without it being an archive error.
+var errStopExpanding = errors.New("stop expanding")
+
+// expandArchive stores every file within an archive as a file of its own,
+// named after the entry with its relative path and modification time kept in
+// sourcePath and modifiedAt. Each entry is typed by its extension and content
+// and checked against the policy; its bytes count against the quota and the
+// per-file limit like those of an uploaded file. Entries with unsafe paths,
+// links and other special entries are reported as failed. An archive that
+// breaks the expansion limits (archive.Limits) or cannot be read is reported
+// as a failed file after the entries stored up to that point.
+func expandArchive(ctx context.Context, d UploadDeps, userID, name, format string, content io.Reader, src *sourceReader, o uploadOptions, policy mimetype.Policy, budget *quotaBudget) []uploadResult {
+    var results []uploadResult
+    err := archive.Walk(content, format, d.Storage.TempDir, d.Archive, func(e archive.Entry, r io.Reader) error {
+        var result uploadResult
+        if e.Err != nil {
+            result = uploadResult{Filename: path.Base(e.Path), Path: e.Path, Archive: name, Error: entryFailure(e.Err)}
+        } else {
+            result = storeEntry(ctx, d, userID, name, e, r, src, o, policy, budget)
+        }
+        results = append(results, result)
+        // after a quota failure every further entry would fail the same way
+        if result.Error != nil && (o.atomic || result.Error.fatal || result.Error.Code == codeQuota) { return errStopExpanding }
+        return nil
+    })
+    switch {
+    case errors.Is(err, errStopExpanding):
+    case err != nil:
+        results = append(results, uploadResult{Filename: name, Error: archiveFailure(name, err, src.err)})
+    case len(results) == 0:
+        results = append(results, uploadResult{Filename: name, Error: &uploadError{Code: codeEmptyArchive, Message: "archive contains no files", status: http.StatusUnprocessableEntity}})
+    }
+    return results
+}
+
+func storeEntry(ctx context.Context, d UploadDeps, userID, archiveName string, e archive.Entry, r io.Reader, src *sourceReader, o uploadOptions, policy mimetype.Policy, budget *quotaBudget) uploadResult {
+    filename := path.Base(e.Path)
+    var content io.Reader = r
+    if d.MaxPartSize > 0 { content = &partLimiter{r: content, max: d.MaxPartSize} }
+    br, verdict, err := sniffContent(content, mime.TypeByExtension(path.Ext(filename)), policy)
+    if err != nil { return uploadResult{Filename: filename, Path: e.Path, Archive: archiveName, Error: uploadFailure(filename, err, src.err)} }
+    result := newUploadResult(filename, verdict)
+    result.Path, result.Archive = e.Path, archiveName
+    if result.Error != nil { return result }
+    content = br
+    if budget != nil { content = budget.reader(content) }
+    meta := repo.File{OwnerID: userID, Filename: filename, Tags: o.tags, FolderID: o.folder, SourcePath: &e.Path}
+    if !e.ModTime.IsZero() { meta.ModifiedAt = &e.ModTime }
+    // entries are always new files: equal names in different directories are unrelated
+    f, err := storeFile(ctx, d, meta, false, verdict, content, budget.reservationID())
+    if err != nil { result.Error = uploadFailure(filename, err, src.err); return result }
+    result.stored(f)
+    return result
+}
+
+func entryFailure(err error) *uploadError {
+    if errors.Is(err, archive.ErrUnsafePath) {
+        return &uploadError{Code: codeUnsafePath, Message: "entry path is absolute or leaves the archive", status: http.StatusUnprocessableEntity}
+    }
+    return &uploadError{Code: codeUnsupported, Message: err.Error(), status: http.StatusUnprocessableEntity}
+}
+
+// archiveFailure classifies the error that ended an expansion.
+func archiveFailure(name string, err, srcErr error) *uploadError {
+    switch {
+    case errors.Is(err, archive.ErrTooManyEntries), errors.Is(err, archive.ErrTooLarge), errors.Is(err, archive.ErrRatio):
+        return &uploadError{Code: codeArchiveLimit, Message: err.Error() + "; remaining entries were not expanded", status: http.StatusRequestEntityTooLarge}
+    case errors.Is(err, errPartTooLarge), srcErr != nil:
+        return uploadFailure(name, err, srcErr)
+    }
+    return &uploadError{Code: codeBadArchive, Message: "reading archive: " + err.Error(), status: http.StatusUnprocessableEntity}
+}
@@ -0,0 +1,18 @@
+package httpext
+
+import (
+    "bufio"
+    "errors"
+    "io"
+
+    "github.com/himanshu/file-vault-app/backend/internal/mimetype"
+)
+
+// sniffContent detects the type of content from its first bytes and checks it
+// against policy. The returned reader yields content from the start.
+func sniffContent(content io.Reader, declared string, policy mimetype.Policy) (*bufio.Reader, mimetype.Verdict, error) {
+    br := bufio.NewReaderSize(content, mimetype.SniffLen)
+    head, err := br.Peek(mimetype.SniffLen)
+    if err != nil && !errors.Is(err, io.EOF) && !errors.Is(err, bufio.ErrBufferFull) { return nil, mimetype.Verdict{}, err }
+    return br, policy.Check(declared, mimetype.Detect(head)), nil
+}
@@ -0,0 +1,98 @@
+package httpext
+
+import (
+    "encoding/json"
+    "errors"
+    "io"
+    "log"
+    "net/http"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/himanshu/file-vault-app/backend/internal/dedup"
+    "github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// Dedup pre-check: a client that knows a file's SHA-256 asks whether the
+// content has to be sent at all.
+//
+//    POST /upload/precheck       {"hash", "size", "filename", "mimeType"?, "tags"?}
+//    POST /upload/precheck/{id}  {"proof"}
+//
+// Both answer {"status": "created"|"challenge"|"upload_required"|"rejected", ...}.
+// A challenge lists a hex nonce and byte ranges; the proof is the hex SHA-256
+// of the nonce bytes followed by those ranges of the content (dedup.Proof).
+// A created file is described like an entry of the upload response.
+type precheckRequest struct {
+    Hash     string   `json:"hash"`
+    Size     int64    `json:"size"`
+    Filename string   `json:"filename"`
+    MIMEType string   `json:"mimeType"`
+    Tags     []string `json:"tags"`
+}
+
+type precheckResponse struct {
+    Status    string           `json:"status"`
+    File      *uploadResult    `json:"file,omitempty"`
+    Challenge *dedup.Challenge `json:"challenge,omitempty"`
+    Error     *uploadError     `json:"error,omitempty"`
+}
+
+func registerPrecheckRoutes(r chi.Router, d UploadDeps) {
+    r.Post("/upload/precheck", func(w http.ResponseWriter, r *http.Request) {
+        userID := d.GetUserID(r)
+        if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+        var req precheckRequest
+        if err := json.NewDecoder(io.LimitReader(r.Body, maxFieldSize)).Decode(&req); err != nil { http.Error(w, "bad request body", http.StatusBadRequest); return }
+        tags := []string{}
+        for _, t := range req.Tags {
+            var err error
+            if tags, err = appendTags(tags, t); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+        }
+        res, err := d.Dedup.Precheck(r.Context(), userID, dedup.Request{Hash: req.Hash, Size: req.Size, Filename: req.Filename, MIMEType: req.MIMEType, Tags: tags})
+        writePrecheck(w, res, err)
+    })
+    r.Post("/upload/precheck/{id}", func(w http.ResponseWriter, r *http.Request) {
+        userID := d.GetUserID(r)
+        if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+        var body struct { Proof string `json:"proof"` }
+        if err := json.NewDecoder(io.LimitReader(r.Body, maxFieldSize)).Decode(&body); err != nil { http.Error(w, "bad request body", http.StatusBadRequest); return }
+        res, err := d.Dedup.Answer(r.Context(), userID, chi.URLParam(r, "id"), body.Proof)
+        writePrecheck(w, res, err)
+    })
+}
+
+func writePrecheck(w http.ResponseWriter, res dedup.Result, err error) {
+    var qe *dedup.QuotaError
+    switch {
+    case errors.Is(err, dedup.ErrInvalidRequest):
+        http.Error(w, err.Error(), http.StatusBadRequest)
+        return
+    case errors.Is(err, dedup.ErrChallengeNotFound):
+        http.Error(w, "challenge not found or expired", http.StatusNotFound)
+        return
+    case errors.Is(err, repo.ErrTooManyChallenges):
+        http.Error(w, err.Error(), http.StatusTooManyRequests)
+        return
+    case errors.As(err, &qe):
+        writeQuotaExceeded(w, qe.Quota, qe.Size)
+        return
+    case err != nil:
+        log.Printf("upload precheck: %v", err)
+        http.Error(w, "precheck failed", http.StatusInternalServerError)
+        return
+    }
+    out := precheckResponse{Status: res.Status, Challenge: res.Challenge}
+    status := http.StatusOK
+    switch res.Status {
+    case dedup.StatusCreated:
+        f := newUploadResult(res.File.Filename, res.Verdict)
+        f.stored(storedFile{File: *res.File, Deduplicated: true})
+        out.File, status = &f, http.StatusCreated
+    case dedup.StatusRejected:
+        out.Error = &uploadError{Code: res.Verdict.Code, Message: res.Verdict.Reason}
+        status = http.StatusUnsupportedMediaType
+    }
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(out)
+}
@@ -3,15 +3,16 @@ package httpext
 import (
     "net"
     "net/http"
-    "os"
     "path/filepath"
 
     "github.com/go-chi/chi/v5"
     "github.com/himanshu/file-vault-app/backend/internal/repo"
+    "github.com/himanshu/file-vault-app/backend/internal/storage"
 )
 
 type PublicDeps struct {
     Repo *repo.Repository
+    Storage *storage.Service
 }
 
 func RegisterPublicRoutes(r chi.Router, d PublicDeps) {
@@ -19,14 +20,20 @@ func RegisterPublicRoutes(r chi.Router, d PublicDeps) {
         token := chi.URLParam(r, "token")
         fw, err := d.Repo.GetFileByPublicToken(r.Context(), token)
         if err != nil { http.NotFound(w, r); return }
+        if fw.Quarantined {
+            http.Error(w, "file unavailable: stored content failed an integrity check", http.StatusServiceUnavailable)
+            return
+        }
         // increment downloads
         ip, _, _ := net.SplitHostPort(r.RemoteAddr)
         _ = d.Repo.InsertDownload(r.Context(), fw.ID, nil, ip)
         // stream file
-        f, err := os.Open(fw.BlobPath)
+        sb, err := d.Repo.GetStoredBlob(r.Context(), fw.BlobHash)
+        if err != nil { http.Error(w, "file missing", http.StatusNotFound); return }
+        f, err := d.Storage.Open(r.Context(), sb)
         if err != nil { http.Error(w, "file missing", http.StatusNotFound); return }
         defer f.Close()
-        if fw.MIMEType != nil { w.Header().Set("Content-Type", *fw.MIMEType) }
+        if ct := fw.ContentType(); ct != nil { w.Header().Set("Content-Type", *ct) }
         w.Header().Set("Content-Disposition", "inline; filename=\""+filepath.Base(fw.Filename)+"\"")
         http.ServeContent(w, r, fw.Filename, fw.CreatedAt, f)
     })
@@ -0,0 +1,78 @@
+package httpext
+
+import (
+    "context"
+    "encoding/json"
+    "errors"
+    "io"
+    "net/http"
+
+    "github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+var errQuotaExceeded = errors.New("storage quota exceeded")
+
+// writeQuotaExceeded answers 413 with the numbers behind the decision.
+func writeQuotaExceeded(w http.ResponseWriter, q repo.Quota, requested int64) {
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(http.StatusRequestEntityTooLarge)
+    _ = json.NewEncoder(w).Encode(map[string]any{
+        "error":          "quota_exceeded",
+        "usedBytes":      q.UsedBytes,
+        "reservedBytes":  q.ReservedBytes,
+        "limitBytes":     q.LimitBytes,
+        "requestedBytes": requested,
+    })
+}
+
+// quotaBudget caps the file bytes of one request at what its reservation
+// holds. It is shared by all parts of a multipart request. When grow is set
+// the reservation is topped up as bytes arrive instead of failing the file.
+// Files committed under the budget are taken off the reservation, which is
+// why it names it.
+type quotaBudget struct {
+    reservation string
+    left        int64
+    read        int64
+    grow        func(bytes int64) (int64, error)
+}
+
+// reservationBudget returns the budget of reservation res, grown on demand
+// when the request size was not known up front.
+func reservationBudget(ctx context.Context, d UploadDeps, userID string, res repo.Reservation, growable bool) *quotaBudget {
+    b := &quotaBudget{reservation: res.ID, left: res.Bytes}
+    if growable {
+        b.grow = func(bytes int64) (int64, error) {
+            added, _, err := d.Repo.GrowReservation(ctx, res.ID, userID, bytes, d.QuotaBytes)
+            return added, err
+        }
+    }
+    return b
+}
+
+// reservationID is the reservation that files stored under b shrink; none
+// for a nil budget, as reservations do not limit unlimited quotas.
+func (b *quotaBudget) reservationID() string {
+    if b == nil { return "" }
+    return b.reservation
+}
+
+func (b *quotaBudget) reader(r io.Reader) io.Reader { return &budgetReader{r: r, b: b} }
+
+type budgetReader struct {
+    r io.Reader
+    b *quotaBudget
+}
+
+func (br *budgetReader) Read(p []byte) (int, error) {
+    n, err := br.r.Read(p)
+    br.b.read += int64(n)
+    br.b.left -= int64(n)
+    if br.b.left < 0 && br.b.grow != nil {
+        added, gerr := br.b.grow(max(-br.b.left, repo.ReservationStep))
+        if gerr != nil && !errors.Is(gerr, repo.ErrQuotaExceeded) { return n, gerr }
+        br.b.left += added
+    }
+    if br.b.left < 0 { return n, errQuotaExceeded }
+    return n, err
+}
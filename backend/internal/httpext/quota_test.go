@@ -0,0 +1,101 @@
+package httpext
+
+import (
+    "bytes"
+    "errors"
+    "io"
+    "testing"
+
+    "github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+func TestQuotaBudgetFixed(t *testing.T) {
+    b := &quotaBudget{left: 10}
+    if _, err := io.ReadAll(b.reader(bytes.NewReader(make([]byte, 6)))); err != nil {
+        t.Fatal(err)
+    }
+    // the budget is shared by the files of a request
+    if _, err := io.ReadAll(b.reader(bytes.NewReader(make([]byte, 6)))); !errors.Is(err, errQuotaExceeded) {
+        t.Fatalf("second file over the budget: %v", err)
+    }
+    if b.read != 12 {
+        t.Fatalf("read %d bytes", b.read)
+    }
+}
+
+// A growable budget tops its reservation up in steps as bytes arrive, and
+// fails once the quota has nothing left to give.
+func TestQuotaBudgetGrows(t *testing.T) {
+    quotaLeft := int64(repo.ReservationStep + 100)
+    var asked []int64
+    b := &quotaBudget{left: 10, grow: func(n int64) (int64, error) {
+        asked = append(asked, n)
+        if quotaLeft == 0 {
+            return 0, repo.ErrQuotaExceeded
+        }
+        added := min(n, quotaLeft)
+        quotaLeft -= added
+        return added, nil
+    }}
+    if _, err := io.ReadAll(b.reader(io.LimitReader(zeros{}, 1000))); err != nil {
+        t.Fatal(err)
+    }
+    if len(asked) != 1 || asked[0] < repo.ReservationStep {
+        t.Fatalf("grow asked for %v", asked)
+    }
+    if _, err := io.ReadAll(b.reader(io.LimitReader(zeros{}, repo.ReservationStep))); !errors.Is(err, errQuotaExceeded) {
+        t.Fatalf("reading past the quota: %v", err)
+    }
+    if quotaLeft != 0 {
+        t.Fatalf("%d bytes of quota never handed out", quotaLeft)
+    }
+
+    failing := &quotaBudget{grow: func(int64) (int64, error) { return 0, io.ErrClosedPipe }}
+    if _, err := io.ReadAll(failing.reader(bytes.NewReader([]byte("x")))); err != io.ErrClosedPipe {
+        t.Fatalf("grow error: %v", err)
+    }
+}
+
+type zeros struct{}
+
+func (zeros) Read(p []byte) (int, error) {
+    clear(p)
+    return len(p), nil
+}
+
+// quotaModel follows the reservation arithmetic of repo.GrowReservation and
+// repo.ShrinkReservation for one upload.
+type quotaModel struct{ limit, used, reserved int64 }
+
+func (q *quotaModel) grow(n int64) (int64, error) {
+    added := min(n, q.limit-q.used-q.reserved)
+    if added <= 0 { return 0, repo.ErrQuotaExceeded }
+    q.reserved += added
+    return added, nil
+}
+
+// commit is what storeFile does for a stored file.
+func (q *quotaModel) commit(n int64) {
+    q.used += n
+    q.reserved = max(q.reserved-n, 0)
+}
+
+// One request of unknown size can fill the quota: files it has committed
+// count as used and no longer as reserved, so they do not shrink what the
+// reservation may still grow by.
+func TestQuotaBudgetFillsQuota(t *testing.T) {
+    const file = 8 << 20
+    q := &quotaModel{limit: 3*repo.ReservationStep + file/2}
+    q.reserved = min(q.limit, repo.ReservationStep)
+    b := &quotaBudget{left: q.reserved, grow: q.grow}
+    for {
+        if _, err := io.Copy(io.Discard, b.reader(io.LimitReader(zeros{}, file))); err != nil {
+            if !errors.Is(err, errQuotaExceeded) { t.Fatal(err) }
+            break
+        }
+        q.commit(file)
+    }
+    if q.used < q.limit-file {
+        t.Fatalf("stored %d of %d bytes", q.used, q.limit)
+    }
+}
@@ -0,0 +1,314 @@
+package httpext
+
+import (
+    "crypto/md5"
+    "crypto/sha1"
+    "crypto/sha256"
+    "encoding/base64"
+    "errors"
+    "hash"
+    "log"
+    "net/http"
+    "sort"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/himanshu/file-vault-app/backend/internal/mimetype"
+    "github.com/himanshu/file-vault-app/backend/internal/repo"
+    "github.com/himanshu/file-vault-app/backend/internal/tus"
+    "github.com/jackc/pgx/v5"
+)
+
+// tus 1.0 resumable uploads. Completed uploads are stored exactly like
+// multipart uploads (storeFile); the new file's id is returned in X-File-ID.
+// Upload-Metadata may name the file ("filename"), its type ("filetype") and
+// the folder to store it in ("folder", a folder id). As with multipart
+// uploads, a file of the same name gets a new version unless "onConflict" is
+// "new", and "fileId" names the file to add a version to. "tags" (comma
+// separated) tags a new file.
+const (
+    tusVersion    = "1.0.0"
+    tusExtensions = "creation,creation-with-upload,termination,checksum,expiration"
+    tusChecksums  = "md5,sha1,sha256"
+    offsetStream  = "application/offset+octet-stream"
+    // statusChecksumMismatch is defined by the tus checksum extension.
+    statusChecksumMismatch = 460
+)
+
+// TusExposedHeaders lists the response headers browser clients need to read.
+var TusExposedHeaders = []string{"Location", "Upload-Offset", "Upload-Length", "Upload-Metadata", "Upload-Expires",
+    "Tus-Resumable", "Tus-Version", "Tus-Extension", "Tus-Max-Size", "Tus-Checksum-Algorithm", "X-File-ID"}
+
+func registerTusRoutes(r chi.Router, d UploadDeps) {
+    r.Route("/tus", func(r chi.Router) {
+        r.Use(tusResumable)
+        r.Options("/", func(w http.ResponseWriter, r *http.Request) { tusOptions(w, d) })
+        r.Post("/", func(w http.ResponseWriter, r *http.Request) { handleTusCreate(w, r, d) })
+        r.Head("/{id}", func(w http.ResponseWriter, r *http.Request) { handleTusHead(w, r, d) })
+        r.Patch("/{id}", func(w http.ResponseWriter, r *http.Request) { handleTusPatch(w, r, d) })
+        r.Delete("/{id}", func(w http.ResponseWriter, r *http.Request) { handleTusDelete(w, r, d) })
+    })
+}
+
+// tusResumable enforces the protocol version on every request but OPTIONS.
+func tusResumable(next http.Handler) http.Handler {
+    return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+        w.Header().Set("Tus-Resumable", tusVersion)
+        if r.Method != http.MethodOptions && r.Header.Get("Tus-Resumable") != tusVersion {
+            w.Header().Set("Tus-Version", tusVersion)
+            http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+            return
+        }
+        next.ServeHTTP(w, r)
+    })
+}
+
+func tusOptions(w http.ResponseWriter, d UploadDeps) {
+    w.Header().Set("Tus-Version", tusVersion)
+    w.Header().Set("Tus-Extension", tusExtensions)
+    w.Header().Set("Tus-Checksum-Algorithm", tusChecksums)
+    if d.TusMaxSize > 0 { w.Header().Set("Tus-Max-Size", strconv.FormatInt(d.TusMaxSize, 10)) }
+    w.WriteHeader(http.StatusNoContent)
+}
+
+func handleTusCreate(w http.ResponseWriter, r *http.Request, d UploadDeps) {
+    userID := d.GetUserID(r)
+    if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+    if r.Header.Get("Upload-Defer-Length") != "" { http.Error(w, "deferred length not supported", http.StatusBadRequest); return }
+    length, err := strconv.ParseInt(r.Header.Get("Upload-Length"), 10, 64)
+    if err != nil || length < 0 { http.Error(w, "invalid Upload-Length", http.StatusBadRequest); return }
+    if d.TusMaxSize > 0 && length > d.TusMaxSize { http.Error(w, "upload too large", http.StatusRequestEntityTooLarge); return }
+    meta, err := parseTusMetadata(r.Header.Get("Upload-Metadata"))
+    if err != nil { http.Error(w, "invalid Upload-Metadata", http.StatusBadRequest); return }
+    // refuse a denied declared type before any bytes are sent; the content is checked on completion
+    if declared := tusDeclaredMIME(meta); declared != "" {
+        policy, err := d.Repo.GetUploadPolicy(r.Context())
+        if err != nil { http.Error(w, "policy lookup failed", http.StatusInternalServerError); return }
+        if v := policy.Check(declared, ""); v.Rejected() {
+            writeUploadResponse(w, uploadResponse{Files: []uploadResult{newUploadResult(tusFilename(meta), v)}})
+            return
+        }
+    }
+
+    if _, err := uploadFolder(r.Context(), d, userID, meta["folder"]); err != nil {
+        if errors.Is(err, errFolderNotFound) { http.Error(w, err.Error(), http.StatusBadRequest); return }
+        http.Error(w, "folder lookup failed", http.StatusInternalServerError)
+        return
+    }
+    if _, err := parseOnConflict(meta["onConflict"]); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+    if _, err := appendTags(nil, meta["tags"]); err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+    if id := meta["fileId"]; id != "" {
+        if _, err := d.Repo.GetFile(r.Context(), userID, id); err != nil {
+            if errors.Is(err, pgx.ErrNoRows) { http.Error(w, "file to replace not found", http.StatusBadRequest); return }
+            http.Error(w, "file lookup failed", http.StatusInternalServerError)
+            return
+        }
+    }
+
+    // the whole upload is reserved now so that it cannot fail on quota halfway
+    res, quota, err := d.Repo.ReserveQuota(r.Context(), userID, length, false, d.QuotaBytes, d.Tus.Expiry)
+    if errors.Is(err, repo.ErrQuotaExceeded) { writeQuotaExceeded(w, quota, length); return }
+    if err != nil { http.Error(w, "quota check failed", http.StatusInternalServerError); return }
+    info, err := d.Tus.Create(tus.Info{OwnerID: userID, Length: length, Metadata: meta, ReservationID: res.ID})
+    if err != nil {
+        _ = d.Repo.ReleaseReservation(r.Context(), res.ID)
+        http.Error(w, "create upload failed", http.StatusInternalServerError)
+        return
+    }
+    w.Header().Set("Location", "/tus/"+info.ID)
+    w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+
+    // creation-with-upload: the request body carries the first bytes
+    if r.Header.Get("Content-Type") == offsetStream || length == 0 {
+        unlock, err := d.Tus.Lock(info.ID)
+        if err != nil { http.Error(w, err.Error(), http.StatusLocked); return }
+        defer unlock()
+        tusAppend(w, r, d, info, http.StatusCreated)
+        return
+    }
+    w.WriteHeader(http.StatusCreated)
+}
+
+func handleTusHead(w http.ResponseWriter, r *http.Request, d UploadDeps) {
+    info, ok := tusUpload(w, r, d)
+    if !ok { return }
+    w.Header().Set("Cache-Control", "no-store")
+    w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+    w.Header().Set("Upload-Length", strconv.FormatInt(info.Length, 10))
+    w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+    if len(info.Metadata) > 0 { w.Header().Set("Upload-Metadata", formatTusMetadata(info.Metadata)) }
+    w.WriteHeader(http.StatusOK)
+}
+
+func handleTusPatch(w http.ResponseWriter, r *http.Request, d UploadDeps) {
+    if r.Header.Get("Content-Type") != offsetStream { http.Error(w, "Content-Type must be "+offsetStream, http.StatusUnsupportedMediaType); return }
+    offset, err := strconv.ParseInt(r.Header.Get("Upload-Offset"), 10, 64)
+    if err != nil || offset < 0 { http.Error(w, "invalid Upload-Offset", http.StatusBadRequest); return }
+    if _, ok := tusUpload(w, r, d); !ok { return }
+    id := chi.URLParam(r, "id")
+    unlock, err := d.Tus.Lock(id)
+    if err != nil { http.Error(w, err.Error(), http.StatusLocked); return }
+    defer unlock()
+    // re-read under the lock; another request may have appended meanwhile
+    info, err := d.Tus.Get(id)
+    if err != nil { http.NotFound(w, r); return }
+    if offset != info.Offset { http.Error(w, "offset mismatch", http.StatusConflict); return }
+    tusAppend(w, r, d, info, http.StatusNoContent)
+}
+
+// tusAppend appends the request body and, once every byte has arrived, stores
+// the file. It writes the response.
+func tusAppend(w http.ResponseWriter, r *http.Request, d UploadDeps, info tus.Info, status int) {
+    if r.ContentLength > info.Length-info.Offset { http.Error(w, "body exceeds Upload-Length", http.StatusRequestEntityTooLarge); return }
+    sum, expected, err := parseTusChecksum(r.Header.Get("Upload-Checksum"))
+    if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+    if !info.Complete() {
+        info, err = d.Tus.Append(info, r.Body, sum, expected)
+        if errors.Is(err, tus.ErrChecksumMismatch) { http.Error(w, "checksum mismatch", statusChecksumMismatch); return }
+        if info.ReservationID != "" { _ = d.Repo.ExtendReservation(r.Context(), info.ReservationID, info.ExpiresAt) }
+        if err != nil {
+            // whatever arrived before the error is kept; the client resumes from HEAD
+            http.Error(w, "upload interrupted", http.StatusInternalServerError)
+            return
+        }
+    }
+    w.Header().Set("Upload-Offset", strconv.FormatInt(info.Offset, 10))
+    w.Header().Set("Upload-Expires", info.ExpiresAt.Format(http.TimeFormat))
+    if info.Complete() {
+        fileID, rejected, err := finishTusUpload(r, d, info)
+        if err != nil {
+            log.Printf("tus: finish %s: %v", info.ID, err)
+            // the upload is kept so that an empty PATCH can retry
+            http.Error(w, "store upload failed", http.StatusInternalServerError)
+            return
+        }
+        if rejected != nil { writeUploadResponse(w, uploadResponse{Files: []uploadResult{*rejected}}); return }
+        w.Header().Set("X-File-ID", fileID)
+    }
+    w.WriteHeader(status)
+}
+
+// finishTusUpload stores a complete upload and removes it. An upload whose
+// content the policy refuses is removed without being stored.
+func finishTusUpload(r *http.Request, d UploadDeps, info tus.Info) (string, *uploadResult, error) {
+    policy, err := d.Repo.GetUploadPolicy(r.Context())
+    if err != nil { return "", nil, err }
+    f, err := d.Tus.Open(info.ID)
+    if err != nil { return "", nil, err }
+    defer f.Close()
+    filename := tusFilename(info.Metadata)
+    content, verdict, err := sniffContent(f, tusDeclaredMIME(info.Metadata), policy.Policy)
+    if err != nil { return "", nil, err }
+    if verdict.Rejected() {
+        rejected := newUploadResult(filename, verdict)
+        if err := d.Tus.Remove(info.ID); err != nil { log.Printf("tus: remove %s: %v", info.ID, err) }
+        releaseTusReservation(r, d, info)
+        return "", &rejected, nil
+    }
+    // a folder deleted while the upload was in progress leaves the file in the root
+    folder, err := uploadFolder(r.Context(), d, info.OwnerID, info.Metadata["folder"])
+    if errors.Is(err, errFolderNotFound) { log.Printf("tus: %s: folder %s is gone, storing in the root", info.ID, info.Metadata["folder"]); err = nil }
+    if err != nil { return "", nil, err }
+    // likewise a file deleted meanwhile is stored anew
+    fileID := info.Metadata["fileId"]
+    if fileID != "" {
+        if _, err := d.Repo.GetFile(r.Context(), info.OwnerID, fileID); errors.Is(err, pgx.ErrNoRows) {
+            log.Printf("tus: %s: file %s is gone, storing a new file", info.ID, fileID)
+            fileID = ""
+        } else if err != nil { return "", nil, err }
+    }
+    byName, _ := parseOnConflict(info.Metadata["onConflict"])
+    tags, _ := appendTags([]string{}, info.Metadata["tags"])
+    fileRec, err := storeFile(r.Context(), d, repo.File{ID: fileID, OwnerID: info.OwnerID, Filename: filename, Tags: tags, FolderID: folder}, byName, verdict, content, info.ReservationID)
+    if err != nil { return "", nil, err }
+    if err := d.Tus.Remove(info.ID); err != nil { log.Printf("tus: remove %s: %v", info.ID, err) }
+    releaseTusReservation(r, d, info)
+    return fileRec.ID, nil, nil
+}
+
+func tusFilename(meta map[string]string) string {
+    return firstNonEmpty(meta["filename"], meta["name"], "upload")
+}
+
+// tusDeclaredMIME is the type from the upload's metadata, if it is a valid one.
+func tusDeclaredMIME(meta map[string]string) string {
+    return mimetype.Normalize(firstNonEmpty(meta["filetype"], meta["type"]))
+}
+
+func handleTusDelete(w http.ResponseWriter, r *http.Request, d UploadDeps) {
+    info, ok := tusUpload(w, r, d)
+    if !ok { return }
+    unlock, err := d.Tus.Lock(info.ID)
+    if err != nil { http.Error(w, err.Error(), http.StatusLocked); return }
+    defer unlock()
+    if err := d.Tus.Remove(info.ID); err != nil { http.Error(w, "terminate failed", http.StatusInternalServerError); return }
+    releaseTusReservation(r, d, info)
+    w.WriteHeader(http.StatusNoContent)
+}
+
+// releaseTusReservation drops the quota hold of a finished or terminated
+// upload. Holds of abandoned uploads lapse together with the upload.
+func releaseTusReservation(r *http.Request, d UploadDeps, info tus.Info) {
+    if info.ReservationID == "" { return }
+    if err := d.Repo.ReleaseReservation(r.Context(), info.ReservationID); err != nil { log.Printf("tus: release quota for %s: %v", info.ID, err) }
+}
+
+// tusUpload loads the upload named in the URL, answering 404 for uploads of
+// other users and 410 for expired ones.
+func tusUpload(w http.ResponseWriter, r *http.Request, d UploadDeps) (tus.Info, bool) {
+    userID := d.GetUserID(r)
+    if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return tus.Info{}, false }
+    info, err := d.Tus.Get(chi.URLParam(r, "id"))
+    if err != nil || info.OwnerID != userID { http.NotFound(w, r); return tus.Info{}, false }
+    if time.Now().After(info.ExpiresAt) { http.Error(w, "upload expired", http.StatusGone); return tus.Info{}, false }
+    return info, true
+}
+
+// parseTusMetadata decodes "key base64value,key2 base64value2".
+func parseTusMetadata(h string) (map[string]string, error) {
+    meta := map[string]string{}
+    for _, pair := range strings.Split(h, ",") {
+        pair = strings.TrimSpace(pair)
+        if pair == "" { continue }
+        key, enc, _ := strings.Cut(pair, " ")
+        v, err := base64.StdEncoding.DecodeString(enc)
+        if err != nil { return nil, err }
+        meta[key] = string(v)
+    }
+    return meta, nil
+}
+
+func formatTusMetadata(meta map[string]string) string {
+    keys := make([]string, 0, len(meta))
+    for k := range meta { keys = append(keys, k) }
+    sort.Strings(keys)
+    parts := make([]string, len(keys))
+    for i, k := range keys { parts[i] = k + " " + base64.StdEncoding.EncodeToString([]byte(meta[k])) }
+    return strings.Join(parts, ",")
+}
+
+// parseTusChecksum parses "algorithm base64digest" from Upload-Checksum.
+func parseTusChecksum(h string) (hash.Hash, []byte, error) {
+    if h == "" { return nil, nil, nil }
+    algo, enc, _ := strings.Cut(h, " ")
+    expected, err := base64.StdEncoding.DecodeString(enc)
+    if err != nil { return nil, nil, errors.New("invalid Upload-Checksum") }
+    switch algo {
+    case "md5":
+        return md5.New(), expected, nil
+    case "sha1":
+        return sha1.New(), expected, nil
+    case "sha256":
+        return sha256.New(), expected, nil
+    }
+    return nil, nil, errors.New("unsupported checksum algorithm")
+}
+
+func firstNonEmpty(vals ...string) string {
+    for _, v := range vals {
+        if v != "" { return v }
+    }
+    return ""
+}
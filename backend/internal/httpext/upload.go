@@ -5,19 +5,41 @@ import (
     "errors"
     "fmt"
     "io"
+    "log"
+    "mime/multipart"
     "net/http"
+    "slices"
+    "strconv"
     "strings"
+    "time"
 
     "github.com/go-chi/chi/v5"
+    "github.com/himanshu/file-vault-app/backend/internal/archive"
+    "github.com/himanshu/file-vault-app/backend/internal/dedup"
+    "github.com/himanshu/file-vault-app/backend/internal/mimetype"
     "github.com/himanshu/file-vault-app/backend/internal/repo"
     "github.com/himanshu/file-vault-app/backend/internal/storage"
+    "github.com/himanshu/file-vault-app/backend/internal/tus"
+    "github.com/jackc/pgx/v5"
 )
 
 type UploadDeps struct {
     Storage *storage.Service
     Repo *repo.Repository
-    MaxFormMemory int64
+    // MaxPartSize limits each uploaded file in a multipart request; 0 means no limit.
+    MaxPartSize int64
+    // QuotaBytes is the default per-user quota; negative means unlimited.
+    QuotaBytes int64
     GetUserID func(*http.Request) string
+    // Tus enables resumable uploads under /tus when set.
+    Tus *tus.Store
+    TusMaxSize int64
+    // Archive bounds the expansion of archives uploaded with ?expand=true.
+    Archive archive.Limits
+    // Versions bounds the earlier versions kept when files are replaced.
+    Versions repo.VersionRetention
+    // Dedup enables the hash pre-check under /upload/precheck when set.
+    Dedup *dedup.Service
 }
 
 func RegisterUploadRoutes(r chi.Router, d UploadDeps) {
@@ -27,77 +49,349 @@ func RegisterUploadRoutes(r chi.Router, d UploadDeps) {
     r.Get("/files", func(w http.ResponseWriter, r *http.Request) {
         handleList(w, r, d)
     })
+    r.Get("/files/{id}/versions/{version}", func(w http.ResponseWriter, r *http.Request) {
+        handleVersionDownload(w, r, d)
+    })
+    if d.Tus != nil { registerTusRoutes(r, d) }
+    if d.Dedup != nil { registerPrecheckRoutes(r, d) }
 }
 
+// handleUpload streams a multipart/form-data body part by part, so file
+// content goes straight into storage without being spooled by the form parser.
+// Fields apply to the files that follow them: "mime" overrides the declared
+// MIME type (otherwise each part's Content-Type), "tags" (comma separated,
+// repeatable) sets the tags and "folder" the folder to store them in (the
+// ?folder= query parameter, or the root, otherwise). A file named like an
+// existing file in its folder becomes that file's new version unless
+// "onConflict" (field or query parameter) is "new"; "fileId" makes the next
+// file a new version of the given file whatever its name. Every file's
+// content type is sniffed and checked against the upload policy. The response reports each file's outcome; see
+// uploadResponse, and the upload modes for what happens when some fail.
+//
+// With ?expand=true, zip, tar and tar.gz files are expanded instead of being
+// stored: each entry becomes a file of its own (see expandArchive).
 func handleUpload(w http.ResponseWriter, r *http.Request, d UploadDeps) {
     userID := d.GetUserID(r)
     if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+    mode := r.URL.Query().Get("mode")
+    if mode == "" { mode = modePartial }
+    if !validUploadMode(mode) { http.Error(w, "mode must be partial or atomic", http.StatusBadRequest); return }
+    expand := false
+    if v := r.URL.Query().Get("expand"); v != "" {
+        b, err := strconv.ParseBool(v)
+        if err != nil { http.Error(w, "expand must be true or false", http.StatusBadRequest); return }
+        expand = b
+    }
 
-    if err := r.ParseMultipartForm(d.MaxFormMemory); err != nil { http.Error(w, "bad form", http.StatusBadRequest); return }
-    files := r.MultipartForm.File["files"]
-    declaredMIME := r.FormValue("mime")
-    if len(files) == 0 { http.Error(w, "no files", http.StatusBadRequest); return }
+    mr, err := r.MultipartReader()
+    if err != nil { http.Error(w, "bad form", http.StatusBadRequest); return }
+    policy, err := d.Repo.GetUploadPolicy(r.Context())
+    if err != nil { http.Error(w, "policy lookup failed", http.StatusInternalServerError); return }
 
-    // quota check
-    _, err := d.Repo.SumUserStorage(r.Context(), userID)
+    // Hold quota for the request's size (all remaining quota when it is
+    // larger); file bytes beyond the reservation fail the file. When the size
+    // is unknown, or archives expand to an unknown size, the reservation
+    // starts small and grows as file bytes arrive.
+    reserve := r.ContentLength
+    if expand { reserve = -1 }
+    res, quota, err := d.Repo.ReserveQuota(r.Context(), userID, reserve, true, d.QuotaBytes, uploadReservationTTL)
+    if errors.Is(err, repo.ErrQuotaExceeded) { writeQuotaExceeded(w, quota, r.ContentLength); return }
     if err != nil { http.Error(w, "quota check failed", http.StatusInternalServerError); return }
+    // files created below count as usage from here on, so the hold is released either way
+    defer func() { _ = d.Repo.ReleaseReservation(context.Background(), res.ID) }()
+    var budget *quotaBudget
+    if !quota.Unlimited() { budget = reservationBudget(r.Context(), d, userID, res, reserve < 0) }
 
-    type Uploaded struct { ID, Filename, Hash string; Size int64 }
-    var out []Uploaded
-    var totalNew int64
-    for _, fh := range files {
-        f, err := fh.Open()
-        if err != nil { http.Error(w, "open file", http.StatusBadRequest); return }
-        func() {
-            defer f.Close()
-            // MIME validation: basic check using header sniffing
-            // We allow declared MIME but also simple sanity by reading first bytes
-            // For simplicity, accept declared MIME presence; deeper validation could be added.
-            if declaredMIME != "" && !strings.Contains(declaredMIME, "/") {
-                err = errors.New("invalid mime")
-                return
+    resp := uploadResponse{Mode: mode}
+    var declaredMIME string
+    tags := []string{}
+    folder, err := uploadFolder(r.Context(), d, userID, r.URL.Query().Get("folder"))
+    if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+    byName, err := parseOnConflict(r.URL.Query().Get("onConflict"))
+    if err != nil { http.Error(w, err.Error(), http.StatusBadRequest); return }
+    var fileID string
+    badForm := func(msg string) { resp.Error = &uploadError{Code: codeBadForm, Message: msg, status: http.StatusBadRequest} }
+parts:
+    for {
+        part, err := mr.NextPart()
+        if err == io.EOF { break }
+        if err != nil { badForm("malformed multipart body"); break }
+        switch part.FormName() {
+        case "mode", "mime", "tags", "folder", "onConflict", "fileId":
+            v, ferr := readFormField(part)
+            part.Close()
+            if ferr != nil { badForm(ferr.Error()); break parts }
+            switch part.FormName() {
+            case "mode":
+                if len(resp.Files) > 0 { badForm("mode must be sent before the first file"); break parts }
+                if !validUploadMode(v) { badForm("mode must be partial or atomic"); break parts }
+                mode, resp.Mode = v, v
+            case "mime":
+                if v != "" && mimetype.Normalize(v) == "" { badForm("invalid mime"); break parts }
+                declaredMIME = v
+            case "folder":
+                if folder, ferr = uploadFolder(r.Context(), d, userID, v); ferr != nil { badForm(ferr.Error()); break parts }
+            case "onConflict":
+                if byName, ferr = parseOnConflict(v); ferr != nil { badForm(ferr.Error()); break parts }
+            case "fileId":
+                if _, ferr = d.Repo.GetFile(r.Context(), userID, v); ferr != nil { badForm("file to replace not found"); break parts }
+                fileID = v
+            default:
+                if tags, ferr = appendTags(tags, v); ferr != nil { badForm(ferr.Error()); break parts }
             }
-            hash, path, size, werr := d.Storage.WriteAndHash(f)
-            if werr != nil { err = werr; return }
-
-            // insert blob if new
-            // Note: path may already exist; Insert with DO NOTHING
-            var mimePtr *string
-            if declaredMIME != "" { mimePtr = &declaredMIME }
-            if ierr := d.Repo.InsertBlob(r.Context(), repo.Blob{Hash: hash, SizeBytes: size, MIMEType: mimePtr, StoragePath: path, RefCount: 0}); ierr != nil {
-                // ignore unique conflict; continue
-            }
-            // create logical file
-            fileRec, ferr := d.Repo.CreateFile(r.Context(), repo.File{
-                OwnerID: userID,
-                BlobHash: hash,
-                Filename: fh.Filename,
-                SizeBytes: size,
-                MIMEType: mimePtr,
-                IsPublic: false,
-                Tags: []string{},
-            })
-            if ferr != nil { err = ferr; return }
-            _ = d.Repo.IncBlobRef(r.Context(), hash, 1)
-            out = append(out, Uploaded{ID: fileRec.ID, Filename: fileRec.Filename, Hash: hash, Size: size})
-            totalNew += size
-        }()
-        if err != nil { http.Error(w, fmt.Sprintf("upload error: %v", err), http.StatusBadRequest); return }
+            continue
+        case "files":
+            // like ParseMultipartForm, a part without a filename is a plain value
+            if part.FileName() == "" { part.Close(); continue }
+        default:
+            part.Close()
+            continue
+        }
+        results := uploadPart(r.Context(), d, userID, part, uploadOptions{declaredMIME, tags, folder, fileID, byName, expand, mode == modeAtomic}, policy.Policy, budget)
+        fileID = ""
+        part.Close()
+        resp.Files = append(resp.Files, results...)
+        if slices.ContainsFunc(results, func(f uploadResult) bool { return f.Error != nil && (mode == modeAtomic || f.Error.fatal) }) { break }
+    }
+    if len(resp.Files) == 0 && resp.Error == nil {
+        resp.Error = &uploadError{Code: codeNoFiles, Message: "no files", status: http.StatusBadRequest}
     }
+    if mode == modeAtomic && (resp.Error != nil || slices.ContainsFunc(resp.Files, func(f uploadResult) bool { return f.Error != nil })) {
+        rollbackUploads(d, userID, resp.Files)
+    }
+    writeUploadResponse(w, resp)
+}
 
-    // return JSON
-    w.Header().Set("Content-Type", "application/json")
-    io.WriteString(w, `{"ok":true}`)
+// uploadOptions are the settings a file part is uploaded with.
+type uploadOptions struct {
+    declaredMIME string
+    tags []string
+    folder *string
+    // fileID names the file to add a version to; byName matches files by name.
+    fileID string
+    byName bool
+    expand bool
+    // atomic stops an archive's expansion at the first failed entry.
+    atomic bool
+}
+
+// uploadPart stores one file part, or the files of an archive being expanded,
+// reporting the outcomes.
+func uploadPart(ctx context.Context, d UploadDeps, userID string, part *multipart.Part, o uploadOptions, policy mimetype.Policy, budget *quotaBudget) []uploadResult {
+    declared := o.declaredMIME
+    if declared == "" { declared = part.Header.Get("Content-Type") }
+    src := &sourceReader{r: part}
+    var content io.Reader = src
+    if d.MaxPartSize > 0 { content = &partLimiter{r: content, max: d.MaxPartSize} }
+    br, verdict, err := sniffContent(content, declared, policy)
+    if err != nil { return []uploadResult{{Filename: part.FileName(), Error: uploadFailure(part.FileName(), err, src.err)}} }
+    if o.expand {
+        // the archive is not stored, so its own type is not subject to the policy; its entries are
+        head, _ := br.Peek(mimetype.SniffLen)
+        if format := archive.Format(verdict.Detected, head); format != "" {
+            return expandArchive(ctx, d, userID, part.FileName(), format, br, src, o, policy, budget)
+        }
+    }
+    result := newUploadResult(part.FileName(), verdict)
+    // a refused part's remaining bytes are skipped by NextPart without counting against the budget
+    if result.Error != nil { return []uploadResult{result} }
+    content = br
+    if budget != nil { content = budget.reader(content) }
+    f, err := storeFile(ctx, d, repo.File{ID: o.fileID, OwnerID: userID, Filename: part.FileName(), Tags: o.tags, FolderID: o.folder}, o.byName, verdict, content, budget.reservationID())
+    if err != nil { result.Error = uploadFailure(part.FileName(), err, src.err); return []uploadResult{result} }
+    result.stored(f)
+    return []uploadResult{result}
+}
+
+var errFolderNotFound = errors.New("folder not found")
+
+// parseOnConflict reads the onConflict upload option: "version" (the
+// default) adds a version to a file of the same name, "new" creates a file.
+func parseOnConflict(v string) (byName bool, err error) {
+    switch v {
+    case "", "version": return true, nil
+    case "new": return false, nil
+    }
+    return false, errors.New("onConflict must be version or new")
+}
+
+// uploadFolder resolves the target folder id of an upload; "" is the root.
+func uploadFolder(ctx context.Context, d UploadDeps, userID, id string) (*string, error) {
+    if id == "" { return nil, nil }
+    f, err := d.Repo.GetFolder(ctx, userID, id)
+    if errors.Is(err, pgx.ErrNoRows) { return nil, errFolderNotFound }
+    if err != nil { return nil, err }
+    return &f.ID, nil
+}
+
+// rollbackUploads undoes the files an atomic upload stored before failing:
+// new files are removed, added versions dropped. Their content is left for
+// garbage collection.
+func rollbackUploads(d UploadDeps, userID string, results []uploadResult) {
+    for i := range results {
+        res := &results[i]
+        if res.Error != nil { continue }
+        var err error
+        switch {
+        case res.Unchanged:
+        case res.Version > 1:
+            err = d.Repo.DropVersion(context.Background(), userID, res.ID, res.Version)
+        default:
+            err = d.Repo.DeleteFileAndMaybeBlob(context.Background(), userID, res.ID)
+        }
+        if err != nil {
+            log.Printf("upload: roll back %s: %v", res.ID, err)
+            res.Error = &uploadError{Code: codeRollbackFail, Message: "stored, but could not be removed after another file failed"}
+            continue
+        }
+        res.ID, res.Version = "", 0
+        res.Error = &uploadError{Code: codeRolledBack, Message: "not kept because another file in the request failed"}
+    }
+}
+
+// storedFile is the outcome of storeFile.
+type storedFile struct {
+    repo.File
+    // Deduplicated is set when identical content was already stored,
+    // Unchanged when it already was the file's current version.
+    Deduplicated, Unchanged bool
+}
+
+// storeFile writes content to storage and records it, typed according to v,
+// as described by meta (owner, name, tags and the like): as a new version of
+// file meta.ID when set, or with byName of the file with the same name in the
+// same folder if there is one (see repo.PutFile), otherwise as a new file.
+// The blob row, the file row and the reference count are committed together;
+// if that fails, objects this call created are deleted again unless another
+// upload of the same content has recorded them meanwhile. A new version is
+// taken off reservation in the same transaction, as from then on it counts
+// as used.
+// Multipart, archive and tus uploads all end here.
+func storeFile(ctx context.Context, d UploadDeps, meta repo.File, byName bool, v mimetype.Verdict, content io.Reader, reservation string) (storedFile, error) {
+    sb, err := d.Storage.WriteAndHash(ctx, content, v.ContentType())
+    if err != nil { return storedFile{}, err }
+
+    meta.BlobHash, meta.SizeBytes = sb.Hash, sb.Size
+    meta.MIMEType, meta.DetectedMIME, meta.MIMEMismatch = nil, nil, v.Mismatch
+    if v.Declared != "" { meta.MIMEType = &v.Declared }
+    if v.Detected != "" { meta.DetectedMIME = &v.Detected }
+    if meta.Tags == nil { meta.Tags = []string{} }
+    var out storedFile
+    err = d.Repo.WithTx(ctx, func(tx *repo.Repository) error {
+        if err := checkReused(ctx, d, tx, sb); err != nil { return err }
+        inserted, err := tx.InsertBlob(ctx, repo.NewBlob(sb, meta.DetectedMIME))
+        if err != nil { return err }
+        f, changed, err := tx.PutFile(ctx, meta, byName, d.Versions)
+        if err != nil { return err }
+        out = storedFile{File: f, Deduplicated: !inserted, Unchanged: !changed}
+        if reservation == "" || !changed { return nil }
+        return tx.ShrinkReservation(ctx, reservation, meta.SizeBytes)
+    })
+    if err != nil {
+        discardCreated(d, sb)
+        return storedFile{}, err
+    }
+    return out, nil
+}
+
+// errContentRemoved is returned when content an upload found already stored
+// was deleted by the garbage collector before the upload could record it.
+var errContentRemoved = errors.New("stored content was removed during the upload; retry")
+
+// checkReused makes sure the objects WriteAndHash found already stored are
+// still there, holding their locks (see repo.LockKeys) until tx commits so
+// that they cannot be deleted before the blob references them. Objects with a
+// row are safe; the others may just have been garbage collected.
+func checkReused(ctx context.Context, d UploadDeps, tx *repo.Repository, sb storage.Blob) error {
+    if len(sb.Reused) == 0 { return nil }
+    if err := tx.LockKeys(ctx, sb.Reused); err != nil { return err }
+    unrecorded, err := tx.UnreferencedKeys(ctx, sb.Reused)
+    if err != nil { return err }
+    for _, k := range unrecorded {
+        _, err := d.Storage.Backend.Stat(ctx, k)
+        if errors.Is(err, storage.ErrNotFound) { return errContentRemoved }
+        if err != nil { return err }
+    }
+    return nil
+}
+
+// discardCreated is the compensation for a rolled back storeFile. It runs
+// detached from the request, whose cancellation is a common cause of the
+// rollback.
+func discardCreated(d UploadDeps, sb storage.Blob) {
+    if len(sb.Created) == 0 { return }
+    ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+    defer cancel()
+    _, err := d.Repo.DeleteUnreferenced(ctx, sb.Created, func(keys []string) error {
+        d.Storage.Discard(ctx, keys)
+        return nil
+    })
+    if err != nil { log.Printf("upload: discard content of %s: %v", sb.Hash, err) }
+}
+
+// uploadReservationTTL bounds how long a multipart upload holds quota should
+// the server die before releasing it.
+const uploadReservationTTL = 6 * time.Hour
+
+// maxFieldSize bounds non-file form fields, which are read into memory.
+const maxFieldSize = 64 << 10
+
+var errPartTooLarge = errors.New("file exceeds the per-file size limit")
+
+func readFormField(part *multipart.Part) (string, error) {
+    b, err := io.ReadAll(io.LimitReader(part, maxFieldSize+1))
+    if err != nil { return "", err }
+    if len(b) > maxFieldSize { return "", fmt.Errorf("form field %q too large", part.FormName()) }
+    return strings.TrimSpace(string(b)), nil
+}
+
+// appendTags adds the comma separated tags in v, skipping blanks and
+// duplicates; see repo.CleanTag for what makes a valid tag.
+func appendTags(tags []string, v string) ([]string, error) {
+    for _, t := range strings.Split(v, ",") {
+        if strings.TrimSpace(t) == "" { continue }
+        t, err := repo.CleanTag(t)
+        if err != nil { return nil, err }
+        if !slices.Contains(tags, t) { tags = append(tags, t) }
+    }
+    return tags, nil
+}
+
+// sourceReader records the error reading the request body returned, telling
+// a broken request apart from failures of the wrappers and of storage.
+type sourceReader struct {
+    r io.Reader
+    err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+    n, err := s.r.Read(p)
+    if err != nil && err != io.EOF { s.err = err }
+    return n, err
+}
+
+// partLimiter fails the stream as soon as more than max bytes have been read,
+// so oversized files are rejected without being consumed in full.
+type partLimiter struct {
+    r io.Reader
+    n, max int64
+}
+
+func (l *partLimiter) Read(p []byte) (int, error) {
+    n, err := l.r.Read(p)
+    l.n += int64(n)
+    if l.n > l.max { return n, errPartTooLarge }
+    return n, err
 }
 
 func handleList(w http.ResponseWriter, r *http.Request, d UploadDeps) {
     userID := d.GetUserID(r)
     if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
-    files, err := d.Repo.ListFilesByOwner(context.Background(), userID, 50, 0)
+    page, err := d.Repo.ListFilesPage(context.Background(), userID, repo.FileFilters{}, repo.Page{First: 50})
     if err != nil { http.Error(w, "list error", http.StatusInternalServerError); return }
     // very simple JSON to avoid adding deps
     w.Header().Set("Content-Type", "application/json")
-    io.WriteString(w, fmt.Sprintf("{\"count\":%d}", len(files)))
+    io.WriteString(w, fmt.Sprintf("{\"count\":%d}", len(page.Files)))
 }
 
 
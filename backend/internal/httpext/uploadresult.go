@@ -0,0 +1,161 @@
+package httpext
+
+import (
+    "encoding/json"
+    "errors"
+    "log"
+    "net/http"
+
+    "github.com/himanshu/file-vault-app/backend/internal/archive"
+    "github.com/himanshu/file-vault-app/backend/internal/mimetype"
+)
+
+// Upload modes, chosen per request with the "mode" query parameter or a
+// "mode" form field sent before the first file.
+//
+// In partial mode (the default) every file is attempted and the files that
+// were stored are kept even when others fail; a mix of outcomes is answered
+// with 207 Multi-Status. In atomic mode the first failure stops the upload and
+// the files already stored by the request are removed again.
+const (
+    modePartial = "partial"
+    modeAtomic  = "atomic"
+)
+
+func validUploadMode(m string) bool { return m == modePartial || m == modeAtomic }
+
+// uploadResponse is the body of every POST /upload response past the
+// authentication and quota checks:
+//
+//    {
+//      "mode": "partial",
+//      "ok": false,            // every file stored, no request error
+//      "uploaded": 1,
+//      "failed": 1,
+//      "files": [
+//        {"id": "…", "filename": "a.pdf", "hash": "…", "size": 1234,
+//         "mimeType": "application/pdf", "detectedMimeType": "application/pdf",
+//         "mimeMismatch": false, "deduplicated": true, "version": 2},
+//        {"filename": "b.exe", "size": 0, "detectedMimeType": "application/vnd.microsoft.portable-executable",
+//         "mimeMismatch": false, "deduplicated": false,
+//         "error": {"code": "type_denied", "message": "type … is not allowed"}}
+//      ],
+//      "error": {"code": "bad_form", "message": "…"}   // request-level failure, if any
+//    }
+//
+// files lists the file parts in request order. The status is 200 when every
+// file was stored, 207 when outcomes are mixed, and otherwise the status of
+// the failure (e.g. 413 or 415; in atomic mode, of the file that failed).
+type uploadResponse struct {
+    Mode     string         `json:"mode,omitempty"`
+    OK       bool           `json:"ok"`
+    Uploaded int            `json:"uploaded"`
+    Failed   int            `json:"failed"`
+    Files    []uploadResult `json:"files"`
+    Error    *uploadError   `json:"error,omitempty"`
+}
+
+// uploadResult is the outcome for one file. mimeType is the declared type.
+type uploadResult struct {
+    ID           string       `json:"id,omitempty"`
+    Filename     string       `json:"filename"`
+    Hash         string       `json:"hash,omitempty"`
+    Size         int64        `json:"size"`
+    MIMEType     string       `json:"mimeType,omitempty"`
+    DetectedMIME string       `json:"detectedMimeType,omitempty"`
+    MIMEMismatch bool         `json:"mimeMismatch"`
+    // Deduplicated is set when identical content was already stored.
+    Deduplicated bool         `json:"deduplicated"`
+    // Version is the file's version after the upload; Unchanged is set when
+    // the content already was the current version.
+    Version      int          `json:"version,omitempty"`
+    Unchanged    bool         `json:"unchanged,omitempty"`
+    // Path and Archive locate a file expanded from an uploaded archive.
+    Path         string       `json:"path,omitempty"`
+    Archive      string       `json:"archive,omitempty"`
+    Error        *uploadError `json:"error,omitempty"`
+}
+
+// Error codes besides the mimetype.Code* policy rejections.
+const (
+    codeBadForm      = "bad_form"
+    codeNoFiles      = "no_files"
+    codeTooLarge     = "file_too_large"
+    codeQuota        = "quota_exceeded"
+    codeStoreFailed  = "store_failed"
+    codeRetry        = "retry"
+    codeRolledBack   = "rolled_back"
+    codeRollbackFail = "rollback_failed"
+)
+
+type uploadError struct {
+    Code    string `json:"code"`
+    Message string `json:"message"`
+    status  int
+    // fatal errors leave the multipart stream unusable, ending the request.
+    fatal bool
+}
+
+func newUploadResult(filename string, v mimetype.Verdict) uploadResult {
+    res := uploadResult{Filename: filename, MIMEType: v.Declared, DetectedMIME: v.Detected, MIMEMismatch: v.Mismatch}
+    if v.Rejected() { res.Error = &uploadError{Code: v.Code, Message: v.Reason, status: http.StatusUnsupportedMediaType} }
+    return res
+}
+
+func (res *uploadResult) stored(f storedFile) {
+    res.ID, res.Filename, res.Hash, res.Size = f.ID, f.Filename, f.BlobHash, f.SizeBytes
+    res.Version, res.Deduplicated, res.Unchanged = f.Version, f.Deduplicated, f.Unchanged
+}
+
+// uploadFailure classifies an error from storing one file. srcErr is the error,
+// if any, that reading the request body produced.
+func uploadFailure(filename string, err, srcErr error) *uploadError {
+    switch {
+    case errors.Is(err, errQuotaExceeded):
+        return &uploadError{Code: codeQuota, Message: err.Error(), status: http.StatusRequestEntityTooLarge}
+    case errors.Is(err, errPartTooLarge):
+        return &uploadError{Code: codeTooLarge, Message: err.Error(), status: http.StatusRequestEntityTooLarge}
+    case errors.Is(err, archive.ErrTooLarge), errors.Is(err, archive.ErrRatio):
+        return &uploadError{Code: codeArchiveLimit, Message: err.Error(), status: http.StatusRequestEntityTooLarge}
+    case errors.Is(err, errContentRemoved):
+        return &uploadError{Code: codeRetry, Message: err.Error(), status: http.StatusServiceUnavailable}
+    case srcErr != nil:
+        return &uploadError{Code: codeBadForm, Message: "reading file: " + srcErr.Error(), status: http.StatusBadRequest, fatal: true}
+    }
+    log.Printf("upload: store %q: %v", filename, err)
+    return &uploadError{Code: codeStoreFailed, Message: "could not store file", status: http.StatusInternalServerError}
+}
+
+// finish fills in the counters and returns the response status.
+func (resp *uploadResponse) finish() int {
+    resp.Uploaded, resp.Failed = 0, 0
+    var statuses []int
+    for _, f := range resp.Files {
+        if f.Error == nil { resp.Uploaded++; continue }
+        resp.Failed++
+        if f.Error.status != 0 { statuses = append(statuses, f.Error.status) }
+    }
+    resp.OK = resp.Failed == 0 && resp.Error == nil
+    switch {
+    case resp.Error != nil:
+        return resp.Error.status
+    case resp.Failed == 0:
+        return http.StatusOK
+    case resp.Mode == modeAtomic && len(statuses) > 0:
+        return statuses[0]
+    case resp.Uploaded > 0 || len(statuses) == 0:
+        return http.StatusMultiStatus
+    }
+    for _, s := range statuses[1:] {
+        if s != statuses[0] { return http.StatusMultiStatus }
+    }
+    return statuses[0]
+}
+
+func writeUploadResponse(w http.ResponseWriter, resp uploadResponse) {
+    if resp.Files == nil { resp.Files = []uploadResult{} }
+    status := resp.finish()
+    w.Header().Set("Content-Type", "application/json")
+    w.WriteHeader(status)
+    _ = json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,38 @@
+package httpext
+
+import (
+    "errors"
+    "net/http"
+    "path/filepath"
+    "strconv"
+
+    "github.com/go-chi/chi/v5"
+    "github.com/jackc/pgx/v5"
+)
+
+// handleVersionDownload streams version {version} of the caller's file {id},
+// the current one or an earlier one kept in its history.
+func handleVersionDownload(w http.ResponseWriter, r *http.Request, d UploadDeps) {
+    userID := d.GetUserID(r)
+    if userID == "" { http.Error(w, "unauthorized", http.StatusUnauthorized); return }
+    n, err := strconv.Atoi(chi.URLParam(r, "version"))
+    if err != nil || n < 1 { http.Error(w, "invalid version", http.StatusBadRequest); return }
+    f, err := d.Repo.GetFile(r.Context(), userID, chi.URLParam(r, "id"))
+    if errors.Is(err, pgx.ErrNoRows) { http.NotFound(w, r); return }
+    if err != nil { http.Error(w, "file lookup failed", http.StatusInternalServerError); return }
+    v, err := d.Repo.GetVersion(r.Context(), userID, f.ID, n)
+    if errors.Is(err, pgx.ErrNoRows) { http.NotFound(w, r); return }
+    if err != nil { http.Error(w, "version lookup failed", http.StatusInternalServerError); return }
+    if _, err := d.Repo.GetServableBlob(r.Context(), v.BlobHash); errors.Is(err, pgx.ErrNoRows) {
+        http.Error(w, "version unavailable: stored content failed an integrity check", http.StatusServiceUnavailable)
+        return
+    } else if err != nil { http.Error(w, "blob lookup failed", http.StatusInternalServerError); return }
+    sb, err := d.Repo.GetStoredBlob(r.Context(), v.BlobHash)
+    if err != nil { http.Error(w, "file missing", http.StatusNotFound); return }
+    rd, err := d.Storage.Open(r.Context(), sb)
+    if err != nil { http.Error(w, "file missing", http.StatusNotFound); return }
+    defer rd.Close()
+    if ct := v.ContentType(); ct != nil { w.Header().Set("Content-Type", *ct) }
+    w.Header().Set("Content-Disposition", "attachment; filename=\""+filepath.Base(f.Filename)+"\"")
+    http.ServeContent(w, r, f.Filename, v.CreatedAt, rd)
+}
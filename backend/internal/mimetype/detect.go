@@ -0,0 +1,205 @@
+// Package mimetype identifies file content by its leading bytes and decides
+// whether uploads of a type are acceptable.
+package mimetype
+
+import (
+	"bytes"
+	"encoding/binary"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// SniffLen is how many leading bytes Detect wants. Office documents and other
+// zip containers are recognised by entry names, which are usually but not
+// always within the first few kilobytes.
+const SniffLen = 32 << 10
+
+// Generic is reported when nothing more specific is known.
+const Generic = "application/octet-stream"
+
+type magic struct {
+	offset int
+	sig    []byte
+	mime   string
+}
+
+var magics = []magic{
+	{0, []byte("%PDF-"), "application/pdf"},
+	{0, []byte("\x89PNG\r\n\x1a\n"), "image/png"},
+	{0, []byte("\xff\xd8\xff"), "image/jpeg"},
+	{0, []byte("GIF87a"), "image/gif"},
+	{0, []byte("GIF89a"), "image/gif"},
+	{0, []byte("BM"), "image/bmp"},
+	{0, []byte("II*\x00"), "image/tiff"},
+	{0, []byte("MM\x00*"), "image/tiff"},
+	{0, []byte("\x00\x00\x01\x00"), "image/x-icon"},
+	{0, []byte("8BPS"), "image/vnd.adobe.photoshop"},
+	{0, []byte("\x1f\x8b"), "application/gzip"},
+	{0, []byte("BZh"), "application/x-bzip2"},
+	{0, []byte("\xfd7zXZ\x00"), "application/x-xz"},
+	{0, []byte("\x28\xb5\x2f\xfd"), "application/zstd"},
+	{0, []byte("7z\xbc\xaf\x27\x1c"), "application/x-7z-compressed"},
+	{0, []byte("Rar!\x1a\x07"), "application/vnd.rar"},
+	{257, []byte("ustar"), "application/x-tar"},
+	{0, []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1"), "application/x-ole-storage"},
+	{0, []byte("{\\rtf"), "application/rtf"},
+	{0, []byte("OggS"), "application/ogg"},
+	{0, []byte("fLaC"), "audio/flac"},
+	{0, []byte("ID3"), "audio/mpeg"},
+	{0, []byte("MThd"), "audio/midi"},
+	{0, []byte("FLV"), "video/x-flv"},
+	{0, []byte("\x00\x00\x01\xba"), "video/mpeg"},
+	{0, []byte("\x00\x00\x01\xb3"), "video/mpeg"},
+	{0, []byte("wOFF"), "font/woff"},
+	{0, []byte("wOF2"), "font/woff2"},
+	{0, []byte("\x00\x01\x00\x00\x00"), "font/ttf"},
+	{0, []byte("OTTO"), "font/otf"},
+	{0, []byte("\x00asm"), "application/wasm"},
+	{0, []byte("\x7fELF"), "application/x-elf"},
+	{0, []byte("MZ"), "application/vnd.microsoft.portable-executable"},
+	{0, []byte("\xcf\xfa\xed\xfe"), "application/x-mach-binary"},
+	{0, []byte("\xca\xfe\xba\xbe"), "application/x-mach-binary"},
+	{0, []byte("SQLite format 3\x00"), "application/vnd.sqlite3"},
+}
+
+// Detect returns the MIME type of content starting with head.
+func Detect(head []byte) string {
+	switch {
+	case bytes.HasPrefix(head, []byte("PK\x03\x04")):
+		return detectZip(head)
+	case len(head) >= 12 && bytes.HasPrefix(head, []byte("RIFF")):
+		switch string(head[8:12]) {
+		case "WEBP":
+			return "image/webp"
+		case "WAVE":
+			return "audio/wav"
+		case "AVI ":
+			return "video/x-msvideo"
+		}
+	case len(head) >= 12 && string(head[4:8]) == "ftyp":
+		return detectISOBMFF(head)
+	case bytes.HasPrefix(head, []byte("\x1a\x45\xdf\xa3")):
+		if bytes.Contains(head[:min(len(head), 64)], []byte("webm")) {
+			return "video/webm"
+		}
+		return "video/x-matroska"
+	case len(head) >= 2 && head[0] == 0xff && head[1]&0xe0 == 0xe0 && head[1]&0x06 != 0:
+		// MPEG audio frame sync; AAC ADTS has layer bits 00
+		return "audio/mpeg"
+	}
+	for _, m := range magics {
+		if len(head) >= m.offset+len(m.sig) && bytes.Equal(head[m.offset:m.offset+len(m.sig)], m.sig) {
+			return m.mime
+		}
+	}
+	if isSVG(head) {
+		return "image/svg+xml"
+	}
+	return Normalize(http.DetectContentType(head))
+}
+
+// detectISOBMFF tells MP4, QuickTime, HEIF and friends apart by major brand.
+func detectISOBMFF(head []byte) string {
+	switch brand := string(head[8:12]); {
+	case brand == "qt  ":
+		return "video/quicktime"
+	case brand == "M4A " || brand == "M4B ":
+		return "audio/mp4"
+	case brand == "heic" || brand == "heix" || brand == "mif1" || brand == "msf1":
+		return "image/heic"
+	case brand == "avif":
+		return "image/avif"
+	case strings.HasPrefix(brand, "3gp"):
+		return "video/3gpp"
+	}
+	return "video/mp4"
+}
+
+// detectZip looks at the names of the entries within head to recognise zip
+// based document formats.
+func detectZip(head []byte) string {
+	var names []string
+	for off := 0; off+30 <= len(head); {
+		if !bytes.Equal(head[off:off+4], []byte("PK\x03\x04")) {
+			break
+		}
+		nameLen := int(binary.LittleEndian.Uint16(head[off+26:]))
+		extraLen := int(binary.LittleEndian.Uint16(head[off+28:]))
+		compSize := int(binary.LittleEndian.Uint32(head[off+18:]))
+		end := off + 30 + nameLen
+		if end > len(head) {
+			break
+		}
+		name := string(head[off+30 : end])
+		names = append(names, name)
+		data := min(end+extraLen, len(head))
+		if name == "mimetype" && len(names) == 1 && head[off+8] == 0 {
+			// ODF and EPUB store their type uncompressed as the first entry
+			value := head[data:min(data+128, len(head))]
+			if compSize > len(value) {
+				value = nil // cut short by the end of head
+			} else if compSize > 0 {
+				value = value[:compSize]
+			} else if i := bytes.Index(value, []byte("PK")); i >= 0 {
+				value = value[:i] // size is in a descriptor after the data
+			}
+			if t := Normalize(string(leadingMIME(value))); t != "" {
+				return t
+			}
+		}
+		if binary.LittleEndian.Uint16(head[off+6:])&0x08 != 0 {
+			// the sizes follow the data in a descriptor, so look for the next header
+			next := bytes.Index(head[data:], []byte("PK\x03\x04"))
+			if next < 0 {
+				break
+			}
+			off = data + next
+			continue
+		}
+		off = data + compSize
+	}
+	for _, n := range names {
+		switch {
+		case strings.HasPrefix(n, "word/"):
+			return "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+		case strings.HasPrefix(n, "xl/"):
+			return "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"
+		case strings.HasPrefix(n, "ppt/"):
+			return "application/vnd.openxmlformats-officedocument.presentationml.presentation"
+		case n == "META-INF/MANIFEST.MF":
+			return "application/java-archive"
+		case n == "AndroidManifest.xml":
+			return "application/vnd.android.package-archive"
+		}
+	}
+	return "application/zip"
+}
+
+// leadingMIME returns the prefix of b made of characters valid in a MIME type.
+func leadingMIME(b []byte) []byte {
+	for i, c := range b {
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || strings.IndexByte("/.+-_", c) >= 0) {
+			return b[:i]
+		}
+	}
+	return b
+}
+
+func isSVG(head []byte) bool {
+	s := bytes.TrimSpace(head[:min(len(head), 1024)])
+	if !bytes.HasPrefix(s, []byte("<")) {
+		return false
+	}
+	return bytes.Contains(bytes.ToLower(head[:min(len(head), 4096)]), []byte("<svg"))
+}
+
+// Normalize lower-cases a MIME type and drops its parameters. Invalid input
+// yields "".
+func Normalize(t string) string {
+	mt, _, err := mime.ParseMediaType(t)
+	if err != nil || !strings.Contains(mt, "/") {
+		return ""
+	}
+	return mt
+}
@@ -0,0 +1,136 @@
+package mimetype
+
+import (
+	"archive/zip"
+	"bytes"
+	"testing"
+)
+
+// zipOf builds a zip of the named entries. Those in stored are stored with
+// their sizes in the header, like the mimetype entry of ODF files; the others
+// are deflated with a data descriptor, as zip.Writer does.
+func zipOf(t *testing.T, stored map[string]string, names ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, name := range names {
+		var err error
+		if content, ok := stored[name]; ok {
+			w, cerr := zw.CreateRaw(&zip.FileHeader{
+				Name: name, Method: zip.Store,
+				CompressedSize64: uint64(len(content)), UncompressedSize64: uint64(len(content)),
+			})
+			if cerr != nil {
+				t.Fatal(cerr)
+			}
+			_, err = w.Write([]byte(content))
+		} else {
+			w, cerr := zw.Create(name)
+			if cerr != nil {
+				t.Fatal(cerr)
+			}
+			_, err = w.Write([]byte("<xml/>"))
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// ftyp is the start of an ISOBMFF file with major brand brand.
+func ftyp(brand string) []byte {
+	return append([]byte("\x00\x00\x00\x18ftyp"+brand), "\x00\x00\x02\x00isomiso2"...)
+}
+
+func TestDetect(t *testing.T) {
+	docx := zipOf(t, nil, "[Content_Types].xml", "_rels/.rels", "word/document.xml")
+	odt := zipOf(t, map[string]string{"mimetype": "application/vnd.oasis.opendocument.text"}, "mimetype", "content.xml")
+	// with a descriptor after the stored value the header has no size
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateHeader(&zip.FileHeader{Name: "mimetype", Method: zip.Store})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("application/vnd.oasis.opendocument.spreadsheet"))
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	odsDescriptor := buf.Bytes()
+	epub := zipOf(t, map[string]string{"mimetype": "application/epub+zip"}, "mimetype", "META-INF/container.xml")
+	tarball := make([]byte, 512)
+	copy(tarball[257:], "ustar\x0000")
+	for _, c := range []struct {
+		name string
+		head []byte
+		want string
+	}{
+		{"pdf", []byte("%PDF-1.7\n"), "application/pdf"},
+		{"png", []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0dIHDR"), "image/png"},
+		{"jpeg", []byte("\xff\xd8\xff\xe0\x00\x10JFIF"), "image/jpeg"},
+		{"gzip", []byte("\x1f\x8b\x08\x00"), "application/gzip"},
+		{"tar", tarball, "application/x-tar"},
+		{"ole", []byte("\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1\x00"), "application/x-ole-storage"},
+		{"elf", []byte("\x7fELF\x02\x01\x01"), "application/x-elf"},
+		{"webp", []byte("RIFF\x24\x00\x00\x00WEBPVP8 "), "image/webp"},
+		{"wav", []byte("RIFF\x24\x00\x00\x00WAVEfmt "), "audio/wav"},
+		{"truncated riff", []byte("RIFF"), "text/plain"},
+		{"webm", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x84webm"), "video/webm"},
+		{"matroska", []byte("\x1a\x45\xdf\xa3\x9f\x42\x86\x81\x01\x42\x82\x88matroska"), "video/x-matroska"},
+		{"mp3 frame", []byte("\xff\xfb\x90\x64\x00"), "audio/mpeg"},
+		{"svg", []byte(`<?xml version="1.0"?>` + "\n" + `<svg xmlns="http://www.w3.org/2000/svg"/>`), "image/svg+xml"},
+		{"html", []byte("<!DOCTYPE html><html><body>"), "text/html"},
+		{"text", []byte("a,b\n1,2\n"), "text/plain"},
+		{"empty", nil, "text/plain"},
+		{"binary", []byte{0, 1, 2, 3, 4, 5}, Generic},
+
+		{"mp4", ftyp("isom"), "video/mp4"},
+		{"quicktime", ftyp("qt  "), "video/quicktime"},
+		{"m4a", ftyp("M4A "), "audio/mp4"},
+		{"heic", ftyp("heic"), "image/heic"},
+		{"heif", ftyp("mif1"), "image/heic"},
+		{"avif", ftyp("avif"), "image/avif"},
+		{"3gp", ftyp("3gp5"), "video/3gpp"},
+		{"unknown brand", ftyp("abcd"), "video/mp4"},
+		{"truncated ftyp", []byte("\x00\x00\x00\x18ftyp"), Generic},
+
+		{"docx", docx, "application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		{"xlsx", zipOf(t, nil, "[Content_Types].xml", "xl/workbook.xml"), "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		{"pptx", zipOf(t, nil, "[Content_Types].xml", "ppt/presentation.xml"), "application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		{"jar", zipOf(t, nil, "META-INF/MANIFEST.MF", "a/B.class"), "application/java-archive"},
+		{"apk", zipOf(t, nil, "AndroidManifest.xml", "classes.dex"), "application/vnd.android.package-archive"},
+		{"odt", odt, "application/vnd.oasis.opendocument.text"},
+		{"epub", epub, "application/epub+zip"},
+		{"plain zip", zipOf(t, nil, "a.txt", "b/c.txt"), "application/zip"},
+		{"zip signature only", []byte("PK\x03\x04"), "application/zip"},
+		{"zip header cut short", docx[:20], "application/zip"},
+		{"zip name cut short", docx[:35], "application/zip"},
+		// the entry naming the format is beyond head
+		{"docx cut before word/", docx[:bytes.Index(docx, []byte("word/"))], "application/zip"},
+		{"ods with a descriptor", odsDescriptor, "application/vnd.oasis.opendocument.spreadsheet"},
+		// a value cut short would name some other type
+		{"odt cut in the value", odt[:bytes.Index(odt, []byte("opendocument"))], "application/zip"},
+	} {
+		if got := Detect(c.head); got != c.want {
+			t.Errorf("%s: Detect = %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestNormalize(t *testing.T) {
+	for _, c := range []struct{ in, want string }{
+		{"image/png", "image/png"},
+		{"Text/HTML; charset=utf-8", "text/html"},
+		{"", ""},
+		{"png", ""},
+		{"image/png; =", ""},
+	} {
+		if got := Normalize(c.in); got != c.want {
+			t.Errorf("Normalize(%q) = %q, want %q", c.in, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package mimetype
+
+import (
+	"fmt"
+	"path"
+	"slices"
+	"strings"
+)
+
+// What to do with a file whose declared type disagrees with its content.
+const (
+	MismatchFlag   = "flag"
+	MismatchReject = "reject"
+)
+
+// Policy decides which uploads are accepted. Allow and Deny hold types or
+// patterns such as "image/*"; an empty Allow accepts every type not denied.
+type Policy struct {
+	Allow      []string
+	Deny       []string
+	OnMismatch string
+}
+
+// Reasons a Policy refuses a file, as Verdict.Code.
+const (
+	CodeDenied     = "type_denied"
+	CodeNotAllowed = "type_not_allowed"
+	CodeMismatch   = "type_mismatch"
+)
+
+// Verdict is the outcome of checking one file against a Policy.
+type Verdict struct {
+	Declared string
+	Detected string
+	// Mismatch is set when Declared is not a plausible label for the content.
+	Mismatch bool
+	// Code and Reason explain a rejection; they are empty when the file is accepted.
+	Code   string
+	Reason string
+}
+
+func (v Verdict) Rejected() bool { return v.Reason != "" }
+
+// ContentType is the type to treat the file as: the declared type when it
+// agrees with the content (it is usually more specific), the detected one
+// otherwise.
+func (v Verdict) ContentType() string {
+	if v.Declared != "" && v.Declared != Generic && !v.Mismatch {
+		return v.Declared
+	}
+	if v.Detected != "" {
+		return v.Detected
+	}
+	return Generic
+}
+
+// Check applies p to a file declared as declared whose content was detected
+// as detected. A type is refused when either the declared or the detected
+// type is denied; the allowlist is checked against the detected type unless
+// the content was not recognised.
+func (p Policy) Check(declared, detected string) Verdict {
+	v := Verdict{Declared: Normalize(declared), Detected: Normalize(detected)}
+	v.Mismatch = !Compatible(v.Declared, v.Detected)
+	for _, t := range []string{v.Detected, v.Declared} {
+		if t != "" && listed(p.Deny, t) {
+			v.Code, v.Reason = CodeDenied, fmt.Sprintf("type %s is not allowed", t)
+			return v
+		}
+	}
+	effective := v.Detected
+	if effective == "" || effective == Generic {
+		effective = v.Declared
+	}
+	if effective == "" {
+		effective = Generic
+	}
+	if len(p.Allow) > 0 && !listed(p.Allow, effective) {
+		v.Code, v.Reason = CodeNotAllowed, fmt.Sprintf("type %s is not in the allowed list", effective)
+		return v
+	}
+	if v.Mismatch && p.OnMismatch == MismatchReject {
+		v.Code, v.Reason = CodeMismatch, fmt.Sprintf("declared type %s does not match detected type %s", v.Declared, v.Detected)
+	}
+	return v
+}
+
+// Match reports whether t matches pattern: an exact type or a pattern where
+// "*" stands for any run of characters other than "/", as in "image/*" or
+// "application/*+xml".
+func Match(pattern, t string) bool {
+	ok, _ := path.Match(pattern, t)
+	return ok
+}
+
+func matchAny(patterns []string, t string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool { return Match(p, t) })
+}
+
+// listed is matchAny ignoring alternative spellings, so that listing
+// application/x-msdownload also covers detected Windows executables.
+func listed(patterns []string, t string) bool {
+	return slices.ContainsFunc(patterns, func(p string) bool { return Match(p, t) || Match(canonical(p), canonical(t)) })
+}
+
+// ValidPattern reports whether s is usable in an allow or deny list.
+func ValidPattern(s string) bool {
+	major, minor, ok := strings.Cut(s, "/")
+	if !ok || major == "" || minor == "" || strings.ContainsAny(s, " ;,[]\\?") {
+		return false
+	}
+	_, err := path.Match(s, "")
+	return err == nil
+}
+
+// aliases maps non-standard spellings to the types Detect reports.
+var aliases = map[string]string{
+	"image/jpg":                    "image/jpeg",
+	"image/pjpeg":                  "image/jpeg",
+	"image/x-png":                  "image/png",
+	"image/x-ms-bmp":               "image/bmp",
+	"image/vnd.microsoft.icon":     "image/x-icon",
+	"audio/x-wav":                  "audio/wav",
+	"audio/wave":                   "audio/wav",
+	"audio/vnd.wave":               "audio/wav",
+	"audio/mp3":                    "audio/mpeg",
+	"audio/x-flac":                 "audio/flac",
+	"audio/x-m4a":                  "audio/mp4",
+	"audio/x-midi":                 "audio/midi",
+	"video/avi":                    "video/x-msvideo",
+	"video/msvideo":                "video/x-msvideo",
+	"application/x-pdf":            "application/pdf",
+	"application/x-zip-compressed": "application/zip",
+	"application/x-gzip":           "application/gzip",
+	"application/x-rar-compressed": "application/vnd.rar",
+	"application/x-rar":            "application/vnd.rar",
+	"application/x-gtar":           "application/x-tar",
+	"application/x-ustar":          "application/x-tar",
+	"application/x-zstd":           "application/zstd",
+	"application/x-msdownload":     "application/vnd.microsoft.portable-executable",
+	"application/x-dosexec":        "application/vnd.microsoft.portable-executable",
+	"application/x-msdos-program":  "application/vnd.microsoft.portable-executable",
+	"application/x-executable":     "application/x-elf",
+	"application/x-sharedlib":      "application/x-elf",
+	"application/x-sqlite3":        "application/vnd.sqlite3",
+}
+
+// carriers lists, for detected container formats, the declared types whose
+// content legitimately looks like that container.
+var carriers = map[string][]string{
+	"application/zip": {
+		"application/vnd.openxmlformats-officedocument.*", "application/vnd.oasis.opendocument.*",
+		"application/epub+zip", "application/java-archive", "application/vnd.android.package-archive",
+		"application/vnd.ms-xpsdocument", "application/x-xpinstall", "model/vnd.usdz+zip",
+	},
+	"application/x-ole-storage": {
+		"application/msword", "application/vnd.ms-excel", "application/vnd.ms-powerpoint",
+		"application/vnd.ms-outlook", "application/vnd.visio", "application/x-msi",
+	},
+	"application/ogg":  {"audio/ogg", "video/ogg", "audio/opus", "audio/vorbis"},
+	"video/mp4":        {"audio/mp4", "video/x-m4v", "video/quicktime"},
+	"video/quicktime":  {"video/mp4"},
+	"video/webm":       {"audio/webm"},
+	"video/x-matroska": {"audio/x-matroska", "video/webm", "audio/webm"},
+	"image/heic":       {"image/heif", "image/heic-sequence", "image/heif-sequence"},
+	"application/gzip": {"application/x-compressed-tar", "application/x-tgz"},
+	"text/xml":         {"application/xml", "application/*+xml", "image/svg+xml"},
+	"image/svg+xml":    {"text/xml", "application/xml"},
+}
+
+// textual lists non-text/* types that are plain text.
+var textual = []string{
+	"application/json", "application/*+json", "application/xml", "application/*+xml", "application/javascript",
+	"application/ecmascript", "application/x-yaml", "application/yaml", "application/toml", "application/sql",
+	"application/x-sh", "application/x-httpd-php", "application/x-tex", "application/x-ndjson", "application/graphql",
+	"image/svg+xml",
+}
+
+// Compatible reports whether declared is a plausible label for content
+// detected as detected. Unknown or missing types are compatible with anything.
+func Compatible(declared, detected string) bool {
+	if declared == "" || declared == Generic || detected == "" || detected == Generic {
+		return true
+	}
+	declared, detected = canonical(declared), canonical(detected)
+	if declared == detected || matchAny(carriers[detected], declared) {
+		return true
+	}
+	// text can be labelled with any text type: Detect cannot tell CSV from
+	// Markdown, and a declared text/plain is never more dangerous than HTML
+	if isText(detected) && isText(declared) {
+		return true
+	}
+	return false
+}
+
+func canonical(t string) string {
+	if a, ok := aliases[t]; ok {
+		return a
+	}
+	return t
+}
+
+func isText(t string) bool { return strings.HasPrefix(t, "text/") || matchAny(textual, t) }
@@ -0,0 +1,101 @@
+package mimetype
+
+import "testing"
+
+const docx = "application/vnd.openxmlformats-officedocument.wordprocessingml.document"
+
+func TestCompatible(t *testing.T) {
+	for _, c := range []struct {
+		declared, detected string
+		want               bool
+	}{
+		{"image/png", "image/png", true},
+		{"", "image/png", true},
+		{Generic, "image/png", true},
+		{"image/png", "", true},
+		{"image/png", Generic, true},
+		{"image/png", "image/jpeg", false},
+		{"application/pdf", "application/zip", false},
+		{"text/html", "image/png", false},
+		// aliases
+		{"image/jpg", "image/jpeg", true},
+		{"audio/x-wav", "audio/wav", true},
+		{"application/x-zip-compressed", "application/zip", true},
+		{"application/x-msdownload", "application/vnd.microsoft.portable-executable", true},
+		{"image/jpg", "image/png", false},
+		// formats carried in a container
+		{docx, "application/zip", true},
+		{"application/vnd.oasis.opendocument.text", "application/zip", true},
+		{"application/epub+zip", "application/zip", true},
+		{"application/msword", "application/x-ole-storage", true},
+		{"audio/ogg", "application/ogg", true},
+		{"audio/mp4", "video/mp4", true},
+		{"application/atom+xml", "text/xml", true},
+		{"image/svg+xml", "text/xml", true},
+		{"application/xml", "image/svg+xml", true},
+		// but not the other way round, nor across containers
+		{"application/zip", docx, false},
+		{"application/x-ole-storage", "application/msword", false},
+		{"application/msword", "application/zip", false},
+		{"audio/ogg", "video/mp4", false},
+		// text types stand in for each other
+		{"text/csv", "text/plain", true},
+		{"text/markdown", "text/html", true},
+		{"application/json", "text/plain", true},
+		{"application/ld+json", "text/plain", true},
+		{"text/plain", "image/png", false},
+	} {
+		if got := Compatible(c.declared, c.detected); got != c.want {
+			t.Errorf("Compatible(%q, %q) = %v, want %v", c.declared, c.detected, got, c.want)
+		}
+	}
+}
+
+func TestPolicyCheck(t *testing.T) {
+	for _, c := range []struct {
+		name               string
+		policy             Policy
+		declared, detected string
+		code               string
+		mismatch           bool
+	}{
+		{"no lists", Policy{}, "image/png", "image/png", "", false},
+		{"deny on detected", Policy{Deny: []string{"application/x-elf"}}, "text/plain", "application/x-elf", CodeDenied, true},
+		{"deny on declared", Policy{Deny: []string{"text/html"}}, "text/html", "text/plain", CodeDenied, false},
+		{"deny a pattern", Policy{Deny: []string{"video/*"}}, "", "video/mp4", CodeDenied, false},
+		{"deny an alias", Policy{Deny: []string{"application/x-msdownload"}}, Generic, "application/vnd.microsoft.portable-executable", CodeDenied, false},
+		{"deny a declared alias", Policy{Deny: []string{"application/vnd.microsoft.portable-executable"}}, "application/x-dosexec", Generic, CodeDenied, false},
+		{"deny ignores parameters", Policy{Deny: []string{"text/html"}}, "Text/HTML; charset=utf-8", "text/plain", CodeDenied, false},
+		{"deny before allow", Policy{Allow: []string{"image/*"}, Deny: []string{"image/svg+xml"}}, "image/svg+xml", "image/svg+xml", CodeDenied, false},
+		{"allow on detected", Policy{Allow: []string{"image/*"}}, Generic, "image/png", "", false},
+		{"allow not on declared", Policy{Allow: []string{"image/*"}}, "image/png", "application/pdf", CodeNotAllowed, true},
+		{"allow on declared when not recognised", Policy{Allow: []string{"image/*"}}, "image/png", Generic, "", false},
+		{"allow nothing known", Policy{Allow: []string{"image/*"}}, "", "", CodeNotAllowed, false},
+		{"allow a carried format", Policy{Allow: []string{"application/zip"}}, docx, "application/zip", "", false},
+		{"mismatch flagged", Policy{OnMismatch: MismatchFlag}, "image/png", "application/pdf", "", true},
+		{"mismatch rejected", Policy{OnMismatch: MismatchReject}, "image/png", "application/pdf", CodeMismatch, true},
+		{"alias is no mismatch", Policy{OnMismatch: MismatchReject}, "image/jpg", "image/jpeg", "", false},
+		{"carrier is no mismatch", Policy{OnMismatch: MismatchReject}, docx, "application/zip", "", false},
+	} {
+		v := c.policy.Check(c.declared, c.detected)
+		if v.Code != c.code || v.Mismatch != c.mismatch || v.Rejected() != (c.code != "") {
+			t.Errorf("%s: Check(%q, %q) = %+v; want code %q, mismatch %v", c.name, c.declared, c.detected, v, c.code, c.mismatch)
+		}
+	}
+}
+
+func TestVerdictContentType(t *testing.T) {
+	for _, c := range []struct {
+		v    Verdict
+		want string
+	}{
+		{Verdict{Declared: "text/csv", Detected: "text/plain"}, "text/csv"},
+		{Verdict{Declared: "image/png", Detected: "application/pdf", Mismatch: true}, "application/pdf"},
+		{Verdict{Declared: Generic, Detected: "image/png"}, "image/png"},
+		{Verdict{}, Generic},
+	} {
+		if got := c.v.ContentType(); got != c.want {
+			t.Errorf("%+v: ContentType = %q, want %q", c.v, got, c.want)
+		}
+	}
+}
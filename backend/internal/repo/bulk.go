@@ -0,0 +1,330 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// Bulk actions. BulkTrash moves files to the trash; BulkDelete deletes them
+// for good, from the trash too, releasing their blob references.
+const (
+	BulkTrash      = "trash"
+	BulkDelete     = "delete"
+	BulkSetPublic  = "set_public"
+	BulkAddTags    = "add_tags"
+	BulkRemoveTags = "remove_tags"
+	BulkMove       = "move"
+)
+
+// Outcomes of a bulk action for one file.
+const (
+	BulkDone     = "done"
+	BulkNotFound = "not_found"
+)
+
+// Bulk job states.
+const (
+	JobQueued  = "queued"
+	JobRunning = "running"
+	JobDone    = "done"
+	JobFailed  = "failed"
+)
+
+// BulkOp is an action on many files with its parameters, which are stored
+// with jobs as JSON.
+type BulkOp struct {
+	Action   string   `json:"-"`
+	IsPublic bool     `json:"isPublic,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	// FolderID is where BulkMove moves files, nil for the root folder.
+	FolderID *string `json:"folderId,omitempty"`
+}
+
+// Validate checks op and cleans its tags.
+func (op *BulkOp) Validate() error {
+	switch op.Action {
+	case BulkTrash, BulkDelete, BulkSetPublic, BulkMove:
+	case BulkAddTags, BulkRemoveTags:
+		tags, err := CleanTags(op.Tags)
+		if err != nil {
+			return err
+		}
+		if len(tags) == 0 {
+			return errors.New("no tags given")
+		}
+		op.Tags = tags
+	default:
+		return fmt.Errorf("unknown bulk action %q", op.Action)
+	}
+	return nil
+}
+
+// BulkSelection selects the files of a bulk operation: FileIDs, or with
+// Filters the files outside the trash that match them.
+type BulkSelection struct {
+	FileIDs []string
+	Filters *FileFilters
+}
+
+// BulkItem is the outcome of a bulk operation for one file, BulkDone or
+// BulkNotFound.
+type BulkItem struct {
+	FileID string
+	Status string
+}
+
+// BulkJob is a bulk operation run in the background over FileIDs, of which
+// the first Processed are done: Succeeded of them were changed and the
+// others, listed in NotFound, were gone.
+type BulkJob struct {
+	ID         string
+	OwnerID    string
+	Op         BulkOp
+	FileIDs    []string
+	Status     string
+	Processed  int
+	Succeeded  int
+	NotFound   []string
+	Error      *string
+	CreatedAt  time.Time
+	StartedAt  *time.Time
+	FinishedAt *time.Time
+}
+
+// params comes before action so that scanning it does not clear Op.Action.
+const bulkJobColumns = "id, owner_id, params, action, file_ids, status, processed, succeeded, not_found, error, created_at, started_at, finished_at"
+
+func (j *BulkJob) scanDest() []any {
+	return []any{&j.ID, &j.OwnerID, &j.Op, &j.Op.Action, &j.FileIDs, &j.Status, &j.Processed, &j.Succeeded, &j.NotFound, &j.Error, &j.CreatedAt, &j.StartedAt, &j.FinishedAt}
+}
+
+// Bulk applies op to the owner's selected files in one transaction and
+// returns the outcome for each. When more than syncLimit files are selected
+// it queues a job for them instead and returns that.
+func (r *Repository) Bulk(ctx context.Context, ownerID string, op BulkOp, sel BulkSelection, syncLimit int) ([]BulkItem, *BulkJob, error) {
+	if err := op.Validate(); err != nil {
+		return nil, nil, err
+	}
+	ids := make([]string, 0, len(sel.FileIDs))
+	seen := map[string]bool{}
+	for _, id := range sel.FileIDs {
+		if !uuidRe.MatchString(id) {
+			return nil, nil, fmt.Errorf("invalid file id %q", id)
+		}
+		// ids come back from the database in lower case
+		id = strings.ToLower(id)
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	var items []BulkItem
+	var job *BulkJob
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		var err error
+		if sel.Filters != nil {
+			if ids, err = tx.selectFileIDs(ctx, ownerID, *sel.Filters); err != nil {
+				return err
+			}
+		}
+		if len(ids) > syncLimit {
+			j := BulkJob{}
+			job = &j
+			return tx.DB.QueryRow(ctx, `
+                INSERT INTO bulk_jobs (owner_id, action, params, file_ids) VALUES ($1,$2,$3,$4::uuid[])
+                RETURNING `+bulkJobColumns, ownerID, op.Action, op, ids).Scan(j.scanDest()...)
+		}
+		items, err = tx.applyBulk(ctx, ownerID, op, ids)
+		return err
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	return items, job, nil
+}
+
+// selectFileIDs returns the ids of the owner's files outside the trash that
+// match filters, oldest first.
+func (r *Repository) selectFileIDs(ctx context.Context, ownerID string, filters FileFilters) ([]string, error) {
+	conds, args, err := filters.conditions(2)
+	if err != nil {
+		return nil, err
+	}
+	where := append([]string{"owner_id = $1", "deleted_at IS NULL"}, conds...)
+	rows, err := r.DB.Query(ctx, "SELECT id FROM files WHERE "+strings.Join(where, " AND ")+" ORDER BY created_at, id", append([]any{ownerID}, args...)...)
+	if err != nil {
+		return nil, err
+	}
+	return scanIDs(rows)
+}
+
+// applyBulk applies op to the owner's files ids. Files in the trash are only
+// found by BulkDelete.
+func (r *Repository) applyBulk(ctx context.Context, ownerID string, op BulkOp, ids []string) ([]BulkItem, error) {
+	var done []string
+	if op.Action == BulkDelete {
+		rows, err := r.DB.Query(ctx, `SELECT id FROM files WHERE id = ANY($1::uuid[]) AND owner_id=$2 FOR UPDATE`, ids, ownerID)
+		if err != nil {
+			return nil, err
+		}
+		if done, err = scanIDs(rows); err != nil {
+			return nil, err
+		}
+		if len(done) > 0 {
+			if _, err := r.purgeFiles(ctx, `f.id = ANY($1::uuid[]) AND f.owner_id=$2`, done, ownerID); err != nil {
+				return nil, err
+			}
+		}
+	} else {
+		args := []any{ids, ownerID}
+		var set string
+		switch op.Action {
+		case BulkTrash:
+			set = "deleted_at = now()"
+		case BulkSetPublic:
+			set, args = "is_public = $3", append(args, op.IsPublic)
+		case BulkAddTags:
+			set, args = "tags = "+addTagsSQL, append(args, op.Tags)
+		case BulkRemoveTags:
+			set, args = "tags = "+removeTagsSQL, append(args, op.Tags)
+		case BulkMove:
+			if op.FolderID != nil {
+				if _, err := r.GetFolder(ctx, ownerID, *op.FolderID); err != nil {
+					return nil, err
+				}
+			}
+			set, args = "folder_id = $3", append(args, op.FolderID)
+		}
+		rows, err := r.DB.Query(ctx, `
+            UPDATE files SET `+set+`
+            WHERE id = ANY($1::uuid[]) AND owner_id=$2 AND deleted_at IS NULL
+            RETURNING id`, args...)
+		if err != nil {
+			return nil, err
+		}
+		if done, err = scanIDs(rows); err != nil {
+			return nil, err
+		}
+	}
+	found := map[string]bool{}
+	for _, id := range done {
+		found[id] = true
+	}
+	items := make([]BulkItem, len(ids))
+	for i, id := range ids {
+		items[i] = BulkItem{FileID: id, Status: BulkNotFound}
+		if found[id] {
+			items[i].Status = BulkDone
+		}
+	}
+	return items, nil
+}
+
+func scanIDs(rows pgx.Rows) ([]string, error) {
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
+	}
+	return out, rows.Err()
+}
+
+// ClaimBulkJob leases the oldest queued job, or running job whose lease ran
+// out, for lease. It returns pgx.ErrNoRows when there is none.
+func (r *Repository) ClaimBulkJob(ctx context.Context, lease time.Duration) (BulkJob, error) {
+	var j BulkJob
+	err := r.DB.QueryRow(ctx, `
+        UPDATE bulk_jobs SET status='running', started_at=COALESCE(started_at, now()), lease_until=now() + $1::interval
+        WHERE id = (
+            SELECT id FROM bulk_jobs
+            WHERE status IN ('queued', 'running') AND (lease_until IS NULL OR lease_until < now())
+            ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+        RETURNING `+bulkJobColumns, lease).Scan(j.scanDest()...)
+	return j, err
+}
+
+// RunBulkBatch applies the operation of job to its next batchSize files and
+// records the progress, renewing the lease, in one transaction. It returns
+// the job as updated, done once every file was processed.
+func (r *Repository) RunBulkBatch(ctx context.Context, job BulkJob, batchSize int, lease time.Duration) (BulkJob, error) {
+	var out BulkJob
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		var processed int
+		if err := tx.DB.QueryRow(ctx, `SELECT processed FROM bulk_jobs WHERE id=$1 FOR UPDATE`, job.ID).Scan(&processed); err != nil {
+			return err
+		}
+		ids := job.FileIDs[min(processed, len(job.FileIDs)):min(processed+batchSize, len(job.FileIDs))]
+		op := job.Op
+		if err := op.Validate(); err != nil {
+			return err
+		}
+		items, err := tx.applyBulk(ctx, job.OwnerID, op, ids)
+		if err != nil {
+			return err
+		}
+		notFound := []string{}
+		for _, it := range items {
+			if it.Status == BulkNotFound {
+				notFound = append(notFound, it.FileID)
+			}
+		}
+		return tx.DB.QueryRow(ctx, `
+            UPDATE bulk_jobs SET processed = processed + $2, succeeded = succeeded + $3, not_found = not_found || $4::uuid[],
+                status = CASE WHEN processed + $2 >= cardinality(file_ids) THEN 'done' ELSE status END,
+                finished_at = CASE WHEN processed + $2 >= cardinality(file_ids) THEN now() END,
+                lease_until = now() + $5::interval
+            WHERE id=$1
+            RETURNING `+bulkJobColumns, job.ID, len(ids), len(ids)-len(notFound), notFound, lease).Scan(out.scanDest()...)
+	})
+	return out, err
+}
+
+// FailBulkJob stops a job, recording why. Batches already run stay applied.
+func (r *Repository) FailBulkJob(ctx context.Context, id, reason string) error {
+	_, err := r.DB.Exec(ctx, `UPDATE bulk_jobs SET status='failed', error=$2, finished_at=now(), lease_until=NULL WHERE id=$1`, id, reason)
+	return err
+}
+
+// GetBulkJob returns the owner's job id, or pgx.ErrNoRows.
+func (r *Repository) GetBulkJob(ctx context.Context, ownerID, id string) (BulkJob, error) {
+	var j BulkJob
+	err := r.DB.QueryRow(ctx, `SELECT `+bulkJobColumns+` FROM bulk_jobs WHERE id=$1 AND owner_id=$2`, id, ownerID).Scan(j.scanDest()...)
+	return j, err
+}
+
+// ListBulkJobs returns the owner's jobs, newest first.
+func (r *Repository) ListBulkJobs(ctx context.Context, ownerID string, limit int) ([]BulkJob, error) {
+	rows, err := r.DB.Query(ctx, `SELECT `+bulkJobColumns+` FROM bulk_jobs WHERE owner_id=$1 ORDER BY created_at DESC, id LIMIT $2`, ownerID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BulkJob
+	for rows.Next() {
+		var j BulkJob
+		if err := rows.Scan(j.scanDest()...); err != nil {
+			return nil, err
+		}
+		out = append(out, j)
+	}
+	return out, rows.Err()
+}
+
+// DeleteFinishedBulkJobs deletes jobs that finished more than retention ago
+// and returns how many it deleted.
+func (r *Repository) DeleteFinishedBulkJobs(ctx context.Context, retention time.Duration) (int64, error) {
+	cmd, err := r.DB.Exec(ctx, `DELETE FROM bulk_jobs WHERE finished_at < now() - $1::interval`, retention)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
@@ -0,0 +1,94 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrTooManyChallenges is returned by CreateUploadChallenge when the user has
+// too many unanswered challenges.
+var ErrTooManyChallenges = errors.New("too many outstanding upload challenges")
+
+// maxOpenChallenges bounds the unexpired challenges one user may hold.
+const maxOpenChallenges = 100
+
+// UploadChallenge asks the client to prove it holds the content of BlobHash
+// by hashing Nonce and the byte ranges given by RangeOffsets/RangeLengths.
+type UploadChallenge struct {
+	ID           string
+	UserID       string
+	BlobHash     string
+	SizeBytes    int64
+	Filename     string
+	MIMEType     *string
+	Tags         []string
+	Nonce        []byte
+	RangeOffsets []int64
+	RangeLengths []int64
+	CreatedAt    time.Time
+	ExpiresAt    time.Time
+}
+
+// CreateUploadChallenge stores c (ID and CreatedAt are assigned) valid for ttl.
+// The user's expired challenges are removed on the way.
+func (r *Repository) CreateUploadChallenge(ctx context.Context, c UploadChallenge, ttl time.Duration) (UploadChallenge, error) {
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM upload_challenges WHERE user_id=$1 AND expires_at <= now()`, c.UserID); err != nil {
+			return err
+		}
+		var open int
+		if err := tx.DB.QueryRow(ctx, `SELECT COUNT(*) FROM upload_challenges WHERE user_id=$1`, c.UserID).Scan(&open); err != nil {
+			return err
+		}
+		if open >= maxOpenChallenges {
+			return ErrTooManyChallenges
+		}
+		return tx.DB.QueryRow(ctx, `
+            INSERT INTO upload_challenges (user_id, blob_hash, size_bytes, filename, mime_type, tags, nonce, range_offsets, range_lengths, expires_at)
+            VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9, now() + $10::interval)
+            RETURNING id, created_at, expires_at`,
+			c.UserID, c.BlobHash, c.SizeBytes, c.Filename, c.MIMEType, c.Tags, c.Nonce, c.RangeOffsets, c.RangeLengths, ttl).Scan(&c.ID, &c.CreatedAt, &c.ExpiresAt)
+	})
+	return c, err
+}
+
+// TakeUploadChallenge removes and returns the user's unexpired challenge id,
+// so that every challenge can be answered once. pgx.ErrNoRows is returned
+// when there is none.
+func (r *Repository) TakeUploadChallenge(ctx context.Context, userID, id string) (UploadChallenge, error) {
+	var c UploadChallenge
+	err := r.DB.QueryRow(ctx, `
+        DELETE FROM upload_challenges WHERE id=$1 AND user_id=$2 AND expires_at > now()
+        RETURNING id, user_id, blob_hash, size_bytes, filename, mime_type, tags, nonce, range_offsets, range_lengths, created_at, expires_at`,
+		id, userID).Scan(&c.ID, &c.UserID, &c.BlobHash, &c.SizeBytes, &c.Filename, &c.MIMEType, &c.Tags, &c.Nonce, &c.RangeOffsets, &c.RangeLengths, &c.CreatedAt, &c.ExpiresAt)
+	return c, err
+}
+
+// GetServableBlob returns a blob that is not quarantined; pgx.ErrNoRows otherwise.
+func (r *Repository) GetServableBlob(ctx context.Context, hash string) (Blob, error) {
+	var b Blob
+	err := r.DB.QueryRow(ctx, `SELECT hash, size_bytes, mime_type FROM blobs WHERE hash=$1 AND quarantined_at IS NULL`, hash).Scan(&b.Hash, &b.SizeBytes, &b.MIMEType)
+	return b, err
+}
+
+// UserHasBlob reports whether the user owns a file with the given content.
+func (r *Repository) UserHasBlob(ctx context.Context, userID, hash string) (bool, error) {
+	var ok bool
+	err := r.DB.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE owner_id=$1 AND blob_hash=$2)`, userID, hash).Scan(&ok)
+	return ok, err
+}
+
+// CreateFileRef creates f for an already stored blob and takes a reference on
+// the blob in the same transaction.
+func (r *Repository) CreateFileRef(ctx context.Context, f File) (File, error) {
+	var out File
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		var err error
+		if out, err = tx.CreateFile(ctx, f); err != nil {
+			return err
+		}
+		return tx.IncBlobRef(ctx, f.BlobHash, 1)
+	})
+	return out, err
+}
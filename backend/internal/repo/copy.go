@@ -0,0 +1,130 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrContentUnavailable is returned when copying a file whose blob the
+// integrity scrubber quarantined.
+var ErrContentUnavailable = errors.New("file unavailable: stored content failed an integrity check")
+
+// CopySource names a file to copy: FileID, one of the user's files or one
+// shared with them, or else the file behind the public link Token.
+type CopySource struct {
+	FileID string
+	Token  string
+	// Filename names the copy; empty keeps the name of the source.
+	Filename string
+}
+
+// CopyFiles copies srcs into the user's folderID (nil for the root) as new
+// files referencing the same blobs, so no content is stored twice. Copies of
+// the user's own files keep their tags and metadata; copies of other users'
+// files start without. Either all files are copied or, when a source is not
+// found or the copies do not fit the user's quota (their override or
+// defaultQuota), none is.
+func (r *Repository) CopyFiles(ctx context.Context, userID string, srcs []CopySource, folderID *string, defaultQuota int64) ([]File, error) {
+	out := make([]File, 0, len(srcs))
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if folderID != nil {
+			if _, err := tx.GetFolder(ctx, userID, *folderID); err != nil {
+				return err
+			}
+		}
+		// serialized with ReserveQuota, so that uploads in flight cannot
+		// claim the same space
+		if _, err := tx.DB.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('quota:' || $1::text))`, userID); err != nil {
+			return err
+		}
+		copies := make([]File, len(srcs))
+		var size int64
+		for i, src := range srcs {
+			f, err := tx.copySource(ctx, userID, src)
+			if err != nil {
+				return err
+			}
+			if src.Filename != "" {
+				if f.Filename, err = CleanFolderName(src.Filename); err != nil {
+					return err
+				}
+			}
+			f.OwnerID, f.FolderID, f.IsPublic = userID, folderID, false
+			copies[i] = f
+			size += f.SizeBytes
+		}
+		quota, err := getQuota(ctx, tx.DB, userID, defaultQuota)
+		if err != nil {
+			return err
+		}
+		if !quota.Unlimited() && size > quota.Remaining() {
+			return fmt.Errorf("%w: %d bytes requested, %d left", ErrQuotaExceeded, size, quota.Remaining())
+		}
+		for _, f := range copies {
+			var created File
+			err := tx.DB.QueryRow(ctx, `
+                INSERT INTO files (owner_id, blob_hash, filename, size_bytes, mime_type, tags, detected_mime, mime_mismatch, source_path, modified_at, folder_id, metadata)
+                VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+                RETURNING `+fileColumns(""),
+				f.OwnerID, f.BlobHash, f.Filename, f.SizeBytes, f.MIMEType, f.Tags, f.DetectedMIME, f.MIMEMismatch, f.SourcePath, f.ModifiedAt, f.FolderID, f.Metadata).Scan(created.scanDest()...)
+			if err != nil {
+				return err
+			}
+			if err := tx.IncBlobRef(ctx, f.BlobHash, 1); err != nil {
+				return err
+			}
+			out = append(out, created)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// copySource returns the file src names if userID may copy it, or
+// pgx.ErrNoRows. Tags, metadata and the archive entry of other users' files
+// are cleared.
+func (r *Repository) copySource(ctx context.Context, userID string, src CopySource) (File, error) {
+	var f File
+	var quarantined bool
+	var err error
+	if src.Token != "" {
+		err = r.DB.QueryRow(ctx, `
+            SELECT `+fileColumns("f")+`, b.quarantined_at IS NOT NULL
+            FROM shares s
+            JOIN files f ON f.id = s.file_id
+            JOIN blobs b ON b.hash = f.blob_hash
+            WHERE s.public_token=$1 AND f.deleted_at IS NULL
+            LIMIT 1`, src.Token).Scan(append(f.scanDest(), &quarantined)...)
+	} else {
+		if !uuidRe.MatchString(src.FileID) {
+			return f, fmt.Errorf("invalid file id %q", src.FileID)
+		}
+		err = r.DB.QueryRow(ctx, `
+            SELECT `+fileColumns("f")+`, b.quarantined_at IS NOT NULL
+            FROM files f
+            JOIN blobs b ON b.hash = f.blob_hash
+            WHERE f.id=$2 AND f.deleted_at IS NULL
+              AND (f.owner_id = $1 OR EXISTS (SELECT 1 FROM shares s WHERE s.file_id = f.id AND s.shared_with_user_id = $1))`,
+			userID, src.FileID).Scan(append(f.scanDest(), &quarantined)...)
+	}
+	if err != nil {
+		return f, err
+	}
+	if quarantined {
+		return f, ErrContentUnavailable
+	}
+	if f.OwnerID != userID {
+		f.Tags, f.Metadata, f.SourcePath, f.ModifiedAt = []string{}, map[string]any{}, nil, nil
+	}
+	if f.Tags == nil {
+		f.Tags = []string{}
+	}
+	if f.Metadata == nil {
+		f.Metadata = map[string]any{}
+	}
+	return f, nil
+}
@@ -0,0 +1,231 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+var (
+	ErrFolderExists = errors.New("a folder with that name already exists here")
+	ErrFolderCycle  = errors.New("a folder cannot be moved into itself or its subfolders")
+	ErrInvalidName  = errors.New("folder names must be 1-255 characters without '/' and not '.' or '..'")
+)
+
+// uniqueViolation is the SQLSTATE of a unique constraint violation.
+const uniqueViolation = "23505"
+
+// Folder is a node of a user's folder tree; ParentID is nil at the root.
+type Folder struct {
+	ID        string
+	OwnerID   string
+	ParentID  *string
+	Name      string
+	CreatedAt time.Time
+}
+
+const folderColumns = "id, owner_id, parent_id, name, created_at"
+
+func (f *Folder) scanDest() []any {
+	return []any{&f.ID, &f.OwnerID, &f.ParentID, &f.Name, &f.CreatedAt}
+}
+
+func scanFolders(rows pgx.Rows) ([]Folder, error) {
+	defer rows.Close()
+	var out []Folder
+	for rows.Next() {
+		var f Folder
+		if err := rows.Scan(f.scanDest()...); err != nil {
+			return nil, err
+		}
+		out = append(out, f)
+	}
+	return out, rows.Err()
+}
+
+// CleanFolderName trims name and checks that it is usable as a folder name.
+func CleanFolderName(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if name == "" || name == "." || name == ".." || len(name) > 255 || strings.ContainsAny(name, "/\x00") {
+		return "", ErrInvalidName
+	}
+	return name, nil
+}
+
+// folderErr maps a unique violation on the folder name index to ErrFolderExists.
+func folderErr(err error) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == uniqueViolation {
+		return ErrFolderExists
+	}
+	return err
+}
+
+// CreateFolder creates a folder named name under parentID (nil for the root).
+// pgx.ErrNoRows is returned when the parent is not the owner's.
+func (r *Repository) CreateFolder(ctx context.Context, ownerID string, parentID *string, name string) (Folder, error) {
+	name, err := CleanFolderName(name)
+	if err != nil {
+		return Folder{}, err
+	}
+	var f Folder
+	err = r.DB.QueryRow(ctx, `
+        INSERT INTO folders (owner_id, parent_id, name)
+        SELECT $1, $2, $3
+        WHERE $2::uuid IS NULL OR EXISTS (SELECT 1 FROM folders WHERE id=$2 AND owner_id=$1)
+        RETURNING `+folderColumns, ownerID, parentID, name).Scan(f.scanDest()...)
+	return f, folderErr(err)
+}
+
+// GetFolder returns the owner's folder id, or pgx.ErrNoRows.
+func (r *Repository) GetFolder(ctx context.Context, ownerID, id string) (Folder, error) {
+	var f Folder
+	err := r.DB.QueryRow(ctx, `SELECT `+folderColumns+` FROM folders WHERE id=$1 AND owner_id=$2`, id, ownerID).Scan(f.scanDest()...)
+	return f, err
+}
+
+// ListFolders returns the subfolders of parentID (nil for the root) by name.
+func (r *Repository) ListFolders(ctx context.Context, ownerID string, parentID *string) ([]Folder, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+folderColumns+` FROM folders
+        WHERE owner_id=$1 AND parent_id IS NOT DISTINCT FROM $2::uuid
+        ORDER BY name`, ownerID, parentID)
+	if err != nil {
+		return nil, err
+	}
+	return scanFolders(rows)
+}
+
+// ListFilesInFolder returns the files directly in folderID (nil for the root)
+// by name.
+func (r *Repository) ListFilesInFolder(ctx context.Context, ownerID string, folderID *string, limit, offset int) ([]File, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+fileColumns("")+` FROM files
+        WHERE owner_id=$1 AND folder_id IS NOT DISTINCT FROM $2::uuid AND deleted_at IS NULL
+        ORDER BY filename, created_at LIMIT $3 OFFSET $4`, ownerID, folderID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// FolderPath returns the folders from the root down to id, for breadcrumbs.
+func (r *Repository) FolderPath(ctx context.Context, ownerID, id string) ([]Folder, error) {
+	rows, err := r.DB.Query(ctx, `
+        WITH RECURSIVE path AS (
+            SELECT `+folderColumns+`, 0 AS depth FROM folders WHERE id=$1 AND owner_id=$2
+            UNION ALL
+            SELECT f.id, f.owner_id, f.parent_id, f.name, f.created_at, p.depth + 1
+            FROM folders f JOIN path p ON f.id = p.parent_id
+        )
+        SELECT `+folderColumns+` FROM path ORDER BY depth DESC`, id, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	path, err := scanFolders(rows)
+	if err == nil && len(path) == 0 {
+		err = pgx.ErrNoRows
+	}
+	return path, err
+}
+
+// RenameFolder renames the owner's folder id.
+func (r *Repository) RenameFolder(ctx context.Context, ownerID, id, name string) error {
+	name, err := CleanFolderName(name)
+	if err != nil {
+		return err
+	}
+	cmd, err := r.DB.Exec(ctx, `UPDATE folders SET name=$3 WHERE id=$1 AND owner_id=$2`, id, ownerID, name)
+	if err != nil {
+		return folderErr(err)
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// MoveFolder moves the owner's folder id under parentID (nil for the root).
+// Moves of one user are serialized so that two concurrent moves cannot
+// together create a cycle.
+func (r *Repository) MoveFolder(ctx context.Context, ownerID, id string, parentID *string) error {
+	return r.WithTx(ctx, func(tx *Repository) error {
+		if _, err := tx.DB.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('folders:' || $1::text))`, ownerID); err != nil {
+			return err
+		}
+		if _, err := tx.GetFolder(ctx, ownerID, id); err != nil {
+			return err
+		}
+		if parentID != nil {
+			path, err := tx.FolderPath(ctx, ownerID, *parentID)
+			if err != nil {
+				return err
+			}
+			for _, f := range path {
+				if f.ID == id {
+					return ErrFolderCycle
+				}
+			}
+		}
+		_, err := tx.DB.Exec(ctx, `UPDATE folders SET parent_id=$3 WHERE id=$1 AND owner_id=$2`, id, ownerID, parentID)
+		return folderErr(err)
+	})
+}
+
+// DeleteFolder deletes the owner's folder id with all its subfolders, moving
+// the files within them to the trash, from which they are restored into the
+// root folder. It returns the number of files moved to the trash.
+func (r *Repository) DeleteFolder(ctx context.Context, ownerID, id string) (int64, error) {
+	var trashed int64
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if _, err := tx.DB.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('folders:' || $1::text))`, ownerID); err != nil {
+			return err
+		}
+		// files already in the trash leave the folder as well, keeping their
+		// deletion time; now() is the transaction's start, so only the files
+		// trashed here carry it
+		err := tx.DB.QueryRow(ctx, `
+            WITH RECURSIVE tree AS (
+                SELECT id FROM folders WHERE id=$1 AND owner_id=$2
+                UNION ALL
+                SELECT f.id FROM folders f JOIN tree t ON f.parent_id = t.id
+            ), moved AS (
+                UPDATE files SET folder_id=NULL, deleted_at=COALESCE(deleted_at, now())
+                WHERE folder_id IN (SELECT id FROM tree)
+                RETURNING deleted_at = now() AS trashed
+            )
+            SELECT COUNT(*) FILTER (WHERE trashed) FROM moved`, id, ownerID).Scan(&trashed)
+		if err != nil {
+			return err
+		}
+		// subfolders go with it through the parent_id cascade
+		cmd, err := tx.DB.Exec(ctx, `DELETE FROM folders WHERE id=$1 AND owner_id=$2`, id, ownerID)
+		if err != nil {
+			return err
+		}
+		if cmd.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	})
+	return trashed, err
+}
+
+// MoveFile moves the owner's file into folderID (nil for the root).
+func (r *Repository) MoveFile(ctx context.Context, ownerID, fileID string, folderID *string) error {
+	cmd, err := r.DB.Exec(ctx, `
+        UPDATE files SET folder_id=$3
+        WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL
+          AND ($3::uuid IS NULL OR EXISTS (SELECT 1 FROM folders WHERE id=$3 AND owner_id=$2))`, fileID, ownerID, folderID)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
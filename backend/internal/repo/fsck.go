@@ -0,0 +1,184 @@
+package repo
+
+import (
+	"context"
+)
+
+// RefCountDrift is a blob or chunk whose stored ref_count differs from the
+// number of references actually present.
+type RefCountDrift struct {
+	Hash   string `json:"hash"`
+	Stored int64  `json:"stored"`
+	Actual int64  `json:"actual"`
+}
+
+// blob references are files and file_versions rows; chunk references are
+// manifest entries
+const (
+	blobRefs = `
+        SELECT b.hash, b.ref_count, COUNT(f.blob_hash) AS actual
+        FROM blobs b LEFT JOIN (
+            SELECT blob_hash FROM files UNION ALL SELECT blob_hash FROM file_versions
+        ) f ON f.blob_hash = b.hash
+        GROUP BY b.hash HAVING b.ref_count <> COUNT(f.blob_hash)`
+	chunkRefs = `
+        SELECT c.hash, c.ref_count, COUNT(bc.chunk_hash) AS actual
+        FROM chunks c LEFT JOIN blob_chunks bc ON bc.chunk_hash = c.hash
+        GROUP BY c.hash HAVING c.ref_count <> COUNT(bc.chunk_hash)`
+)
+
+// BlobRefCountDrift lists blobs whose ref_count does not match their files
+// and file versions.
+func (r *Repository) BlobRefCountDrift(ctx context.Context) ([]RefCountDrift, error) {
+	return r.refCountDrift(ctx, blobRefs)
+}
+
+// ChunkRefCountDrift lists chunks whose ref_count does not match the number of
+// times blob manifests reference them.
+func (r *Repository) ChunkRefCountDrift(ctx context.Context) ([]RefCountDrift, error) {
+	return r.refCountDrift(ctx, chunkRefs)
+}
+
+func (r *Repository) refCountDrift(ctx context.Context, q string) ([]RefCountDrift, error) {
+	rows, err := r.DB.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []RefCountDrift
+	for rows.Next() {
+		var d RefCountDrift
+		if err := rows.Scan(&d.Hash, &d.Stored, &d.Actual); err != nil {
+			return nil, err
+		}
+		out = append(out, d)
+	}
+	return out, rows.Err()
+}
+
+// FixBlobRefCounts sets every blob's ref_count to its number of files and
+// file versions.
+func (r *Repository) FixBlobRefCounts(ctx context.Context) (int64, error) {
+	return r.fixRefCounts(ctx, "blobs", blobRefs)
+}
+
+// FixChunkRefCounts sets every chunk's ref_count to its number of manifest entries.
+func (r *Repository) FixChunkRefCounts(ctx context.Context) (int64, error) {
+	return r.fixRefCounts(ctx, "chunks", chunkRefs)
+}
+
+// fixRefCounts sets ref_count to the actual count for the rows of table that
+// refs reports. The rows are locked before they are counted: uploads and
+// deletes change ref_count in the transaction that adds or removes the
+// reference, so each one either commits before the count sees it or adjusts
+// the repaired value afterwards, instead of being overwritten by it.
+func (r *Repository) fixRefCounts(ctx context.Context, table, refs string) (int64, error) {
+	var n int64
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		rows, err := tx.DB.Query(ctx, `
+            SELECT hash FROM `+table+` WHERE hash IN (SELECT hash FROM (`+refs+`) d)
+            ORDER BY hash FOR UPDATE`)
+		if err != nil {
+			return err
+		}
+		hashes, err := scanIDs(rows)
+		if err != nil || len(hashes) == 0 {
+			return err
+		}
+		// counted again now that no reference can change under the locks
+		cmd, err := tx.DB.Exec(ctx, `
+            UPDATE `+table+` t SET ref_count = d.actual FROM (`+refs+`) d
+            WHERE t.hash = d.hash AND t.hash = ANY($1)`, hashes)
+		n = cmd.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+// DanglingFiles returns files whose blob row does not exist. The foreign key
+// normally prevents this, but restored or hand-edited databases may not have it.
+func (r *Repository) DanglingFiles(ctx context.Context) ([]File, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+fileColumns("f")+`
+        FROM files f
+        WHERE NOT EXISTS (SELECT 1 FROM blobs b WHERE b.hash = f.blob_hash)
+        ORDER BY f.created_at`)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// DeleteDanglingFiles removes files whose blob row does not exist, together
+// with their earlier versions, whose blob references are released.
+func (r *Repository) DeleteDanglingFiles(ctx context.Context) (int64, error) {
+	var n int64
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		const dangling = `NOT EXISTS (SELECT 1 FROM blobs b WHERE b.hash = f.blob_hash)`
+		if err := tx.deleteVersionsOf(ctx, dangling); err != nil {
+			return err
+		}
+		cmd, err := tx.DB.Exec(ctx, `DELETE FROM files f WHERE `+dangling)
+		n = cmd.RowsAffected()
+		return err
+	})
+	return n, err
+}
+
+// ListBlobs returns blobs in hash order after afterHash.
+func (r *Repository) ListBlobs(ctx context.Context, afterHash string, limit int) ([]Blob, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, storage_path, chunked, stored_size
+        FROM blobs WHERE hash > $1 ORDER BY hash LIMIT $2`, afterHash, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.Hash, &b.SizeBytes, &b.StoragePath, &b.Chunked, &b.StoredSize); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// ListChunks returns chunks in hash order after afterHash.
+func (r *Repository) ListChunks(ctx context.Context, afterHash string, limit int) ([]Chunk, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, storage_path, stored_size, ref_count
+        FROM chunks WHERE hash > $1 ORDER BY hash LIMIT $2`, afterHash, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Chunk
+	for rows.Next() {
+		var c Chunk
+		if err := rows.Scan(&c.Hash, &c.SizeBytes, &c.StoragePath, &c.StoredSize, &c.RefCount); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// BlobsUsingChunks returns the hashes of blobs whose manifest includes any of chunkHashes.
+func (r *Repository) BlobsUsingChunks(ctx context.Context, chunkHashes []string) ([]string, error) {
+	rows, err := r.DB.Query(ctx, `SELECT DISTINCT blob_hash FROM blob_chunks WHERE chunk_hash = ANY($1) ORDER BY blob_hash`, chunkHashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,170 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// Chunk is a content-defined chunk row.
+type Chunk struct {
+	Hash        string
+	SizeBytes   int64
+	StoragePath string
+	StoredSize  *int64
+	RefCount    int64
+}
+
+// ListCollectableBlobs returns blobs that have had no references for longer
+// than grace and are not pointed at by any file or file version, in hash order
+// after afterHash.
+func (r *Repository) ListCollectableBlobs(ctx context.Context, grace time.Duration, afterHash string, limit int) ([]Blob, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, storage_path, chunked, stored_size
+        FROM blobs b
+        WHERE b.ref_count <= 0 AND b.zero_ref_at < now() - $1::interval
+          AND NOT EXISTS (SELECT 1 FROM files f WHERE f.blob_hash = b.hash)
+          AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.blob_hash = b.hash)
+          AND b.hash > $2
+        ORDER BY b.hash
+        LIMIT $3`, grace, afterHash, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.Hash, &b.SizeBytes, &b.StoragePath, &b.Chunked, &b.StoredSize); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// DeleteCollectableBlob removes a blob row if it is still collectable,
+// releasing its chunk references, and calls del to delete its content, all
+// while holding the lock on its key (see LockKeys): an upload that found the
+// content stored meanwhile waits and then sees it gone. If del fails nothing
+// is removed. deleted is false if the blob gained a reference.
+func (r *Repository) DeleteCollectableBlob(ctx context.Context, hash string, grace time.Duration, del func() error) (deleted bool, err error) {
+	err = r.WithTx(ctx, func(tx *Repository) error {
+		if err := tx.LockKeys(ctx, []string{storage.BlobKey(hash)}); err != nil {
+			return err
+		}
+		var chunked bool
+		err := tx.DB.QueryRow(ctx, `
+            SELECT chunked FROM blobs b
+            WHERE b.hash=$1 AND b.ref_count <= 0 AND b.zero_ref_at < now() - $2::interval
+              AND NOT EXISTS (SELECT 1 FROM files f WHERE f.blob_hash = b.hash)
+              AND NOT EXISTS (SELECT 1 FROM file_versions v WHERE v.blob_hash = b.hash)
+            FOR UPDATE`, hash, grace).Scan(&chunked)
+		if err == pgx.ErrNoRows {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if chunked {
+			if _, err := tx.DB.Exec(ctx, `
+                UPDATE chunks c SET ref_count = c.ref_count - m.n
+                FROM (SELECT chunk_hash, COUNT(*) AS n FROM blob_chunks WHERE blob_hash=$1 GROUP BY chunk_hash) m
+                WHERE c.hash = m.chunk_hash`, hash); err != nil {
+				return err
+			}
+		}
+		if _, err := tx.DB.Exec(ctx, `DELETE FROM blobs WHERE hash=$1`, hash); err != nil {
+			return err
+		}
+		if err := del(); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	return deleted && err == nil, err
+}
+
+// ListCollectableChunks returns chunks no blob has referenced for longer than
+// grace, in hash order after afterHash.
+func (r *Repository) ListCollectableChunks(ctx context.Context, grace time.Duration, afterHash string, limit int) ([]Chunk, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, storage_path, stored_size, ref_count
+        FROM chunks c
+        WHERE c.ref_count <= 0 AND c.zero_ref_at < now() - $1::interval
+          AND NOT EXISTS (SELECT 1 FROM blob_chunks bc WHERE bc.chunk_hash = c.hash)
+          AND c.hash > $2
+        ORDER BY c.hash
+        LIMIT $3`, grace, afterHash, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Chunk
+	for rows.Next() {
+		var c Chunk
+		if err := rows.Scan(&c.Hash, &c.SizeBytes, &c.StoragePath, &c.StoredSize, &c.RefCount); err != nil {
+			return nil, err
+		}
+		out = append(out, c)
+	}
+	return out, rows.Err()
+}
+
+// DeleteCollectableChunk removes a chunk row if it is still collectable and
+// calls del to delete its content, holding the lock on its key like
+// DeleteCollectableBlob. If del fails nothing is removed.
+func (r *Repository) DeleteCollectableChunk(ctx context.Context, hash string, grace time.Duration, del func() error) (deleted bool, err error) {
+	err = r.WithTx(ctx, func(tx *Repository) error {
+		if err := tx.LockKeys(ctx, []string{storage.ChunkKey(hash)}); err != nil {
+			return err
+		}
+		cmd, err := tx.DB.Exec(ctx, `
+            DELETE FROM chunks c
+            WHERE c.hash=$1 AND c.ref_count <= 0 AND c.zero_ref_at < now() - $2::interval
+              AND NOT EXISTS (SELECT 1 FROM blob_chunks bc WHERE bc.chunk_hash = c.hash)`, hash, grace)
+		if err != nil || cmd.RowsAffected() == 0 {
+			return err
+		}
+		if err := del(); err != nil {
+			return err
+		}
+		deleted = true
+		return nil
+	})
+	return deleted && err == nil, err
+}
+
+// KnownBlobHashes returns which of hashes have a blobs row.
+func (r *Repository) KnownBlobHashes(ctx context.Context, hashes []string) (map[string]bool, error) {
+	return r.knownHashes(ctx, `SELECT hash FROM blobs WHERE hash = ANY($1)`, hashes)
+}
+
+// KnownChunkHashes returns which of hashes have a chunks row.
+func (r *Repository) KnownChunkHashes(ctx context.Context, hashes []string) (map[string]bool, error) {
+	return r.knownHashes(ctx, `SELECT hash FROM chunks WHERE hash = ANY($1)`, hashes)
+}
+
+func (r *Repository) knownHashes(ctx context.Context, q string, hashes []string) (map[string]bool, error) {
+	out := make(map[string]bool, len(hashes))
+	if len(hashes) == 0 {
+		return out, nil
+	}
+	rows, err := r.DB.Query(ctx, q, hashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		out[h] = true
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,322 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+	"slices"
+	"strconv"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrInvalidMetadata is returned, wrapped with the reason, for metadata keys,
+// values and rules that are not acceptable.
+var ErrInvalidMetadata = errors.New("invalid metadata")
+
+// Metadata value types.
+const (
+	MetaString  = "string"
+	MetaNumber  = "number"
+	MetaBoolean = "boolean"
+)
+
+// Limits on file metadata.
+const (
+	MaxMetadataKeys     = 64
+	MaxMetadataValueLen = 1024
+)
+
+var metadataKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// CheckMetadataKey checks that key is 1-64 letters, digits, '_', '.' or '-'.
+func CheckMetadataKey(key string) error {
+	if !metadataKeyRe.MatchString(key) {
+		return fmt.Errorf("%w: key %q must be 1-64 letters, digits, '_', '.' or '-'", ErrInvalidMetadata, key)
+	}
+	return nil
+}
+
+// MetadataType returns the type of a metadata value, or "" if it is not a
+// string, number or boolean.
+func MetadataType(v any) string {
+	switch v.(type) {
+	case string:
+		return MetaString
+	case float64:
+		return MetaNumber
+	case bool:
+		return MetaBoolean
+	}
+	return ""
+}
+
+// MetadataRule constrains the values of one metadata key. OwnerID is nil for
+// rules of the whole organization, which apply to every user in addition to
+// their own rules.
+type MetadataRule struct {
+	ID      string
+	OwnerID *string
+	Key     string
+	// Type is the value type required, MetaString, MetaNumber or MetaBoolean.
+	Type string
+	// Pattern is a regular expression strings must match in full; Allowed,
+	// when not empty, lists the only strings accepted.
+	Pattern *string
+	Allowed []string
+	// Min and Max bound numbers, inclusively.
+	Min       *float64
+	Max       *float64
+	UpdatedAt time.Time
+
+	re *regexp.Regexp // Pattern compiled by compilePattern
+}
+
+const metadataRuleColumns = "id, owner_id, key, value_type, pattern, allowed, min_value, max_value, updated_at"
+
+func (m *MetadataRule) scanDest() []any {
+	return []any{&m.ID, &m.OwnerID, &m.Key, &m.Type, &m.Pattern, &m.Allowed, &m.Min, &m.Max, &m.UpdatedAt}
+}
+
+// Validate checks that the rule itself is well formed.
+func (m MetadataRule) Validate() error {
+	if err := CheckMetadataKey(m.Key); err != nil {
+		return err
+	}
+	switch m.Type {
+	case MetaString:
+		if m.Pattern != nil {
+			if _, err := compilePattern(*m.Pattern); err != nil {
+				return fmt.Errorf("%w: pattern: %v", ErrInvalidMetadata, err)
+			}
+		}
+		if m.Min != nil || m.Max != nil {
+			return fmt.Errorf("%w: min and max apply to numbers", ErrInvalidMetadata)
+		}
+	case MetaNumber:
+		if m.Pattern != nil || len(m.Allowed) > 0 {
+			return fmt.Errorf("%w: pattern and allowed values apply to strings", ErrInvalidMetadata)
+		}
+		if m.Min != nil && m.Max != nil && *m.Min > *m.Max {
+			return fmt.Errorf("%w: min exceeds max", ErrInvalidMetadata)
+		}
+	case MetaBoolean:
+		if m.Pattern != nil || len(m.Allowed) > 0 || m.Min != nil || m.Max != nil {
+			return fmt.Errorf("%w: booleans take no constraints", ErrInvalidMetadata)
+		}
+	default:
+		return fmt.Errorf("%w: type must be string, number or boolean", ErrInvalidMetadata)
+	}
+	return nil
+}
+
+// compilePattern compiles a rule's pattern to match whole values. The parsed
+// expression is anchored rather than the pattern's text, which an unbalanced
+// group or \Q could carry past the anchors.
+func compilePattern(pattern string) (*regexp.Regexp, error) {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	anchored := &syntax.Regexp{Op: syntax.OpConcat, Sub: []*syntax.Regexp{{Op: syntax.OpBeginText}, re, {Op: syntax.OpEndText}}}
+	return regexp.Compile(anchored.String())
+}
+
+// Check checks a value for the rule's key.
+func (m MetadataRule) Check(v any) error {
+	if t := MetadataType(v); t != m.Type {
+		return fmt.Errorf("%w: %s must be a %s", ErrInvalidMetadata, m.Key, m.Type)
+	}
+	switch v := v.(type) {
+	case string:
+		if m.Pattern != nil {
+			re := m.re
+			if re == nil {
+				var err error
+				if re, err = compilePattern(*m.Pattern); err != nil {
+					return fmt.Errorf("%w: %s: pattern: %v", ErrInvalidMetadata, m.Key, err)
+				}
+			}
+			if !re.MatchString(v) {
+				return fmt.Errorf("%w: %s must match %s", ErrInvalidMetadata, m.Key, *m.Pattern)
+			}
+		}
+		if len(m.Allowed) > 0 && !slices.Contains(m.Allowed, v) {
+			return fmt.Errorf("%w: %s must be one of %q", ErrInvalidMetadata, m.Key, m.Allowed)
+		}
+	case float64:
+		if m.Min != nil && v < *m.Min {
+			return fmt.Errorf("%w: %s must be at least %s", ErrInvalidMetadata, m.Key, strconv.FormatFloat(*m.Min, 'g', -1, 64))
+		}
+		if m.Max != nil && v > *m.Max {
+			return fmt.Errorf("%w: %s must be at most %s", ErrInvalidMetadata, m.Key, strconv.FormatFloat(*m.Max, 'g', -1, 64))
+		}
+	}
+	return nil
+}
+
+// ListMetadataRules returns the organization's rules and the user's, by key,
+// their patterns compiled.
+func (r *Repository) ListMetadataRules(ctx context.Context, ownerID string) ([]MetadataRule, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+metadataRuleColumns+` FROM metadata_rules
+        WHERE owner_id IS NULL OR owner_id=$1
+        ORDER BY key, owner_id NULLS FIRST`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []MetadataRule
+	for rows.Next() {
+		var m MetadataRule
+		if err := rows.Scan(m.scanDest()...); err != nil {
+			return nil, err
+		}
+		if m.Pattern != nil {
+			if m.re, err = compilePattern(*m.Pattern); err != nil {
+				return nil, fmt.Errorf("metadata rule %s: pattern: %w", m.ID, err)
+			}
+		}
+		out = append(out, m)
+	}
+	return out, rows.Err()
+}
+
+// PutMetadataRule creates or replaces the rule for m.Key of m.OwnerID. Values
+// already stored are not checked against it.
+func (r *Repository) PutMetadataRule(ctx context.Context, m MetadataRule) (MetadataRule, error) {
+	if err := m.Validate(); err != nil {
+		return MetadataRule{}, err
+	}
+	if m.Allowed == nil {
+		m.Allowed = []string{}
+	}
+	var out MetadataRule
+	err := r.DB.QueryRow(ctx, `
+        INSERT INTO metadata_rules (owner_id, key, value_type, pattern, allowed, min_value, max_value)
+        VALUES ($1,$2,$3,$4,$5,$6,$7)
+        ON CONFLICT (COALESCE(owner_id, '00000000-0000-0000-0000-000000000000'::uuid), key) DO UPDATE SET
+            value_type=EXCLUDED.value_type, pattern=EXCLUDED.pattern, allowed=EXCLUDED.allowed,
+            min_value=EXCLUDED.min_value, max_value=EXCLUDED.max_value, updated_at=now()
+        RETURNING `+metadataRuleColumns, m.OwnerID, m.Key, m.Type, m.Pattern, m.Allowed, m.Min, m.Max).Scan(out.scanDest()...)
+	return out, err
+}
+
+// DeleteMetadataRule deletes the rule for key of ownerID (nil for the
+// organization).
+func (r *Repository) DeleteMetadataRule(ctx context.Context, ownerID *string, key string) error {
+	cmd, err := r.DB.Exec(ctx, `DELETE FROM metadata_rules WHERE owner_id IS NOT DISTINCT FROM $1::uuid AND key=$2`, ownerID, key)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// SetFileMetadata sets keys of the owner's file to the values in set, after
+// checking them against the organization's and the owner's rules.
+func (r *Repository) SetFileMetadata(ctx context.Context, ownerID, fileID string, set map[string]any) (File, error) {
+	var out File
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		rules, err := tx.ListMetadataRules(ctx, ownerID)
+		if err != nil {
+			return err
+		}
+		for k, v := range set {
+			if err := CheckMetadataKey(k); err != nil {
+				return err
+			}
+			if MetadataType(v) == "" {
+				return fmt.Errorf("%w: %s must be a string, number or boolean", ErrInvalidMetadata, k)
+			}
+			if s, ok := v.(string); ok && (!utf8.ValidString(s) || len(s) > MaxMetadataValueLen) {
+				return fmt.Errorf("%w: %s must be valid text of at most %d bytes", ErrInvalidMetadata, k, MaxMetadataValueLen)
+			}
+			for _, rule := range rules {
+				if rule.Key == k {
+					if err := rule.Check(v); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		var cur map[string]any
+		err = tx.DB.QueryRow(ctx, `SELECT metadata FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL FOR UPDATE`, fileID, ownerID).Scan(&cur)
+		if err != nil {
+			return err
+		}
+		for k, v := range set {
+			cur[k] = v
+		}
+		if len(cur) > MaxMetadataKeys {
+			return fmt.Errorf("%w: at most %d keys per file", ErrInvalidMetadata, MaxMetadataKeys)
+		}
+		return tx.DB.QueryRow(ctx, `UPDATE files SET metadata=$3 WHERE id=$1 AND owner_id=$2 RETURNING `+fileColumns(""),
+			fileID, ownerID, cur).Scan(out.scanDest()...)
+	})
+	return out, err
+}
+
+// UnsetFileMetadata removes keys from the owner's file.
+func (r *Repository) UnsetFileMetadata(ctx context.Context, ownerID, fileID string, keys []string) (File, error) {
+	var out File
+	err := r.DB.QueryRow(ctx, `
+        UPDATE files SET metadata = metadata - $3::text[]
+        WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL
+        RETURNING `+fileColumns(""), fileID, ownerID, keys).Scan(out.scanDest()...)
+	return out, err
+}
+
+// MetadataFilter selects files by one metadata key: with Equals, files whose
+// value equals it; with Exists, files that have (or lack) the key; with Min
+// or Max, files whose value is a number in the range.
+type MetadataFilter struct {
+	Key    string
+	Equals any
+	Exists *bool
+	Min    *float64
+	Max    *float64
+}
+
+// conditions returns the SQL conditions for f, with arguments numbered from
+// argn.
+func (f MetadataFilter) conditions(argn int) (conds []string, args []any, err error) {
+	if err := CheckMetadataKey(f.Key); err != nil {
+		return nil, nil, err
+	}
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + itoa(argn+len(args)-1)
+	}
+	if f.Equals != nil {
+		if MetadataType(f.Equals) == "" {
+			return nil, nil, fmt.Errorf("%w: %s: values are strings, numbers or booleans", ErrInvalidMetadata, f.Key)
+		}
+		// containment can use the GIN index
+		conds = append(conds, "metadata @> "+arg(map[string]any{f.Key: f.Equals})+"::jsonb")
+	}
+	if f.Exists != nil {
+		c := "metadata ? " + arg(f.Key)
+		if !*f.Exists {
+			c = "NOT " + c
+		}
+		conds = append(conds, c)
+	}
+	if f.Min != nil || f.Max != nil {
+		key := arg(f.Key)
+		num := "(CASE WHEN jsonb_typeof(metadata->" + key + ") = 'number' THEN (metadata->>" + key + ")::double precision END)"
+		if f.Min != nil {
+			conds = append(conds, num+" >= "+arg(*f.Min))
+		}
+		if f.Max != nil {
+			conds = append(conds, num+" <= "+arg(*f.Max))
+		}
+	}
+	return conds, args, nil
+}
@@ -0,0 +1,95 @@
+package repo
+
+import (
+	"errors"
+	"testing"
+)
+
+func ptr[T any](v T) *T { return &v }
+
+func TestMetadataRuleValidate(t *testing.T) {
+	for _, c := range []struct {
+		name string
+		rule MetadataRule
+		ok   bool
+	}{
+		{"string", MetadataRule{Key: "project", Type: MetaString}, true},
+		{"string pattern", MetadataRule{Key: "project", Type: MetaString, Pattern: ptr(`[a-z]+-\d+`)}, true},
+		{"string allowed", MetadataRule{Key: "stage", Type: MetaString, Allowed: []string{"draft", "final"}}, true},
+		{"bad pattern", MetadataRule{Key: "project", Type: MetaString, Pattern: ptr(`a(`)}, false},
+		{"pattern leaving its group", MetadataRule{Key: "project", Type: MetaString, Pattern: ptr(`a)|(.*`)}, false},
+		{"string bounds", MetadataRule{Key: "project", Type: MetaString, Min: ptr(1.0)}, false},
+		{"number", MetadataRule{Key: "pages", Type: MetaNumber, Min: ptr(1.0), Max: ptr(1.0)}, true},
+		{"number min over max", MetadataRule{Key: "pages", Type: MetaNumber, Min: ptr(2.0), Max: ptr(1.0)}, false},
+		{"number pattern", MetadataRule{Key: "pages", Type: MetaNumber, Pattern: ptr(`\d+`)}, false},
+		{"number allowed", MetadataRule{Key: "pages", Type: MetaNumber, Allowed: []string{"1"}}, false},
+		{"boolean", MetadataRule{Key: "final", Type: MetaBoolean}, true},
+		{"boolean bounds", MetadataRule{Key: "final", Type: MetaBoolean, Max: ptr(1.0)}, false},
+		{"boolean allowed", MetadataRule{Key: "final", Type: MetaBoolean, Allowed: []string{"true"}}, false},
+		{"unknown type", MetadataRule{Key: "when", Type: "date"}, false},
+		{"bad key", MetadataRule{Key: "a b", Type: MetaString}, false},
+	} {
+		err := c.rule.Validate()
+		if c.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidMetadata)) {
+			t.Errorf("%s: Validate() = %v", c.name, err)
+		}
+	}
+}
+
+func TestMetadataRuleCheck(t *testing.T) {
+	code := MetadataRule{Key: "code", Type: MetaString, Pattern: ptr(`[A-Z]{2}-\d+`)}
+	either := MetadataRule{Key: "side", Type: MetaString, Pattern: ptr(`left|right`)}
+	// \Q quotes to the end of the pattern, and must not take the anchor with it
+	quoted := MetadataRule{Key: "q", Type: MetaString, Pattern: ptr(`\Qa)|(.*`)}
+	caseless := MetadataRule{Key: "c", Type: MetaString, Pattern: ptr(`(?i)abc`)}
+	stage := MetadataRule{Key: "stage", Type: MetaString, Allowed: []string{"draft", "final"}}
+	pages := MetadataRule{Key: "pages", Type: MetaNumber, Min: ptr(1.0), Max: ptr(500.0)}
+	final := MetadataRule{Key: "final", Type: MetaBoolean}
+	for _, c := range []struct {
+		rule MetadataRule
+		v    any
+		ok   bool
+	}{
+		{code, "AB-12", true},
+		{code, "AB-12x", false},
+		{code, "xAB-12", false},
+		{code, "ab-12", false},
+		{code, 12.0, false},
+		{either, "left", true},
+		{either, "right", true},
+		{either, "leftover", false},
+		{either, "upright", false},
+		{quoted, "a)|(.*", true},
+		{quoted, "anything", false},
+		{caseless, "ABC", true},
+		{caseless, "abcd", false},
+		{stage, "draft", true},
+		{stage, "Draft", false},
+		{stage, true, false},
+		{pages, 1.0, true},
+		{pages, 500.0, true},
+		{pages, 0.5, false},
+		{pages, 501.0, false},
+		{pages, "12", false},
+		{final, true, true},
+		{final, false, true},
+		{final, "true", false},
+		{final, 1.0, false},
+	} {
+		err := c.rule.Check(c.v)
+		if c.ok != (err == nil) || (err != nil && !errors.Is(err, ErrInvalidMetadata)) {
+			t.Errorf("%s: Check(%#v) = %v", c.rule.Key, c.v, err)
+		}
+		// a rule as ListMetadataRules returns it, its pattern compiled
+		if c.rule.Pattern != nil {
+			compiled := c.rule
+			var err error
+			if compiled.re, err = compilePattern(*c.rule.Pattern); err != nil {
+				t.Fatal(err)
+			}
+			if got := compiled.Check(c.v); (got == nil) != c.ok {
+				t.Errorf("%s: compiled Check(%#v) = %v", c.rule.Key, c.v, got)
+			}
+		}
+	}
+}
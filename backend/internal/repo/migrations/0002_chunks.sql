@@ -0,0 +1,20 @@
+-- Content-defined chunks (sub-file deduplication)
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS chunked BOOLEAN NOT NULL DEFAULT false;
+
+CREATE TABLE IF NOT EXISTS chunks (
+    hash CHAR(64) PRIMARY KEY,
+    size_bytes BIGINT NOT NULL,
+    storage_path TEXT NOT NULL,
+    ref_count BIGINT NOT NULL DEFAULT 0,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+
+-- Per-blob chunk manifest, in content order
+CREATE TABLE IF NOT EXISTS blob_chunks (
+    blob_hash CHAR(64) NOT NULL REFERENCES blobs(hash) ON DELETE CASCADE,
+    seq INT NOT NULL,
+    chunk_hash CHAR(64) NOT NULL REFERENCES chunks(hash) ON DELETE RESTRICT,
+    offset_bytes BIGINT NOT NULL,
+    PRIMARY KEY (blob_hash, seq)
+);
+CREATE INDEX IF NOT EXISTS idx_blob_chunks_chunk ON blob_chunks(chunk_hash);
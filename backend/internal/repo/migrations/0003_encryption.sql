@@ -0,0 +1,7 @@
+-- Encryption at rest: data keys wrapped by a master key (NULL key_id = plaintext)
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS key_id TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS key_id TEXT;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS wrapped_key BYTEA;
+CREATE INDEX IF NOT EXISTS idx_blobs_key_id ON blobs(key_id);
+CREATE INDEX IF NOT EXISTS idx_chunks_key_id ON chunks(key_id);
@@ -0,0 +1,5 @@
+-- Transparent compression (NULL codec = stored raw; NULL stored_size = unknown, older rows)
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS codec TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS stored_size BIGINT;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS codec TEXT;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS stored_size BIGINT;
@@ -0,0 +1,24 @@
+-- Garbage collection: remember when a blob or chunk last dropped to zero references
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS zero_ref_at TIMESTAMPTZ;
+ALTER TABLE chunks ADD COLUMN IF NOT EXISTS zero_ref_at TIMESTAMPTZ;
+
+CREATE OR REPLACE FUNCTION track_zero_ref() RETURNS trigger AS $$
+BEGIN
+    IF NEW.ref_count <= 0 THEN
+        NEW.zero_ref_at := COALESCE(NEW.zero_ref_at, now());
+    ELSE
+        NEW.zero_ref_at := NULL;
+    END IF;
+    RETURN NEW;
+END
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE TRIGGER blobs_track_zero_ref BEFORE INSERT OR UPDATE OF ref_count ON blobs
+    FOR EACH ROW EXECUTE FUNCTION track_zero_ref();
+CREATE OR REPLACE TRIGGER chunks_track_zero_ref BEFORE INSERT OR UPDATE OF ref_count ON chunks
+    FOR EACH ROW EXECUTE FUNCTION track_zero_ref();
+
+UPDATE blobs SET zero_ref_at = now() WHERE ref_count <= 0 AND zero_ref_at IS NULL;
+UPDATE chunks SET zero_ref_at = now() WHERE ref_count <= 0 AND zero_ref_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_blobs_zero_ref ON blobs(zero_ref_at) WHERE zero_ref_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_chunks_zero_ref ON chunks(zero_ref_at) WHERE zero_ref_at IS NOT NULL;
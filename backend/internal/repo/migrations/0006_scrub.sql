@@ -0,0 +1,8 @@
+-- Integrity scrubbing: when each blob was last re-hashed and with what result.
+-- Blobs that are missing or no longer match their hash are quarantined.
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS last_verified_at TIMESTAMPTZ;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS verify_status TEXT NOT NULL DEFAULT 'unverified';
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS verify_error TEXT;
+ALTER TABLE blobs ADD COLUMN IF NOT EXISTS quarantined_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_blobs_last_verified ON blobs(last_verified_at NULLS FIRST);
+CREATE INDEX IF NOT EXISTS idx_blobs_verify_status ON blobs(verify_status) WHERE verify_status <> 'ok';
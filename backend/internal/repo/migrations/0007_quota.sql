@@ -0,0 +1,13 @@
+-- Per-user quota override (NULL uses USER_QUOTA_BYTES, negative is unlimited)
+ALTER TABLE users ADD COLUMN IF NOT EXISTS quota_bytes BIGINT;
+
+-- Space held by uploads in flight, released when the upload is committed as
+-- files or abandoned. Rows past expires_at no longer count.
+CREATE TABLE IF NOT EXISTS quota_reservations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL,
+    bytes BIGINT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_quota_reservations_user ON quota_reservations(user_id, expires_at);
@@ -0,0 +1,17 @@
+-- Type detected from each file's content, and whether the type the client
+-- declared disagreed with it.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS detected_mime TEXT;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS mime_mismatch BOOLEAN NOT NULL DEFAULT false;
+CREATE INDEX IF NOT EXISTS idx_files_mime_mismatch ON files(owner_id) WHERE mime_mismatch;
+
+-- Upload type policy, a single row edited by admins. Patterns are MIME types
+-- or globs such as image/*; an empty allow list accepts every type not denied.
+CREATE TABLE IF NOT EXISTS upload_policy (
+    id BOOLEAN PRIMARY KEY DEFAULT true CHECK (id),
+    allow_types TEXT[] NOT NULL DEFAULT '{}',
+    deny_types TEXT[] NOT NULL DEFAULT '{}',
+    on_mismatch TEXT NOT NULL DEFAULT 'flag' CHECK (on_mismatch IN ('flag', 'reject')),
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    updated_by UUID
+);
+INSERT INTO upload_policy (id) VALUES (true) ON CONFLICT (id) DO NOTHING;
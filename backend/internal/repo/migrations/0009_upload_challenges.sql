@@ -0,0 +1,18 @@
+-- Proof-of-ownership challenges for uploads deduplicated by hash. The client
+-- must answer with a digest of the listed byte ranges of the content before a
+-- file row is created for an existing blob. Rows are single use.
+CREATE TABLE IF NOT EXISTS upload_challenges (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    blob_hash TEXT NOT NULL,
+    size_bytes BIGINT NOT NULL,
+    filename TEXT NOT NULL,
+    mime_type TEXT,
+    tags TEXT[] NOT NULL DEFAULT '{}',
+    nonce BYTEA NOT NULL,
+    range_offsets BIGINT[] NOT NULL,
+    range_lengths BIGINT[] NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ NOT NULL
+);
+CREATE INDEX IF NOT EXISTS idx_upload_challenges_user ON upload_challenges(user_id, expires_at);
@@ -0,0 +1,4 @@
+-- Files expanded from an uploaded archive keep the entry's path within the
+-- archive and its modification time.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS source_path TEXT;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS modified_at TIMESTAMPTZ;
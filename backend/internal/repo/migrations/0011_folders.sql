@@ -0,0 +1,17 @@
+-- Folders organise a user's files in a tree. Names are unique among the
+-- folders of one parent, the root (no parent) included. Files are not deleted
+-- through the foreign key: deleting a folder deletes its files explicitly so
+-- that their blob references are released.
+CREATE TABLE IF NOT EXISTS folders (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    parent_id UUID REFERENCES folders(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_folders_parent_name
+    ON folders(owner_id, COALESCE(parent_id, '00000000-0000-0000-0000-000000000000'::uuid), name);
+CREATE INDEX IF NOT EXISTS idx_folders_parent ON folders(parent_id);
+
+ALTER TABLE files ADD COLUMN IF NOT EXISTS folder_id UUID REFERENCES folders(id);
+CREATE INDEX IF NOT EXISTS idx_files_folder ON files(folder_id);
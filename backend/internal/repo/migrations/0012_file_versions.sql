@@ -0,0 +1,27 @@
+-- File versioning. A files row is the current version of a logical file;
+-- earlier versions live in file_versions, each holding a reference on its
+-- blob like a file does. updated_at is when the current version was stored.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS version INT NOT NULL DEFAULT 1;
+ALTER TABLE files ADD COLUMN IF NOT EXISTS updated_at TIMESTAMPTZ;
+UPDATE files SET updated_at = created_at WHERE updated_at IS NULL;
+ALTER TABLE files ALTER COLUMN updated_at SET DEFAULT now();
+ALTER TABLE files ALTER COLUMN updated_at SET NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_files_owner_folder_name ON files(owner_id, folder_id, filename);
+
+-- Versions are deleted explicitly together with their file, releasing their
+-- blob references, so the foreign key does not cascade.
+CREATE TABLE IF NOT EXISTS file_versions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    file_id UUID NOT NULL REFERENCES files(id),
+    version INT NOT NULL,
+    blob_hash CHAR(64) NOT NULL REFERENCES blobs(hash) ON DELETE RESTRICT,
+    size_bytes BIGINT NOT NULL,
+    mime_type TEXT,
+    detected_mime TEXT,
+    mime_mismatch BOOLEAN NOT NULL DEFAULT false,
+    created_at TIMESTAMPTZ NOT NULL,
+    superseded_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    UNIQUE (file_id, version)
+);
+CREATE INDEX IF NOT EXISTS idx_file_versions_blob ON file_versions(blob_hash);
+CREATE INDEX IF NOT EXISTS idx_file_versions_superseded ON file_versions(superseded_at);
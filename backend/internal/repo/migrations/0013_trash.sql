@@ -0,0 +1,6 @@
+-- Trash. Deleting a file sets deleted_at; the file keeps its blob references
+-- (and counts towards the quota) until it is purged from the trash, which
+-- deletes it for good.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_files_trash ON files(owner_id, deleted_at) WHERE deleted_at IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_files_deleted_at ON files(deleted_at) WHERE deleted_at IS NOT NULL;
@@ -0,0 +1,13 @@
+-- Full-text index of file contents. Text is extracted once per blob, so files
+-- sharing content through deduplication share the entry; content keeps the
+-- (truncated) extracted text for search snippets.
+CREATE TABLE IF NOT EXISTS blob_text (
+    blob_hash CHAR(64) PRIMARY KEY REFERENCES blobs(hash) ON DELETE CASCADE,
+    status TEXT NOT NULL,
+    content TEXT NOT NULL DEFAULT '',
+    tsv TSVECTOR NOT NULL DEFAULT ''::tsvector,
+    error TEXT,
+    indexed_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS idx_blob_text_tsv ON blob_text USING gin (tsv);
+CREATE INDEX IF NOT EXISTS idx_files_blob ON files(blob_hash);
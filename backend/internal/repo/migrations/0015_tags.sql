@@ -0,0 +1,4 @@
+-- Tags are filtered with && and aggregated per user.
+UPDATE files SET tags = '{}' WHERE tags IS NULL;
+ALTER TABLE files ALTER COLUMN tags SET NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_files_tags ON files USING gin (tags);
@@ -0,0 +1,18 @@
+-- Custom key-value metadata on files, and the rules values must follow. Rules
+-- belong to a user, or with no owner to the whole organization.
+ALTER TABLE files ADD COLUMN IF NOT EXISTS metadata JSONB NOT NULL DEFAULT '{}';
+CREATE INDEX IF NOT EXISTS idx_files_metadata ON files USING gin (metadata);
+
+CREATE TABLE IF NOT EXISTS metadata_rules (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    owner_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    key TEXT NOT NULL,
+    value_type TEXT NOT NULL,
+    pattern TEXT,
+    allowed TEXT[] NOT NULL DEFAULT '{}',
+    min_value DOUBLE PRECISION,
+    max_value DOUBLE PRECISION,
+    updated_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_metadata_rules_key
+    ON metadata_rules(COALESCE(owner_id, '00000000-0000-0000-0000-000000000000'::uuid), key);
@@ -0,0 +1,20 @@
+-- Keyset pagination of file listings. Downloads are counted on the file so
+-- listings can be ordered by them; the count is backfilled once, when the
+-- column is added.
+DO $$
+BEGIN
+    IF NOT EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'files' AND column_name = 'download_count') THEN
+        ALTER TABLE files ADD COLUMN download_count BIGINT NOT NULL DEFAULT 0;
+        UPDATE files f SET download_count = d.n
+        FROM (SELECT file_id, COUNT(*) AS n FROM downloads GROUP BY file_id) d
+        WHERE d.file_id = f.id;
+    END IF;
+END $$;
+
+-- one index per sort key, ending with id as the tie-breaker; scanned backwards
+-- for descending order
+CREATE INDEX IF NOT EXISTS idx_files_owner_name ON files(owner_id, filename, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_files_owner_size ON files(owner_id, size_bytes, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_files_owner_created ON files(owner_id, created_at, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_files_owner_downloads ON files(owner_id, download_count, id) WHERE deleted_at IS NULL;
+CREATE INDEX IF NOT EXISTS idx_files_created_id ON files(created_at, id);
@@ -0,0 +1,23 @@
+-- Bulk operations over more files than are handled in one request run as
+-- jobs. The selection is fixed when the job is queued; the job works through
+-- it in batches, each committed with the progress it made.
+CREATE TABLE IF NOT EXISTS bulk_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    owner_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    action TEXT NOT NULL,
+    params JSONB NOT NULL DEFAULT '{}',
+    file_ids UUID[] NOT NULL,
+    status TEXT NOT NULL DEFAULT 'queued',
+    processed INT NOT NULL DEFAULT 0,
+    succeeded INT NOT NULL DEFAULT 0,
+    not_found UUID[] NOT NULL DEFAULT '{}',
+    error TEXT,
+    -- a running job whose lease ran out (its worker stopped) is taken up again
+    lease_until TIMESTAMPTZ,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    started_at TIMESTAMPTZ,
+    finished_at TIMESTAMPTZ
+);
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_pending ON bulk_jobs(created_at) WHERE status IN ('queued', 'running');
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_owner ON bulk_jobs(owner_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_bulk_jobs_finished ON bulk_jobs(finished_at) WHERE finished_at IS NOT NULL;
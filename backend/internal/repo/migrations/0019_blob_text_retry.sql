@@ -0,0 +1,6 @@
+-- Blobs that could not be read for indexing (a storage error, not content
+-- that has no text) are retried with backoff instead of blocking the blobs
+-- after them.
+ALTER TABLE blob_text ADD COLUMN IF NOT EXISTS attempts INT NOT NULL DEFAULT 0;
+ALTER TABLE blob_text ADD COLUMN IF NOT EXISTS retry_at TIMESTAMPTZ;
+CREATE INDEX IF NOT EXISTS idx_blob_text_retry ON blob_text(retry_at) WHERE status = 'error';
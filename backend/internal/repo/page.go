@@ -0,0 +1,227 @@
+package repo
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Keys file listings can be sorted by.
+const (
+	SortName          = "name"
+	SortSize          = "size"
+	SortCreatedAt     = "created_at"
+	SortDownloadCount = "download_count"
+)
+
+// sortColumns maps sort keys to their column and its type.
+var sortColumns = map[string][2]string{
+	SortName:          {"filename", "text"},
+	SortSize:          {"size_bytes", "bigint"},
+	SortCreatedAt:     {"created_at", "timestamptz"},
+	SortDownloadCount: {"download_count", "bigint"},
+}
+
+// Page sizes.
+const (
+	DefaultPageSize = 50
+	MaxPageSize     = 500
+)
+
+// ErrInvalidCursor is returned for cursors that were not issued for the
+// listing's sort key.
+var ErrInvalidCursor = errors.New("invalid cursor")
+
+// FileSort orders a file listing by Key; files with equal keys are ordered
+// by id in the same direction.
+type FileSort struct {
+	Key  string
+	Desc bool
+}
+
+// Page selects part of a listing: the First files after the cursor After, or
+// the Last files before the cursor Before. Both cursors may be given, and
+// neither First nor Last means DefaultPageSize files from the start.
+type Page struct {
+	First  int
+	After  string
+	Last   int
+	Before string
+	// Sort defaults to the newest files first.
+	Sort FileSort
+}
+
+// FilePage is a page of a file listing.
+type FilePage struct {
+	Files []File
+	// Cursors[i] is the cursor of Files[i].
+	Cursors         []string
+	HasNextPage     bool
+	HasPreviousPage bool
+	// TotalCount and TotalSize cover every file in the listing, not just
+	// the page.
+	TotalCount int64
+	TotalSize  int64
+}
+
+// ListFilesPage returns a page of the owner's files matching filters.
+func (r *Repository) ListFilesPage(ctx context.Context, ownerID string, filters FileFilters, pg Page) (FilePage, error) {
+	conds, args, err := filters.conditions(2)
+	if err != nil {
+		return FilePage{}, err
+	}
+	where := append([]string{"owner_id = $1", "deleted_at IS NULL"}, conds...)
+	return r.listFiles(ctx, where, append([]any{ownerID}, args...), pg)
+}
+
+// ListAllFilesPage returns a page of every user's files, including those in
+// the trash, which have DeletedAt set.
+func (r *Repository) ListAllFilesPage(ctx context.Context, pg Page) (FilePage, error) {
+	return r.listFiles(ctx, nil, nil, pg)
+}
+
+// listFiles pages through the files matching the conditions where. Pages are
+// found by seeking past the cursor's sort key and id, so rows added or
+// removed elsewhere in the listing do not shift them.
+func (r *Repository) listFiles(ctx context.Context, where []string, args []any, pg Page) (FilePage, error) {
+	sort := pg.Sort
+	if sort.Key == "" {
+		sort = FileSort{Key: SortCreatedAt, Desc: true}
+	}
+	col, ok := sortColumns[sort.Key]
+	if !ok {
+		return FilePage{}, fmt.Errorf("unknown sort key %q", sort.Key)
+	}
+	if pg.First < 0 || pg.Last < 0 {
+		return FilePage{}, errors.New("first and last must not be negative")
+	}
+	if pg.First > 0 && pg.Last > 0 {
+		return FilePage{}, errors.New("first and last cannot be combined")
+	}
+
+	var out FilePage
+	cond := "TRUE"
+	if len(where) > 0 {
+		cond = strings.Join(where, " AND ")
+	}
+	if err := r.DB.QueryRow(ctx, `SELECT COUNT(*), COALESCE(SUM(size_bytes),0) FROM files WHERE `+cond, args...).Scan(&out.TotalCount, &out.TotalSize); err != nil {
+		return FilePage{}, err
+	}
+
+	// seek past the cursors: after follows the sort order, before precedes it
+	after, before := ">", "<"
+	if sort.Desc {
+		after, before = before, after
+	}
+	for _, c := range []struct{ cursor, op string }{{pg.After, after}, {pg.Before, before}} {
+		if c.cursor == "" {
+			continue
+		}
+		v, id, err := decodeCursor(sort.Key, c.cursor)
+		if err != nil {
+			return FilePage{}, err
+		}
+		args = append(args, v, id)
+		where = append(where, "("+col[0]+", id) "+c.op+" ($"+itoa(len(args)-1)+"::"+col[1]+", $"+itoa(len(args))+"::uuid)")
+	}
+
+	// the last files are the first in reverse order
+	backward := pg.Last > 0
+	n := pg.First
+	if backward {
+		n = pg.Last
+	}
+	if n == 0 {
+		n = DefaultPageSize
+	}
+	n = min(n, MaxPageSize)
+	dir := "ASC"
+	if sort.Desc != backward {
+		dir = "DESC"
+	}
+	cond = "TRUE"
+	if len(where) > 0 {
+		cond = strings.Join(where, " AND ")
+	}
+	// one more row than asked tells whether there is more
+	args = append(args, n+1)
+	rows, err := r.DB.Query(ctx, "SELECT "+fileColumns("")+" FROM files WHERE "+cond+
+		" ORDER BY "+col[0]+" "+dir+", id "+dir+" LIMIT $"+itoa(len(args)), args...)
+	if err != nil {
+		return FilePage{}, err
+	}
+	files, err := scanFiles(rows)
+	if err != nil {
+		return FilePage{}, err
+	}
+	more := len(files) > n
+	if more {
+		files = files[:n]
+	}
+	if backward {
+		slices.Reverse(files)
+		out.HasPreviousPage, out.HasNextPage = more, pg.Before != ""
+	} else {
+		out.HasNextPage, out.HasPreviousPage = more, pg.After != ""
+	}
+	out.Files = files
+	out.Cursors = make([]string, len(files))
+	for i, f := range files {
+		out.Cursors[i] = encodeCursor(sort.Key, f)
+	}
+	return out, nil
+}
+
+// cursor is the position of a file in a listing sorted by Key: its sort key
+// Value, as text, and its id.
+type cursor struct {
+	Key   string `json:"k"`
+	Value string `json:"v"`
+	ID    string `json:"id"`
+}
+
+var uuidRe = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+func encodeCursor(key string, f File) string {
+	c := cursor{Key: key, ID: f.ID}
+	switch key {
+	case SortName:
+		c.Value = f.Filename
+	case SortSize:
+		c.Value = strconv.FormatInt(f.SizeBytes, 10)
+	case SortCreatedAt:
+		c.Value = f.CreatedAt.Format(time.RFC3339Nano)
+	case SortDownloadCount:
+		c.Value = strconv.FormatInt(f.DownloadCount, 10)
+	}
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeCursor returns the sort key value and id of a cursor for key.
+func decodeCursor(key, s string) (value any, id string, err error) {
+	var c cursor
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || json.Unmarshal(b, &c) != nil || c.Key != key || !uuidRe.MatchString(c.ID) {
+		return nil, "", ErrInvalidCursor
+	}
+	switch key {
+	case SortName:
+		value = c.Value
+	case SortSize, SortDownloadCount:
+		value, err = strconv.ParseInt(c.Value, 10, 64)
+	case SortCreatedAt:
+		value, err = time.Parse(time.RFC3339Nano, c.Value)
+	}
+	if err != nil {
+		return nil, "", ErrInvalidCursor
+	}
+	return value, c.ID, nil
+}
@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"testing"
+	"time"
+)
+
+const testFileID = "0b8f1c2e-4a5d-4e6f-8a9b-0c1d2e3f4a5b"
+
+func TestCursorRoundTrip(t *testing.T) {
+	f := File{
+		ID:            testFileID,
+		Filename:      `report "final", v2.pdf`,
+		SizeBytes:     1 << 40,
+		CreatedAt:     time.Date(2026, 3, 4, 5, 6, 7, 123456789, time.FixedZone("", 3600)),
+		DownloadCount: 42,
+	}
+	for key, want := range map[string]any{
+		SortName:          f.Filename,
+		SortSize:          f.SizeBytes,
+		SortCreatedAt:     f.CreatedAt,
+		SortDownloadCount: f.DownloadCount,
+	} {
+		v, id, err := decodeCursor(key, encodeCursor(key, f))
+		if err != nil || id != f.ID {
+			t.Fatalf("%s: decodeCursor = %v, %q, %v", key, v, id, err)
+		}
+		if tm, ok := v.(time.Time); ok {
+			// the seek compares against the full precision timestamp
+			if !tm.Equal(f.CreatedAt) {
+				t.Fatalf("%s: decoded %v, want %v", key, tm, f.CreatedAt)
+			}
+		} else if v != want {
+			t.Fatalf("%s: decoded %v, want %v", key, v, want)
+		}
+	}
+}
+
+func TestDecodeCursorRejects(t *testing.T) {
+	f := File{ID: testFileID, SizeBytes: 10}
+	enc := func(json string) string { return base64.RawURLEncoding.EncodeToString([]byte(json)) }
+	for name, c := range map[string]struct{ key, cursor string }{
+		"other sort key": {SortName, encodeCursor(SortSize, f)},
+		"not base64":     {SortSize, "!!!"},
+		"not json":       {SortSize, enc("size")},
+		"bad id":         {SortSize, enc(`{"k":"size","v":"10","id":"1; DROP TABLE files"}`)},
+		"bad size":       {SortSize, enc(`{"k":"size","v":"ten","id":"` + testFileID + `"}`)},
+		"bad time":       {SortCreatedAt, enc(`{"k":"created_at","v":"yesterday","id":"` + testFileID + `"}`)},
+		"empty":          {SortName, ""},
+	} {
+		if _, _, err := decodeCursor(c.key, c.cursor); !errors.Is(err, ErrInvalidCursor) {
+			t.Errorf("%s: decodeCursor = %v", name, err)
+		}
+	}
+}
+
+// Invalid page requests are refused before the database is queried.
+func TestListFilesPageValidates(t *testing.T) {
+	r := &Repository{}
+	for name, pg := range map[string]Page{
+		"unknown sort":   {Sort: FileSort{Key: "owner_id"}},
+		"negative first": {First: -1},
+		"negative last":  {Last: -1},
+		"first and last": {First: 1, Last: 1},
+	} {
+		if _, err := r.ListAllFilesPage(context.Background(), pg); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/mimetype"
+)
+
+// UploadPolicy is the admin-edited policy applied to every uploaded file.
+type UploadPolicy struct {
+	mimetype.Policy
+	UpdatedAt time.Time
+	UpdatedBy *string
+}
+
+func (r *Repository) GetUploadPolicy(ctx context.Context) (UploadPolicy, error) {
+	var p UploadPolicy
+	err := r.DB.QueryRow(ctx, `SELECT allow_types, deny_types, on_mismatch, updated_at, updated_by FROM upload_policy`).Scan(
+		&p.Allow, &p.Deny, &p.OnMismatch, &p.UpdatedAt, &p.UpdatedBy)
+	return p, err
+}
+
+func (r *Repository) SetUploadPolicy(ctx context.Context, p mimetype.Policy, updatedBy string) (UploadPolicy, error) {
+	if p.Allow == nil {
+		p.Allow = []string{}
+	}
+	if p.Deny == nil {
+		p.Deny = []string{}
+	}
+	var out UploadPolicy
+	err := r.DB.QueryRow(ctx, `
+        UPDATE upload_policy SET allow_types=$1, deny_types=$2, on_mismatch=$3, updated_at=now(), updated_by=$4
+        RETURNING allow_types, deny_types, on_mismatch, updated_at, updated_by`,
+		p.Allow, p.Deny, p.OnMismatch, updatedBy).Scan(&out.Allow, &out.Deny, &out.OnMismatch, &out.UpdatedAt, &out.UpdatedBy)
+	return out, err
+}
@@ -0,0 +1,179 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// ErrQuotaExceeded is returned by ReserveQuota when the user has no room left.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// Quota is a user's storage allowance. LimitBytes is negative when unlimited.
+type Quota struct {
+	LimitBytes    int64
+	UsedBytes     int64
+	ReservedBytes int64
+}
+
+func (q Quota) Unlimited() bool { return q.LimitBytes < 0 }
+
+// Remaining is the space left after used and reserved bytes; -1 when unlimited.
+func (q Quota) Remaining() int64 {
+	if q.Unlimited() {
+		return -1
+	}
+	return max(q.LimitBytes-q.UsedBytes-q.ReservedBytes, 0)
+}
+
+// Reservation holds quota for an upload in flight.
+type Reservation struct {
+	ID    string
+	Bytes int64
+}
+
+func getQuota(ctx context.Context, q DB, userID string, defaultLimit int64) (Quota, error) {
+	var quota Quota
+	err := q.QueryRow(ctx, `
+        SELECT
+            COALESCE((SELECT quota_bytes FROM users WHERE id=$1), $2),
+            (SELECT COALESCE(SUM(size_bytes),0) FROM files WHERE owner_id=$1)
+              + (SELECT COALESCE(SUM(v.size_bytes),0) FROM file_versions v JOIN files f ON f.id = v.file_id WHERE f.owner_id=$1),
+            (SELECT COALESCE(SUM(bytes),0) FROM quota_reservations WHERE user_id=$1 AND expires_at > now())`,
+		userID, defaultLimit).Scan(&quota.LimitBytes, &quota.UsedBytes, &quota.ReservedBytes)
+	return quota, err
+}
+
+// GetQuota returns the user's limit (their override or defaultLimit), the
+// bytes used by their files (earlier versions included) and the bytes reserved
+// by uploads in flight.
+func (r *Repository) GetQuota(ctx context.Context, userID string, defaultLimit int64) (Quota, error) {
+	return getQuota(ctx, r.DB, userID, defaultLimit)
+}
+
+// ReservationStep is how much quota an upload of unknown size holds at a
+// time. Holding all of the remaining quota instead would fail every other
+// upload of the user until it completes.
+const ReservationStep = 64 << 20
+
+// ReserveQuota holds bytes of the user's quota until ttl passes or the
+// reservation is released. With bytes < 0 (size not known up front) up to
+// ReservationStep is reserved, to be topped up with GrowReservation as the
+// upload proceeds. When bytes exceeds the remaining quota and allowPartial is
+// set, the remaining quota is reserved; callers then enforce
+// Reservation.Bytes while streaming. Otherwise ErrQuotaExceeded is returned
+// together with the quota. Reservations of one user are serialized so that
+// concurrent uploads cannot both claim the same space.
+func (r *Repository) ReserveQuota(ctx context.Context, userID string, bytes int64, allowPartial bool, defaultLimit int64, ttl time.Duration) (Reservation, Quota, error) {
+	var res Reservation
+	var quota Quota
+	err := pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		if err := lockQuota(ctx, tx, userID); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(ctx, `DELETE FROM quota_reservations WHERE user_id=$1 AND expires_at <= now()`, userID); err != nil {
+			return err
+		}
+		var err error
+		if quota, err = getQuota(ctx, tx, userID, defaultLimit); err != nil {
+			return err
+		}
+		res.Bytes = bytes
+		if !quota.Unlimited() {
+			left := quota.Remaining()
+			switch {
+			case bytes < 0:
+				res.Bytes = min(left, ReservationStep)
+			case bytes > left && allowPartial:
+				res.Bytes = left
+			case bytes > left:
+				return ErrQuotaExceeded
+			}
+			if res.Bytes == 0 && bytes != 0 {
+				return ErrQuotaExceeded
+			}
+		} else if bytes < 0 {
+			res.Bytes = 0
+		}
+		return tx.QueryRow(ctx, `
+            INSERT INTO quota_reservations (user_id, bytes, expires_at)
+            VALUES ($1, $2, now() + $3::interval) RETURNING id`, userID, res.Bytes, ttl).Scan(&res.ID)
+	})
+	return res, quota, err
+}
+
+// GrowReservation adds up to bytes to the reservation id of userID, as much
+// as the remaining quota allows, and returns how many bytes were added.
+// ErrQuotaExceeded is returned together with the quota when nothing is left,
+// pgx.ErrNoRows when the reservation expired.
+func (r *Repository) GrowReservation(ctx context.Context, id, userID string, bytes, defaultLimit int64) (int64, Quota, error) {
+	var added int64
+	var quota Quota
+	err := pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		if err := lockQuota(ctx, tx, userID); err != nil {
+			return err
+		}
+		var err error
+		if quota, err = getQuota(ctx, tx, userID, defaultLimit); err != nil {
+			return err
+		}
+		added = bytes
+		if !quota.Unlimited() {
+			if added = min(bytes, quota.Remaining()); added <= 0 {
+				return ErrQuotaExceeded
+			}
+		}
+		cmd, err := tx.Exec(ctx, `
+            UPDATE quota_reservations SET bytes = bytes + $3
+            WHERE id=$1 AND user_id=$2 AND expires_at > now()`, id, userID, added)
+		if err != nil {
+			return err
+		}
+		if cmd.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+		return nil
+	})
+	return added, quota, err
+}
+
+// lockQuota serializes changes to userID's reservations until tx ends.
+func lockQuota(ctx context.Context, tx pgx.Tx, userID string) error {
+	_, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('quota:' || $1::text))`, userID)
+	return err
+}
+
+// ExtendReservation moves a reservation's expiry to expiresAt.
+func (r *Repository) ExtendReservation(ctx context.Context, id string, expiresAt time.Time) error {
+	_, err := r.DB.Exec(ctx, `UPDATE quota_reservations SET expires_at=$2 WHERE id=$1`, id, expiresAt)
+	return err
+}
+
+// ShrinkReservation takes bytes an upload has just stored as a file off its
+// reservation id. Run in the transaction that records the file, it keeps the
+// bytes from counting as both used and reserved while the upload goes on.
+func (r *Repository) ShrinkReservation(ctx context.Context, id string, bytes int64) error {
+	_, err := r.DB.Exec(ctx, `UPDATE quota_reservations SET bytes = GREATEST(bytes - $2, 0) WHERE id=$1`, id, bytes)
+	return err
+}
+
+// ReleaseReservation drops a reservation, either because its upload was
+// committed (the bytes now count as files) or because it was abandoned.
+func (r *Repository) ReleaseReservation(ctx context.Context, id string) error {
+	_, err := r.DB.Exec(ctx, `DELETE FROM quota_reservations WHERE id=$1`, id)
+	return err
+}
+
+// SetUserQuota sets a user's quota override; nil restores the default.
+func (r *Repository) SetUserQuota(ctx context.Context, userID string, quotaBytes *int64) error {
+	cmd, err := r.DB.Exec(ctx, `UPDATE users SET quota_bytes=$2 WHERE id=$1`, userID, quotaBytes)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package repo
+
+import "testing"
+
+func TestQuotaRemaining(t *testing.T) {
+	for _, c := range []struct {
+		q    Quota
+		want int64
+	}{
+		{Quota{LimitBytes: 100}, 100},
+		{Quota{LimitBytes: 100, UsedBytes: 30, ReservedBytes: 20}, 50},
+		{Quota{LimitBytes: 100, UsedBytes: 100}, 0},
+		// an override lowered below the usage leaves nothing, not a negative
+		{Quota{LimitBytes: 100, UsedBytes: 80, ReservedBytes: 40}, 0},
+		{Quota{LimitBytes: -1, UsedBytes: 1 << 40}, -1},
+	} {
+		if got := c.q.Remaining(); got != c.want {
+			t.Errorf("%+v.Remaining() = %d, want %d", c.q, got, c.want)
+		}
+		if c.q.Unlimited() != (c.want < 0) {
+			t.Errorf("%+v.Unlimited() = %v", c.q, c.q.Unlimited())
+		}
+	}
+}
@@ -9,13 +9,16 @@ import (
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
+
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
 )
 
 type Repository struct {
-	Pool *pgxpool.Pool
+	// DB is the pool, or a transaction for repositories passed to WithTx callbacks.
+	DB DB
 }
 
-func New(pool *pgxpool.Pool) *Repository { return &Repository{Pool: pool} }
+func New(pool *pgxpool.Pool) *Repository { return &Repository{DB: pool} }
 
 // User
 type User struct {
@@ -33,30 +36,73 @@ func (r *Repository) UpsertUserByID(ctx context.Context, id string, email string
         ON CONFLICT (id) DO UPDATE SET email = EXCLUDED.email, name = EXCLUDED.name
         RETURNING id, email, name, role, created_at`
 	var u User
-	err := r.Pool.QueryRow(ctx, q, id, email, name).Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.CreatedAt)
+	err := r.DB.QueryRow(ctx, q, id, email, name).Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.CreatedAt)
 	return u, err
 }
 
 func (r *Repository) EnsureUserExists(ctx context.Context, id string) error {
 	// Create placeholder if not exists
-	_, err := r.Pool.Exec(ctx, `INSERT INTO users (id, email, name) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING`, id, id+"@local", "User")
+	_, err := r.DB.Exec(ctx, `INSERT INTO users (id, email, name) VALUES ($1, $2, $3) ON CONFLICT (id) DO NOTHING`, id, id+"@local", "User")
 	return err
 }
 
-// Blob
+// Blob is a unit of deduplicated content. StoragePath is the storage backend
+// key (rows written by older versions may hold an absolute disk path).
 type Blob struct {
 	Hash        string
 	SizeBytes   int64
 	MIMEType    *string
 	StoragePath string
 	RefCount    int64
+	Chunked     bool
+	KeyID       *string
+	WrappedKey  []byte
+	Codec       *string
+	StoredSize  *int64
 	CreatedAt   time.Time
+
+	// Chunks is the chunk manifest written by InsertBlob for chunked blobs.
+	Chunks []storage.Chunk
+}
+
+// NewBlob builds the row for content written by storage.Service.WriteAndHash.
+func NewBlob(sb storage.Blob, mime *string) Blob {
+	return Blob{Hash: sb.Hash, SizeBytes: sb.Size, MIMEType: mime, StoragePath: sb.Key, Chunked: sb.Chunked(), Chunks: sb.Chunks,
+		KeyID: nilIfEmpty(sb.KeyID), WrappedKey: sb.WrappedKey, Codec: nilIfEmpty(sb.Codec), StoredSize: nilIfZero(sb.StoredSize)}
+}
+
+func nilIfEmpty(s string) *string {
+	if s == "" {
+		return nil
+	}
+	return &s
+}
+
+func nilIfZero(n int64) *int64 {
+	if n == 0 {
+		return nil
+	}
+	return &n
+}
+
+func encoding(keyID *string, wrapped []byte, codec *string, stored *int64) storage.Encoding {
+	var e storage.Encoding
+	if keyID != nil {
+		e.KeyID, e.WrappedKey = *keyID, wrapped
+	}
+	if codec != nil {
+		e.Codec = *codec
+	}
+	if stored != nil {
+		e.StoredSize = *stored
+	}
+	return e
 }
 
 func (r *Repository) GetBlob(ctx context.Context, hash string) (Blob, error) {
-	const q = `SELECT hash, size_bytes, mime_type, storage_path, ref_count, created_at FROM blobs WHERE hash=$1`
+	const q = `SELECT hash, size_bytes, mime_type, storage_path, ref_count, chunked, key_id, wrapped_key, codec, stored_size, created_at FROM blobs WHERE hash=$1`
 	var b Blob
-	err := r.Pool.QueryRow(ctx, q, hash).Scan(&b.Hash, &b.SizeBytes, &b.MIMEType, &b.StoragePath, &b.RefCount, &b.CreatedAt)
+	err := r.DB.QueryRow(ctx, q, hash).Scan(&b.Hash, &b.SizeBytes, &b.MIMEType, &b.StoragePath, &b.RefCount, &b.Chunked, &b.KeyID, &b.WrappedKey, &b.Codec, &b.StoredSize, &b.CreatedAt)
 	if err != nil {
 		if errors.Is(err, pgx.ErrNoRows) {
 			return Blob{}, err
@@ -66,14 +112,125 @@ func (r *Repository) GetBlob(ctx context.Context, hash string) (Blob, error) {
 	return b, nil
 }
 
-func (r *Repository) InsertBlob(ctx context.Context, b Blob) error {
-	const q = `INSERT INTO blobs (hash, size_bytes, mime_type, storage_path, ref_count) VALUES ($1,$2,$3,$4,$5) ON CONFLICT (hash) DO NOTHING`
-	_, err := r.Pool.Exec(ctx, q, b.Hash, b.SizeBytes, b.MIMEType, b.StoragePath, b.RefCount)
+// InsertBlob records a blob if it is new and reports whether it was. For
+// chunked blobs the chunk manifest is written in the same transaction and each
+// chunk's ref_count is raised by the number of times the blob references it.
+func (r *Repository) InsertBlob(ctx context.Context, b Blob) (bool, error) {
+	const q = `
+        INSERT INTO blobs (hash, size_bytes, mime_type, storage_path, ref_count, chunked, key_id, wrapped_key, codec, stored_size)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10) ON CONFLICT (hash) DO NOTHING`
+	if !b.Chunked {
+		cmd, err := r.DB.Exec(ctx, q, b.Hash, b.SizeBytes, b.MIMEType, b.StoragePath, b.RefCount, false, b.KeyID, b.WrappedKey, b.Codec, b.StoredSize)
+		return err == nil && cmd.RowsAffected() > 0, err
+	}
+	inserted := false
+	err := pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		cmd, err := tx.Exec(ctx, q, b.Hash, b.SizeBytes, b.MIMEType, b.StoragePath, b.RefCount, true, b.KeyID, b.WrappedKey, b.Codec, b.StoredSize)
+		if err != nil || cmd.RowsAffected() == 0 {
+			return err
+		}
+		inserted = true
+		return insertChunkManifest(ctx, tx, b.Hash, b.Chunks)
+	})
+	return inserted && err == nil, err
+}
+
+func insertChunkManifest(ctx context.Context, tx pgx.Tx, blobHash string, chunks []storage.Chunk) error {
+	counts := map[string]int64{}
+	var hashes, keys []string
+	var sizes, refs []int64
+	var keyIDs, codecs []*string
+	var wrapped [][]byte
+	var stored []*int64
+	for _, c := range chunks {
+		if counts[c.Hash] == 0 {
+			hashes = append(hashes, c.Hash)
+			keys = append(keys, c.Key)
+			sizes = append(sizes, c.Size)
+			keyIDs = append(keyIDs, nilIfEmpty(c.KeyID))
+			wrapped = append(wrapped, c.WrappedKey)
+			codecs = append(codecs, nilIfEmpty(c.Codec))
+			stored = append(stored, nilIfZero(c.StoredSize))
+		}
+		counts[c.Hash]++
+	}
+	for _, h := range hashes {
+		refs = append(refs, counts[h])
+	}
+	if _, err := tx.Exec(ctx, `
+        INSERT INTO chunks (hash, size_bytes, storage_path, ref_count, key_id, wrapped_key, codec, stored_size)
+        SELECT * FROM unnest($1::text[], $2::bigint[], $3::text[], $4::bigint[], $5::text[], $6::bytea[], $7::text[], $8::bigint[])
+        ON CONFLICT (hash) DO UPDATE SET ref_count = chunks.ref_count + EXCLUDED.ref_count`,
+		hashes, sizes, keys, refs, keyIDs, wrapped, codecs, stored); err != nil {
+		return err
+	}
+	rows := make([][]any, len(chunks))
+	for i, c := range chunks {
+		rows[i] = []any{blobHash, int32(i), c.Hash, c.Offset}
+	}
+	_, err := tx.CopyFrom(ctx, pgx.Identifier{"blob_chunks"}, []string{"blob_hash", "seq", "chunk_hash", "offset_bytes"}, pgx.CopyFromRows(rows))
 	return err
 }
 
+// ObjectEncoding returns how the object under key was stored according to
+// the chunks or (unchunked) blobs row it belongs to; ok is false when there
+// is no such row. It serves as storage.Service.Recorded.
+func (r *Repository) ObjectEncoding(ctx context.Context, key string) (enc storage.Encoding, ok bool, err error) {
+	hash, chunk, valid := storage.ParseKey(key)
+	if !valid {
+		return enc, false, nil
+	}
+	q := `SELECT key_id, wrapped_key, codec, stored_size FROM blobs WHERE hash=$1 AND NOT chunked`
+	if chunk {
+		q = `SELECT key_id, wrapped_key, codec, stored_size FROM chunks WHERE hash=$1`
+	}
+	var keyID, codec *string
+	var wrapped []byte
+	var stored *int64
+	err = r.DB.QueryRow(ctx, q, hash).Scan(&keyID, &wrapped, &codec, &stored)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return enc, false, nil
+	}
+	if err != nil {
+		return enc, false, err
+	}
+	return encoding(keyID, wrapped, codec, stored), true, nil
+}
+
+// GetStoredBlob returns the storage descriptor for a blob, including its chunk manifest.
+func (r *Repository) GetStoredBlob(ctx context.Context, hash string) (storage.Blob, error) {
+	b, err := r.GetBlob(ctx, hash)
+	if err != nil {
+		return storage.Blob{}, err
+	}
+	sb := storage.Blob{Hash: b.Hash, Key: b.StoragePath, Size: b.SizeBytes, Encoding: encoding(b.KeyID, b.WrappedKey, b.Codec, b.StoredSize)}
+	if !b.Chunked {
+		return sb, nil
+	}
+	rows, err := r.DB.Query(ctx, `
+        SELECT c.hash, c.storage_path, bc.offset_bytes, c.size_bytes, c.key_id, c.wrapped_key, c.codec, c.stored_size
+        FROM blob_chunks bc JOIN chunks c ON c.hash = bc.chunk_hash
+        WHERE bc.blob_hash=$1 ORDER BY bc.seq`, hash)
+	if err != nil {
+		return storage.Blob{}, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var c storage.Chunk
+		var keyID, codec *string
+		var wrapped []byte
+		var stored *int64
+		if err := rows.Scan(&c.Hash, &c.Key, &c.Offset, &c.Size, &keyID, &wrapped, &codec, &stored); err != nil {
+			return storage.Blob{}, err
+		}
+		c.Encoding = encoding(keyID, wrapped, codec, stored)
+		sb.Chunks = append(sb.Chunks, c)
+	}
+	return sb, rows.Err()
+}
+
 func (r *Repository) IncBlobRef(ctx context.Context, hash string, delta int64) error {
-	_, err := r.Pool.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + $2 WHERE hash=$1`, hash, delta)
+	_, err := r.DB.Exec(ctx, `UPDATE blobs SET ref_count = ref_count + $2 WHERE hash=$1`, hash, delta)
 	return err
 }
 
@@ -88,30 +245,59 @@ type File struct {
 	IsPublic  bool
 	Tags      []string
 	CreatedAt time.Time
+	// DetectedMIME is the type sniffed from the content at upload; MIMEType
+	// is what the client declared. MIMEMismatch is set when they disagree.
+	DetectedMIME *string
+	MIMEMismatch bool
+	// SourcePath and ModifiedAt describe the archive entry a file was
+	// expanded from: its relative path and modification time.
+	SourcePath *string
+	ModifiedAt *time.Time
+	// FolderID is nil for files in the root folder.
+	FolderID *string
+	// Version numbers the file's current content, stored at UpdatedAt;
+	// earlier versions are FileVersions.
+	Version   int
+	UpdatedAt time.Time
+	// DeletedAt is set while the file is in the trash.
+	DeletedAt *time.Time
+	// Metadata maps custom keys to strings, numbers or booleans.
+	Metadata map[string]any
+	// DownloadCount counts the downloads through the file's public link.
+	DownloadCount int64
 }
 
-func (r *Repository) CreateFile(ctx context.Context, f File) (File, error) {
-	const q = `
-        INSERT INTO files (owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags)
-        VALUES ($1,$2,$3,$4,$5,$6,$7)
-        RETURNING id, owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags, created_at`
-	var out File
-	err := r.Pool.QueryRow(ctx, q, f.OwnerID, f.BlobHash, f.Filename, f.SizeBytes, f.MIMEType, f.IsPublic, f.Tags).Scan(
-		&out.ID, &out.OwnerID, &out.BlobHash, &out.Filename, &out.SizeBytes, &out.MIMEType, &out.IsPublic, &out.Tags, &out.CreatedAt,
-	)
-	return out, err
+// fileColumns lists the columns scanned by File.scanDest, qualified with
+// alias when it is not empty.
+func fileColumns(alias string) string {
+	cols := []string{"id", "owner_id", "blob_hash", "filename", "size_bytes", "mime_type", "is_public", "tags", "created_at", "detected_mime", "mime_mismatch", "source_path", "modified_at", "folder_id", "version", "updated_at", "deleted_at", "metadata", "download_count"}
+	if alias != "" {
+		for i, c := range cols {
+			cols[i] = alias + "." + c
+		}
+	}
+	return strings.Join(cols, ", ")
 }
 
-func (r *Repository) ListFilesByOwner(ctx context.Context, ownerID string, limit int, offset int) ([]File, error) {
-	rows, err := r.Pool.Query(ctx, `SELECT id, owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags, created_at FROM files WHERE owner_id=$1 ORDER BY created_at DESC LIMIT $2 OFFSET $3`, ownerID, limit, offset)
-	if err != nil {
-		return nil, err
+func (f *File) scanDest() []any {
+	return []any{&f.ID, &f.OwnerID, &f.BlobHash, &f.Filename, &f.SizeBytes, &f.MIMEType, &f.IsPublic, &f.Tags, &f.CreatedAt, &f.DetectedMIME, &f.MIMEMismatch, &f.SourcePath, &f.ModifiedAt, &f.FolderID, &f.Version, &f.UpdatedAt, &f.DeletedAt, &f.Metadata, &f.DownloadCount}
+}
+
+// ContentType is the type to serve the file as: the declared type unless the
+// content contradicted it.
+func (f File) ContentType() *string {
+	if f.MIMEMismatch || f.MIMEType == nil {
+		return f.DetectedMIME
 	}
+	return f.MIMEType
+}
+
+func scanFiles(rows pgx.Rows) ([]File, error) {
 	defer rows.Close()
 	var out []File
 	for rows.Next() {
 		var f File
-		if err := rows.Scan(&f.ID, &f.OwnerID, &f.BlobHash, &f.Filename, &f.SizeBytes, &f.MIMEType, &f.IsPublic, &f.Tags, &f.CreatedAt); err != nil {
+		if err := rows.Scan(f.scanDest()...); err != nil {
 			return nil, err
 		}
 		out = append(out, f)
@@ -119,99 +305,298 @@ func (r *Repository) ListFilesByOwner(ctx context.Context, ownerID string, limit
 	return out, rows.Err()
 }
 
+func (r *Repository) CreateFile(ctx context.Context, f File) (File, error) {
+	q := `
+        INSERT INTO files (owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags, detected_mime, mime_mismatch, source_path, modified_at, folder_id)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12)
+        RETURNING ` + fileColumns("")
+	var out File
+	err := r.DB.QueryRow(ctx, q, f.OwnerID, f.BlobHash, f.Filename, f.SizeBytes, f.MIMEType, f.IsPublic, f.Tags, f.DetectedMIME, f.MIMEMismatch, f.SourcePath, f.ModifiedAt, f.FolderID).Scan(out.scanDest()...)
+	return out, err
+}
+
+// GetFile returns the owner's file id, or pgx.ErrNoRows; files in the trash
+// are not found.
+func (r *Repository) GetFile(ctx context.Context, ownerID, id string) (File, error) {
+	var f File
+	err := r.DB.QueryRow(ctx, "SELECT "+fileColumns("")+" FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL", id, ownerID).Scan(f.scanDest()...)
+	return f, err
+}
+
 type FileFilters struct {
-	NameLike  *string
+	NameLike *string
+	// MIMETypes matches the declared or detected type; "*" stands for any
+	// run of characters, as in image/*.
 	MIMETypes []string
 	SizeMin   *int64
 	SizeMax   *int64
 	DateFrom  *time.Time
 	DateTo    *time.Time
 	Tags      []string
+	// MIMEMismatch selects files whose declared type disagreed with their content.
+	MIMEMismatch *bool
+	IsPublic     *bool
+	// Metadata filters must all match.
+	Metadata []MetadataFilter
+	// Expr must match as well as the other filters.
+	Expr *FilterExpr
+}
+
+// FilterExpr combines filters with AND, OR and NOT. Exactly one of its
+// fields is set.
+type FilterExpr struct {
+	And     []FilterExpr
+	Or      []FilterExpr
+	Not     *FilterExpr
+	Filters *FileFilters
 }
 
+// condition returns the SQL condition for e, with arguments numbered from
+// argn.
+func (e FilterExpr) condition(argn int) (string, []any, error) {
+	var args []any
+	join := func(es []FilterExpr, op string) (string, []any, error) {
+		conds := make([]string, len(es))
+		for i, x := range es {
+			c, xargs, err := x.condition(argn + len(args))
+			if err != nil {
+				return "", nil, err
+			}
+			conds[i] = c
+			args = append(args, xargs...)
+		}
+		return "(" + strings.Join(conds, op) + ")", args, nil
+	}
+	switch {
+	case e.Filters != nil:
+		conds, args, err := e.Filters.conditions(argn)
+		if err != nil || len(conds) == 0 {
+			return "TRUE", nil, err
+		}
+		// a file without a type or a metadata value does not match, so is
+		// matched by the negation
+		return "COALESCE((" + strings.Join(conds, " AND ") + "), FALSE)", args, nil
+	case e.Not != nil:
+		c, args, err := e.Not.condition(argn)
+		return "NOT " + c, args, err
+	case len(e.Or) > 0:
+		return join(e.Or, " OR ")
+	case len(e.And) > 0:
+		return join(e.And, " AND ")
+	}
+	return "TRUE", nil, nil
+}
+
+// likePatterns turns MIME type patterns into LIKE patterns.
+func likePatterns(types []string) []string {
+	out := make([]string, len(types))
+	esc := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "%")
+	for i, t := range types {
+		out[i] = esc.Replace(t)
+	}
+	return out
+}
+
+// conditions returns the SQL conditions for f, with arguments numbered from
+// argn.
+func (f FileFilters) conditions(argn int) (where []string, args []any, err error) {
+	arg := func(v any) string {
+		args = append(args, v)
+		return "$" + itoa(argn+len(args)-1)
+	}
+	if f.NameLike != nil && *f.NameLike != "" {
+		where = append(where, "filename ILIKE "+arg("%"+*f.NameLike+"%"))
+	}
+	if len(f.MIMETypes) > 0 {
+		a := arg(likePatterns(f.MIMETypes))
+		where = append(where, "(mime_type LIKE ANY("+a+") OR detected_mime LIKE ANY("+a+"))")
+	}
+	if f.SizeMin != nil {
+		where = append(where, "size_bytes >= "+arg(*f.SizeMin))
+	}
+	if f.SizeMax != nil {
+		where = append(where, "size_bytes <= "+arg(*f.SizeMax))
+	}
+	if f.DateFrom != nil {
+		where = append(where, "created_at >= "+arg(*f.DateFrom))
+	}
+	if f.DateTo != nil {
+		where = append(where, "created_at <= "+arg(*f.DateTo))
+	}
+	if len(f.Tags) > 0 {
+		where = append(where, "tags && "+arg(f.Tags))
+	}
+	if f.MIMEMismatch != nil {
+		where = append(where, "mime_mismatch = "+arg(*f.MIMEMismatch))
+	}
+	if f.IsPublic != nil {
+		where = append(where, "is_public = "+arg(*f.IsPublic))
+	}
+	for _, mf := range f.Metadata {
+		conds, margs, err := mf.conditions(argn + len(args))
+		if err != nil {
+			return nil, nil, err
+		}
+		where = append(where, conds...)
+		args = append(args, margs...)
+	}
+	if f.Expr != nil {
+		c, eargs, err := f.Expr.condition(argn + len(args))
+		if err != nil {
+			return nil, nil, err
+		}
+		where = append(where, c)
+		args = append(args, eargs...)
+	}
+	return where, args, nil
+}
+
+// ListFilesFiltered returns a page of the owner's files by offset, newest
+// first. ListFilesPage pages by cursor instead.
 func (r *Repository) ListFilesFiltered(ctx context.Context, ownerID string, filters FileFilters, limit int, offset int) ([]File, error) {
-	where := []string{"owner_id = $1"}
-	args := []any{ownerID}
-	argn := 2
-	if filters.NameLike != nil && *filters.NameLike != "" {
-		where = append(where, "filename ILIKE $"+itoa(argn))
-		args = append(args, "%"+*filters.NameLike+"%")
-		argn++
-	}
-	if len(filters.MIMETypes) > 0 {
-		where = append(where, "mime_type = ANY($"+itoa(argn)+")")
-		args = append(args, filters.MIMETypes)
-		argn++
-	}
-	if filters.SizeMin != nil {
-		where = append(where, "size_bytes >= $"+itoa(argn))
-		args = append(args, *filters.SizeMin)
-		argn++
-	}
-	if filters.SizeMax != nil {
-		where = append(where, "size_bytes <= $"+itoa(argn))
-		args = append(args, *filters.SizeMax)
-		argn++
-	}
-	if filters.DateFrom != nil {
-		where = append(where, "created_at >= $"+itoa(argn))
-		args = append(args, *filters.DateFrom)
-		argn++
-	}
-	if filters.DateTo != nil {
-		where = append(where, "created_at <= $"+itoa(argn))
-		args = append(args, *filters.DateTo)
-		argn++
-	}
-	if len(filters.Tags) > 0 {
-		where = append(where, "tags && $"+itoa(argn))
-		args = append(args, filters.Tags)
-		argn++
-	}
-	query := "SELECT id, owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags, created_at FROM files WHERE " + strings.Join(where, " AND ") + " ORDER BY created_at DESC LIMIT $" + itoa(argn) + " OFFSET $" + itoa(argn+1)
-	args = append(args, limit, offset)
-	rows, err := r.Pool.Query(ctx, query, args...)
+	conds, args, err := filters.conditions(2)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var out []File
-	for rows.Next() {
-		var f File
-		if err := rows.Scan(&f.ID, &f.OwnerID, &f.BlobHash, &f.Filename, &f.SizeBytes, &f.MIMEType, &f.IsPublic, &f.Tags, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		out = append(out, f)
+	where := append([]string{"owner_id = $1", "deleted_at IS NULL"}, conds...)
+	args = append([]any{ownerID}, args...)
+	argn := len(args) + 1
+	query := "SELECT " + fileColumns("") + " FROM files WHERE " + strings.Join(where, " AND ") + " ORDER BY created_at DESC, id DESC LIMIT $" + itoa(argn) + " OFFSET $" + itoa(argn+1)
+	args = append(args, limit, offset)
+	rows, err := r.DB.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
 	}
-	return out, rows.Err()
+	return scanFiles(rows)
 }
 
 func itoa(i int) string { return fmt.Sprintf("%d", i) }
 
 func (r *Repository) SumUserStorage(ctx context.Context, ownerID string) (int64, error) {
 	var sum int64
-	if err := r.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(size_bytes),0) FROM files WHERE owner_id=$1`, ownerID).Scan(&sum); err != nil {
+	if err := r.DB.QueryRow(ctx, `SELECT COALESCE(SUM(size_bytes),0) FROM files WHERE owner_id=$1`, ownerID).Scan(&sum); err != nil {
 		return 0, err
 	}
 	return sum, nil
 }
 
-func (r *Repository) UserStorageStats(ctx context.Context, ownerID string) (original int64, deduped int64, err error) {
-	if err = r.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(size_bytes),0) FROM files WHERE owner_id=$1`, ownerID).Scan(&original); err != nil {
-		return
+// RewrapKeys re-wraps every blob and chunk data key not yet under activeKeyID,
+// in batches, using rewrap to produce the new wrapped key. Content is not touched.
+// It returns the number of rows updated.
+func (r *Repository) RewrapKeys(ctx context.Context, activeKeyID string, rewrap func(keyID string, wrapped []byte) (string, []byte, error)) (int64, error) {
+	var total int64
+	for _, table := range []string{"blobs", "chunks"} {
+		for {
+			n, err := r.rewrapBatch(ctx, table, activeKeyID, rewrap)
+			total += n
+			if err != nil {
+				return total, err
+			}
+			if n == 0 {
+				break
+			}
+		}
+	}
+	return total, nil
+}
+
+func (r *Repository) rewrapBatch(ctx context.Context, table string, activeKeyID string, rewrap func(string, []byte) (string, []byte, error)) (int64, error) {
+	var n int64
+	err := pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		rows, err := tx.Query(ctx, `SELECT hash, key_id, wrapped_key FROM `+table+` WHERE key_id IS NOT NULL AND key_id <> $1 LIMIT 500 FOR UPDATE SKIP LOCKED`, activeKeyID)
+		if err != nil {
+			return err
+		}
+		type row struct {
+			hash, keyID string
+			wrapped     []byte
+		}
+		var batch []row
+		for rows.Next() {
+			var rw row
+			if err := rows.Scan(&rw.hash, &rw.keyID, &rw.wrapped); err != nil {
+				rows.Close()
+				return err
+			}
+			batch = append(batch, rw)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		for _, rw := range batch {
+			id, wrapped, err := rewrap(rw.keyID, rw.wrapped)
+			if err != nil {
+				return fmt.Errorf("%s %s: %w", table, rw.hash, err)
+			}
+			if _, err := tx.Exec(ctx, `UPDATE `+table+` SET key_id=$2, wrapped_key=$3 WHERE hash=$1`, rw.hash, id, wrapped); err != nil {
+				return err
+			}
+		}
+		n = int64(len(batch))
+		return nil
+	})
+	return n, err
+}
+
+// KeyIDsInUse lists the master key ids still referenced by blobs or chunks.
+func (r *Repository) KeyIDsInUse(ctx context.Context) ([]string, error) {
+	rows, err := r.DB.Query(ctx, `SELECT key_id FROM blobs WHERE key_id IS NOT NULL UNION SELECT key_id FROM chunks WHERE key_id IS NOT NULL`)
+	if err != nil {
+		return nil, err
 	}
-	if err = r.Pool.QueryRow(ctx, `
-        SELECT COALESCE(SUM(b.size_bytes),0)
-        FROM blobs b
-        WHERE b.hash IN (SELECT DISTINCT blob_hash FROM files WHERE owner_id=$1)
-    `, ownerID).Scan(&deduped); err != nil {
-		return
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		out = append(out, id)
 	}
-	return
+	return out, rows.Err()
+}
+
+// StorageStats breaks down a user's storage. OriginalBytes counts every file,
+// DedupedBytes counts each distinct blob once, and ChunkedBytes counts each
+// distinct chunk once (unchunked blobs count in full). StoredBytes is what those
+// objects occupy in the backend; CompressionSavedBytes is the part of the
+// difference due to compression.
+type StorageStats struct {
+	OriginalBytes         int64
+	DedupedBytes          int64
+	ChunkedBytes          int64
+	StoredBytes           int64
+	CompressionSavedBytes int64
+}
+
+func (r *Repository) UserStorageStats(ctx context.Context, ownerID string) (StorageStats, error) {
+	var st StorageStats
+	if err := r.DB.QueryRow(ctx, `SELECT COALESCE(SUM(size_bytes),0) FROM files WHERE owner_id=$1`, ownerID).Scan(&st.OriginalBytes); err != nil {
+		return st, err
+	}
+	if err := r.DB.QueryRow(ctx, `
+        WITH ub AS (SELECT DISTINCT blob_hash FROM files WHERE owner_id=$1),
+        bl AS (SELECT b.* FROM blobs b JOIN ub ON ub.blob_hash = b.hash),
+        objs AS (
+            SELECT size_bytes, stored_size, codec FROM bl WHERE NOT chunked
+            UNION ALL
+            SELECT c.size_bytes, c.stored_size, c.codec FROM chunks c
+            WHERE c.hash IN (SELECT bc.chunk_hash FROM blob_chunks bc JOIN ub ON ub.blob_hash = bc.blob_hash)
+        )
+        SELECT
+            COALESCE((SELECT SUM(size_bytes) FROM bl), 0),
+            COALESCE((SELECT SUM(size_bytes) FROM objs), 0),
+            COALESCE((SELECT SUM(COALESCE(stored_size, size_bytes)) FROM objs), 0),
+            COALESCE((SELECT SUM(size_bytes - stored_size) FROM objs WHERE codec IS NOT NULL), 0)
+    `, ownerID).Scan(&st.DedupedBytes, &st.ChunkedBytes, &st.StoredBytes, &st.CompressionSavedBytes); err != nil {
+		return st, err
+	}
+	return st, nil
 }
 
 func (r *Repository) SetFilePublic(ctx context.Context, ownerID string, fileID string, isPublic bool) error {
-	cmd, err := r.Pool.Exec(ctx, `UPDATE files SET is_public=$1 WHERE id=$2 AND owner_id=$3`, isPublic, fileID, ownerID)
+	cmd, err := r.DB.Exec(ctx, `UPDATE files SET is_public=$1 WHERE id=$2 AND owner_id=$3 AND deleted_at IS NULL`, isPublic, fileID, ownerID)
 	if err != nil {
 		return err
 	}
@@ -221,30 +606,27 @@ func (r *Repository) SetFilePublic(ctx context.Context, ownerID string, fileID s
 	return nil
 }
 
+// DeleteFileAndMaybeBlob deletes a file with its earlier versions and
+// releases their blob references in one transaction.
 func (r *Repository) DeleteFileAndMaybeBlob(ctx context.Context, ownerID string, fileID string) error {
-	// get blob hash
-	var blob string
-	err := r.Pool.QueryRow(ctx, `SELECT blob_hash FROM files WHERE id=$1 AND owner_id=$2`, fileID, ownerID).Scan(&blob)
-	if err != nil {
-		return err
-	}
-	// delete file
-	if _, err := r.Pool.Exec(ctx, `DELETE FROM files WHERE id=$1 AND owner_id=$2`, fileID, ownerID); err != nil {
-		return err
-	}
-	// decrement ref
-	if _, err := r.Pool.Exec(ctx, `UPDATE blobs SET ref_count = ref_count - 1 WHERE hash=$1`, blob); err != nil {
-		return err
-	}
-	// optional: purge blob when zero; leave to GC job for now
-	return nil
+	return r.WithTx(ctx, func(tx *Repository) error {
+		if err := tx.deleteVersionsOf(ctx, `f.id=$1 AND f.owner_id=$2`, fileID, ownerID); err != nil {
+			return err
+		}
+		var blob string
+		if err := tx.DB.QueryRow(ctx, `DELETE FROM files WHERE id=$1 AND owner_id=$2 RETURNING blob_hash`, fileID, ownerID).Scan(&blob); err != nil {
+			return err
+		}
+		// blobs left at zero references are purged by the gc package after a grace period
+		return tx.IncBlobRef(ctx, blob, -1)
+	})
 }
 
 // Sharing and downloads
 func (r *Repository) GetOrCreatePublicToken(ctx context.Context, ownerID string, fileID string, gen func() (string, error)) (string, error) {
 	// ensure ownership
 	var exists bool
-	if err := r.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2)`, fileID, ownerID).Scan(&exists); err != nil {
+	if err := r.DB.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL)`, fileID, ownerID).Scan(&exists); err != nil {
 		return "", err
 	}
 	if !exists {
@@ -252,7 +634,7 @@ func (r *Repository) GetOrCreatePublicToken(ctx context.Context, ownerID string,
 	}
 	// check existing
 	var token string
-	err := r.Pool.QueryRow(ctx, `SELECT public_token FROM shares WHERE file_id=$1 AND public_token IS NOT NULL LIMIT 1`, fileID).Scan(&token)
+	err := r.DB.QueryRow(ctx, `SELECT public_token FROM shares WHERE file_id=$1 AND public_token IS NOT NULL LIMIT 1`, fileID).Scan(&token)
 	if err == nil && token != "" {
 		return token, nil
 	}
@@ -261,7 +643,7 @@ func (r *Repository) GetOrCreatePublicToken(ctx context.Context, ownerID string,
 	if err != nil {
 		return "", err
 	}
-	_, err = r.Pool.Exec(ctx, `INSERT INTO shares (file_id, public_token) VALUES ($1, $2)`, fileID, newToken)
+	_, err = r.DB.Exec(ctx, `INSERT INTO shares (file_id, public_token) VALUES ($1, $2)`, fileID, newToken)
 	if err != nil {
 		return "", err
 	}
@@ -271,42 +653,47 @@ func (r *Repository) GetOrCreatePublicToken(ctx context.Context, ownerID string,
 func (r *Repository) RevokePublicToken(ctx context.Context, ownerID string, fileID string) error {
 	// ensure ownership
 	var exists bool
-	if err := r.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2)`, fileID, ownerID).Scan(&exists); err != nil {
+	if err := r.DB.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL)`, fileID, ownerID).Scan(&exists); err != nil {
 		return err
 	}
 	if !exists {
 		return pgx.ErrNoRows
 	}
-	_, err := r.Pool.Exec(ctx, `DELETE FROM shares WHERE file_id=$1 AND public_token IS NOT NULL`, fileID)
+	_, err := r.DB.Exec(ctx, `DELETE FROM shares WHERE file_id=$1 AND public_token IS NOT NULL`, fileID)
 	return err
 }
 
 type FileWithBlob struct {
 	File
 	BlobPath string
+	// Quarantined is set when the integrity scrubber found the blob missing or corrupt.
+	Quarantined bool
 }
 
 func (r *Repository) GetFileByPublicToken(ctx context.Context, token string) (FileWithBlob, error) {
-	const q = `
-        SELECT f.id, f.owner_id, f.blob_hash, f.filename, f.size_bytes, f.mime_type, f.is_public, f.tags, f.created_at, b.storage_path
+	q := `
+        SELECT ` + fileColumns("f") + `, b.storage_path, b.quarantined_at IS NOT NULL
         FROM shares s
         JOIN files f ON f.id = s.file_id
         JOIN blobs b ON b.hash = f.blob_hash
-        WHERE s.public_token=$1
+        WHERE s.public_token=$1 AND f.deleted_at IS NULL
         LIMIT 1`
 	var fw FileWithBlob
-	err := r.Pool.QueryRow(ctx, q, token).Scan(&fw.ID, &fw.OwnerID, &fw.BlobHash, &fw.Filename, &fw.SizeBytes, &fw.MIMEType, &fw.IsPublic, &fw.Tags, &fw.CreatedAt, &fw.BlobPath)
+	err := r.DB.QueryRow(ctx, q, token).Scan(append(fw.scanDest(), &fw.BlobPath, &fw.Quarantined)...)
 	return fw, err
 }
 
+// InsertDownload records a download and counts it on the file.
 func (r *Repository) InsertDownload(ctx context.Context, fileID string, userID *string, ip string) error {
-	_, err := r.Pool.Exec(ctx, `INSERT INTO downloads (file_id, user_id, ip) VALUES ($1,$2,$3)`, fileID, userID, ip)
+	_, err := r.DB.Exec(ctx, `
+        WITH d AS (INSERT INTO downloads (file_id, user_id, ip) VALUES ($1,$2,$3))
+        UPDATE files SET download_count = download_count + 1 WHERE id=$1`, fileID, userID, ip)
 	return err
 }
 
 func (r *Repository) CountDownloads(ctx context.Context, fileID string) (int64, error) {
 	var c int64
-	if err := r.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM downloads WHERE file_id=$1`, fileID).Scan(&c); err != nil {
+	if err := r.DB.QueryRow(ctx, `SELECT COUNT(*) FROM downloads WHERE file_id=$1`, fileID).Scan(&c); err != nil {
 		return 0, err
 	}
 	return c, nil
@@ -315,14 +702,14 @@ func (r *Repository) CountDownloads(ctx context.Context, fileID string) (int64,
 func (r *Repository) GetPublicTokenForFile(ctx context.Context, ownerID string, fileID string) (string, error) {
 	// ensure ownership
 	var exists bool
-	if err := r.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2)`, fileID, ownerID).Scan(&exists); err != nil {
+	if err := r.DB.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL)`, fileID, ownerID).Scan(&exists); err != nil {
 		return "", err
 	}
 	if !exists {
 		return "", pgx.ErrNoRows
 	}
 	var token string
-	err := r.Pool.QueryRow(ctx, `SELECT public_token FROM shares WHERE file_id=$1 AND public_token IS NOT NULL LIMIT 1`, fileID).Scan(&token)
+	err := r.DB.QueryRow(ctx, `SELECT public_token FROM shares WHERE file_id=$1 AND public_token IS NOT NULL LIMIT 1`, fileID).Scan(&token)
 	if err != nil {
 		return "", err
 	}
@@ -330,25 +717,19 @@ func (r *Repository) GetPublicTokenForFile(ctx context.Context, ownerID string,
 }
 
 // Admin queries
+
+// ListAllFiles returns a page of every user's files by offset, newest first,
+// leaving out those in the trash. ListAllFilesPage pages by cursor instead.
 func (r *Repository) ListAllFiles(ctx context.Context, limit int, offset int) ([]File, error) {
-	rows, err := r.Pool.Query(ctx, `SELECT id, owner_id, blob_hash, filename, size_bytes, mime_type, is_public, tags, created_at FROM files ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
+	rows, err := r.DB.Query(ctx, "SELECT "+fileColumns("")+" FROM files WHERE deleted_at IS NULL ORDER BY created_at DESC, id DESC LIMIT $1 OFFSET $2", limit, offset)
 	if err != nil {
 		return nil, err
 	}
-	defer rows.Close()
-	var out []File
-	for rows.Next() {
-		var f File
-		if err := rows.Scan(&f.ID, &f.OwnerID, &f.BlobHash, &f.Filename, &f.SizeBytes, &f.MIMEType, &f.IsPublic, &f.Tags, &f.CreatedAt); err != nil {
-			return nil, err
-		}
-		out = append(out, f)
-	}
-	return out, rows.Err()
+	return scanFiles(rows)
 }
 
 func (r *Repository) ListAllUsers(ctx context.Context, limit int, offset int) ([]User, error) {
-	rows, err := r.Pool.Query(ctx, `SELECT id, email, name, role, created_at FROM users ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
+	rows, err := r.DB.Query(ctx, `SELECT id, email, name, role, created_at FROM users ORDER BY created_at DESC LIMIT $1 OFFSET $2`, limit, offset)
 	if err != nil {
 		return nil, err
 	}
@@ -367,11 +748,11 @@ func (r *Repository) ListAllUsers(ctx context.Context, limit int, offset int) ([
 func (r *Repository) GetUserByID(ctx context.Context, id string) (User, error) {
 	const q = `SELECT id, email, name, role, created_at FROM users WHERE id=$1`
 	var u User
-	err := r.Pool.QueryRow(ctx, q, id).Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.CreatedAt)
+	err := r.DB.QueryRow(ctx, q, id).Scan(&u.ID, &u.Email, &u.Name, &u.Role, &u.CreatedAt)
 	return u, err
 }
 
 func (r *Repository) SetUserRole(ctx context.Context, userID string, role string) error {
-	_, err := r.Pool.Exec(ctx, `UPDATE users SET role=$1 WHERE id=$2`, role, userID)
+	_, err := r.DB.Exec(ctx, `UPDATE users SET role=$1 WHERE id=$2`, role, userID)
 	return err
 }
@@ -0,0 +1,109 @@
+package repo
+
+import (
+	"context"
+	"time"
+)
+
+// Blob verification states recorded by the integrity scrubber. Blobs that are
+// VerifyMismatch or VerifyMissing are quarantined and not served.
+const (
+	VerifyUnverified = "unverified"
+	VerifyOK         = "ok"
+	VerifyMismatch   = "mismatch"
+	VerifyMissing    = "missing"
+	VerifyError      = "error"
+)
+
+// BlobIntegrity is the scrub state of one blob.
+type BlobIntegrity struct {
+	Hash           string
+	SizeBytes      int64
+	RefCount       int64
+	Status         string
+	LastVerifiedAt *time.Time
+	Error          *string
+	QuarantinedAt  *time.Time
+}
+
+// ListBlobsDueForVerification returns hashes of blobs never verified or last
+// verified before staleBefore, oldest first. Blobs whose last check failed
+// with VerifyError are retried once they were checked before retryBefore.
+func (r *Repository) ListBlobsDueForVerification(ctx context.Context, staleBefore, retryBefore time.Time, limit int) ([]string, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash FROM blobs
+        WHERE last_verified_at IS NULL OR last_verified_at < $1
+           OR (verify_status = 'error' AND last_verified_at < $2)
+        ORDER BY last_verified_at NULLS FIRST, hash
+        LIMIT $3`, staleBefore, retryBefore, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
+
+// RecordVerification stores the outcome of a scrub. A mismatch or missing
+// object quarantines the blob; a successful check releases it. VerifyError
+// leaves the quarantine state unchanged.
+func (r *Repository) RecordVerification(ctx context.Context, hash string, status string, detail string) error {
+	_, err := r.DB.Exec(ctx, `
+        UPDATE blobs SET last_verified_at = now(), verify_status = $2, verify_error = $3,
+            quarantined_at = CASE
+                WHEN $2 IN ('mismatch', 'missing') THEN COALESCE(quarantined_at, now())
+                WHEN $2 = 'ok' THEN NULL
+                ELSE quarantined_at END
+        WHERE hash=$1`, hash, status, nilIfEmpty(detail))
+	return err
+}
+
+// ListBlobIntegrity lists blobs with the given verification status, or all
+// blobs that are not VerifyOK when status is empty, quarantined ones first.
+func (r *Repository) ListBlobIntegrity(ctx context.Context, status string, limit int, offset int) ([]BlobIntegrity, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, ref_count, verify_status, last_verified_at, verify_error, quarantined_at
+        FROM blobs
+        WHERE CASE WHEN $1 = '' THEN verify_status <> 'ok' ELSE verify_status = $1 END
+        ORDER BY quarantined_at NULLS LAST, last_verified_at DESC NULLS LAST, hash
+        LIMIT $2 OFFSET $3`, status, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []BlobIntegrity
+	for rows.Next() {
+		var b BlobIntegrity
+		if err := rows.Scan(&b.Hash, &b.SizeBytes, &b.RefCount, &b.Status, &b.LastVerifiedAt, &b.Error, &b.QuarantinedAt); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// IntegritySummary counts blobs per verification status.
+func (r *Repository) IntegritySummary(ctx context.Context) (map[string]int64, error) {
+	rows, err := r.DB.Query(ctx, `SELECT verify_status, COUNT(*) FROM blobs GROUP BY verify_status`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := map[string]int64{}
+	for rows.Next() {
+		var status string
+		var n int64
+		if err := rows.Scan(&status, &n); err != nil {
+			return nil, err
+		}
+		out[status] = n
+	}
+	return out, rows.Err()
+}
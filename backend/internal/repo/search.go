@@ -0,0 +1,128 @@
+package repo
+
+import (
+	"context"
+	"time"
+)
+
+// Outcomes of extracting a blob's text, recorded in blob_text.status.
+// TextError is a blob that could not be read; it is tried again after
+// blob_text.retry_at.
+const (
+	TextIndexed = "indexed"
+	TextFailed  = "failed"
+	TextError   = "error"
+)
+
+// searchConfig is the text search configuration for contents and file names;
+// 'simple' does not stem, so it suits text in any language.
+const searchConfig = "simple"
+
+// ListBlobsToIndex returns the referenced, servable blobs of one of the
+// given types whose text has not been extracted yet, oldest first, including
+// those that could not be read and are due to be tried again.
+func (r *Repository) ListBlobsToIndex(ctx context.Context, mimeTypes []string, limit int) ([]Blob, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT hash, size_bytes, mime_type FROM blobs b
+        WHERE ref_count > 0 AND quarantined_at IS NULL AND mime_type = ANY($1)
+          AND NOT EXISTS (SELECT 1 FROM blob_text t WHERE t.blob_hash = b.hash
+                          AND (t.status <> 'error' OR t.retry_at > now()))
+        ORDER BY created_at, hash
+        LIMIT $2`, mimeTypes, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []Blob
+	for rows.Next() {
+		var b Blob
+		if err := rows.Scan(&b.Hash, &b.SizeBytes, &b.MIMEType); err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, rows.Err()
+}
+
+// RecordBlobText stores the text extracted from a blob, or with status
+// TextFailed the reason it could not be extracted.
+func (r *Repository) RecordBlobText(ctx context.Context, hash, status, content string, detail *string) error {
+	_, err := r.DB.Exec(ctx, `
+        INSERT INTO blob_text (blob_hash, status, content, tsv, error)
+        VALUES ($1, $2, $3, to_tsvector('`+searchConfig+`', $3), $4)
+        ON CONFLICT (blob_hash) DO UPDATE SET status=EXCLUDED.status, content=EXCLUDED.content,
+            tsv=EXCLUDED.tsv, error=EXCLUDED.error, attempts=0, retry_at=NULL, indexed_at=now()`, hash, status, content, detail)
+	return err
+}
+
+// RecordBlobTextError records that a blob could not be read for indexing.
+// It is listed again after backoff, doubling with each failed attempt up to
+// maxBackoff.
+func (r *Repository) RecordBlobTextError(ctx context.Context, hash, detail string, backoff, maxBackoff time.Duration) error {
+	_, err := r.DB.Exec(ctx, `
+        INSERT INTO blob_text (blob_hash, status, error, attempts, retry_at)
+        VALUES ($1, 'error', $2, 1, now() + $3::interval)
+        ON CONFLICT (blob_hash) DO UPDATE SET status='error', content='', tsv='', error=EXCLUDED.error,
+            attempts=blob_text.attempts + 1,
+            retry_at=now() + LEAST($3::interval * power(2, blob_text.attempts), $4::interval),
+            indexed_at=now()`, hash, detail, backoff, maxBackoff)
+	return err
+}
+
+// SearchHit is a file matching a search.
+type SearchHit struct {
+	File
+	// Shared is set for files shared with the searching user by their owner.
+	Shared bool
+	Rank   float64
+	// Snippet is an excerpt of the file's text with the matches between
+	// HighlightStart and HighlightStop; empty for files without text.
+	Snippet string
+}
+
+// Highlight markers in SearchHit.Snippet, from Unicode's private use area;
+// extracted text is stripped of them.
+const (
+	HighlightStart = "\ue000"
+	HighlightStop  = "\ue001"
+)
+
+// SearchFiles returns the files userID owns or that are shared with them whose
+// name or text matches query, in web search syntax ("quoted phrases", -not,
+// or), best matches first. Name matches weigh more than text matches.
+func (r *Repository) SearchFiles(ctx context.Context, userID, query string, limit, offset int) ([]SearchHit, error) {
+	rows, err := r.DB.Query(ctx, `
+        WITH q AS (SELECT websearch_to_tsquery('`+searchConfig+`', $2) AS q),
+        hits AS (
+            SELECT f.*, t.content,
+                ts_rank_cd(to_tsvector('`+searchConfig+`', f.filename), q.q, 32) * 2
+                    + COALESCE(ts_rank_cd(t.tsv, q.q, 32), 0) AS rank
+            FROM files f
+            CROSS JOIN q
+            LEFT JOIN blob_text t ON t.blob_hash = f.blob_hash
+            WHERE f.deleted_at IS NULL
+              AND (f.owner_id = $1 OR EXISTS (SELECT 1 FROM shares s WHERE s.file_id = f.id AND s.shared_with_user_id = $1))
+              AND (to_tsvector('`+searchConfig+`', f.filename) @@ q.q OR t.tsv @@ q.q)
+            ORDER BY rank DESC, f.created_at DESC, f.id
+            LIMIT $3 OFFSET $4
+        )
+        SELECT `+fileColumns("h")+`, h.owner_id <> $1, h.rank,
+            COALESCE(ts_headline('`+searchConfig+`', h.content, q.q, $5), '')
+        FROM hits h CROSS JOIN q
+        ORDER BY h.rank DESC, h.created_at DESC, h.id`,
+		userID, query, limit, offset,
+		`StartSel="`+HighlightStart+`", StopSel="`+HighlightStop+`", MaxWords=30, MinWords=10, MaxFragments=2, FragmentDelimiter=" … "`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []SearchHit
+	for rows.Next() {
+		var h SearchHit
+		if err := rows.Scan(append(h.scanDest(), &h.Shared, &h.Rank, &h.Snippet)...); err != nil {
+			return nil, err
+		}
+		out = append(out, h)
+	}
+	return out, rows.Err()
+}
@@ -0,0 +1,135 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"unicode"
+)
+
+// ErrInvalidTag is returned for tags that are empty, longer than MaxTagLen or
+// contain commas or control characters.
+var ErrInvalidTag = errors.New("tags must be 1-64 characters without commas or control characters")
+
+// MaxTagLen bounds the length of a tag in characters.
+const MaxTagLen = 64
+
+// CleanTag trims tag and checks that it is usable as a tag.
+func CleanTag(tag string) (string, error) {
+	tag = strings.TrimSpace(tag)
+	if tag == "" || len([]rune(tag)) > MaxTagLen || strings.ContainsFunc(tag, func(r rune) bool { return r == ',' || unicode.IsControl(r) }) {
+		return "", ErrInvalidTag
+	}
+	return tag, nil
+}
+
+// CleanTags cleans every tag and drops duplicates, keeping the first.
+func CleanTags(tags []string) ([]string, error) {
+	out := make([]string, 0, len(tags))
+	seen := map[string]bool{}
+	for _, t := range tags {
+		t, err := CleanTag(t)
+		if err != nil {
+			return nil, err
+		}
+		if !seen[t] {
+			seen[t] = true
+			out = append(out, t)
+		}
+	}
+	return out, nil
+}
+
+// TagStat is a tag with the number and total size of the files carrying it.
+type TagStat struct {
+	Tag   string
+	Files int64
+	Bytes int64
+}
+
+// updateTags applies set, an expression over the tags column and $3, to the
+// owner's files fileIDs that are not in the trash and returns the files.
+// Files that are not found are left out.
+func (r *Repository) updateTags(ctx context.Context, ownerID string, fileIDs []string, set string, tags []string) ([]File, error) {
+	tags, err := CleanTags(tags)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := r.DB.Query(ctx, `
+        UPDATE files SET tags = `+set+`
+        WHERE id = ANY($1::uuid[]) AND owner_id=$2 AND deleted_at IS NULL
+        RETURNING `+fileColumns(""), fileIDs, ownerID, tags)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// Expressions for updateTags adding and removing the tags $3.
+const (
+	addTagsSQL    = `tags || ARRAY(SELECT t FROM unnest($3::text[]) t WHERE t <> ALL(tags))`
+	removeTagsSQL = `ARRAY(SELECT t FROM unnest(tags) WITH ORDINALITY u(t, n) WHERE t <> ALL($3::text[]) ORDER BY n)`
+)
+
+// AddTags adds tags to the owner's files, after the tags they already carry.
+func (r *Repository) AddTags(ctx context.Context, ownerID string, fileIDs, tags []string) ([]File, error) {
+	return r.updateTags(ctx, ownerID, fileIDs, addTagsSQL, tags)
+}
+
+// RemoveTags removes tags from the owner's files.
+func (r *Repository) RemoveTags(ctx context.Context, ownerID string, fileIDs, tags []string) ([]File, error) {
+	return r.updateTags(ctx, ownerID, fileIDs, removeTagsSQL, tags)
+}
+
+// SetTags replaces the tags of the owner's files.
+func (r *Repository) SetTags(ctx context.Context, ownerID string, fileIDs, tags []string) ([]File, error) {
+	return r.updateTags(ctx, ownerID, fileIDs, `$3::text[]`, tags)
+}
+
+// ListTags returns the owner's tags by name, counting the files not in the
+// trash.
+func (r *Repository) ListTags(ctx context.Context, ownerID string) ([]TagStat, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT t, COUNT(*), COALESCE(SUM(f.size_bytes), 0)
+        FROM files f CROSS JOIN unnest(f.tags) t
+        WHERE f.owner_id=$1 AND f.deleted_at IS NULL
+        GROUP BY t ORDER BY t`, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []TagStat
+	for rows.Next() {
+		var s TagStat
+		if err := rows.Scan(&s.Tag, &s.Files, &s.Bytes); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, rows.Err()
+}
+
+// MergeTags replaces the tags from with into on all of the owner's files, the
+// trash included, and returns the number of files changed. A file carrying
+// several of them, or into already, keeps into once, where the first of them
+// was. Renaming a tag is merging it into the new name.
+func (r *Repository) MergeTags(ctx context.Context, ownerID string, from []string, into string) (int64, error) {
+	from, err := CleanTags(from)
+	if err != nil {
+		return 0, err
+	}
+	if into, err = CleanTag(into); err != nil {
+		return 0, err
+	}
+	cmd, err := r.DB.Exec(ctx, `
+        UPDATE files SET tags = ARRAY(
+            SELECT t FROM (
+                SELECT CASE WHEN u.t = ANY($2::text[]) THEN $3::text ELSE u.t END AS t, MIN(u.n) AS n
+                FROM unnest(tags) WITH ORDINALITY u(t, n) GROUP BY 1
+            ) merged ORDER BY n)
+        WHERE owner_id=$1 AND tags && $2::text[]`, ownerID, from, into)
+	if err != nil {
+		return 0, err
+	}
+	return cmd.RowsAffected(), nil
+}
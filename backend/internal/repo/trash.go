@@ -0,0 +1,73 @@
+package repo
+
+import (
+	"context"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// TrashFile moves the owner's file id to the trash. It is no longer listed,
+// served through its public links or versioned until it is restored.
+func (r *Repository) TrashFile(ctx context.Context, ownerID, id string) error {
+	cmd, err := r.DB.Exec(ctx, `UPDATE files SET deleted_at=now() WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL`, id, ownerID)
+	if err != nil {
+		return err
+	}
+	if cmd.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+	return nil
+}
+
+// RestoreFile takes the owner's file id out of the trash.
+func (r *Repository) RestoreFile(ctx context.Context, ownerID, id string) (File, error) {
+	var f File
+	err := r.DB.QueryRow(ctx, `
+        UPDATE files SET deleted_at=NULL WHERE id=$1 AND owner_id=$2 AND deleted_at IS NOT NULL
+        RETURNING `+fileColumns(""), id, ownerID).Scan(f.scanDest()...)
+	return f, err
+}
+
+// ListTrash returns the owner's files in the trash, most recently deleted first.
+func (r *Repository) ListTrash(ctx context.Context, ownerID string, limit, offset int) ([]File, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+fileColumns("")+` FROM files
+        WHERE owner_id=$1 AND deleted_at IS NOT NULL
+        ORDER BY deleted_at DESC, id LIMIT $2 OFFSET $3`, ownerID, limit, offset)
+	if err != nil {
+		return nil, err
+	}
+	return scanFiles(rows)
+}
+
+// EmptyTrash deletes the owner's files in the trash for good and returns how
+// many it deleted.
+func (r *Repository) EmptyTrash(ctx context.Context, ownerID string) (int64, error) {
+	return r.purgeFiles(ctx, `f.owner_id=$1 AND f.deleted_at IS NOT NULL`, ownerID)
+}
+
+// PurgeTrash deletes the files of all users that have been in the trash for
+// longer than retention and returns how many it deleted.
+func (r *Repository) PurgeTrash(ctx context.Context, retention time.Duration) (int64, error) {
+	return r.purgeFiles(ctx, `f.deleted_at < now() - $1::interval`, retention)
+}
+
+// purgeFiles deletes the files f matched by cond with their versions and
+// releases their blob references, as DeleteFileAndMaybeBlob does for one file.
+func (r *Repository) purgeFiles(ctx context.Context, cond string, args ...any) (int64, error) {
+	var n int64
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if err := tx.deleteVersionsOf(ctx, cond, args...); err != nil {
+			return err
+		}
+		var err error
+		n, err = tx.releaseRefs(ctx, `
+            WITH gone AS (
+                DELETE FROM files f WHERE `+cond+` RETURNING blob_hash
+            )
+            SELECT blob_hash, COUNT(*) FROM gone GROUP BY blob_hash`, args...)
+		return err
+	})
+	return n, err
+}
@@ -0,0 +1,99 @@
+package repo
+
+import (
+	"context"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+// DB is the query interface shared by *pgxpool.Pool and pgx.Tx, so that
+// Repository methods run unchanged inside and outside a transaction.
+type DB interface {
+	Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	CopyFrom(ctx context.Context, table pgx.Identifier, columns []string, src pgx.CopyFromSource) (int64, error)
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// WithTx runs fn with a Repository whose queries all belong to one
+// transaction, committed if fn returns nil and rolled back otherwise. Methods
+// that open a transaction of their own use a savepoint inside it, and WithTx
+// on a transactional Repository nests the same way.
+func (r *Repository) WithTx(ctx context.Context, fn func(tx *Repository) error) error {
+	return pgx.BeginFunc(ctx, r.DB, func(tx pgx.Tx) error {
+		return fn(&Repository{DB: tx})
+	})
+}
+
+// UnreferencedKeys returns the storage keys among keys that no blob or chunk
+// row points to. Keys are matched through the hash they are derived from;
+// keys storage.ParseKey does not understand are never returned.
+func (r *Repository) UnreferencedKeys(ctx context.Context, keys []string) ([]string, error) {
+	var blobKeys, chunkKeys, blobHashes, chunkHashes []string
+	for _, k := range keys {
+		hash, chunk, ok := storage.ParseKey(k)
+		switch {
+		case !ok:
+		case chunk:
+			chunkKeys, chunkHashes = append(chunkKeys, k), append(chunkHashes, hash)
+		default:
+			blobKeys, blobHashes = append(blobKeys, k), append(blobHashes, hash)
+		}
+	}
+	rows, err := r.DB.Query(ctx, `
+        SELECT k FROM unnest($1::text[], $2::text[]) AS t(k, h) WHERE NOT EXISTS (SELECT 1 FROM blobs WHERE hash = t.h)
+        UNION ALL
+        SELECT k FROM unnest($3::text[], $4::text[]) AS t(k, h) WHERE NOT EXISTS (SELECT 1 FROM chunks WHERE hash = t.h)`,
+		blobKeys, blobHashes, chunkKeys, chunkHashes)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []string
+	for rows.Next() {
+		var k string
+		if err := rows.Scan(&k); err != nil {
+			return nil, err
+		}
+		out = append(out, k)
+	}
+	return out, rows.Err()
+}
+
+// LockKeys takes transaction-scoped locks on storage keys. Whoever deletes an
+// object holds its lock from checking that no row points to it until the
+// object is gone, and an upload that found an object already stored holds it
+// from checking that the object is still there until its rows are committed,
+// so content is never deleted from under a new reference. Locks are taken in
+// a fixed order; LockKeys only has an effect inside a transaction.
+func (r *Repository) LockKeys(ctx context.Context, keys []string) error {
+	_, err := r.DB.Exec(ctx, `
+        SELECT pg_advisory_xact_lock(l) FROM (
+            SELECT DISTINCT hashtext('object:' || k) AS l FROM unnest($1::text[]) AS k ORDER BY l) s`, keys)
+	return err
+}
+
+// DeleteUnreferenced calls del with the keys among keys that no blob or chunk
+// row points to (see UnreferencedKeys), holding their locks until del
+// returns, and returns those keys.
+func (r *Repository) DeleteUnreferenced(ctx context.Context, keys []string, del func(keys []string) error) ([]string, error) {
+	var out []string
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if err := tx.LockKeys(ctx, keys); err != nil {
+			return err
+		}
+		var err error
+		if out, err = tx.UnreferencedKeys(ctx, keys); err != nil || len(out) == 0 {
+			return err
+		}
+		return del(out)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
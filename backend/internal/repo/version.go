@@ -0,0 +1,287 @@
+package repo
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+)
+
+// FileVersion is an earlier version of a file.
+type FileVersion struct {
+	ID           string
+	FileID       string
+	Version      int
+	BlobHash     string
+	SizeBytes    int64
+	MIMEType     *string
+	DetectedMIME *string
+	MIMEMismatch bool
+	// CreatedAt is when the version was stored, SupersededAt when a newer
+	// one replaced it.
+	CreatedAt    time.Time
+	SupersededAt time.Time
+}
+
+// ContentType is the type to serve the version as; see File.ContentType.
+func (v FileVersion) ContentType() *string {
+	if v.MIMEMismatch || v.MIMEType == nil {
+		return v.DetectedMIME
+	}
+	return v.MIMEType
+}
+
+// VersionRetention bounds the earlier versions kept per file: the newest Keep
+// versions, each for MaxAge after it was superseded. Zero disables a bound.
+type VersionRetention struct {
+	Keep   int
+	MaxAge time.Duration
+}
+
+const versionColumns = "id, file_id, version, blob_hash, size_bytes, mime_type, detected_mime, mime_mismatch, created_at, superseded_at"
+
+func (v *FileVersion) scanDest() []any {
+	return []any{&v.ID, &v.FileID, &v.Version, &v.BlobHash, &v.SizeBytes, &v.MIMEType, &v.DetectedMIME, &v.MIMEMismatch, &v.CreatedAt, &v.SupersededAt}
+}
+
+// PutFile records f, whose blob is stored, as a new version of the owner's
+// file f.ID; or, with f.ID empty and byName set, of the newest file named
+// f.Filename in f.FolderID if there is one; otherwise as a new file. It
+// returns the file and whether it changed: content identical to the current
+// version leaves the file as it is.
+func (r *Repository) PutFile(ctx context.Context, f File, byName bool, keep VersionRetention) (File, bool, error) {
+	var out File
+	changed := true
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		if f.ID == "" && byName {
+			// serialize uploads of one name so that they chain instead of each creating a file
+			if _, err := tx.DB.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('file:' || $1::text || ':' || COALESCE($2::text, '') || ':' || $3))`,
+				f.OwnerID, f.FolderID, f.Filename); err != nil {
+				return err
+			}
+			err := tx.DB.QueryRow(ctx, `
+                SELECT id FROM files
+                WHERE owner_id=$1 AND folder_id IS NOT DISTINCT FROM $2::uuid AND filename=$3 AND deleted_at IS NULL
+                ORDER BY created_at DESC LIMIT 1`, f.OwnerID, f.FolderID, f.Filename).Scan(&f.ID)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return err
+			}
+		}
+		var err error
+		if f.ID != "" {
+			out, changed, err = tx.addVersion(ctx, f, keep)
+			return err
+		}
+		if out, err = tx.CreateFile(ctx, f); err != nil {
+			return err
+		}
+		return tx.IncBlobRef(ctx, f.BlobHash, 1)
+	})
+	return out, changed, err
+}
+
+// addVersion makes f's content current for the owner's file f.ID. The
+// previous version keeps its blob reference in the history; the new content
+// takes one of its own. It reports false, changing nothing, when the content
+// is current already.
+func (r *Repository) addVersion(ctx context.Context, f File, keep VersionRetention) (File, bool, error) {
+	var cur File
+	err := r.DB.QueryRow(ctx, `SELECT `+fileColumns("")+` FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL FOR UPDATE`, f.ID, f.OwnerID).Scan(cur.scanDest()...)
+	if err != nil {
+		return File{}, false, err
+	}
+	if cur.BlobHash == f.BlobHash {
+		return cur, false, nil
+	}
+	if err := r.supersede(ctx, cur); err != nil {
+		return File{}, false, err
+	}
+	var out File
+	err = r.DB.QueryRow(ctx, `
+        UPDATE files SET blob_hash=$2, size_bytes=$3, mime_type=$4, detected_mime=$5, mime_mismatch=$6,
+            source_path=$7, modified_at=$8, version=version+1, updated_at=now()
+        WHERE id=$1
+        RETURNING `+fileColumns(""), f.ID, f.BlobHash, f.SizeBytes, f.MIMEType, f.DetectedMIME, f.MIMEMismatch, f.SourcePath, f.ModifiedAt).Scan(out.scanDest()...)
+	if err != nil {
+		return File{}, false, err
+	}
+	if err := r.IncBlobRef(ctx, f.BlobHash, 1); err != nil {
+		return File{}, false, err
+	}
+	_, err = r.PruneVersions(ctx, &f.ID, VersionRetention{Keep: keep.Keep})
+	return out, true, err
+}
+
+// supersede moves the current version of cur into the history.
+func (r *Repository) supersede(ctx context.Context, cur File) error {
+	_, err := r.DB.Exec(ctx, `
+        INSERT INTO file_versions (file_id, version, blob_hash, size_bytes, mime_type, detected_mime, mime_mismatch, created_at)
+        VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+		cur.ID, cur.Version, cur.BlobHash, cur.SizeBytes, cur.MIMEType, cur.DetectedMIME, cur.MIMEMismatch, cur.UpdatedAt)
+	return err
+}
+
+// ListVersions returns the earlier versions of the owner's file, newest first.
+func (r *Repository) ListVersions(ctx context.Context, ownerID, fileID string) ([]FileVersion, error) {
+	rows, err := r.DB.Query(ctx, `
+        SELECT `+versionColumns+` FROM file_versions
+        WHERE file_id=$1 AND EXISTS (SELECT 1 FROM files WHERE id=$1 AND owner_id=$2 AND deleted_at IS NULL)
+        ORDER BY version DESC`, fileID, ownerID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var out []FileVersion
+	for rows.Next() {
+		var v FileVersion
+		if err := rows.Scan(v.scanDest()...); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, rows.Err()
+}
+
+// GetVersion returns version n of the owner's file, the current one included
+// (with an empty ID and zero SupersededAt), or pgx.ErrNoRows.
+func (r *Repository) GetVersion(ctx context.Context, ownerID, fileID string, n int) (FileVersion, error) {
+	f, err := r.GetFile(ctx, ownerID, fileID)
+	if err != nil {
+		return FileVersion{}, err
+	}
+	if f.Version == n {
+		return FileVersion{FileID: f.ID, Version: f.Version, BlobHash: f.BlobHash, SizeBytes: f.SizeBytes, MIMEType: f.MIMEType,
+			DetectedMIME: f.DetectedMIME, MIMEMismatch: f.MIMEMismatch, CreatedAt: f.UpdatedAt}, nil
+	}
+	var v FileVersion
+	err = r.DB.QueryRow(ctx, `SELECT `+versionColumns+` FROM file_versions WHERE file_id=$1 AND version=$2`, fileID, n).Scan(v.scanDest()...)
+	return v, err
+}
+
+// RestoreVersion makes the content of earlier version n current again, as a
+// new version; the history is kept.
+func (r *Repository) RestoreVersion(ctx context.Context, ownerID, fileID string, n int, keep VersionRetention) (File, error) {
+	var out File
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		var v FileVersion
+		err := tx.DB.QueryRow(ctx, `
+            SELECT `+versionColumns+` FROM file_versions
+            WHERE file_id=$1 AND version=$3 AND EXISTS (SELECT 1 FROM files WHERE id=$1 AND owner_id=$2)`,
+			fileID, ownerID, n).Scan(v.scanDest()...)
+		if err != nil {
+			return err
+		}
+		out, _, err = tx.addVersion(ctx, File{
+			ID: fileID, OwnerID: ownerID, BlobHash: v.BlobHash, SizeBytes: v.SizeBytes,
+			MIMEType: v.MIMEType, DetectedMIME: v.DetectedMIME, MIMEMismatch: v.MIMEMismatch,
+		}, keep)
+		return err
+	})
+	return out, err
+}
+
+// PruneVersions deletes the earlier versions of fileID (of every file when
+// nil) that keep no longer retains, releasing their blob references, and
+// returns how many it deleted.
+func (r *Repository) PruneVersions(ctx context.Context, fileID *string, keep VersionRetention) (int64, error) {
+	if keep.Keep <= 0 && keep.MaxAge <= 0 {
+		return 0, nil
+	}
+	var maxAge *time.Duration
+	if keep.MaxAge > 0 {
+		maxAge = &keep.MaxAge
+	}
+	var n int64
+	err := r.WithTx(ctx, func(tx *Repository) error {
+		var err error
+		n, err = tx.releaseRefs(ctx, `
+            WITH ranked AS (
+                SELECT id, superseded_at, row_number() OVER (PARTITION BY file_id ORDER BY version DESC) AS rank
+                FROM file_versions WHERE $1::uuid IS NULL OR file_id=$1
+            ), gone AS (
+                DELETE FROM file_versions v USING ranked
+                WHERE v.id = ranked.id
+                  AND (($2::int > 0 AND ranked.rank > $2) OR ranked.superseded_at < now() - $3::interval)
+                RETURNING v.blob_hash
+            )
+            SELECT blob_hash, COUNT(*) FROM gone GROUP BY blob_hash`, fileID, keep.Keep, maxAge)
+		return err
+	})
+	return n, err
+}
+
+// releaseRefs runs q, which deletes references and yields (blob_hash, count)
+// rows, and takes the references off the blobs. It returns the number of
+// references released.
+func (r *Repository) releaseRefs(ctx context.Context, q string, args ...any) (int64, error) {
+	rows, err := r.DB.Query(ctx, q, args...)
+	if err != nil {
+		return 0, err
+	}
+	refs := map[string]int64{}
+	for rows.Next() {
+		var hash string
+		var n int64
+		if err := rows.Scan(&hash, &n); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		refs[hash] = n
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var total int64
+	for hash, n := range refs {
+		// blobs left at zero references are purged by the gc package after a grace period
+		if err := r.IncBlobRef(ctx, hash, -n); err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// deleteVersionsOf deletes the history of the files matched by the condition
+// cond on files f, releasing the blob references.
+func (r *Repository) deleteVersionsOf(ctx context.Context, cond string, args ...any) error {
+	_, err := r.releaseRefs(ctx, `
+        WITH gone AS (
+            DELETE FROM file_versions v USING files f
+            WHERE v.file_id = f.id AND `+cond+`
+            RETURNING v.blob_hash
+        )
+        SELECT blob_hash, COUNT(*) FROM gone GROUP BY blob_hash`, args...)
+	return err
+}
+
+// DropVersion undoes the upload of version n of the owner's file, making the
+// newest earlier version current again. It fails with pgx.ErrNoRows when n is
+// no longer the current version.
+func (r *Repository) DropVersion(ctx context.Context, ownerID, fileID string, n int) error {
+	return r.WithTx(ctx, func(tx *Repository) error {
+		var cur File
+		err := tx.DB.QueryRow(ctx, `SELECT `+fileColumns("")+` FROM files WHERE id=$1 AND owner_id=$2 AND version=$3 FOR UPDATE`, fileID, ownerID, n).Scan(cur.scanDest()...)
+		if err != nil {
+			return err
+		}
+		// the earlier version's blob reference moves back to the file
+		var prev FileVersion
+		err = tx.DB.QueryRow(ctx, `
+            DELETE FROM file_versions WHERE id = (SELECT id FROM file_versions WHERE file_id=$1 ORDER BY version DESC LIMIT 1)
+            RETURNING `+versionColumns, fileID).Scan(prev.scanDest()...)
+		if err != nil {
+			return err
+		}
+		_, err = tx.DB.Exec(ctx, `
+            UPDATE files SET blob_hash=$2, size_bytes=$3, mime_type=$4, detected_mime=$5, mime_mismatch=$6,
+                source_path=NULL, modified_at=NULL, version=$7, updated_at=$8
+            WHERE id=$1`, fileID, prev.BlobHash, prev.SizeBytes, prev.MIMEType, prev.DetectedMIME, prev.MIMEMismatch, prev.Version, prev.CreatedAt)
+		if err != nil {
+			return err
+		}
+		return tx.IncBlobRef(ctx, cur.BlobHash, -1)
+	})
+}
@@ -0,0 +1,174 @@
+// Package scrub periodically re-reads stored blobs and checks that they still
+// hash to their recorded hash, quarantining blobs that are missing or corrupt.
+package scrub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+type Options struct {
+	// MaxAge is how long a verification result is trusted before the blob is
+	// checked again.
+	MaxAge time.Duration
+	// BytesPerSecond caps the read rate so scrubbing does not starve
+	// downloads; 0 means unthrottled.
+	BytesPerSecond int64
+}
+
+type Report struct {
+	Checked  int `json:"checked"`
+	OK       int `json:"ok"`
+	Mismatch int `json:"mismatch"`
+	Missing  int `json:"missing"`
+	Errors   int `json:"errors"`
+}
+
+func (r *Report) add(status string) {
+	r.Checked++
+	switch status {
+	case repo.VerifyOK:
+		r.OK++
+	case repo.VerifyMismatch:
+		r.Mismatch++
+	case repo.VerifyMissing:
+		r.Missing++
+	default:
+		r.Errors++
+	}
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("scrub: checked %d blobs: %d ok, %d mismatched, %d missing, %d errors",
+		r.Checked, r.OK, r.Mismatch, r.Missing, r.Errors)
+}
+
+type Scrubber struct {
+	Repo    *repo.Repository
+	Storage *storage.Service
+	Opts    Options
+}
+
+func New(r *repo.Repository, s *storage.Service, opts Options) *Scrubber {
+	return &Scrubber{Repo: r, Storage: s, Opts: opts}
+}
+
+const batchSize = 100
+
+// Run verifies every blob that is due. Each blob is stamped as it is checked,
+// so an interrupted pass resumes where it stopped.
+func (s *Scrubber) Run(ctx context.Context) (Report, error) {
+	var rep Report
+	start := time.Now()
+	staleBefore := start.Add(-s.Opts.MaxAge)
+	for {
+		hashes, err := s.Repo.ListBlobsDueForVerification(ctx, staleBefore, start, batchSize)
+		if err != nil {
+			return rep, err
+		}
+		for _, h := range hashes {
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+			status, err := s.Verify(ctx, h)
+			if err != nil {
+				return rep, err
+			}
+			rep.add(status)
+		}
+		if len(hashes) < batchSize {
+			return rep, nil
+		}
+	}
+}
+
+// Verify checks a single blob now, regardless of when it was last verified,
+// records the outcome and returns the resulting status.
+func (s *Scrubber) Verify(ctx context.Context, hash string) (string, error) {
+	sb, err := s.Repo.GetStoredBlob(ctx, hash)
+	if err != nil {
+		return "", fmt.Errorf("blob %s: %w", hash, err)
+	}
+	var status, detail string
+	err = s.Storage.Verify(ctx, sb, s.throttle(ctx))
+	switch {
+	case err == nil:
+		status = repo.VerifyOK
+	case errors.Is(err, storage.ErrNotFound):
+		status, detail = repo.VerifyMissing, err.Error()
+	case errors.Is(err, storage.ErrCorrupt):
+		status, detail = repo.VerifyMismatch, err.Error()
+	case ctx.Err() != nil:
+		return "", ctx.Err()
+	default:
+		status, detail = repo.VerifyError, err.Error()
+	}
+	if status != repo.VerifyOK {
+		log.Printf("scrub: blob %s: %s: %s", hash, status, detail)
+	}
+	return status, s.Repo.RecordVerification(ctx, hash, status, detail)
+}
+
+// Start runs a scrub pass every interval until ctx is cancelled.
+func (s *Scrubber) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				rep, err := s.Run(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("scrub: %v", err)
+				}
+				if rep.Checked > 0 {
+					log.Print(rep.String())
+				}
+			}
+		}
+	}()
+}
+
+func (s *Scrubber) throttle(ctx context.Context) func(io.Reader) io.Reader {
+	if s.Opts.BytesPerSecond <= 0 {
+		return nil
+	}
+	return func(r io.Reader) io.Reader {
+		return &throttledReader{ctx: ctx, r: r, rate: s.Opts.BytesPerSecond, start: time.Now()}
+	}
+}
+
+// throttledReader sleeps as needed to keep the average read rate at or below rate.
+type throttledReader struct {
+	ctx   context.Context
+	r     io.Reader
+	rate  int64
+	start time.Time
+	read  int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if int64(len(p)) > t.rate {
+		p = p[:t.rate]
+	}
+	n, err := t.r.Read(p)
+	t.read += int64(n)
+	due := t.start.Add(time.Duration(float64(t.read) / float64(t.rate) * float64(time.Second)))
+	if wait := time.Until(due); wait > 0 {
+		select {
+		case <-t.ctx.Done():
+			return n, t.ctx.Err()
+		case <-time.After(wait):
+		}
+	}
+	return n, err
+}
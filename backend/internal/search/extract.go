@@ -0,0 +1,101 @@
+package search
+
+import (
+	"bytes"
+	"errors"
+	"html"
+	"strings"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+// Types lists the content types text is extracted from. Markdown and CSV are
+// detected as text/plain, but may be declared as their own types.
+var Types = []string{"text/plain", "text/markdown", "text/csv", "text/html", "application/pdf"}
+
+// ErrUnsupported is returned by Extract for types it does not handle.
+var ErrUnsupported = errors.New("search: unsupported content type")
+
+// Extract returns the text of content of type mimeType, truncated to about
+// maxText bytes.
+func Extract(mimeType string, content []byte, maxText int) (string, error) {
+	var text string
+	switch mimeType {
+	case "text/plain", "text/markdown", "text/csv":
+		text = string(content)
+	case "text/html":
+		text = htmlText(content)
+	case "application/pdf":
+		var err error
+		if text, err = pdfText(content, maxText); err != nil {
+			return "", err
+		}
+	default:
+		return "", ErrUnsupported
+	}
+	return clean(text, maxText), nil
+}
+
+// clean makes text storable and safe to highlight: valid UTF-8 without NUL
+// bytes (which PostgreSQL text cannot hold) or the highlight markers, cut to
+// at most max bytes.
+func clean(text string, max int) string {
+	if len(text) > max {
+		// a character cut in half is replaced below
+		text = text[:max]
+	}
+	text = strings.ToValidUTF8(text, " ")
+	return strings.NewReplacer("\x00", " ", repo.HighlightStart, " ", repo.HighlightStop, " ").Replace(text)
+}
+
+// htmlText returns the text of an HTML document: markup, comments, scripts
+// and styles are dropped and character references decoded.
+func htmlText(doc []byte) string {
+	var out strings.Builder
+	for len(doc) > 0 {
+		i := bytes.IndexByte(doc, '<')
+		if i < 0 {
+			out.WriteString(html.UnescapeString(string(doc)))
+			break
+		}
+		out.WriteString(html.UnescapeString(string(doc[:i])))
+		doc = doc[i:]
+		switch {
+		case bytes.HasPrefix(doc, []byte("<!--")):
+			doc = skipPast(doc, "-->")
+		case hasTagPrefix(doc, "<script"):
+			doc = skipPast(doc, "</script>")
+		case hasTagPrefix(doc, "<style"):
+			doc = skipPast(doc, "</style>")
+		default:
+			if i := bytes.IndexByte(doc, '>'); i >= 0 {
+				doc = doc[i+1:]
+			} else {
+				doc = nil
+			}
+		}
+		// tags separate words
+		out.WriteByte(' ')
+	}
+	return out.String()
+}
+
+// hasTagPrefix reports whether doc starts with the opening tag tag, ignoring case.
+func hasTagPrefix(doc []byte, tag string) bool {
+	if len(doc) <= len(tag) || !bytes.EqualFold(doc[:len(tag)], []byte(tag)) {
+		return false
+	}
+	c := doc[len(tag)]
+	return c == '>' || c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '/'
+}
+
+// skipPast returns doc after the first occurrence of end, case-insensitively,
+// or nothing if there is none.
+func skipPast(doc []byte, end string) []byte {
+	for i := 0; i+len(end) <= len(doc); i++ {
+		if bytes.EqualFold(doc[i:i+len(end)], []byte(end)) {
+			return doc[i+len(end):]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,366 @@
+package search
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf16"
+	"unicode/utf8"
+)
+
+var (
+	errNotPDF       = errors.New("search: not a PDF document")
+	errEncryptedPDF = errors.New("search: encrypted PDF")
+)
+
+// maxStreamBytes bounds the decompressed size of one PDF stream.
+const maxStreamBytes = 16 << 20
+
+// pdfText returns the text shown by the content streams of a PDF document, at
+// most max bytes of it. It is a best effort: strings are
+// read as PDFDocEncoding or UTF-16, so text in fonts with custom encodings
+// (such as subsetted CID fonts without a Unicode mapping) is not recovered.
+func pdfText(doc []byte, max int) (string, error) {
+	if !bytes.HasPrefix(doc, []byte("%PDF-")) {
+		return "", errNotPDF
+	}
+	var out strings.Builder
+	for rest := doc; out.Len() < max; {
+		dict, data, next, ok := nextStream(rest)
+		if !ok {
+			break
+		}
+		rest = next
+		if !contentStream(dict) {
+			continue
+		}
+		if bytes.Contains(dict, []byte("/FlateDecode")) {
+			zr, err := zlib.NewReader(bytes.NewReader(data))
+			if err != nil {
+				continue
+			}
+			// a truncated or corrupt stream still yields what was decoded
+			data, _ = io.ReadAll(io.LimitReader(zr, maxStreamBytes))
+		}
+		contentText(&out, data)
+	}
+	if out.Len() == 0 && bytes.Contains(doc, []byte("/Encrypt")) {
+		return "", errEncryptedPDF
+	}
+	// one stream can show more than was wanted
+	text := out.String()
+	if len(text) > max {
+		n := max
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+	return text, nil
+}
+
+// nextStream finds the next stream in doc, returning its dictionary, its raw
+// data and the rest of doc after it.
+func nextStream(doc []byte) (dict, data, rest []byte, ok bool) {
+	for {
+		i := bytes.Index(doc, []byte("stream"))
+		if i < 0 {
+			return nil, nil, nil, false
+		}
+		start := i + len("stream")
+		// the keyword, not the end of "endstream", followed by an end of line
+		if i >= 3 && string(doc[i-3:i]) == "end" {
+			doc = doc[start:]
+			continue
+		}
+		switch {
+		case bytes.HasPrefix(doc[start:], []byte("\r\n")):
+			start += 2
+		case bytes.HasPrefix(doc[start:], []byte("\n")):
+			start++
+		default:
+			doc = doc[start:]
+			continue
+		}
+		d := doc[:i]
+		if j := bytes.LastIndex(d, []byte("obj")); j >= 0 {
+			d = d[j:]
+		}
+		end := bytes.Index(doc[start:], []byte("endstream"))
+		if end < 0 {
+			return d, doc[start:], nil, true
+		}
+		return d, doc[start : start+end], doc[start+end+len("endstream"):], true
+	}
+}
+
+// contentStream reports whether a stream with dictionary dict may hold page
+// content: images, fonts, cross-reference and object streams do not, nor do
+// streams in encodings other than Flate.
+func contentStream(dict []byte) bool {
+	for _, skip := range []string{
+		"/Subtype/Image", "/Subtype /Image", "/Type/XRef", "/Type /XRef", "/Type/ObjStm", "/Type /ObjStm",
+		"/Length1", "/Length2", "/Length3", "/FontFile", "/Type/Metadata", "/Type /Metadata",
+		"/DCTDecode", "/JPXDecode", "/CCITTFaxDecode", "/JBIG2Decode", "/LZWDecode", "/ASCII85Decode", "/ASCIIHexDecode", "/RunLengthDecode",
+	} {
+		if bytes.Contains(dict, []byte(skip)) {
+			return false
+		}
+	}
+	return true
+}
+
+// contentText appends the text shown by the content stream cs to out.
+func contentText(out *strings.Builder, cs []byte) {
+	var operands []any // strings and numbers since the last operator
+	inArray := false
+	var array []any
+	emit := func(s string) {
+		for _, r := range s {
+			if unicode.IsPrint(r) {
+				out.WriteRune(r)
+			} else {
+				out.WriteByte(' ')
+			}
+		}
+	}
+	push := func(v any) {
+		if inArray {
+			array = append(array, v)
+		} else {
+			operands = append(operands, v)
+		}
+	}
+	for i := 0; i < len(cs); {
+		c := cs[i]
+		switch {
+		case isPDFSpace(c):
+			i++
+		case c == '%':
+			for i < len(cs) && cs[i] != '\n' && cs[i] != '\r' {
+				i++
+			}
+		case c == '(':
+			s, n := literalString(cs[i:])
+			push(s)
+			i += n
+		case c == '<' && i+1 < len(cs) && cs[i+1] == '<':
+			i += 2
+		case c == '>' && i+1 < len(cs) && cs[i+1] == '>':
+			i += 2
+		case c == '<':
+			s, n := hexString(cs[i:])
+			push(s)
+			i += n
+		case c == '[':
+			inArray, array = true, nil
+			i++
+		case c == ']':
+			inArray = false
+			operands = append(operands, array)
+			i++
+		case c == '/':
+			i++
+			for i < len(cs) && !isPDFSpace(cs[i]) && !isPDFDelim(cs[i]) {
+				i++
+			}
+		default:
+			j := i
+			for j < len(cs) && !isPDFSpace(cs[j]) && !isPDFDelim(cs[j]) {
+				j++
+			}
+			if j == i {
+				// a stray delimiter
+				i++
+				continue
+			}
+			tok := string(cs[i:j])
+			i = j
+			if f, err := strconv.ParseFloat(tok, 64); err == nil {
+				push(f)
+				continue
+			}
+			switch tok {
+			case "Tj":
+				emitLast(operands, emit)
+			case "'", `"`:
+				out.WriteByte('\n')
+				emitLast(operands, emit)
+			case "TJ":
+				if len(operands) > 0 {
+					if arr, ok := operands[len(operands)-1].([]any); ok {
+						for _, v := range arr {
+							switch v := v.(type) {
+							case string:
+								emit(v)
+							case float64:
+								// a large negative adjustment moves to the next word
+								if v < -200 {
+									out.WriteByte(' ')
+								}
+							}
+						}
+					}
+				}
+			case "Td", "TD", "Tm", "T*":
+				out.WriteByte(' ')
+			case "ET":
+				out.WriteByte('\n')
+			case "BI":
+				// inline image data up to EI
+				if k := bytes.Index(cs[i:], []byte("EI")); k >= 0 {
+					i += k + 2
+				} else {
+					i = len(cs)
+				}
+			}
+			operands = operands[:0]
+		}
+	}
+}
+
+func emitLast(operands []any, emit func(string)) {
+	if len(operands) > 0 {
+		if s, ok := operands[len(operands)-1].(string); ok {
+			emit(s)
+		}
+	}
+}
+
+func isPDFSpace(c byte) bool {
+	return c == ' ' || c == '\n' || c == '\r' || c == '\t' || c == '\f' || c == 0
+}
+
+func isPDFDelim(c byte) bool {
+	return strings.IndexByte("()<>[]{}/%", c) >= 0
+}
+
+// literalString decodes the literal string at the start of b, returning it and
+// the number of bytes it took.
+func literalString(b []byte) (string, int) {
+	var s []byte
+	depth := 0
+	i := 1
+	for ; i < len(b); i++ {
+		c := b[i]
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				return decodePDFString(s), i + 1
+			}
+			depth--
+		case '\\':
+			i++
+			if i >= len(b) {
+				break
+			}
+			switch e := b[i]; e {
+			case 'n':
+				c = '\n'
+			case 'r':
+				c = '\r'
+			case 't':
+				c = '\t'
+			case 'b':
+				c = '\b'
+			case 'f':
+				c = '\f'
+			case '\r':
+				// line continuation
+				if i+1 < len(b) && b[i+1] == '\n' {
+					i++
+				}
+				continue
+			case '\n':
+				continue
+			default:
+				if e >= '0' && e <= '7' {
+					v := 0
+					for k := 0; k < 3 && i < len(b) && b[i] >= '0' && b[i] <= '7'; k++ {
+						v = v*8 + int(b[i]-'0')
+						i++
+					}
+					i--
+					c = byte(v)
+				} else {
+					c = e
+				}
+			}
+		}
+		s = append(s, c)
+	}
+	return decodePDFString(s), i
+}
+
+// hexString decodes the hex string at the start of b, returning it and the
+// number of bytes it took.
+func hexString(b []byte) (string, int) {
+	var s []byte
+	var hi byte
+	half := false
+	i := 1
+	for ; i < len(b) && b[i] != '>'; i++ {
+		v, ok := unhex(b[i])
+		if !ok {
+			continue
+		}
+		if half {
+			s = append(s, hi<<4|v)
+		} else {
+			hi = v
+		}
+		half = !half
+	}
+	if half {
+		s = append(s, hi<<4)
+	}
+	return decodePDFString(s), min(i+1, len(b))
+}
+
+func unhex(c byte) (byte, bool) {
+	switch {
+	case c >= '0' && c <= '9':
+		return c - '0', true
+	case c >= 'a' && c <= 'f':
+		return c - 'a' + 10, true
+	case c >= 'A' && c <= 'F':
+		return c - 'A' + 10, true
+	}
+	return 0, false
+}
+
+// decodePDFString reads a string as UTF-16 when it has a byte order mark or
+// looks like two-byte Latin text, and as PDFDocEncoding (approximated by
+// Latin-1) otherwise.
+func decodePDFString(s []byte) string {
+	utf16be := bytes.HasPrefix(s, []byte{0xfe, 0xff})
+	if utf16be {
+		s = s[2:]
+	} else if len(s) >= 2 && len(s)%2 == 0 {
+		utf16be = true
+		for k := 0; k < len(s); k += 2 {
+			if s[k] != 0 {
+				utf16be = false
+				break
+			}
+		}
+	}
+	if utf16be {
+		u := make([]uint16, len(s)/2)
+		for k := range u {
+			u[k] = uint16(s[2*k])<<8 | uint16(s[2*k+1])
+		}
+		return string(utf16.Decode(u))
+	}
+	r := make([]rune, len(s))
+	for k, c := range s {
+		r[k] = rune(c)
+	}
+	return string(r)
+}
@@ -0,0 +1,123 @@
+package search
+
+import (
+	"bytes"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+// flate compresses a content stream as /FlateDecode does.
+func flate(s string) string {
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	zw.Write([]byte(s))
+	zw.Close()
+	return buf.String()
+}
+
+// pdfOf builds a document holding one object per stream, each given as its
+// dictionary and data.
+func pdfOf(streams ...[2]string) []byte {
+	var b strings.Builder
+	b.WriteString("%PDF-1.4\n%\xe2\xe3\xcf\xd3\n")
+	for i, s := range streams {
+		fmt.Fprintf(&b, "%d 0 obj\n<< /Length %d %s >>\nstream\n%s\nendstream\nendobj\n", i+1, len(s[1]), s[0], s[1])
+	}
+	b.WriteString("trailer\n<< /Root 1 0 R >>\n%%EOF\n")
+	return []byte(b.String())
+}
+
+const helloPage = "BT /F1 12 Tf 72 712 Td (Hello, world) Tj ET"
+
+func TestPDFText(t *testing.T) {
+	hello := pdfOf([2]string{"/Filter /FlateDecode", flate(helloPage)})
+	compressed := flate(helloPage + "\nBT (" + strings.Repeat("more text ", 100) + ") Tj ET")
+	for _, c := range []struct {
+		name string
+		doc  []byte
+		want string
+	}{
+		{"flate", hello, "Hello, world"},
+		{"uncompressed", pdfOf([2]string{"", helloPage}), "Hello, world"},
+		{"kerned", pdfOf([2]string{"", "BT [(Hel) 20 (lo) -250 (world)] TJ ET"}), "Hello world"},
+		{"escapes", pdfOf([2]string{"", `BT (a\(b\) \101\102 (nested)) Tj ET`}), "a(b) AB (nested)"},
+		{"utf-16", pdfOf([2]string{"", "BT <FEFF00E9007400E9> Tj ET"}), "été"},
+		{"next line", pdfOf([2]string{"", "BT (one) Tj (two) ' ET"}), "one\ntwo"},
+		{"inline image", pdfOf([2]string{"", "BI /W 1 /H 1 ID (not text) Tj EI BT (after) Tj ET"}), "after"},
+		{"image skipped", pdfOf([2]string{"/Subtype /Image", "BT (pixels) Tj ET"}, [2]string{"", helloPage}), "Hello, world"},
+		{"endstream missing", []byte("%PDF-1.4\n1 0 obj\n<< >>\nstream\n" + helloPage), "Hello, world"},
+		{"endstream missing, flate", []byte("%PDF-1.4\n1 0 obj\n<< /Filter /FlateDecode >>\nstream\n" + flate(helloPage)), "Hello, world"},
+		{"flate cut short", pdfOf([2]string{"/Filter /FlateDecode", compressed[:len(compressed)/2]}), "Hello, world"},
+		{"not a stream keyword", pdfOf([2]string{"/Name /streamer", helloPage}), "Hello, world"},
+		{"string never closed", pdfOf([2]string{"", "BT (Hello"}), ""},
+		{"truncated header", []byte("%PDF-"), ""},
+	} {
+		got, err := pdfText(c.doc, 1<<20)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if !strings.Contains(got, c.want) {
+			t.Errorf("%s: text %q does not contain %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestPDFTextErrors(t *testing.T) {
+	if _, err := pdfText([]byte("PK\x03\x04"), 100); !errors.Is(err, errNotPDF) {
+		t.Errorf("zip: %v", err)
+	}
+	encrypted := append(pdfOf([2]string{"/Filter /FlateDecode", "\x8f\x12garbage"}), "trailer << /Encrypt 5 0 R >>"...)
+	if _, err := pdfText(encrypted, 100); !errors.Is(err, errEncryptedPDF) {
+		t.Errorf("encrypted: %v", err)
+	}
+}
+
+// However the document ends, text comes out of what was read.
+func TestPDFTextTruncated(t *testing.T) {
+	doc := pdfOf([2]string{"/Filter /FlateDecode", flate(helloPage)}, [2]string{"", "BT <FEFF00E9> Tj (a\\) b) Tj ET"})
+	for n := range doc {
+		got, err := pdfText(doc[:n], 1<<20)
+		if err != nil && !errors.Is(err, errNotPDF) {
+			t.Fatalf("cut at %d: %v", n, err)
+		}
+		if !utf8.ValidString(got) {
+			t.Fatalf("cut at %d: invalid text %q", n, got)
+		}
+	}
+}
+
+func TestPDFTextMax(t *testing.T) {
+	// one stream shows far more than max
+	page := "BT (" + strings.Repeat("é", 1000) + ") Tj ET"
+	doc := pdfOf([2]string{"/Filter /FlateDecode", flate(page)}, [2]string{"", page})
+	for _, max := range []int{0, 1, 2, 3, 100, 1999} {
+		got, err := pdfText(doc, max)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got) > max || !utf8.ValidString(got) || len(got) < max-1 {
+			t.Errorf("max %d: %d bytes of text, valid %v", max, len(got), utf8.ValidString(got))
+		}
+	}
+}
+
+func FuzzPDFText(f *testing.F) {
+	f.Add(pdfOf([2]string{"/Filter /FlateDecode", flate(helloPage)}))
+	f.Add(pdfOf([2]string{"", "BT [(a) -300 (b)] TJ <FEFF00E9> Tj (c\\101\\) ' ET BI ID xx EI"}))
+	f.Add([]byte("%PDF-1.4\n1 0 obj\n<< >>\nstream\nBT (no end"))
+	f.Add([]byte("%PDF-1.4\nstream\r\n(\\"))
+	f.Add([]byte("%PDF-1.4\nendstream stream\n<<>> [ <a (\\12"))
+	f.Add([]byte("%PDF-"))
+	f.Fuzz(func(t *testing.T, doc []byte) {
+		const max = 64
+		text, _ := pdfText(doc, max)
+		if len(text) > max {
+			t.Fatalf("%d bytes of text, max %d", len(text), max)
+		}
+	})
+}
@@ -0,0 +1,151 @@
+// Package search extracts the text of stored plain text, Markdown, CSV, HTML
+// and PDF blobs into the full-text index that the search query uses. Text is
+// extracted once per blob, so deduplicated files share their index entry.
+package search
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+	"github.com/himanshu/file-vault-app/backend/internal/storage"
+)
+
+type Options struct {
+	// MaxBytes bounds how much of a blob is read; text beyond it is not
+	// indexed.
+	MaxBytes int64
+	// MaxText bounds the text kept per blob.
+	MaxText int
+}
+
+type Report struct {
+	Indexed int `json:"indexed"`
+	Failed  int `json:"failed"`
+	// Deferred counts blobs that could not be read; they are tried again
+	// on a later pass.
+	Deferred int `json:"deferred"`
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("search: indexed %d blobs, %d failed, %d deferred", r.Indexed, r.Failed, r.Deferred)
+}
+
+type Indexer struct {
+	Repo    *repo.Repository
+	Storage *storage.Service
+	Opts    Options
+}
+
+func New(r *repo.Repository, s *storage.Service, opts Options) *Indexer {
+	return &Indexer{Repo: r, Storage: s, Opts: opts}
+}
+
+const batchSize = 50
+
+// Blobs that cannot be read are retried after retryBackoff, doubling with
+// each attempt up to maxRetryBackoff.
+const (
+	retryBackoff    = time.Minute
+	maxRetryBackoff = 24 * time.Hour
+)
+
+// Run indexes every blob not indexed yet. Blobs whose text cannot be
+// extracted are recorded as failed and not retried; blobs that cannot be
+// read are skipped until their retry is due. Only database errors end the
+// pass.
+func (ix *Indexer) Run(ctx context.Context) (Report, error) {
+	var rep Report
+	for {
+		blobs, err := ix.Repo.ListBlobsToIndex(ctx, Types, batchSize)
+		if err != nil {
+			return rep, err
+		}
+		for _, b := range blobs {
+			if err := ctx.Err(); err != nil {
+				return rep, err
+			}
+			status, err := ix.Index(ctx, b)
+			if err != nil {
+				return rep, err
+			}
+			switch status {
+			case repo.TextIndexed:
+				rep.Indexed++
+			case repo.TextFailed:
+				rep.Failed++
+			default:
+				rep.Deferred++
+			}
+		}
+		if len(blobs) < batchSize {
+			return rep, nil
+		}
+	}
+}
+
+// Index extracts and records the text of blob b, returning the status it
+// recorded. Content that cannot be extracted is recorded as failed; a blob
+// that cannot be read is recorded as an error to be tried again later.
+// Errors returned are those of the database.
+func (ix *Indexer) Index(ctx context.Context, b repo.Blob) (string, error) {
+	if b.MIMEType == nil {
+		detail := "no content type"
+		return repo.TextFailed, ix.Repo.RecordBlobText(ctx, b.Hash, repo.TextFailed, "", &detail)
+	}
+	sb, err := ix.Repo.GetStoredBlob(ctx, b.Hash)
+	if err != nil {
+		return "", fmt.Errorf("blob %s: %w", b.Hash, err)
+	}
+	content, err := ix.read(ctx, sb)
+	if err != nil {
+		if ctx.Err() != nil {
+			return "", ctx.Err()
+		}
+		detail := err.Error()
+		log.Printf("search: blob %s: %s; retrying later", b.Hash, detail)
+		return repo.TextError, ix.Repo.RecordBlobTextError(ctx, b.Hash, detail, retryBackoff, maxRetryBackoff)
+	}
+	text, err := Extract(*b.MIMEType, content, ix.Opts.MaxText)
+	if err != nil {
+		detail := err.Error()
+		log.Printf("search: blob %s: %s", b.Hash, detail)
+		return repo.TextFailed, ix.Repo.RecordBlobText(ctx, b.Hash, repo.TextFailed, "", &detail)
+	}
+	return repo.TextIndexed, ix.Repo.RecordBlobText(ctx, b.Hash, repo.TextIndexed, text, nil)
+}
+
+// read returns up to Opts.MaxBytes of sb's content.
+func (ix *Indexer) read(ctx context.Context, sb storage.Blob) ([]byte, error) {
+	rd, err := ix.Storage.Open(ctx, sb)
+	if err != nil {
+		return nil, err
+	}
+	defer rd.Close()
+	return io.ReadAll(io.LimitReader(rd, ix.Opts.MaxBytes))
+}
+
+// Start runs an indexing pass every interval until ctx is cancelled.
+func (ix *Indexer) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				rep, err := ix.Run(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("search: %v", err)
+				}
+				if rep.Indexed+rep.Failed > 0 {
+					log.Print(rep.String())
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,43 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// ErrNotFound is returned by a Backend when the requested key does not exist.
+var ErrNotFound = errors.New("storage: object not found")
+
+// ErrCorrupt is returned when stored content can no longer be decoded or does
+// not hash to the expected value.
+var ErrCorrupt = errors.New("storage: content is corrupt")
+
+// ObjectInfo describes a stored object.
+type ObjectInfo struct {
+	Key     string
+	Size    int64
+	ModTime time.Time
+}
+
+// Backend is a flat key/value object store holding blob content. Keys are
+// slash-separated relative paths such as "ab/cd/abcd...".
+type Backend interface {
+	// Put stores size bytes read from r under key, replacing any existing object.
+	Put(ctx context.Context, key string, r io.Reader, size int64) error
+	// Get opens the whole object for reading.
+	Get(ctx context.Context, key string) (io.ReadCloser, error)
+	// GetRange opens n bytes of the object starting at off.
+	GetRange(ctx context.Context, key string, off, n int64) (io.ReadCloser, error)
+	Stat(ctx context.Context, key string) (ObjectInfo, error)
+	Delete(ctx context.Context, key string) error
+	// List calls fn for every object whose key starts with prefix.
+	List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error
+}
+
+// fileAdopter is implemented by backends that can take ownership of a local
+// spool file without copying it.
+type fileAdopter interface {
+	AdoptFile(ctx context.Context, key string, path string) error
+}
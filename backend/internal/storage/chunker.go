@@ -0,0 +1,103 @@
+package storage
+
+import (
+	"io"
+	"math/bits"
+)
+
+// ChunkParams configures content-defined chunking. The zero value disables
+// chunking and blobs are stored as single objects.
+type ChunkParams struct {
+	Min int
+	Avg int
+	Max int
+}
+
+func (p ChunkParams) Enabled() bool { return p.Avg > 0 }
+
+// gear is the FastCDC rolling hash table. It is derived from a fixed seed so
+// that chunk boundaries are stable across processes and releases.
+var gear = func() [256]uint64 {
+	var t [256]uint64
+	x := uint64(0x9e3779b97f4a7c15)
+	for i := range t {
+		// splitmix64
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		t[i] = z ^ (z >> 31)
+	}
+	return t
+}()
+
+// cut returns the length of the next chunk at the start of data using
+// FastCDC normalized chunking: a stricter mask below Avg and a looser one
+// above it pull chunk sizes towards the average.
+func (p ChunkParams) cut(data []byte) int {
+	n := len(data)
+	if n <= p.Min {
+		return n
+	}
+	if n > p.Max {
+		n = p.Max
+	}
+	normal := p.Avg
+	if normal > n {
+		normal = n
+	}
+	b := bits.Len(uint(p.Avg)) - 1
+	maskS := ^uint64(0) << (64 - (b + 2))
+	maskL := ^uint64(0) << (64 - (b - 2))
+	var fp uint64
+	i := p.Min
+	for ; i < normal; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + gear[data[i]]
+		if fp&maskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r          io.Reader
+	p          ChunkParams
+	buf        []byte
+	start, end int
+	eof        bool
+}
+
+func newChunker(r io.Reader, p ChunkParams) *chunker {
+	return &chunker{r: r, p: p, buf: make([]byte, p.Max)}
+}
+
+// next returns the next chunk. The slice is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	if c.end-c.start < c.p.Max && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		n, err := io.ReadFull(c.r, c.buf[c.end:])
+		c.end += n
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			c.eof = true
+		} else if err != nil {
+			return nil, err
+		}
+	}
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+	n := c.p.cut(c.buf[c.start:c.end])
+	chunk := c.buf[c.start : c.start+n]
+	c.start += n
+	return chunk, nil
+}
@@ -0,0 +1,92 @@
+package storage
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"testing"
+	"testing/iotest"
+)
+
+var testChunkParams = ChunkParams{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+
+func chunkAll(t *testing.T, r io.Reader, p ChunkParams) [][]byte {
+	t.Helper()
+	var chunks [][]byte
+	c := newChunker(r, p)
+	for {
+		b, err := c.next()
+		if err == io.EOF {
+			return chunks
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		chunks = append(chunks, bytes.Clone(b))
+	}
+}
+
+func TestChunkerBoundaries(t *testing.T) {
+	p := testChunkParams
+	random := make([]byte, 1<<20)
+	rand.New(rand.NewSource(1)).Read(random)
+	for _, c := range []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"below min", random[:p.Min-1]},
+		{"exactly min", random[:p.Min]},
+		{"exactly max", random[:p.Max]},
+		{"random", random},
+		// no content boundary ever matches, so every chunk is cut at Max
+		{"zeros", make([]byte, 5*p.Max+3)},
+	} {
+		chunks := chunkAll(t, bytes.NewReader(c.data), p)
+		if got := bytes.Join(chunks, nil); !bytes.Equal(got, c.data) {
+			t.Fatalf("%s: chunks do not reassemble the input", c.name)
+		}
+		for i, b := range chunks {
+			last := i == len(chunks)-1
+			if len(b) > p.Max || len(b) == 0 || (!last && len(b) <= p.Min) {
+				t.Fatalf("%s: chunk %d of %d has %d bytes", c.name, i, len(chunks), len(b))
+			}
+		}
+		// boundaries do not depend on how the reader splits its reads
+		small := chunkAll(t, iotest.HalfReader(bytes.NewReader(c.data)), p)
+		if len(small) != len(chunks) {
+			t.Fatalf("%s: %d chunks from short reads, %d from full reads", c.name, len(small), len(chunks))
+		}
+	}
+	if n := len(chunkAll(t, bytes.NewReader(make([]byte, 5*p.Max+3)), p)); n != 6 {
+		t.Fatalf("zeros: %d chunks, want 6", n)
+	}
+}
+
+// Inserting bytes near the start of a stream only moves the first
+// boundaries: later chunks are found again, which is what makes them
+// deduplicate.
+func TestChunkerResynchronizes(t *testing.T) {
+	p := testChunkParams
+	data := make([]byte, 1<<20)
+	rand.New(rand.NewSource(2)).Read(data)
+	before := chunkAll(t, bytes.NewReader(data), p)
+	after := chunkAll(t, bytes.NewReader(append([]byte("inserted"), data...)), p)
+
+	seen := map[string]bool{}
+	for _, b := range before {
+		seen[string(b)] = true
+	}
+	shared := 0
+	for _, b := range after {
+		if seen[string(b)] {
+			shared++
+		}
+	}
+	if shared < len(before)-2 {
+		t.Fatalf("only %d of %d chunks survive an insertion", shared, len(before))
+	}
+	if avg := len(data) / len(before); avg < p.Min || avg > p.Max {
+		t.Fatalf("average chunk size %d outside [%d, %d]", avg, p.Min, p.Max)
+	}
+}
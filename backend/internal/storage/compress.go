@@ -0,0 +1,182 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// CodecZstd marks objects stored as a zstd stream.
+const CodecZstd = "zstd"
+
+// Unencrypted compressed objects carry a small header so that the codec of an
+// object can be recovered from the backend alone.
+const (
+	zstdMagic      = "FVZ1"
+	zstdHeaderSize = 8
+)
+
+// Compressed content is only kept when it saves at least this fraction.
+const minCompressionSaving = 0.10
+
+// incompressible lists MIME types whose payload is already compressed.
+var incompressible = map[string]bool{
+	"application/zip":              true,
+	"application/gzip":             true,
+	"application/x-gzip":           true,
+	"application/x-bzip2":          true,
+	"application/x-xz":             true,
+	"application/zstd":             true,
+	"application/x-7z-compressed":  true,
+	"application/x-rar-compressed": true,
+	"application/vnd.rar":          true,
+	"application/pdf":              true,
+	"application/epub+zip":         true,
+	"application/java-archive":     true,
+}
+
+// Compressible reports whether content declared as mimeType is worth compressing.
+// Media types are skipped except for uncompressed formats such as SVG, BMP and WAV.
+func Compressible(mimeType string) bool {
+	mt := strings.ToLower(strings.TrimSpace(strings.SplitN(mimeType, ";", 2)[0]))
+	switch mt {
+	case "image/svg+xml", "image/bmp", "image/x-ms-bmp", "image/tiff", "audio/wav", "audio/x-wav":
+		return true
+	}
+	if strings.HasPrefix(mt, "image/") || strings.HasPrefix(mt, "video/") || strings.HasPrefix(mt, "audio/") {
+		return false
+	}
+	// OOXML / ODF documents are zip containers
+	if strings.HasPrefix(mt, "application/vnd.openxmlformats-") || strings.HasPrefix(mt, "application/vnd.oasis.opendocument.") {
+		return false
+	}
+	return !incompressible[mt]
+}
+
+func worthCompressing(original, compressed int64) bool {
+	return float64(compressed) <= float64(original)*(1-minCompressionSaving)
+}
+
+func (s *Service) encoder() (*zstd.Encoder, error) {
+	return zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(s.CompressionLevel)), zstd.WithEncoderConcurrency(1))
+}
+
+// compressFile writes a zstd stream of src to a new spool file. The caller
+// removes the returned file.
+func (s *Service) compressFile(src *os.File) (*os.File, int64, error) {
+	if _, err := src.Seek(0, io.SeekStart); err != nil {
+		return nil, 0, err
+	}
+	dst, err := os.CreateTemp(s.TempDir, "upload-*.zst")
+	if err != nil {
+		return nil, 0, err
+	}
+	enc, err := s.encoder()
+	if err == nil {
+		enc.Reset(dst)
+		if _, err = io.Copy(enc, src); err == nil {
+			err = enc.Close()
+		}
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return nil, 0, err
+	}
+	size, err := dst.Seek(0, io.SeekCurrent)
+	if err == nil {
+		_, err = dst.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		dst.Close()
+		os.Remove(dst.Name())
+		return nil, 0, err
+	}
+	return dst, size, nil
+}
+
+// compressBytes compresses a chunk in memory.
+func (s *Service) compressBytes(data []byte) ([]byte, error) {
+	enc, err := s.encoder()
+	if err != nil {
+		return nil, err
+	}
+	defer enc.Close()
+	return enc.EncodeAll(data, nil), nil
+}
+
+func zstdHeader() []byte {
+	h := make([]byte, zstdHeaderSize)
+	copy(h, zstdMagic)
+	return h
+}
+
+func isZstdHeader(h []byte) bool {
+	return len(h) >= zstdHeaderSize && bytes.Equal(h[:4], []byte(zstdMagic))
+}
+
+// decompressRange returns bytes [off, off+n) of the content decoded from a
+// zstd stream. zstd streams are not seekable, so everything before off is
+// decoded and discarded.
+func decompressRange(src io.ReadCloser, off, n int64) (io.ReadCloser, error) {
+	in := &sourceReader{r: src}
+	dec, err := zstd.NewReader(in, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		src.Close()
+		return nil, err
+	}
+	d := &decodeReader{Reader: io.LimitReader(dec, n), dec: dec, src: src, in: in}
+	if _, err := io.CopyN(io.Discard, dec, off); err != nil {
+		d.Close()
+		if errors.Is(err, io.EOF) {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, d.classify(err)
+	}
+	return d, nil
+}
+
+// sourceReader remembers read errors of the compressed stream so that they
+// can be told apart from decoding errors.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+type decodeReader struct {
+	io.Reader
+	dec *zstd.Decoder
+	src io.Closer
+	in  *sourceReader
+}
+
+func (d *decodeReader) Read(p []byte) (int, error) {
+	n, err := d.Reader.Read(p)
+	return n, d.classify(err)
+}
+
+// classify reports a failure to decode otherwise readable input as ErrCorrupt.
+func (d *decodeReader) classify(err error) error {
+	if err == nil || err == io.EOF || d.in.err != nil || errors.Is(err, ErrCorrupt) {
+		return err
+	}
+	return fmt.Errorf("%w: %v", ErrCorrupt, err)
+}
+
+func (d *decodeReader) Close() error {
+	d.dec.Close()
+	return d.src.Close()
+}
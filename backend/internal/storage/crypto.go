@@ -0,0 +1,522 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Keyring holds the master keys used to wrap per-blob data keys. All key
+// versions are kept so that rows wrapped under an older key stay readable
+// until they are re-wrapped; Active is used for everything new.
+//
+// The key file is JSON: {"active": "<id>", "keys": {"<id>": "<base64 32 bytes>"}}.
+type Keyring struct {
+	mu      sync.RWMutex
+	path    string
+	modTime time.Time
+	active  string
+	keys    map[string][]byte
+}
+
+type keyFile struct {
+	Active string            `json:"active"`
+	Keys   map[string]string `json:"keys"`
+}
+
+// LoadKeyring reads the key file at path.
+func LoadKeyring(path string) (*Keyring, error) {
+	k := &Keyring{path: path}
+	if err := k.load(); err != nil {
+		return nil, err
+	}
+	return k, nil
+}
+
+// NewKeyring returns an empty keyring that will be saved to path.
+func NewKeyring(path string) *Keyring { return &Keyring{path: path, keys: map[string][]byte{}} }
+
+func (k *Keyring) load() error {
+	st, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	b, err := os.ReadFile(k.path)
+	if err != nil {
+		return err
+	}
+	var kf keyFile
+	if err := json.Unmarshal(b, &kf); err != nil {
+		return fmt.Errorf("keyfile: %w", err)
+	}
+	keys := make(map[string][]byte, len(kf.Keys))
+	for id, enc := range kf.Keys {
+		raw, err := base64.StdEncoding.DecodeString(enc)
+		if err != nil || len(raw) != 32 {
+			return fmt.Errorf("keyfile: key %q must be 32 base64-encoded bytes", id)
+		}
+		keys[id] = raw
+	}
+	if _, ok := keys[kf.Active]; !ok {
+		return fmt.Errorf("keyfile: active key %q not found", kf.Active)
+	}
+	k.mu.Lock()
+	k.active, k.keys, k.modTime = kf.Active, keys, st.ModTime()
+	k.mu.Unlock()
+	return nil
+}
+
+// ReloadIfChanged re-reads the key file when it was modified, so that a
+// rotation done by another process is picked up by running servers.
+func (k *Keyring) ReloadIfChanged() error {
+	st, err := os.Stat(k.path)
+	if err != nil {
+		return err
+	}
+	k.mu.RLock()
+	same := st.ModTime().Equal(k.modTime)
+	k.mu.RUnlock()
+	if same {
+		return nil
+	}
+	return k.load()
+}
+
+// Save atomically writes the keyring back to its file with 0600 permissions.
+func (k *Keyring) Save() error {
+	k.mu.RLock()
+	kf := keyFile{Active: k.active, Keys: map[string]string{}}
+	for id, raw := range k.keys {
+		kf.Keys[id] = base64.StdEncoding.EncodeToString(raw)
+	}
+	k.mu.RUnlock()
+	b, err := json.MarshalIndent(kf, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(k.path), ".keyfile-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if err := tmp.Chmod(0o600); err != nil {
+		tmp.Close()
+		return err
+	}
+	if _, err := tmp.Write(append(b, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), k.path)
+}
+
+// Rotate generates a new master key and makes it active. Older keys are kept.
+func (k *Keyring) Rotate() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	id := "k" + time.Now().UTC().Format("20060102T150405Z")
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if _, ok := k.keys[id]; ok {
+		return "", fmt.Errorf("keyring: key %q already exists", id)
+	}
+	k.keys[id] = raw
+	k.active = id
+	return id, nil
+}
+
+// Remove drops a key version. The active key cannot be removed.
+func (k *Keyring) Remove(id string) error {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if id == k.active {
+		return errors.New("keyring: cannot remove the active key")
+	}
+	delete(k.keys, id)
+	return nil
+}
+
+func (k *Keyring) Active() string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	return k.active
+}
+
+// IDs lists all key versions.
+func (k *Keyring) IDs() []string {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	ids := make([]string, 0, len(k.keys))
+	for id := range k.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (k *Keyring) key(id string) ([]byte, error) {
+	k.mu.RLock()
+	defer k.mu.RUnlock()
+	raw, ok := k.keys[id]
+	if !ok {
+		return nil, fmt.Errorf("keyring: unknown key %q", id)
+	}
+	return raw, nil
+}
+
+// deriveDataKey returns the data key for content with the given hash sealed
+// with salt. Keys are derived from the master key so that concurrent writers
+// of the same payload produce identical ciphertext and deduplication keeps
+// working. The salt identifies the payload (see sealHeader), so that content
+// stored compressed one time and raw another is not sealed twice under one
+// key with the same segment nonces. Objects sealed before salts were
+// introduced have a nil salt.
+func (k *Keyring) deriveDataKey(keyID, contentHash string, salt []byte) ([]byte, error) {
+	master, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	m := hmac.New(sha256.New, master)
+	m.Write([]byte("filevault-dek:" + contentHash))
+	if salt != nil {
+		m.Write([]byte(":"))
+		m.Write(salt)
+	}
+	return m.Sum(nil), nil
+}
+
+// Wrap encrypts a data key under the active master key.
+func (k *Keyring) Wrap(dek []byte) (string, []byte, error) {
+	id := k.Active()
+	master, err := k.key(id)
+	if err != nil {
+		return "", nil, err
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return "", nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return id, aead.Seal(nonce, nonce, dek, []byte(id)), nil
+}
+
+// Unwrap decrypts a data key wrapped under master key keyID.
+func (k *Keyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	master, err := k.key(keyID)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(master)
+	if err != nil {
+		return nil, err
+	}
+	if len(wrapped) < aead.NonceSize() {
+		return nil, errors.New("keyring: wrapped key too short")
+	}
+	return aead.Open(nil, wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():], []byte(keyID))
+}
+
+// Rewrap moves a wrapped data key to the active master key without touching
+// the content it protects.
+func (k *Keyring) Rewrap(keyID string, wrapped []byte) (string, []byte, error) {
+	dek, err := k.Unwrap(keyID, wrapped)
+	if err != nil {
+		return "", nil, err
+	}
+	return k.Wrap(dek)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Sealed objects start with a fixed-size header followed by AES-256-GCM
+// segments of segmentSize plaintext bytes, each carrying its own tag. The
+// segment index is the nonce and the last segment is flagged in the
+// additional data, so segments cannot be reordered or the object truncated.
+// Fixed-size segments let a plaintext range be mapped to a ciphertext range.
+const (
+	sealMagic      = "FVE2"
+	sealHeaderSize = 64
+	segmentShift   = 16
+	segmentSize    = 1 << segmentShift
+	segmentTagSize = 16
+)
+
+// Header layout: magic[4] segmentShift[1] len(keyID)[1] keyID[..41] salt[16]
+// codec[1]. The salt is the start of the SHA-256 of the sealed payload, the
+// bytes after compression. Objects with magic sealMagicV1 have keyID[..57]
+// and no salt.
+const (
+	sealMagicV1   = "FVE1"
+	saltSize      = 16
+	maxKeyIDLen   = sealHeaderSize - 7 - saltSize
+	maxKeyIDLenV1 = sealHeaderSize - 7
+)
+
+func sealHeader(keyID, codec string, salt []byte) ([]byte, error) {
+	if len(keyID) > maxKeyIDLen {
+		return nil, fmt.Errorf("keyring: key id %q too long", keyID)
+	}
+	if len(salt) != saltSize {
+		return nil, fmt.Errorf("storage: salt must be %d bytes", saltSize)
+	}
+	h := make([]byte, sealHeaderSize)
+	copy(h, sealMagic)
+	h[4] = segmentShift
+	h[5] = byte(len(keyID))
+	copy(h[6:], keyID)
+	copy(h[sealHeaderSize-1-saltSize:], salt)
+	switch codec {
+	case "":
+	case CodecZstd:
+		h[sealHeaderSize-1] = 1
+	default:
+		return nil, fmt.Errorf("storage: unknown codec %q", codec)
+	}
+	return h, nil
+}
+
+// parseSealHeader returns the master key id, codec and salt recorded in a
+// sealed object's header, or ok=false if the object is not sealed. The salt
+// is nil for objects sealed without one.
+func parseSealHeader(h []byte) (keyID, codec string, salt []byte, ok bool) {
+	if len(h) < sealHeaderSize || h[4] != segmentShift {
+		return "", "", nil, false
+	}
+	switch string(h[:4]) {
+	case sealMagic:
+		if int(h[5]) > maxKeyIDLen {
+			return "", "", nil, false
+		}
+		salt = bytes.Clone(h[sealHeaderSize-1-saltSize : sealHeaderSize-1])
+	case sealMagicV1:
+		if int(h[5]) > maxKeyIDLenV1 {
+			return "", "", nil, false
+		}
+	default:
+		return "", "", nil, false
+	}
+	switch h[sealHeaderSize-1] {
+	case 0:
+	case 1:
+		codec = CodecZstd
+	default:
+		return "", "", nil, false
+	}
+	return string(h[6 : 6+int(h[5])]), codec, salt, true
+}
+
+// payloadSalt returns the salt for sealing the payload r of content with
+// the given hash: the start of the payload's SHA-256, which is the content
+// hash itself unless the payload is compressed. r is left where it was.
+func payloadSalt(contentHash string, r io.ReadSeeker, codec string) ([]byte, error) {
+	if codec == "" {
+		sum, err := hex.DecodeString(contentHash)
+		if err != nil || len(sum) < saltSize {
+			return nil, fmt.Errorf("storage: invalid content hash %q", contentHash)
+		}
+		return sum[:saltSize], nil
+	}
+	pos, err := r.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return nil, err
+	}
+	if _, err := r.Seek(pos, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil)[:saltSize], nil
+}
+
+func segmentCount(plainSize int64) int64 {
+	if plainSize == 0 {
+		return 1
+	}
+	return (plainSize + segmentSize - 1) / segmentSize
+}
+
+// SealedSize is the stored size of plainSize bytes of sealed content.
+func SealedSize(plainSize int64) int64 {
+	return sealHeaderSize + plainSize + segmentCount(plainSize)*segmentTagSize
+}
+
+// sealedPlainSize inverts SealedSize.
+func sealedPlainSize(sealedSize int64) int64 {
+	body := sealedSize - sealHeaderSize
+	segs := (body + segmentSize + segmentTagSize - 1) / (segmentSize + segmentTagSize)
+	if segs < 1 {
+		segs = 1
+	}
+	return body - segs*segmentTagSize
+}
+
+func segmentNonce(i int64) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[4:], uint64(i))
+	return n
+}
+
+func segmentAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// sealReader encrypts plainSize bytes from r, producing the header and segments.
+type sealReader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	segs    int64
+	i       int64
+	plain   []byte
+	out     []byte
+	pending []byte
+}
+
+func newSealReader(r io.Reader, plainSize int64, dek []byte, keyID, codec string, salt []byte) (io.Reader, error) {
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	h, err := sealHeader(keyID, codec, salt)
+	if err != nil {
+		return nil, err
+	}
+	return &sealReader{
+		r:       r,
+		aead:    aead,
+		segs:    segmentCount(plainSize),
+		plain:   make([]byte, segmentSize),
+		out:     make([]byte, 0, segmentSize+segmentTagSize),
+		pending: h,
+	}, nil
+}
+
+func (s *sealReader) Read(p []byte) (int, error) {
+	for len(s.pending) == 0 {
+		if s.i >= s.segs {
+			return 0, io.EOF
+		}
+		n, err := io.ReadFull(s.r, s.plain)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		last := s.i == s.segs-1
+		if !last && n < segmentSize {
+			return 0, io.ErrUnexpectedEOF
+		}
+		s.pending = s.aead.Seal(s.out[:0], segmentNonce(s.i), s.plain[:n], segmentAD(last))
+		s.i++
+	}
+	n := copy(p, s.pending)
+	s.pending = s.pending[n:]
+	return n, nil
+}
+
+// openSealedRange returns plaintext bytes [off, off+n) of a sealed object,
+// fetching only the segments that cover the range.
+func openSealedRange(get func(off, n int64) (io.ReadCloser, error), dek []byte, plainSize, off, n int64) (io.ReadCloser, error) {
+	aead, err := newGCM(dek)
+	if err != nil {
+		return nil, err
+	}
+	if n <= 0 {
+		return io.NopCloser(bytes.NewReader(nil)), nil
+	}
+	first := off / segmentSize
+	last := (off + n - 1) / segmentSize
+	const stride = segmentSize + segmentTagSize
+	cOff := sealHeaderSize + first*stride
+	cEnd := sealHeaderSize + (last+1)*stride
+	if max := SealedSize(plainSize); cEnd > max {
+		cEnd = max
+	}
+	rc, err := get(cOff, cEnd-cOff)
+	if err != nil {
+		return nil, err
+	}
+	return &openReader{
+		rc:   rc,
+		aead: aead,
+		segs: segmentCount(plainSize),
+		i:    first,
+		skip: off - first*segmentSize,
+		left: n,
+		buf:  make([]byte, stride),
+	}, nil
+}
+
+type openReader struct {
+	rc      io.ReadCloser
+	aead    cipher.AEAD
+	segs    int64
+	i       int64
+	skip    int64
+	left    int64
+	buf     []byte
+	pending []byte
+}
+
+func (o *openReader) Read(p []byte) (int, error) {
+	for len(o.pending) == 0 {
+		if o.left <= 0 {
+			return 0, io.EOF
+		}
+		m, err := io.ReadFull(o.rc, o.buf)
+		if err != nil && err != io.ErrUnexpectedEOF {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, err
+		}
+		plain, err := o.aead.Open(o.buf[:0], segmentNonce(o.i), o.buf[:m], segmentAD(o.i == o.segs-1))
+		if err != nil {
+			return 0, fmt.Errorf("%w: segment %d: %v", ErrCorrupt, o.i, err)
+		}
+		o.i++
+		plain = plain[o.skip:]
+		o.skip = 0
+		if int64(len(plain)) > o.left {
+			plain = plain[:o.left]
+		}
+		o.left -= int64(len(plain))
+		o.pending = plain
+	}
+	n := copy(p, o.pending)
+	o.pending = o.pending[n:]
+	return n, nil
+}
+
+func (o *openReader) Close() error { return o.rc.Close() }
@@ -0,0 +1,298 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"math/rand"
+	"path/filepath"
+	"testing"
+)
+
+func testKeyring(t *testing.T) *Keyring {
+	t.Helper()
+	k := NewKeyring(filepath.Join(t.TempDir(), "keys.json"))
+	if _, err := k.Rotate(); err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+func readAll(t *testing.T, s *Service, b Blob) []byte {
+	t.Helper()
+	f, err := s.Open(context.Background(), b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	got, err := io.ReadAll(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return got
+}
+
+// The same content stored raw and compressed must not be sealed under one
+// data key, since both use the same segment nonces.
+func TestSealKeyDependsOnPayload(t *testing.T) {
+	k := testKeyring(t)
+	data := bytes.Repeat([]byte("compressible text "), 10000)
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	s := &Service{Compression: true, CompressionLevel: 3}
+	z, err := s.compressBytes(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rawSalt, err := payloadSalt(hash, bytes.NewReader(data), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	zr := bytes.NewReader(z)
+	zSalt, err := payloadSalt(hash, zr, CodecZstd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(rawSalt, zSalt) {
+		t.Fatal("raw and compressed payloads got the same salt")
+	}
+	if zr.Len() != len(z) {
+		t.Fatal("payloadSalt did not rewind the payload")
+	}
+	rawKey, _ := k.deriveDataKey(k.Active(), hash, rawSalt)
+	zKey, _ := k.deriveDataKey(k.Active(), hash, zSalt)
+	if bytes.Equal(rawKey, zKey) {
+		t.Fatal("raw and compressed payloads got the same data key")
+	}
+	again, _ := k.deriveDataKey(k.Active(), hash, rawSalt)
+	if !bytes.Equal(rawKey, again) {
+		t.Fatal("data key derivation is not deterministic")
+	}
+}
+
+func TestSealHeaderRoundTrip(t *testing.T) {
+	salt := bytes.Repeat([]byte{7}, saltSize)
+	h, err := sealHeader("k20260101T000000Z", CodecZstd, salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyID, codec, got, ok := parseSealHeader(h)
+	if !ok || keyID != "k20260101T000000Z" || codec != CodecZstd || !bytes.Equal(got, salt) {
+		t.Fatalf("parseSealHeader = %q, %q, %x, %v", keyID, codec, got, ok)
+	}
+
+	// objects sealed before salts were introduced
+	v1 := make([]byte, sealHeaderSize)
+	copy(v1, sealMagicV1)
+	v1[4], v1[5] = segmentShift, 2
+	copy(v1[6:], "k1")
+	keyID, codec, got, ok = parseSealHeader(v1)
+	if !ok || keyID != "k1" || codec != "" || got != nil {
+		t.Fatalf("parseSealHeader(v1) = %q, %q, %x, %v", keyID, codec, got, ok)
+	}
+
+	if _, err := sealHeader(string(bytes.Repeat([]byte("k"), maxKeyIDLen+1)), "", salt); err == nil {
+		t.Fatal("sealHeader accepted an over-long key id")
+	}
+}
+
+// Storing content compressed and then deduplicating it against an upload
+// that would not have been compressed reads back the stored object.
+func TestEncryptedWriteAndDedup(t *testing.T) {
+	dir := t.TempDir()
+	s := &Service{Backend: NewDisk(filepath.Join(dir, "blobs")), TempDir: dir, Keys: testKeyring(t), Compression: true, CompressionLevel: 3}
+	data := bytes.Repeat([]byte("hello world "), 20000)
+	b, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "text/plain")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b.Codec != CodecZstd || !b.Encrypted() {
+		t.Fatalf("stored with codec %q, encrypted %v", b.Codec, b.Encrypted())
+	}
+	if got := readAll(t, s, b); !bytes.Equal(got, data) {
+		t.Fatal("content does not round-trip")
+	}
+	dup, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dup.Created) != 0 || dup.Codec != CodecZstd {
+		t.Fatalf("dedup created %v with codec %q", dup.Created, dup.Codec)
+	}
+	if got := readAll(t, s, dup); !bytes.Equal(got, data) {
+		t.Fatal("deduplicated content does not round-trip")
+	}
+}
+
+func TestSealedSizes(t *testing.T) {
+	for _, n := range []int64{0, 1, segmentSize - 1, segmentSize, segmentSize + 1, 3*segmentSize + 5, 1 << 30} {
+		sealed := SealedSize(n)
+		if got := sealedPlainSize(sealed); got != n {
+			t.Fatalf("sealedPlainSize(SealedSize(%d)) = %d", n, got)
+		}
+	}
+}
+
+// seal returns data sealed under dek.
+func seal(t *testing.T, data, dek []byte) []byte {
+	t.Helper()
+	r, err := newSealReader(bytes.NewReader(data), int64(len(data)), dek, "k1", "", make([]byte, saltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sealed, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int64(len(sealed)) != SealedSize(int64(len(data))) {
+		t.Fatalf("sealed %d bytes into %d, SealedSize says %d", len(data), len(sealed), SealedSize(int64(len(data))))
+	}
+	return sealed
+}
+
+func TestOpenSealedRange(t *testing.T) {
+	dek := bytes.Repeat([]byte{1}, 32)
+	data := make([]byte, 3*segmentSize+5)
+	rand.New(rand.NewSource(1)).Read(data)
+	sealed := seal(t, data, dek)
+	size := int64(len(data))
+
+	for _, c := range []struct{ off, n int64 }{
+		{0, size},
+		{0, 1},
+		{size - 1, 1},
+		{segmentSize - 1, 2},
+		{segmentSize, segmentSize},
+		{10, 2*segmentSize + 7},
+		{3 * segmentSize, 5},
+		{5, 0},
+	} {
+		var fetched int64
+		get := func(off, n int64) (io.ReadCloser, error) {
+			if off < sealHeaderSize || off+n > int64(len(sealed)) {
+				t.Fatalf("range [%d, %d) fetched for plaintext [%d, %d)", off, off+n, c.off, c.off+c.n)
+			}
+			fetched = n
+			return io.NopCloser(bytes.NewReader(sealed[off : off+n])), nil
+		}
+		rc, err := openSealedRange(get, dek, size, c.off, c.n)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("[%d, %d): %v", c.off, c.off+c.n, err)
+		}
+		if !bytes.Equal(got, data[c.off:c.off+c.n]) {
+			t.Fatalf("[%d, %d): wrong plaintext", c.off, c.off+c.n)
+		}
+		// only the segments covering the range are fetched
+		if segs := (fetched + segmentSize + segmentTagSize - 1) / (segmentSize + segmentTagSize); c.n > 0 && segs != (c.off+c.n-1)/segmentSize-c.off/segmentSize+1 {
+			t.Fatalf("[%d, %d): fetched %d bytes", c.off, c.off+c.n, fetched)
+		}
+	}
+}
+
+func TestOpenSealedRangeRejectsTampering(t *testing.T) {
+	dek := bytes.Repeat([]byte{1}, 32)
+	data := make([]byte, 2*segmentSize+5)
+	sealed := seal(t, data, dek)
+	size := int64(len(data))
+	open := func(sealed []byte, off, n int64) error {
+		get := func(off, n int64) (io.ReadCloser, error) {
+			return io.NopCloser(bytes.NewReader(sealed[off:min(off+n, int64(len(sealed)))])), nil
+		}
+		rc, err := openSealedRange(get, dek, size, off, n)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		_, err = io.ReadAll(rc)
+		return err
+	}
+
+	flipped := bytes.Clone(sealed)
+	flipped[sealHeaderSize+segmentSize+segmentTagSize+3] ^= 1
+	if err := open(flipped, 0, size); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("flipped bit: %v", err)
+	}
+	if err := open(flipped, 0, segmentSize); err != nil {
+		t.Fatalf("segment before the flipped bit: %v", err)
+	}
+
+	// swapping two full segments breaks their nonces
+	const stride = segmentSize + segmentTagSize
+	swapped := bytes.Clone(sealed)
+	copy(swapped[sealHeaderSize:], sealed[sealHeaderSize+stride:sealHeaderSize+2*stride])
+	copy(swapped[sealHeaderSize+stride:], sealed[sealHeaderSize:sealHeaderSize+stride])
+	if err := open(swapped, 0, segmentSize); !errors.Is(err, ErrCorrupt) {
+		t.Fatalf("swapped segments: %v", err)
+	}
+
+	// a truncated object cannot pass its last full segment off as the end
+	truncated := sealed[:sealHeaderSize+2*stride]
+	if err := open(truncated, 0, size); err == nil {
+		t.Fatal("truncated object opened")
+	}
+}
+
+// After a rotation re-wraps every recorded data key and prunes the old
+// master key, content already stored deduplicates through the recorded
+// encoding rather than the retired key named in the object header.
+func TestDedupAfterRotateAndPrune(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		dir := t.TempDir()
+		k := testKeyring(t)
+		s := &Service{Backend: NewDisk(filepath.Join(dir, "blobs")), TempDir: dir, Keys: k}
+		if chunked {
+			s.Chunking = ChunkParams{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+		}
+		recorded := map[string]Encoding{}
+		s.Recorded = func(_ context.Context, key string) (Encoding, bool, error) {
+			enc, ok := recorded[key]
+			return enc, ok, nil
+		}
+		data := make([]byte, 64<<10)
+		rand.New(rand.NewSource(3)).Read(data)
+		b, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded[b.Key] = b.Encoding
+		for _, c := range b.Chunks {
+			recorded[c.Key] = c.Encoding
+		}
+
+		// vaultctl rotate-key -prune
+		old := k.Active()
+		k.keys["k2"], k.active = bytes.Repeat([]byte{2}, 32), "k2"
+		for key, enc := range recorded {
+			if !enc.Encrypted() {
+				continue
+			}
+			if enc.KeyID, enc.WrappedKey, err = k.Rewrap(enc.KeyID, enc.WrappedKey); err != nil {
+				t.Fatal(err)
+			}
+			recorded[key] = enc
+		}
+		if err := k.Remove(old); err != nil {
+			t.Fatal(err)
+		}
+
+		again, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("chunked=%v: re-upload after pruning: %v", chunked, err)
+		}
+		if len(again.Created) != 0 {
+			t.Fatalf("chunked=%v: re-upload stored %v again", chunked, again.Created)
+		}
+		if got := readAll(t, s, again); !bytes.Equal(got, data) {
+			t.Fatalf("chunked=%v: content does not round-trip", chunked)
+		}
+	}
+}
@@ -0,0 +1,73 @@
+package storage
+
+import (
+	"errors"
+	"io"
+)
+
+// Reader is an io.ReadSeekCloser over stored content of a known size. Each
+// seek drops the current stream and the next Read opens a new one at the
+// requested offset, so a range request only fetches the bytes it needs.
+type Reader struct {
+	size int64
+	off  int64
+	open func(off, n int64) (io.ReadCloser, error)
+	rc   io.ReadCloser
+}
+
+func newReader(size int64, open func(off, n int64) (io.ReadCloser, error)) *Reader {
+	return &Reader{size: size, open: open}
+}
+
+func (r *Reader) Size() int64 { return r.size }
+
+func (r *Reader) Read(p []byte) (int, error) {
+	if r.off >= r.size {
+		return 0, io.EOF
+	}
+	if r.rc == nil {
+		rc, err := r.open(r.off, r.size-r.off)
+		if err != nil {
+			return 0, err
+		}
+		r.rc = rc
+	}
+	n, err := r.rc.Read(p)
+	r.off += int64(n)
+	if err == io.EOF && r.off < r.size {
+		err = io.ErrUnexpectedEOF
+	}
+	return n, err
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	var abs int64
+	switch whence {
+	case io.SeekStart:
+		abs = offset
+	case io.SeekCurrent:
+		abs = r.off + offset
+	case io.SeekEnd:
+		abs = r.size + offset
+	default:
+		return 0, errors.New("storage: invalid whence")
+	}
+	if abs < 0 {
+		return 0, errors.New("storage: negative position")
+	}
+	if abs != r.off && r.rc != nil {
+		_ = r.rc.Close()
+		r.rc = nil
+	}
+	r.off = abs
+	return abs, nil
+}
+
+func (r *Reader) Close() error {
+	if r.rc == nil {
+		return nil
+	}
+	err := r.rc.Close()
+	r.rc = nil
+	return err
+}
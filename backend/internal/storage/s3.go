@@ -0,0 +1,367 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// S3 stores objects in an S3-compatible bucket (AWS, MinIO, Ceph RGW, ...).
+// Requests are signed with AWS Signature Version 4.
+type S3 struct {
+	Endpoint  string // e.g. https://s3.eu-west-1.amazonaws.com or http://minio:9000
+	Region    string
+	Bucket    string
+	AccessKey string
+	SecretKey string
+	Prefix    string // optional key prefix inside the bucket
+	PathStyle bool   // address the bucket as endpoint/bucket instead of bucket.endpoint
+	Client    *http.Client
+}
+
+// Objects larger than this are sent with the multipart upload API.
+const (
+	s3MultipartThreshold = 64 << 20
+	s3PartSize           = 64 << 20
+)
+
+func (s *S3) Put(ctx context.Context, key string, r io.Reader, size int64) error {
+	if size < 0 || size > s3MultipartThreshold {
+		return s.putMultipart(ctx, key, r)
+	}
+	resp, err := s.do(ctx, http.MethodPut, key, nil, nil, io.LimitReader(r, size), size)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) putMultipart(ctx context.Context, key string, r io.Reader) error {
+	resp, err := s.do(ctx, http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil, 0)
+	if err != nil {
+		return err
+	}
+	var created struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&created)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("s3: create multipart upload: %w", err)
+	}
+	type part struct {
+		PartNumber int    `xml:"PartNumber"`
+		ETag       string `xml:"ETag"`
+	}
+	var parts []part
+	abort := func() {
+		if resp, err := s.do(context.Background(), http.MethodDelete, key, url.Values{"uploadId": {created.UploadID}}, nil, nil, 0); err == nil {
+			resp.Body.Close()
+		}
+	}
+	buf := make([]byte, s3PartSize)
+	for n := 1; ; n++ {
+		read, rerr := io.ReadFull(r, buf)
+		if read > 0 || n == 1 {
+			q := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {created.UploadID}}
+			resp, err := s.do(ctx, http.MethodPut, key, q, nil, bytes.NewReader(buf[:read]), int64(read))
+			if err != nil {
+				abort()
+				return err
+			}
+			parts = append(parts, part{PartNumber: n, ETag: resp.Header.Get("ETag")})
+			resp.Body.Close()
+		}
+		if rerr == io.EOF || rerr == io.ErrUnexpectedEOF {
+			break
+		}
+		if rerr != nil {
+			abort()
+			return rerr
+		}
+	}
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []part   `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		abort()
+		return err
+	}
+	resp, err = s.do(ctx, http.MethodPost, key, url.Values{"uploadId": {created.UploadID}}, nil, bytes.NewReader(body), int64(len(body)))
+	if err != nil {
+		abort()
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (s *S3) Get(ctx context.Context, key string) (io.ReadCloser, error) {
+	resp, err := s.do(ctx, http.MethodGet, key, nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) GetRange(ctx context.Context, key string, off, n int64) (io.ReadCloser, error) {
+	if n <= 0 {
+		return io.NopCloser(strings.NewReader("")), nil
+	}
+	h := http.Header{"Range": {fmt.Sprintf("bytes=%d-%d", off, off+n-1)}}
+	resp, err := s.do(ctx, http.MethodGet, key, nil, h, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (s *S3) Stat(ctx context.Context, key string) (ObjectInfo, error) {
+	resp, err := s.do(ctx, http.MethodHead, key, nil, nil, nil, 0)
+	if err != nil {
+		return ObjectInfo{}, err
+	}
+	resp.Body.Close()
+	info := ObjectInfo{Key: key, Size: resp.ContentLength}
+	if t, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.ModTime = t
+	}
+	return info, nil
+}
+
+func (s *S3) Delete(ctx context.Context, key string) error {
+	resp, err := s.do(ctx, http.MethodDelete, key, nil, nil, nil, 0)
+	if errors.Is(err, ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List pages through ListObjectsV2 results.
+func (s *S3) List(ctx context.Context, prefix string, fn func(ObjectInfo) error) error {
+	base := ""
+	if s.Prefix != "" {
+		base = strings.Trim(s.Prefix, "/") + "/"
+	}
+	token := ""
+	for {
+		q := url.Values{"list-type": {"2"}, "prefix": {base + prefix}}
+		if token != "" {
+			q.Set("continuation-token", token)
+		}
+		resp, err := s.doBucket(ctx, q)
+		if err != nil {
+			return err
+		}
+		var page struct {
+			Contents []struct {
+				Key          string `xml:"Key"`
+				Size         int64  `xml:"Size"`
+				LastModified string `xml:"LastModified"`
+			} `xml:"Contents"`
+			IsTruncated           bool   `xml:"IsTruncated"`
+			NextContinuationToken string `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("s3: list: %w", err)
+		}
+		for _, c := range page.Contents {
+			info := ObjectInfo{Key: strings.TrimPrefix(c.Key, base), Size: c.Size}
+			if t, err := time.Parse(time.RFC3339, c.LastModified); err == nil {
+				info.ModTime = t
+			}
+			if err := fn(info); err != nil {
+				return err
+			}
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// doBucket sends a signed GET for the bucket itself.
+func (s *S3) doBucket(ctx context.Context, query url.Values) (*http.Response, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: endpoint: %w", err)
+	}
+	if s.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/"
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/"
+	}
+	return s.send(ctx, http.MethodGet, u, query, nil, nil, 0)
+}
+
+// do sends a signed request for key and maps non-2xx responses to errors.
+func (s *S3) do(ctx context.Context, method, key string, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u, err := s.objectURL(key)
+	if err != nil {
+		return nil, err
+	}
+	return s.send(ctx, method, u, query, header, body, size)
+}
+
+func (s *S3) send(ctx context.Context, method string, u *url.URL, query url.Values, header http.Header, body io.Reader, size int64) (*http.Response, error) {
+	u.RawQuery = canonicalQuery(query)
+	req, err := http.NewRequestWithContext(ctx, method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	s.sign(req, time.Now().UTC())
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode/100 != 2 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3: %s %s: %s: %s", method, u.Path, resp.Status, bytes.TrimSpace(msg))
+	}
+	return resp, nil
+}
+
+func (s *S3) objectURL(key string) (*url.URL, error) {
+	u, err := url.Parse(s.Endpoint)
+	if err != nil {
+		return nil, fmt.Errorf("s3: endpoint: %w", err)
+	}
+	full := strings.TrimPrefix(key, "/")
+	if s.Prefix != "" {
+		full = strings.Trim(s.Prefix, "/") + "/" + full
+	}
+	if s.PathStyle {
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + s.Bucket + "/" + full
+	} else {
+		u.Host = s.Bucket + "." + u.Host
+		u.Path = strings.TrimSuffix(u.Path, "/") + "/" + full
+	}
+	u.RawPath = uriEncode(u.Path, false)
+	return u, nil
+}
+
+// sign adds SigV4 headers to req. Payloads are sent unsigned so that large
+// bodies can be streamed without hashing them twice.
+func (s *S3) sign(req *http.Request, now time.Time) {
+	const payloadHash = "UNSIGNED-PAYLOAD"
+	amzDate := now.Format("20060102T150405Z")
+	day := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	req.Header.Set("x-amz-content-sha256", payloadHash)
+
+	signed := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		signed = append(signed, "range")
+	}
+	sort.Strings(signed)
+	var canonHeaders strings.Builder
+	for _, h := range signed {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		canonHeaders.WriteString(h + ":" + strings.TrimSpace(v) + "\n")
+	}
+	canonical := strings.Join([]string{
+		req.Method,
+		uriEncode(req.URL.Path, false),
+		req.URL.RawQuery,
+		canonHeaders.String(),
+		strings.Join(signed, ";"),
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + s.Region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	k := hmacSHA256([]byte("AWS4"+s.SecretKey), day)
+	k = hmacSHA256(k, s.Region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	sig := hex.EncodeToString(hmacSHA256(k, toSign))
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+s.AccessKey+"/"+scope+
+		", SignedHeaders="+strings.Join(signed, ";")+", Signature="+sig)
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes q with sorted keys as required by SigV4.
+func canonicalQuery(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, k := range keys {
+		vs := append([]string(nil), q[k]...)
+		sort.Strings(vs)
+		for _, v := range vs {
+			parts = append(parts, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+// uriEncode percent-encodes everything except RFC 3986 unreserved characters
+// (and '/' unless encodeSlash is set), matching the SigV4 rules.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9',
+			c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,413 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeS3Bucket = "vault"
+	fakeS3Region = "test-1"
+	fakeS3Access = "AKIDTEST"
+	fakeS3Secret = "secret"
+)
+
+// fakeS3 is an in-memory S3 API covering what the S3 backend uses: objects,
+// ranged reads, multipart uploads and paginated ListObjectsV2 on one
+// path-style bucket. Requests must be signed with SigV4 using fakeS3Secret.
+type fakeS3 struct {
+	t        *testing.T
+	pageSize int
+
+	mu      sync.Mutex
+	objects map[string][]byte
+	uploads map[string]map[int][]byte
+	nextID  int
+	// parts counts the parts uploaded through the multipart API.
+	parts int
+}
+
+func newFakeS3(t *testing.T) (*fakeS3, *S3) {
+	f := &fakeS3{t: t, pageSize: 2, objects: map[string][]byte{}, uploads: map[string]map[int][]byte{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, &S3{
+		Endpoint:  srv.URL,
+		Region:    fakeS3Region,
+		Bucket:    fakeS3Bucket,
+		AccessKey: fakeS3Access,
+		SecretKey: fakeS3Secret,
+		Prefix:    "data",
+		PathStyle: true,
+		Client:    srv.Client(),
+	}
+}
+
+var authRe = regexp.MustCompile(`^AWS4-HMAC-SHA256 Credential=([^/]+)/(\d{8})/([^/]+)/s3/aws4_request, SignedHeaders=([a-z0-9;-]+), Signature=([0-9a-f]{64})$`)
+
+// checkSignature verifies the SigV4 headers of r.
+func (f *fakeS3) checkSignature(r *http.Request) error {
+	m := authRe.FindStringSubmatch(r.Header.Get("Authorization"))
+	if m == nil {
+		return fmt.Errorf("malformed Authorization %q", r.Header.Get("Authorization"))
+	}
+	access, day, region, signedHeaders, sig := m[1], m[2], m[3], m[4], m[5]
+	amzDate := r.Header.Get("x-amz-date")
+	if access != fakeS3Access || region != fakeS3Region || !strings.HasPrefix(amzDate, day+"T") {
+		return fmt.Errorf("bad credential scope %q for date %q", m[0], amzDate)
+	}
+	if r.Header.Get("x-amz-content-sha256") == "" {
+		return errors.New("missing x-amz-content-sha256")
+	}
+	var canonHeaders strings.Builder
+	for _, h := range strings.Split(signedHeaders, ";") {
+		v := r.Header.Get(h)
+		if h == "host" {
+			v = r.Host
+		}
+		if v == "" {
+			return fmt.Errorf("signed header %q missing", h)
+		}
+		fmt.Fprintf(&canonHeaders, "%s:%s\n", h, strings.TrimSpace(v))
+	}
+	if r.Header.Get("Range") != "" && !strings.Contains(signedHeaders, "range") {
+		return errors.New("Range is not signed")
+	}
+	canonical := strings.Join([]string{r.Method, r.URL.EscapedPath(), r.URL.RawQuery, canonHeaders.String(), signedHeaders, r.Header.Get("x-amz-content-sha256")}, "\n")
+	scope := day + "/" + region + "/s3/aws4_request"
+	sum := sha256Hex([]byte(canonical))
+	k := hmacSHA256([]byte("AWS4"+fakeS3Secret), day)
+	k = hmacSHA256(k, region)
+	k = hmacSHA256(k, "s3")
+	k = hmacSHA256(k, "aws4_request")
+	if want := hex.EncodeToString(hmacSHA256(k, "AWS4-HMAC-SHA256\n"+amzDate+"\n"+scope+"\n"+sum)); sig != want {
+		return errors.New("signature does not match")
+	}
+	return nil
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if err := f.checkSignature(r); err != nil {
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	path := strings.TrimPrefix(r.URL.Path, "/")
+	bucket, key, _ := strings.Cut(path, "/")
+	if bucket != fakeS3Bucket {
+		http.Error(w, "no such bucket", http.StatusNotFound)
+		return
+	}
+	q := r.URL.Query()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch {
+	case key == "" && r.Method == http.MethodGet && q.Get("list-type") == "2":
+		f.list(w, q.Get("prefix"), q.Get("continuation-token"))
+	case r.Method == http.MethodPost && q.Has("uploads"):
+		f.nextID++
+		id := "upload-" + strconv.Itoa(f.nextID)
+		f.uploads[id] = map[int][]byte{}
+		fmt.Fprintf(w, "<InitiateMultipartUploadResult><UploadId>%s</UploadId></InitiateMultipartUploadResult>", id)
+	case r.Method == http.MethodPut && q.Has("uploadId"):
+		parts, ok := f.uploads[q.Get("uploadId")]
+		if !ok {
+			http.Error(w, "no such upload", http.StatusNotFound)
+			return
+		}
+		n, _ := strconv.Atoi(q.Get("partNumber"))
+		body, _ := io.ReadAll(r.Body)
+		parts[n] = body
+		f.parts++
+		w.Header().Set("ETag", fmt.Sprintf(`"etag-%d"`, n))
+	case r.Method == http.MethodPost && q.Has("uploadId"):
+		f.complete(w, r, key, q.Get("uploadId"))
+	case r.Method == http.MethodDelete && q.Has("uploadId"):
+		delete(f.uploads, q.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut:
+		body, _ := io.ReadAll(r.Body)
+		if int64(len(body)) != r.ContentLength {
+			http.Error(w, "short body", http.StatusBadRequest)
+			return
+		}
+		f.objects[key] = body
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "unsupported", http.StatusMethodNotAllowed)
+	}
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	body, ok := f.objects[key]
+	if !ok {
+		http.Error(w, "no such key", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Last-Modified", time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC).Format(http.TimeFormat))
+	if rg := r.Header.Get("Range"); rg != "" {
+		var lo, hi int
+		if _, err := fmt.Sscanf(rg, "bytes=%d-%d", &lo, &hi); err != nil || lo > hi || hi >= len(body) {
+			http.Error(w, "bad range", http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		body = body[lo : hi+1]
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", lo, hi, len(f.objects[key])))
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+		w.WriteHeader(http.StatusPartialContent)
+	} else {
+		w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	}
+	if r.Method == http.MethodGet {
+		w.Write(body)
+	}
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, r *http.Request, key, id string) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		http.Error(w, "no such upload", http.StatusNotFound)
+		return
+	}
+	var req struct {
+		Parts []struct {
+			PartNumber int
+			ETag       string
+		} `xml:"Part"`
+	}
+	if err := xml.NewDecoder(r.Body).Decode(&req); err != nil || len(req.Parts) == 0 {
+		http.Error(w, "malformed completion", http.StatusBadRequest)
+		return
+	}
+	var body []byte
+	for i, p := range req.Parts {
+		if p.PartNumber != i+1 || p.ETag != fmt.Sprintf(`"etag-%d"`, p.PartNumber) || parts[p.PartNumber] == nil {
+			http.Error(w, "invalid part", http.StatusBadRequest)
+			return
+		}
+		body = append(body, parts[p.PartNumber]...)
+	}
+	f.objects[key] = body
+	delete(f.uploads, id)
+	fmt.Fprint(w, "<CompleteMultipartUploadResult></CompleteMultipartUploadResult>")
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, prefix, after string) {
+	var keys []string
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > after {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > f.pageSize
+	if truncated {
+		keys = keys[:f.pageSize]
+	}
+	var b strings.Builder
+	b.WriteString("<ListBucketResult>")
+	for _, k := range keys {
+		fmt.Fprintf(&b, "<Contents><Key>%s</Key><Size>%d</Size><LastModified>2026-01-02T03:04:05Z</LastModified></Contents>", k, len(f.objects[k]))
+	}
+	fmt.Fprintf(&b, "<IsTruncated>%v</IsTruncated>", truncated)
+	if truncated {
+		fmt.Fprintf(&b, "<NextContinuationToken>%s</NextContinuationToken>", keys[len(keys)-1])
+	}
+	b.WriteString("</ListBucketResult>")
+	io.WriteString(w, b.String())
+}
+
+func TestS3PutGetStatDelete(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+	data := []byte("hello, bucket")
+	if err := s.Put(ctx, "ab/cd/obj", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := f.objects["data/ab/cd/obj"]; !ok {
+		t.Fatalf("object not stored under the prefix: %v", f.objects)
+	}
+	rc, err := s.Get(ctx, "ab/cd/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := io.ReadAll(rc)
+	rc.Close()
+	if !bytes.Equal(got, data) {
+		t.Fatalf("Get = %q", got)
+	}
+	info, err := s.Stat(ctx, "ab/cd/obj")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size != int64(len(data)) || !info.ModTime.Equal(time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)) {
+		t.Fatalf("Stat = %+v", info)
+	}
+	if err := s.Delete(ctx, "ab/cd/obj"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Stat(ctx, "ab/cd/obj"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Stat after Delete: %v", err)
+	}
+	if _, err := s.Get(ctx, "ab/cd/obj"); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("Get after Delete: %v", err)
+	}
+	if err := s.Delete(ctx, "ab/cd/obj"); err != nil {
+		t.Fatalf("deleting a missing object: %v", err)
+	}
+}
+
+func TestS3GetRange(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+	data := []byte("0123456789abcdef")
+	if err := s.Put(ctx, "k", bytes.NewReader(data), int64(len(data))); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct{ off, n int64 }{{0, 1}, {3, 5}, {10, 6}, {0, 16}, {7, 0}} {
+		rc, err := s.GetRange(ctx, "k", c.off, c.n)
+		if err != nil {
+			t.Fatalf("GetRange(%d, %d): %v", c.off, c.n, err)
+		}
+		got, _ := io.ReadAll(rc)
+		rc.Close()
+		if want := data[c.off : c.off+c.n]; !bytes.Equal(got, want) {
+			t.Fatalf("GetRange(%d, %d) = %q, want %q", c.off, c.n, got, want)
+		}
+	}
+}
+
+func TestS3List(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+	keys := []string{"aa/1", "aa/2", "aa/3", "bb/1", "chunks/aa/1"}
+	for _, k := range keys {
+		if err := s.Put(ctx, k, strings.NewReader(k), int64(len(k))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	list := func(prefix string) []string {
+		var got []string
+		err := s.List(ctx, prefix, func(o ObjectInfo) error {
+			if o.Size != int64(len(o.Key)) || o.ModTime.IsZero() {
+				t.Errorf("List: %+v", o)
+			}
+			got = append(got, o.Key)
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	// five objects come back in three pages of two
+	if got := list(""); strings.Join(got, ",") != strings.Join(keys, ",") {
+		t.Fatalf("List(\"\") = %v", got)
+	}
+	if got := list("aa/"); strings.Join(got, ",") != "aa/1,aa/2,aa/3" {
+		t.Fatalf("List(\"aa/\") = %v", got)
+	}
+	stop := errors.New("stop")
+	n := 0
+	if err := s.List(ctx, "", func(ObjectInfo) error { n++; return stop }); err != stop || n != 1 {
+		t.Fatalf("List did not stop at the callback's error: %v after %d", err, n)
+	}
+}
+
+func TestS3Multipart(t *testing.T) {
+	f, s := newFakeS3(t)
+	ctx := context.Background()
+
+	// larger than the threshold: two parts
+	big := bytes.Repeat([]byte("0123456789abcdef"), (s3MultipartThreshold/16)+1)
+	if err := s.Put(ctx, "big", bytes.NewReader(big), int64(len(big))); err != nil {
+		t.Fatal(err)
+	}
+	if f.parts != 2 || len(f.uploads) != 0 {
+		t.Fatalf("uploaded %d parts, %d uploads left open", f.parts, len(f.uploads))
+	}
+	if !bytes.Equal(f.objects["data/big"], big) {
+		t.Fatal("multipart object differs from the input")
+	}
+
+	// unknown size: multipart, even when small
+	f.parts = 0
+	if err := s.Put(ctx, "small", strings.NewReader("tiny"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if f.parts != 1 || string(f.objects["data/small"]) != "tiny" {
+		t.Fatalf("unknown-size put: %d parts, stored %q", f.parts, f.objects["data/small"])
+	}
+
+	// a failing part aborts the upload
+	failing := io.MultiReader(bytes.NewReader(big[:s3PartSize]), &errReader{errors.New("read failed")})
+	if err := s.Put(ctx, "broken", failing, -1); err == nil {
+		t.Fatal("Put succeeded with a failing reader")
+	}
+	if len(f.uploads) != 0 {
+		t.Fatalf("%d uploads left open after a failure", len(f.uploads))
+	}
+	if _, ok := f.objects["data/broken"]; ok {
+		t.Fatal("failed upload was completed")
+	}
+}
+
+type errReader struct{ err error }
+
+func (r *errReader) Read([]byte) (int, error) { return 0, r.err }
+
+func TestS3Signature(t *testing.T) {
+	_, s := newFakeS3(t)
+	ctx := context.Background()
+	// the fake rejects requests whose SigV4 headers are missing or wrong
+	if err := s.Put(ctx, "k", strings.NewReader("v"), 1); err != nil {
+		t.Fatal(err)
+	}
+	rc, err := s.GetRange(ctx, "k", 0, 1)
+	if err != nil {
+		t.Fatalf("signed ranged request rejected: %v", err)
+	}
+	rc.Close()
+
+	s.SecretKey = "wrong"
+	if err := s.Put(ctx, "k", strings.NewReader("v"), 1); err == nil || !strings.Contains(err.Error(), "403") {
+		t.Fatalf("request signed with the wrong secret: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, "http://example.com/vault/a%20b", nil)
+	req.Header.Set("Range", "bytes=0-1")
+	(&S3{Region: fakeS3Region, AccessKey: fakeS3Access, SecretKey: fakeS3Secret}).sign(req, time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC))
+	if got := req.Header.Get("x-amz-date"); got != "20260102T030405Z" {
+		t.Fatalf("x-amz-date = %q", got)
+	}
+	if got := req.Header.Get("x-amz-content-sha256"); got != "UNSIGNED-PAYLOAD" {
+		t.Fatalf("x-amz-content-sha256 = %q", got)
+	}
+	m := authRe.FindStringSubmatch(req.Header.Get("Authorization"))
+	if m == nil || m[2] != "20260102" || m[4] != "host;range;x-amz-content-sha256;x-amz-date" {
+		t.Fatalf("Authorization = %q", req.Header.Get("Authorization"))
+	}
+}
@@ -1,45 +1,400 @@
 package storage
 
 import (
+    "bytes"
+    "context"
     "crypto/sha256"
     "encoding/hex"
+    "errors"
     "fmt"
     "io"
+    "log"
+    "net/http"
     "os"
-    "path/filepath"
+    "sort"
+    "strings"
+
+    "github.com/himanshu/file-vault-app/backend/internal/config"
 )
 
 type Service struct {
-    RootDir string
+    Backend Backend
+    // TempDir is where uploads are spooled while they are hashed.
+    TempDir string
+    // Chunking enables content-defined chunking for new blobs.
+    Chunking ChunkParams
+    // Keys enables encryption at rest for new objects when set.
+    Keys *Keyring
+    // Compression enables zstd compression of compressible content.
+    Compression      bool
+    CompressionLevel int
+    // Recorded reports how an object already known to the database was
+    // stored; ok is false when no row records key. Deduplication trusts it
+    // over the object's own header, which may be plain user content and
+    // names the master key the object was sealed under, not the one its
+    // data key is wrapped under now.
+    Recorded func(ctx context.Context, key string) (enc Encoding, ok bool, err error)
+}
+
+func New(backend Backend, tempDir string) *Service { return &Service{Backend: backend, TempDir: tempDir} }
+
+// NewFromConfig builds the backend selected by cfg.StorageBackend ("disk" or "s3").
+func NewFromConfig(cfg config.Config) (*Service, error) {
+    s, err := newBackendFromConfig(cfg)
+    if err != nil { return nil, err }
+    if cfg.EncryptionKeyFile != "" {
+        k, err := LoadKeyring(cfg.EncryptionKeyFile)
+        if err != nil { return nil, fmt.Errorf("storage: %w", err) }
+        s.Keys = k
+    }
+    s.Compression, s.CompressionLevel = cfg.CompressionEnabled, cfg.CompressionLevel
+    if cfg.ChunkingEnabled {
+        p := ChunkParams{Min: cfg.ChunkMinBytes, Avg: cfg.ChunkAvgBytes, Max: cfg.ChunkMaxBytes}
+        if p.Avg < 64 || p.Min > p.Avg || p.Avg > p.Max { return nil, fmt.Errorf("storage: invalid chunk sizes %d/%d/%d", p.Min, p.Avg, p.Max) }
+        s.Chunking = p
+    }
+    return s, nil
+}
+
+func newBackendFromConfig(cfg config.Config) (*Service, error) {
+    switch cfg.StorageBackend {
+    case "", "disk":
+        tmp := cfg.StorageTempDir
+        if tmp == "" { tmp = cfg.StorageDir }
+        if err := os.MkdirAll(tmp, 0o755); err != nil { return nil, err }
+        return New(NewDisk(cfg.StorageDir), tmp), nil
+    case "s3":
+        if cfg.S3Bucket == "" || cfg.S3Endpoint == "" { return nil, fmt.Errorf("storage: S3_ENDPOINT and S3_BUCKET are required") }
+        tmp := cfg.StorageTempDir
+        if tmp == "" { tmp = os.TempDir() }
+        if err := os.MkdirAll(tmp, 0o755); err != nil { return nil, err }
+        return New(&S3{
+            Endpoint:  cfg.S3Endpoint,
+            Region:    cfg.S3Region,
+            Bucket:    cfg.S3Bucket,
+            AccessKey: cfg.S3AccessKey,
+            SecretKey: cfg.S3SecretKey,
+            Prefix:    cfg.S3Prefix,
+            PathStyle: cfg.S3PathStyle,
+            Client:    http.DefaultClient,
+        }, tmp), nil
+    default:
+        return nil, fmt.Errorf("storage: unknown backend %q", cfg.StorageBackend)
+    }
+}
+
+// BlobKey is the backend key for a content hash, sharded by hash prefix.
+func BlobKey(hash string) string { return hash[:2] + "/" + hash[2:4] + "/" + hash }
+
+// ChunkKey is the backend key for a content-defined chunk.
+func ChunkKey(hash string) string { return "chunks/" + BlobKey(hash) }
+
+// ParseKey recognises keys produced by BlobKey and ChunkKey.
+func ParseKey(key string) (hash string, chunk bool, ok bool) {
+    if strings.HasPrefix(key, "chunks/") { key, chunk = strings.TrimPrefix(key, "chunks/"), true }
+    parts := strings.Split(key, "/")
+    if len(parts) != 3 || len(parts[2]) != 64 { return "", false, false }
+    h := parts[2]
+    if _, err := hex.DecodeString(h); err != nil || parts[0] != h[:2] || parts[1] != h[2:4] { return "", false, false }
+    return h, chunk, true
+}
+
+// Blob describes where a blob's content lives: either a single object under
+// Key, or an ordered list of chunks that reassemble to Size bytes.
+type Blob struct {
+    Hash   string
+    Key    string
+    Size   int64
+    Chunks []Chunk
+    Encoding
+
+    // Created lists the keys of the objects WriteAndHash stored because they
+    // did not exist yet; see Discard. Reused lists the keys of the objects it
+    // found already stored, which the garbage collector may be deleting until
+    // the blob is recorded.
+    Created []string
+    Reused  []string
+}
+
+func (b Blob) Chunked() bool { return len(b.Chunks) > 0 }
+
+// Chunk is one piece of a chunked blob at Offset within the blob.
+type Chunk struct {
+    Hash   string
+    Key    string
+    Offset int64
+    Size   int64
+    Encoding
+}
+
+// Encoding records how an object's bytes were transformed on the way to the
+// backend. The zero value is plaintext.
+type Encoding struct {
+    // KeyID names the master key WrappedKey is wrapped under; empty when not encrypted.
+    KeyID      string
+    WrappedKey []byte
+    // Codec is the compression applied before encryption; empty when stored raw.
+    Codec string
+    // StoredSize is the object's size in the backend; 0 if unknown (older rows).
+    StoredSize int64
 }
 
-func New(root string) *Service { return &Service{RootDir: root} }
+func (e Encoding) Encrypted() bool { return e.KeyID != "" }
 
-// WriteAndHash stores the content to a deterministic path by SHA-256. If the file already
-// exists, it is left intact. Returns hex hash string and absolute path.
-func (s *Service) WriteAndHash(r io.Reader) (string, string, int64, error) {
+// WriteAndHash stores the content under a deterministic key derived from its SHA-256.
+// If the object already exists, it is left intact. With chunking enabled the content
+// is split into content-defined chunks and only chunks not yet stored are written.
+// Content declared as a compressible mimeType is zstd-compressed when that pays
+// off; the hash is always of the original bytes.
+func (s *Service) WriteAndHash(ctx context.Context, r io.Reader, mimeType string) (Blob, error) {
+    if s.Chunking.Enabled() { return s.writeChunked(ctx, r, mimeType) }
     hasher := sha256.New()
-    tmpFile, err := os.CreateTemp(s.RootDir, "upload-*")
-    if err != nil { return "", "", 0, err }
+    tmpFile, err := os.CreateTemp(s.TempDir, "upload-*")
+    if err != nil { return Blob{}, err }
     defer func() { _ = tmpFile.Close(); _ = os.Remove(tmpFile.Name()) }()
 
     written, err := io.Copy(io.MultiWriter(hasher, tmpFile), r)
-    if err != nil { return "", "", 0, err }
+    if err != nil { return Blob{}, err }
     sum := hex.EncodeToString(hasher.Sum(nil))
-    // path by hash prefix for sharding
-    shard := filepath.Join(s.RootDir, sum[:2], sum[2:4])
-    if err := os.MkdirAll(shard, 0o755); err != nil { return "", "", 0, err }
-    finalPath := filepath.Join(shard, sum)
-    if _, err := os.Stat(finalPath); err == nil {
+    b := Blob{Hash: sum, Key: BlobKey(sum), Size: written}
+    if info, err := s.Backend.Stat(ctx, b.Key); err == nil {
         // already exists; dedup
-        return sum, finalPath, written, nil
+        b.Encoding, err = s.existingEncoding(ctx, b.Key, b.Hash, info.Size)
+        b.Reused = []string{b.Key}
+        return b, err
+    }
+    if _, err := tmpFile.Seek(0, io.SeekStart); err != nil { return Blob{}, err }
+    var src io.ReadSeeker = tmpFile
+    srcSize, codec := written, ""
+    if s.Compression && written > 0 && Compressible(mimeType) {
+        zf, zsize, err := s.compressFile(tmpFile)
+        if err != nil { return Blob{}, fmt.Errorf("compress: %w", err) }
+        defer func() { _ = zf.Close(); _ = os.Remove(zf.Name()) }()
+        if worthCompressing(written, zsize) {
+            src, srcSize, codec = zf, zsize, CodecZstd
+        } else if _, err := tmpFile.Seek(0, io.SeekStart); err != nil {
+            return Blob{}, err
+        }
+    }
+    if a, ok := s.Backend.(fileAdopter); ok && codec == "" && s.Keys == nil {
+        if err := tmpFile.Close(); err != nil { return Blob{}, err }
+        if err := a.AdoptFile(ctx, b.Key, tmpFile.Name()); err != nil { return Blob{}, fmt.Errorf("store: %w", err) }
+        b.StoredSize, b.Created = written, []string{b.Key}
+        return b, nil
+    }
+    if b.Encoding, err = s.putObject(ctx, b.Key, b.Hash, src, srcSize, codec); err != nil { return Blob{}, fmt.Errorf("store: %w", err) }
+    b.Created = []string{b.Key}
+    return b, nil
+}
+
+// writeChunked streams r through the chunker, storing each new chunk as it is cut.
+func (s *Service) writeChunked(ctx context.Context, r io.Reader, mimeType string) (Blob, error) {
+    hasher := sha256.New()
+    c := newChunker(io.TeeReader(r, hasher), s.Chunking)
+    compress := s.Compression && Compressible(mimeType)
+    var b Blob
+    for {
+        data, err := c.next()
+        if err == io.EOF { break }
+        if err != nil { return Blob{}, err }
+        sum := sha256.Sum256(data)
+        ch := Chunk{Hash: hex.EncodeToString(sum[:]), Offset: b.Size, Size: int64(len(data))}
+        ch.Key = ChunkKey(ch.Hash)
+        if info, err := s.Backend.Stat(ctx, ch.Key); err == nil {
+            if ch.Encoding, err = s.existingEncoding(ctx, ch.Key, ch.Hash, info.Size); err != nil { return Blob{}, err }
+            b.Reused = append(b.Reused, ch.Key)
+        } else {
+            payload, codec := data, ""
+            if compress {
+                z, err := s.compressBytes(data)
+                if err != nil { return Blob{}, fmt.Errorf("compress: %w", err) }
+                if worthCompressing(int64(len(data)), int64(len(z))) { payload, codec = z, CodecZstd }
+            }
+            if ch.Encoding, err = s.putObject(ctx, ch.Key, ch.Hash, bytes.NewReader(payload), int64(len(payload)), codec); err != nil {
+                return Blob{}, fmt.Errorf("store chunk: %w", err)
+            }
+            b.Created = append(b.Created, ch.Key)
+        }
+        b.Chunks = append(b.Chunks, ch)
+        b.Size += ch.Size
+    }
+    b.Hash = hex.EncodeToString(hasher.Sum(nil))
+    if len(b.Chunks) == 0 {
+        // empty content has no chunks; keep it as a single (empty) object
+        b.Key = BlobKey(b.Hash)
+        var err error
+        if b.Encoding, err = s.putObject(ctx, b.Key, b.Hash, bytes.NewReader(nil), 0, ""); err != nil { return Blob{}, err }
+        b.Created = []string{b.Key}
     }
-    // move temp to final
-    if err := os.Rename(tmpFile.Name(), finalPath); err != nil {
-        return "", "", 0, fmt.Errorf("rename: %w", err)
+    return b, nil
+}
+
+// Discard deletes objects written for content that will not be recorded,
+// typically Blob.Created after the transaction that was to reference them
+// rolled back. Callers must make sure no other row references the keys.
+// Failures are logged; leftover objects are orphans for the garbage collector.
+func (s *Service) Discard(ctx context.Context, keys []string) {
+    for _, k := range keys {
+        if err := s.Backend.Delete(ctx, k); err != nil && !errors.Is(err, ErrNotFound) { log.Printf("storage: discard %s: %v", k, err) }
+    }
+}
+
+// putObject stores size bytes of (possibly compressed) content under key. When
+// a keyring is configured the content is sealed with a data key derived for
+// hash and the payload under the active master key.
+func (s *Service) putObject(ctx context.Context, key, hash string, r io.ReadSeeker, size int64, codec string) (Encoding, error) {
+    if s.Keys != nil {
+        keyID := s.Keys.Active()
+        salt, err := payloadSalt(hash, r, codec)
+        if err != nil { return Encoding{}, err }
+        dek, err := s.Keys.deriveDataKey(keyID, hash, salt)
+        if err != nil { return Encoding{}, err }
+        sr, err := newSealReader(r, size, dek, keyID, codec, salt)
+        if err != nil { return Encoding{}, err }
+        if err := s.Backend.Put(ctx, key, sr, SealedSize(size)); err != nil { return Encoding{}, err }
+        enc, err := s.wrap(dek)
+        enc.Codec, enc.StoredSize = codec, SealedSize(size)
+        return enc, err
+    }
+    if codec != "" {
+        stored := zstdHeaderSize + size
+        if err := s.Backend.Put(ctx, key, io.MultiReader(bytes.NewReader(zstdHeader()), r), stored); err != nil { return Encoding{}, err }
+        return Encoding{Codec: codec, StoredSize: stored}, nil
+    }
+    if err := s.Backend.Put(ctx, key, r, size); err != nil { return Encoding{}, err }
+    return Encoding{StoredSize: size}, nil
+}
+
+// existingEncoding describes an object that is already stored: as recorded
+// in the database when a row refers to it, otherwise by reading its header.
+// Sealed objects record the master key and salt their data key was derived
+// from and their codec, compressed ones their codec.
+func (s *Service) existingEncoding(ctx context.Context, key, hash string, storedSize int64) (Encoding, error) {
+    if s.Recorded != nil {
+        enc, ok, err := s.Recorded(ctx, key)
+        if err != nil { return Encoding{}, err }
+        if ok {
+            if enc.StoredSize == 0 { enc.StoredSize = storedSize }
+            return enc, nil
+        }
+    }
+    // an orphan, adopted by the row about to be written
+    rc, err := s.Backend.GetRange(ctx, key, 0, min(sealHeaderSize, storedSize))
+    if err != nil { return Encoding{}, err }
+    defer rc.Close()
+    h := make([]byte, sealHeaderSize)
+    n, _ := io.ReadFull(rc, h)
+    h = h[:n]
+    if keyID, codec, salt, ok := parseSealHeader(h); ok {
+        if s.Keys == nil { return Encoding{}, fmt.Errorf("storage: %s is encrypted but no key file is configured", key) }
+        dek, err := s.Keys.deriveDataKey(keyID, hash, salt)
+        if err != nil { return Encoding{}, err }
+        enc, err := s.wrap(dek)
+        enc.Codec, enc.StoredSize = codec, storedSize
+        return enc, err
+    }
+    if isZstdHeader(h) { return Encoding{Codec: CodecZstd, StoredSize: storedSize}, nil }
+    return Encoding{StoredSize: storedSize}, nil
+}
+
+func (s *Service) wrap(dek []byte) (Encoding, error) {
+    id, wrapped, err := s.Keys.Wrap(dek)
+    if err != nil { return Encoding{}, err }
+    return Encoding{KeyID: id, WrappedKey: wrapped}, nil
+}
+
+// openRange returns plaintext bytes [off, off+n) of the object under key.
+func (s *Service) openRange(ctx context.Context, key string, enc Encoding, size, off, n int64) (io.ReadCloser, error) {
+    switch enc.Codec {
+    case "":
+        if !enc.Encrypted() { return s.Backend.GetRange(ctx, key, off, n) }
+        return s.openSealed(ctx, key, enc, size, off, n)
+    case CodecZstd:
+        var src io.ReadCloser
+        var err error
+        if enc.Encrypted() {
+            zsize := sealedPlainSize(enc.StoredSize)
+            src, err = s.openSealed(ctx, key, enc, zsize, 0, zsize)
+        } else {
+            src, err = s.Backend.GetRange(ctx, key, zstdHeaderSize, enc.StoredSize-zstdHeaderSize)
+        }
+        if err != nil { return nil, err }
+        return decompressRange(src, off, n)
+    default:
+        return nil, fmt.Errorf("storage: %s has unknown codec %q", key, enc.Codec)
     }
-    return sum, finalPath, written, nil
 }
 
+func (s *Service) openSealed(ctx context.Context, key string, enc Encoding, sealedSize, off, n int64) (io.ReadCloser, error) {
+    if s.Keys == nil { return nil, fmt.Errorf("storage: %s is encrypted but no key file is configured", key) }
+    dek, err := s.Keys.Unwrap(enc.KeyID, enc.WrappedKey)
+    if err != nil { return nil, err }
+    return openSealedRange(func(off, n int64) (io.ReadCloser, error) {
+        return s.Backend.GetRange(ctx, key, off, n)
+    }, dek, sealedSize, off, n)
+}
+
+// Open returns a seekable reader over the blob's content, suitable for
+// http.ServeContent. Seeking is served with ranged backend reads; for chunked
+// blobs only the chunks overlapping the requested range are fetched.
+func (s *Service) Open(ctx context.Context, b Blob) (*Reader, error) {
+    if b.Chunked() {
+        return newReader(b.Size, func(off, n int64) (io.ReadCloser, error) {
+            return s.openChunks(ctx, b.Chunks, off, n), nil
+        }), nil
+    }
+    if _, err := s.Backend.Stat(ctx, b.Key); err != nil { return nil, err }
+    return newReader(b.Size, func(off, n int64) (io.ReadCloser, error) {
+        return s.openRange(ctx, b.Key, b.Encoding, b.Size, off, n)
+    }), nil
+}
+
+func (s *Service) openChunks(ctx context.Context, chunks []Chunk, off, n int64) io.ReadCloser {
+    i := sort.Search(len(chunks), func(i int) bool { return chunks[i].Offset+chunks[i].Size > off })
+    return &chunkStream{ctx: ctx, s: s, chunks: chunks[i:], skip: off - offsetOf(chunks, i), left: n}
+}
+
+func offsetOf(chunks []Chunk, i int) int64 {
+    if i < len(chunks) { return chunks[i].Offset }
+    return 0
+}
 
+// chunkStream reads a byte range across consecutive chunks, opening each one lazily.
+type chunkStream struct {
+    ctx    context.Context
+    s      *Service
+    chunks []Chunk
+    skip   int64 // offset into chunks[0]
+    left   int64
+    cur    io.ReadCloser
+}
 
+func (c *chunkStream) Read(p []byte) (int, error) {
+    for {
+        if c.left <= 0 { return 0, io.EOF }
+        if c.cur == nil {
+            if len(c.chunks) == 0 { return 0, io.ErrUnexpectedEOF }
+            ch := c.chunks[0]
+            n := ch.Size - c.skip
+            if n > c.left { n = c.left }
+            rc, err := c.s.openRange(c.ctx, ch.Key, ch.Encoding, ch.Size, c.skip, n)
+            if err != nil { return 0, fmt.Errorf("chunk %s: %w", ch.Hash, err) }
+            c.cur, c.chunks, c.skip = rc, c.chunks[1:], 0
+        }
+        if int64(len(p)) > c.left { p = p[:c.left] }
+        n, err := c.cur.Read(p)
+        c.left -= int64(n)
+        if err == io.EOF {
+            _ = c.cur.Close()
+            c.cur = nil
+            if n > 0 { return n, nil }
+            continue
+        }
+        return n, err
+    }
+}
+
+func (c *chunkStream) Close() error {
+    if c.cur == nil { return nil }
+    return c.cur.Close()
+}
@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func testService(t *testing.T) *Service {
+	t.Helper()
+	dir := t.TempDir()
+	return New(NewDisk(filepath.Join(dir, "blobs")), dir)
+}
+
+// Objects found already stored are reported as Reused, so that uploads can
+// check they were not garbage collected before the blob is recorded.
+func TestWriteAndHashReused(t *testing.T) {
+	for _, chunked := range []bool{false, true} {
+		s := testService(t)
+		if chunked {
+			s.Chunking = ChunkParams{Min: 1 << 10, Avg: 4 << 10, Max: 16 << 10}
+		}
+		data := make([]byte, 64<<10)
+		rand.New(rand.NewSource(1)).Read(data)
+
+		first, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(first.Created) == 0 || len(first.Reused) != 0 {
+			t.Fatalf("chunked=%v: first write created %d, reused %d objects", chunked, len(first.Created), len(first.Reused))
+		}
+		again, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again.Created) != 0 || !slices.Equal(keySet(again.Reused), keySet(first.Created)) {
+			t.Fatalf("chunked=%v: second write created %v, reused %v; first created %v", chunked, again.Created, again.Reused, first.Created)
+		}
+		if got := readAll(t, s, again); !bytes.Equal(got, data) {
+			t.Fatalf("chunked=%v: content does not round-trip", chunked)
+		}
+	}
+}
+
+func keySet(keys []string) []string {
+	keys = slices.Clone(keys)
+	slices.Sort(keys)
+	return slices.Compact(keys)
+}
+
+// Raw content that happens to start like a compressed or sealed object keeps
+// the encoding recorded for it when it is uploaded again.
+func TestDedupTrustsRecordedEncoding(t *testing.T) {
+	sealed, err := sealHeader("k1", CodecZstd, bytes.Repeat([]byte{1}, saltSize))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, head := range map[string][]byte{"zstd": zstdHeader(), "sealed": sealed} {
+		s := testService(t)
+		recorded := map[string]Encoding{}
+		s.Recorded = func(_ context.Context, key string) (Encoding, bool, error) {
+			enc, ok := recorded[key]
+			return enc, ok, nil
+		}
+		data := append(bytes.Clone(head), []byte("user content that only looks like a header")...)
+		b, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatal(err)
+		}
+		recorded[b.Key] = b.Encoding
+		again, err := s.WriteAndHash(context.Background(), bytes.NewReader(data), "application/octet-stream")
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if again.Codec != "" || again.Encrypted() {
+			t.Fatalf("%s: re-upload read as codec %q, encrypted %v", name, again.Codec, again.Encrypted())
+		}
+		if got := readAll(t, s, again); !bytes.Equal(got, data) {
+			t.Fatalf("%s: re-uploaded content does not round-trip", name)
+		}
+	}
+}
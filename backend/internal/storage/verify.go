@@ -0,0 +1,61 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+)
+
+// Verify reads the blob back the way a download would and checks that it
+// still hashes to b.Hash. It returns ErrNotFound when an object is missing,
+// ErrCorrupt when content is damaged, and other errors for failures that say
+// nothing about the content (for example an unreachable backend). Content is
+// read through limit when it is not nil.
+func (s *Service) Verify(ctx context.Context, b Blob, limit func(io.Reader) io.Reader) error {
+	if b.Chunked() {
+		for _, c := range b.Chunks {
+			if err := s.checkStored(ctx, c.Key, c.StoredSize); err != nil {
+				return err
+			}
+		}
+	} else if err := s.checkStored(ctx, b.Key, b.StoredSize); err != nil {
+		return err
+	}
+
+	f, err := s.Open(ctx, b)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	var r io.Reader = f
+	if limit != nil {
+		r = limit(f)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, r)
+	if err == io.ErrUnexpectedEOF {
+		return fmt.Errorf("%w: content ends after %d of %d bytes", ErrCorrupt, n, b.Size)
+	}
+	if err != nil {
+		return err
+	}
+	if sum := hex.EncodeToString(h.Sum(nil)); sum != b.Hash {
+		return fmt.Errorf("%w: content hashes to %s", ErrCorrupt, sum)
+	}
+	return nil
+}
+
+// checkStored confirms the object exists and, when its stored size is known,
+// that it has not been truncated or extended.
+func (s *Service) checkStored(ctx context.Context, key string, stored int64) error {
+	info, err := s.Backend.Stat(ctx, key)
+	if err != nil {
+		return err
+	}
+	if stored > 0 && info.Size != stored {
+		return fmt.Errorf("%w: %s is %d bytes, expected %d", ErrCorrupt, key, info.Size, stored)
+	}
+	return nil
+}
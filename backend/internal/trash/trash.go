@@ -0,0 +1,50 @@
+// Package trash purges files that have been in the trash for longer than the
+// retention period, deleting them for good and releasing their storage.
+package trash
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+type Purger struct {
+	Repo *repo.Repository
+	// Retention is how long a file stays in the trash.
+	Retention time.Duration
+}
+
+func New(r *repo.Repository, retention time.Duration) *Purger {
+	return &Purger{Repo: r, Retention: retention}
+}
+
+// Run purges the files whose retention has run out and returns how many it
+// deleted.
+func (p *Purger) Run(ctx context.Context) (int64, error) {
+	return p.Repo.PurgeTrash(ctx, p.Retention)
+}
+
+// Start runs the purger every interval until ctx is cancelled.
+func (p *Purger) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				n, err := p.Run(ctx)
+				if err != nil {
+					log.Printf("trash: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("trash: purged %d files", n)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,281 @@
+// Package tus persists partial uploads for the tus resumable upload protocol
+// (https://tus.io/protocols/resumable-upload). Each upload is a data file and
+// a JSON info file in Dir; the upload's offset is the size of the data file.
+package tus
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"hash"
+	"io"
+	"io/fs"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrNotFound         = errors.New("tus: upload not found")
+	ErrLocked           = errors.New("tus: upload is being written by another request")
+	ErrChecksumMismatch = errors.New("tus: checksum mismatch")
+)
+
+// Info describes an upload. Offset is derived from the data file.
+type Info struct {
+	ID       string            `json:"id"`
+	OwnerID  string            `json:"ownerId"`
+	Length   int64             `json:"length"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// ReservationID is the quota reservation held until the upload finishes.
+	ReservationID string    `json:"reservationId,omitempty"`
+	CreatedAt     time.Time `json:"createdAt"`
+	ExpiresAt     time.Time `json:"expiresAt"`
+	Offset        int64     `json:"-"`
+}
+
+// Complete reports whether all bytes have been received.
+func (i Info) Complete() bool { return i.Offset >= i.Length }
+
+type Store struct {
+	Dir string
+	// Expiry is how long an upload may go without a PATCH before it is removed.
+	Expiry time.Duration
+
+	mu     sync.Mutex
+	locked map[string]bool
+}
+
+func NewStore(dir string, expiry time.Duration) (*Store, error) {
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	return &Store{Dir: dir, Expiry: expiry, locked: map[string]bool{}}, nil
+}
+
+func (s *Store) dataPath(id string) string { return filepath.Join(s.Dir, id+".bin") }
+func (s *Store) infoPath(id string) string { return filepath.Join(s.Dir, id+".json") }
+
+// validID guards against path traversal through upload URLs.
+func validID(id string) bool {
+	if len(id) != 32 {
+		return false
+	}
+	_, err := hex.DecodeString(id)
+	return err == nil
+}
+
+// Create starts a new upload described by info (OwnerID, Length, Metadata and
+// ReservationID); the ID and timestamps are assigned here.
+func (s *Store) Create(info Info) (Info, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Info{}, err
+	}
+	now := time.Now().UTC()
+	info.ID, info.Offset, info.CreatedAt, info.ExpiresAt = hex.EncodeToString(b), 0, now, now.Add(s.Expiry)
+	f, err := os.OpenFile(s.dataPath(info.ID), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return Info{}, err
+	}
+	if err := f.Close(); err != nil {
+		return Info{}, err
+	}
+	if err := s.writeInfo(info); err != nil {
+		_ = os.Remove(s.dataPath(info.ID))
+		return Info{}, err
+	}
+	return info, nil
+}
+
+func (s *Store) writeInfo(info Info) error {
+	b, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	tmp := s.infoPath(info.ID) + ".tmp"
+	if err := os.WriteFile(tmp, b, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.infoPath(info.ID))
+}
+
+// Get loads an upload's info and current offset.
+func (s *Store) Get(id string) (Info, error) {
+	if !validID(id) {
+		return Info{}, ErrNotFound
+	}
+	b, err := os.ReadFile(s.infoPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	var info Info
+	if err := json.Unmarshal(b, &info); err != nil {
+		return Info{}, err
+	}
+	st, err := os.Stat(s.dataPath(id))
+	if errors.Is(err, fs.ErrNotExist) {
+		return Info{}, ErrNotFound
+	}
+	if err != nil {
+		return Info{}, err
+	}
+	info.Offset = st.Size()
+	return info, nil
+}
+
+// Lock gives the caller exclusive write access to an upload. The returned
+// function releases it.
+func (s *Store) Lock(id string) (func(), error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.locked[id] {
+		return nil, ErrLocked
+	}
+	s.locked[id] = true
+	return func() {
+		s.mu.Lock()
+		delete(s.locked, id)
+		s.mu.Unlock()
+	}, nil
+}
+
+// Append writes r at the end of the upload, never past its length, and
+// extends its expiry. Bytes received before a connection error are kept so
+// that the client can resume after them. When sum is set the request's bytes
+// are only kept if expected matches their digest; otherwise
+// ErrChecksumMismatch is returned and the upload is left unchanged.
+func (s *Store) Append(info Info, r io.Reader, sum hash.Hash, expected []byte) (Info, error) {
+	f, err := os.OpenFile(s.dataPath(info.ID), os.O_WRONLY, 0)
+	if err != nil {
+		return info, err
+	}
+	defer f.Close()
+	if _, err := f.Seek(info.Offset, io.SeekStart); err != nil {
+		return info, err
+	}
+	var w io.Writer = f
+	if sum != nil {
+		w = io.MultiWriter(f, sum)
+	}
+	n, copyErr := io.Copy(w, io.LimitReader(r, info.Length-info.Offset))
+	if sum != nil && (copyErr != nil || subtle.ConstantTimeCompare(sum.Sum(nil), expected) != 1) {
+		if err := f.Truncate(info.Offset); err != nil {
+			return info, err
+		}
+		if copyErr != nil {
+			return info, copyErr
+		}
+		return info, ErrChecksumMismatch
+	}
+	if err := f.Sync(); err != nil {
+		return info, err
+	}
+	info.Offset += n
+	info.ExpiresAt = time.Now().UTC().Add(s.Expiry)
+	if err := s.writeInfo(info); err != nil {
+		return info, err
+	}
+	return info, copyErr
+}
+
+// Open returns the received bytes of an upload.
+func (s *Store) Open(id string) (*os.File, error) {
+	if !validID(id) {
+		return nil, ErrNotFound
+	}
+	return os.Open(s.dataPath(id))
+}
+
+// Remove deletes an upload and its data.
+func (s *Store) Remove(id string) error {
+	if !validID(id) {
+		return ErrNotFound
+	}
+	for _, p := range []string{s.dataPath(id), s.infoPath(id)} {
+		if err := os.Remove(p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	return nil
+}
+
+// ExpireStale removes uploads whose expiry has passed and returns how many
+// were removed.
+func (s *Store) ExpireStale(ctx context.Context) (int, error) {
+	entries, err := os.ReadDir(s.Dir)
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	n := 0
+	for _, e := range entries {
+		if err := ctx.Err(); err != nil {
+			return n, err
+		}
+		if id, ok := strings.CutSuffix(e.Name(), ".bin"); ok && validID(id) {
+			// data without info is left by a crash during Create
+			if _, err := os.Stat(s.infoPath(id)); errors.Is(err, fs.ErrNotExist) {
+				if fi, err := e.Info(); err == nil && now.Sub(fi.ModTime()) > s.Expiry {
+					_ = s.Remove(id)
+				}
+			}
+			continue
+		}
+		id, ok := strings.CutSuffix(e.Name(), ".json")
+		if !ok || !validID(id) {
+			continue
+		}
+		info, err := s.Get(id)
+		if errors.Is(err, ErrNotFound) {
+			// info without data: the data was removed by hand
+			_ = s.Remove(id)
+			continue
+		}
+		if err != nil || now.Before(info.ExpiresAt) {
+			continue
+		}
+		unlock, err := s.Lock(id)
+		if err != nil {
+			continue
+		}
+		err = s.Remove(id)
+		unlock()
+		if err != nil {
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// Start expires stale uploads every interval until ctx is cancelled.
+func (s *Store) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				n, err := s.ExpireStale(ctx)
+				if err != nil && ctx.Err() == nil {
+					log.Printf("tus cleanup: %v", err)
+				}
+				if n > 0 {
+					log.Printf("tus cleanup: removed %d expired uploads", n)
+				}
+			}
+		}
+	}()
+}
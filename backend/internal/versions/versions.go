@@ -0,0 +1,50 @@
+// Package versions prunes file history that the retention policy no longer
+// keeps. Uploads already trim a file's history to the newest versions when
+// they add one; the age bound is applied here, in the background.
+package versions
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/himanshu/file-vault-app/backend/internal/repo"
+)
+
+type Pruner struct {
+	Repo *repo.Repository
+	Keep repo.VersionRetention
+}
+
+func New(r *repo.Repository, keep repo.VersionRetention) *Pruner {
+	return &Pruner{Repo: r, Keep: keep}
+}
+
+// Run deletes the versions of all files that are no longer retained and
+// returns how many it deleted.
+func (p *Pruner) Run(ctx context.Context) (int64, error) {
+	return p.Repo.PruneVersions(ctx, nil, p.Keep)
+}
+
+// Start runs the pruner every interval until ctx is cancelled.
+func (p *Pruner) Start(ctx context.Context, interval time.Duration) {
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-t.C:
+				n, err := p.Run(ctx)
+				if err != nil {
+					log.Printf("versions: %v", err)
+					continue
+				}
+				if n > 0 {
+					log.Printf("versions: pruned %d versions", n)
+				}
+			}
+		}
+	}()
+}
@@ -30,8 +30,12 @@ function Uploader(): JSX.Element {
         headers: { 'X-User-ID': uid },
         body: form,
       })
-      if (!res.ok) throw new Error('upload failed')
-      setMessage('Uploaded successfully')
+      const body = await res.json().catch(() => null)
+      if (!body) throw new Error('upload failed')
+      const failures = (body.files || []).filter((f: any) => f.error)
+      if (body.error) throw new Error(body.error.message || body.error)
+      if (failures.length === 0) setMessage('Uploaded successfully')
+      else setMessage(`Uploaded ${body.uploaded}, failed ${body.failed}: ` + failures.map((f: any) => `${f.filename} (${f.error.message})`).join(', '))
     } catch (e: any) {
       setMessage(e.message || 'Upload error')
     }